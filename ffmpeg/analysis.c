@@ -0,0 +1,225 @@
+#include "analysis.h"
+#include "logging.h"
+
+#include <libavfilter/buffersrc.h>
+#include <libavfilter/buffersink.h>
+#include <libavutil/avstring.h>
+#include <libavutil/channel_layout.h>
+
+//
+// Frame analysis
+//
+// Decoded frames of the segment are also sent into a filtergraph per media
+// type, and events are read back from the metadata of the filtered frames:
+//
+//   video: (blackdetect), (scale, select) -> sink
+//   audio: silencedetect -> sink
+//
+// select is only used to score scene changes and passes every frame. The
+// graphs only live for a single segment, so intervals still in progress at
+// the end of a segment are closed at the end of its last frame.
+//
+
+#define DEFAULT_BLACK_RATIO   0.98
+#define DEFAULT_SILENCE_NOISE -60.0 // dB
+
+// Scene scores don't need full resolution pictures
+#define SCENE_WIDTH 320
+
+int analysis_needs_video(analysis_params *params)
+{
+  return params->scene_threshold > 0 || params->black_duration > 0;
+}
+
+int analysis_needs_audio(analysis_params *params)
+{
+  return params->silence_duration > 0;
+}
+
+int init_analysis(struct analysis_ctx *ctx, analysis_params *params, input_results *res)
+{
+  int ret = 0;
+  memset(ctx, 0, sizeof *ctx);
+  ctx->params = *params;
+  ctx->res = res;
+  res->nb_scenes = res->nb_black = res->nb_silence = 0;
+  if (!analysis_needs_video(params) && !analysis_needs_audio(params)) return 0;
+  if (ctx->params.black_ratio <= 0) ctx->params.black_ratio = DEFAULT_BLACK_RATIO;
+  if (!ctx->params.silence_noise) ctx->params.silence_noise = DEFAULT_SILENCE_NOISE;
+  ctx->frame = av_frame_alloc();
+  ctx->sw_frame = av_frame_alloc();
+  if (!ctx->frame || !ctx->sw_frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(init_analysis_err, "Unable to allocate analysis frames");
+  }
+  return 0;
+
+init_analysis_err:
+  free_analysis(ctx);
+  return ret;
+}
+
+static int init_video_analysis(struct analysis_ctx *ctx, AVStream *ist, AVFrame *frame)
+{
+  char args[512], descr[512] = "[in]";
+  AVRational tb = ist->time_base;
+  analysis_params *p = &ctx->params;
+
+  snprintf(args, sizeof args,
+    "video_size=%dx%d:pix_fmt=%d:time_base=%d/%d:pixel_aspect=%d/%d",
+    frame->width, frame->height, frame->format, tb.num, tb.den,
+    frame->sample_aspect_ratio.num, frame->sample_aspect_ratio.den);
+  if (p->black_duration > 0) {
+    // intervals shorter than the minimum duration are discarded when read
+    av_strlcatf(descr, sizeof descr, "blackdetect=d=0:pic_th=%f,", p->black_ratio);
+  }
+  if (p->scene_threshold > 0) {
+    av_strlcatf(descr, sizeof descr, "scale=w=%d:h=-2,select='gte(scene,0)',", SCENE_WIDTH);
+  }
+  av_strlcatf(descr, sizeof descr, "null[out]");
+  return init_frame_graph(&ctx->video, "buffer", args, "buffersink", descr);
+}
+
+static int init_audio_analysis(struct analysis_ctx *ctx, AVStream *ist, AVFrame *frame)
+{
+  char args[512], descr[512];
+  AVRational tb = ist->time_base;
+  uint64_t layout = frame->channel_layout;
+
+  if (!layout) layout = av_get_default_channel_layout(frame->channels);
+  snprintf(args, sizeof args,
+    "time_base=%d/%d:sample_rate=%d:sample_fmt=%s:channel_layout=0x%"PRIx64,
+    tb.num, tb.den, frame->sample_rate,
+    av_get_sample_fmt_name(frame->format), layout);
+  snprintf(descr, sizeof descr, "[in]silencedetect=n=%fdB:d=%f[out]",
+    ctx->params.silence_noise, ctx->params.silence_duration);
+  return init_frame_graph(&ctx->audio, "abuffer", args, "abuffersink", descr);
+}
+
+static void add_interval(time_interval *list, int *nb, double start, double end, double min)
+{
+  if (end - start < min || *nb >= MAX_ANALYSIS_EVENTS) return;
+  list[*nb].start = start;
+  list[*nb].end = end;
+  (*nb)++;
+}
+
+static void read_video_events(struct analysis_ctx *ctx, AVFrame *frame, double t)
+{
+  input_results *res = ctx->res;
+  AVDictionaryEntry *e = av_dict_get(frame->metadata, "lavfi.scene_score", NULL, 0);
+  if (e && strtod(e->value, NULL) >= ctx->params.scene_threshold &&
+      res->nb_scenes < MAX_ANALYSIS_EVENTS) {
+    res->scenes[res->nb_scenes++] = t;
+  }
+  if (av_dict_get(frame->metadata, "lavfi.black_end", NULL, 0) && ctx->in_black) {
+    add_interval(res->black, &res->nb_black, ctx->black_start, t, ctx->params.black_duration);
+    ctx->in_black = 0;
+  }
+  if (av_dict_get(frame->metadata, "lavfi.black_start", NULL, 0)) {
+    ctx->black_start = t;
+    ctx->in_black = 1;
+  }
+}
+
+static void read_audio_events(struct analysis_ctx *ctx, AVFrame *frame)
+{
+  // silencedetect reports the exact times within the frame
+  input_results *res = ctx->res;
+  AVDictionaryEntry *e = av_dict_get(frame->metadata, "lavfi.silence_end", NULL, 0);
+  if (e && ctx->in_silence) {
+    add_interval(res->silence, &res->nb_silence, ctx->silence_start, strtod(e->value, NULL), 0);
+    ctx->in_silence = 0;
+  }
+  e = av_dict_get(frame->metadata, "lavfi.silence_start", NULL, 0);
+  if (e) {
+    ctx->silence_start = strtod(e->value, NULL);
+    ctx->in_silence = 1;
+  }
+}
+
+static int drain_analysis(struct analysis_ctx *ctx, struct frame_graph *g)
+{
+  int ret = 0;
+  AVFrame *frame = ctx->frame;
+
+  while (1) {
+    av_frame_unref(frame);
+    ret = av_buffersink_get_frame(g->sink, frame);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) return 0;
+    if (ret < 0) LPMS_ERR(drain_analysis_err, "Error consuming the analysis filtergraph");
+    if (g == &ctx->video) {
+      read_video_events(ctx, frame, frame->pts * av_q2d(av_buffersink_get_time_base(g->sink)));
+    } else read_audio_events(ctx, frame);
+  }
+
+drain_analysis_err:
+  return ret;
+}
+
+int analyze_frame(struct analysis_ctx *ctx, AVStream *ist, AVFrame *frame)
+{
+  int ret = 0;
+  int is_video = AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type;
+  struct frame_graph *g = is_video ? &ctx->video : &ctx->audio;
+  double tb = av_q2d(ist->time_base);
+
+  if (is_video && !analysis_needs_video(&ctx->params)) return 0;
+  if (!is_video && !analysis_needs_audio(&ctx->params)) return 0;
+  if (AV_NOPTS_VALUE == frame->pts) return 0;
+
+  if (frame->hw_frames_ctx) {
+    av_frame_unref(ctx->sw_frame);
+    ret = av_hwframe_transfer_data(ctx->sw_frame, frame, 0);
+    if (ret < 0) LPMS_ERR(analyze_frame_err, "Unable to download frame for analysis");
+    av_frame_copy_props(ctx->sw_frame, frame);
+    frame = ctx->sw_frame;
+  }
+  if (!g->graph) {
+    ret = is_video ? init_video_analysis(ctx, ist, frame) : init_audio_analysis(ctx, ist, frame);
+    if (ret < 0) LPMS_ERR(analyze_frame_err, "Unable to set up analysis filtergraph");
+  }
+  if (is_video) ctx->video_end = (frame->pts + frame->pkt_duration) * tb;
+  else ctx->audio_end = frame->pts * tb + (double) frame->nb_samples / frame->sample_rate;
+
+  ret = av_buffersrc_write_frame(g->src, frame);
+  if (ret < 0) LPMS_ERR(analyze_frame_err, "Error feeding the analysis filtergraph");
+  ret = drain_analysis(ctx, g);
+
+analyze_frame_err:
+  return ret;
+}
+
+int finish_analysis(struct analysis_ctx *ctx)
+{
+  int ret = 0;
+  input_results *res = ctx->res;
+  struct frame_graph *graphs[] = { &ctx->video, &ctx->audio };
+
+  for (int i = 0; i < 2; i++) {
+    if (!graphs[i]->graph) continue;
+    ret = av_buffersrc_write_frame(graphs[i]->src, NULL);
+    if (ret < 0) LPMS_ERR(finish_analysis_err, "Error flushing the analysis filtergraph");
+    ret = drain_analysis(ctx, graphs[i]);
+    if (ret < 0) LPMS_ERR(finish_analysis_err, "Error draining the analysis filtergraph");
+  }
+  if (ctx->in_black) {
+    add_interval(res->black, &res->nb_black, ctx->black_start, ctx->video_end, ctx->params.black_duration);
+    ctx->in_black = 0;
+  }
+  if (ctx->in_silence) {
+    add_interval(res->silence, &res->nb_silence, ctx->silence_start, ctx->audio_end, 0);
+    ctx->in_silence = 0;
+  }
+
+finish_analysis_err:
+  return ret;
+}
+
+void free_analysis(struct analysis_ctx *ctx)
+{
+  free_frame_graph(&ctx->video);
+  free_frame_graph(&ctx->audio);
+  if (ctx->frame) av_frame_free(&ctx->frame);
+  if (ctx->sw_frame) av_frame_free(&ctx->sw_frame);
+}
@@ -0,0 +1,30 @@
+#ifndef _LPMS_ANALYSIS_H_
+#define _LPMS_ANALYSIS_H_
+
+#include "filter.h"
+
+// Analysis of decoded frames during a transcode; see analysis_params.
+// Results are written into the input results of the segment.
+struct analysis_ctx {
+  analysis_params params;
+  input_results *res;
+
+  struct frame_graph video; // blackdetect, select for scene scores
+  struct frame_graph audio; // silencedetect
+  AVFrame *frame;           // filtered
+  AVFrame *sw_frame;        // downloaded from hardware decoders
+
+  // Intervals in progress, and the end of the last frame of each type
+  int in_black, in_silence;
+  double black_start, silence_start;
+  double video_end, audio_end;
+};
+
+int  init_analysis(struct analysis_ctx *ctx, analysis_params *params, input_results *res);
+int  analysis_needs_video(analysis_params *params);
+int  analysis_needs_audio(analysis_params *params);
+int  analyze_frame(struct analysis_ctx *ctx, AVStream *ist, AVFrame *frame);
+int  finish_analysis(struct analysis_ctx *ctx);
+void free_analysis(struct analysis_ctx *ctx);
+
+#endif // _LPMS_ANALYSIS_H_
@@ -2,7 +2,14 @@ package ffmpeg
 
 import (
 	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -1286,3 +1293,2000 @@ func TestTranscoder_NoKeyframe(t *testing.T) {
 	noKeyframeSegment(t, Software)
 }
 */
+
+func TestTranscoderAPI_DemuxerDecoderOpts(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Headerless input can't be probed; needs an explicit demuxer + options
+	cmd := `
+		ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -an -t 1 \
+			-vf scale=320:240 -pix_fmt yuv420p -r 30 -f rawvideo test.yuv
+	`
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.yuv"}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/out.ts",
+		Profile: P144p30fps16x9,
+	}}
+	_, err := Transcode3(in, out)
+	if err == nil {
+		t.Error("Expected autodetection of raw input to fail")
+	}
+
+	in.Demuxer = ComponentOptions{
+		Name: "rawvideo",
+		Opts: map[string]string{
+			"video_size":   "320x240",
+			"pixel_format": "yuv420p",
+			"framerate":    "30",
+		},
+	}
+	in.VideoDecoder = ComponentOptions{
+		Opts: map[string]string{"threads": "1"},
+	}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Error(err)
+	}
+	if res == nil || res.Decoded.Frames != 30 {
+		t.Error("Unexpected decoded frame count ", res)
+	}
+
+	// Unknown components should be reported as such
+	in.Demuxer.Name = "notademuxer"
+	_, err = Transcode3(in, out)
+	if err == nil || err.Error() != "Demuxer not found: notademuxer" {
+		t.Error("Expected 'Demuxer not found', got ", err)
+	}
+	in.Demuxer.Name = "rawvideo"
+	in.VideoDecoder.Name = "notadecoder"
+	_, err = Transcode3(in, out)
+	if err == nil || err.Error() != "Decoder not found: notadecoder" {
+		t.Error("Expected 'Decoder not found', got ", err)
+	}
+}
+
+func TestTranscoderAPI_AudioTracks(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# input with two tagged audio tracks
+		ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -i "$1/../transcoder/test.ts" \
+			-map 0:v -map 0:a -map 1:a -c copy \
+			-metadata:s:a:0 language=eng -metadata:s:a:1 language=spa multi.ts
+	`
+	run(cmd)
+
+	in := &TranscodeOptionsIn{
+		Fname: dir + "/multi.ts",
+		Audio: AudioSelector{Language: "spa"},
+	}
+	out := []TranscodeOptions{{
+		Oname:        dir + "/default.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}, {
+		Oname:        dir + "/mapped.ts",
+		VideoEncoder: ComponentOptions{Name: "drop"},
+		AudioTracks: []AudioTrackOptions{{
+			Input: AudioSelector{Track: 1},
+		}, {
+			Input:   AudioSelector{Language: "spa"},
+			Encoder: ComponentOptions{Name: "copy"},
+		}},
+	}}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.AudioTracks) != 2 {
+		t.Fatal("Unexpected audio tracks ", res.AudioTracks)
+	}
+	for i, lang := range []string{"eng", "spa"} {
+		track := res.AudioTracks[i]
+		if track.Track != i+1 || track.Language != lang || track.Codec != "aac" {
+			t.Error("Unexpected audio track info ", track)
+		}
+	}
+
+	cmd = `
+		# default track selected by language
+		[ $(ffprobe -loglevel warning -show_streams -select_streams a default.ts | grep -c index=) -eq 1 ]
+		ffprobe -loglevel warning -show_streams -select_streams a default.ts | grep TAG:language=spa
+
+		# explicitly mapped tracks, in order
+		[ $(ffprobe -loglevel warning -show_streams -select_streams a mapped.ts | grep -c index=) -eq 2 ]
+		ffprobe -loglevel warning -show_streams mapped.ts | grep TAG:language= | head -1 | grep eng
+		ffprobe -loglevel warning -show_streams mapped.ts | grep TAG:language= | tail -1 | grep spa
+	`
+	run(cmd)
+
+	// Selecting a nonexistent track should fail
+	in.Audio = AudioSelector{Language: "fra"}
+	_, err = Transcode3(in, out[:1])
+	if err == nil || err.Error() != "Stream not found" {
+		t.Error("Expected 'Stream not found', got ", err)
+	}
+
+	// Too many tracks
+	out[1].AudioTracks = make([]AudioTrackOptions, 9)
+	_, err = Transcode3(in, out)
+	if err != ErrTranscoderAud {
+		t.Error("Expected too many audio tracks error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_SharedAudioTrack(t *testing.T) {
+	// Selectors resolving to the same input stream share its decoder, even
+	// if only one of them needs decoding
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts"}
+	out := []TranscodeOptions{{
+		Oname:        dir + "/copied.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}, {
+		Oname:        dir + "/encoded.ts",
+		VideoEncoder: ComponentOptions{Name: "drop"},
+		AudioTracks:  []AudioTrackOptions{{Input: AudioSelector{Track: 1}}},
+	}, {
+		Oname:        dir + "/both.ts",
+		VideoEncoder: ComponentOptions{Name: "drop"},
+		AudioTracks: []AudioTrackOptions{
+			{Input: AudioSelector{}},
+			{Input: AudioSelector{Track: 1}},
+		},
+	}}
+	cmd := `
+		for f in copied.ts encoded.ts; do
+			[ $(ffprobe -loglevel warning -show_streams -select_streams a $f | grep -c index=) -eq 1 ]
+		done
+		[ $(ffprobe -loglevel warning -show_streams -select_streams a both.ts | grep -c index=) -eq 2 ]
+		# every audio stream has about as many packets as the input
+		expected=$(ffprobe -loglevel warning -count_packets -show_streams -select_streams a \
+			"$1/../transcoder/test.ts" | grep nb_read_packets= | cut -d= -f2)
+		for f in copied.ts encoded.ts both.ts; do
+			ffprobe -loglevel warning -count_packets -show_streams -select_streams a $f | \
+				grep nb_read_packets= | cut -d= -f2 | while read n; do
+				[ "$n" -gt $(( expected - 5 )) ]
+			done
+		done
+	`
+	for i := 0; i < 2; i++ {
+		if _, err := Transcode3(in, out); err != nil {
+			t.Fatal(err)
+		}
+		run(cmd)
+		// the default output encodes the shared stream too
+		out[0].AudioEncoder = ComponentOptions{}
+	}
+}
+
+func TestTranscoderAPI_CompareQuality(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Identical inputs should score perfectly
+	fname := "../transcoder/test.ts"
+	res, err := CompareQuality(fname, fname, QualityOptions{SSIM: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Frames) <= 0 || res.SSIM < 0.999 {
+		t.Error("Unexpected SSIM for identical inputs ", res.SSIM, len(res.Frames))
+	}
+	if !math.IsNaN(res.PSNR) || !math.IsNaN(res.VMAF) {
+		t.Error("Expected unset metrics to be NaN")
+	}
+
+	// Compare a downscaled rendition inline with transcoding
+	in := &TranscodeOptionsIn{Fname: fname}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/out.ts",
+		Profile: P144p30fps16x9,
+		Quality: &QualityOptions{},
+	}, {
+		Oname:   dir + "/noquality.ts",
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   dir + "/sampled.ts",
+		Profile: P144p30fps16x9,
+		Quality: &QualityOptions{PSNR: true, SampleInterval: time.Second},
+	}, {
+		// Copied video is never compared
+		Oname:   dir + "/source.ts",
+		Source:  true,
+		Quality: &QualityOptions{},
+	}}
+	tres, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := tres.Encoded[0].Quality
+	if q == nil || tres.Encoded[1].Quality != nil || tres.Encoded[3].Quality != nil {
+		t.Fatal("Unexpected quality results ", tres.Encoded)
+	}
+	inline := tres.Encoded[2].Quality
+	if inline == nil || len(inline.Frames) <= 0 || len(inline.Frames) >= len(q.Frames) {
+		t.Error("Unexpected number of inline sampled frames ", inline)
+	} else if !math.IsNaN(inline.SSIM) || inline.PSNR <= 20 {
+		t.Error("Unexpected inline sampled scores ", inline.SSIM, inline.PSNR)
+	}
+	if len(q.Frames) != tres.Encoded[0].Frames {
+		t.Error("Mismatched compared frames ", len(q.Frames), tres.Encoded[0].Frames)
+	}
+	if q.SSIM <= 0.5 || q.SSIM >= 1 || q.PSNR <= 20 || math.IsInf(q.PSNR, 0) {
+		t.Error("Unexpected quality scores ", q.SSIM, q.PSNR)
+	}
+
+	// Sampling reduces the number of compared frames
+	sampled, err := CompareQuality(fname, dir+"/out.ts", QualityOptions{
+		Resolution:     "256x144",
+		PSNR:           true,
+		SampleInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sampled.Frames) <= 0 || len(sampled.Frames) >= len(q.Frames) {
+		t.Error("Unexpected number of sampled frames ", len(sampled.Frames))
+	}
+
+	// Missing files should fail
+	_, err = CompareQuality(fname, dir+"/nonexistent.ts", QualityOptions{})
+	if err == nil || err.Error() != "No such file or directory" {
+		t.Error("Expected missing file error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_EscapeFilterOption(t *testing.T) {
+	// Escaped once for the option list and once for the filtergraph
+	v := escapeFilterOption(`C:\models\vmaf,v1's.pkl`)
+	if v != `C\\:\\\\models\\\\vmaf\,v1\\\'s.pkl` {
+		t.Error("Unexpected escaping ", v)
+	}
+	if v := escapeFilterOption("/tmp/lpms-vmaf-1.json"); v != "/tmp/lpms-vmaf-1.json" {
+		t.Error("Unexpected escaping of a plain path ", v)
+	}
+}
+
+func TestTranscoderAPI_Signatures(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# same content, altered
+		ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -vf vflip -c:a copy flipped.ts
+		# same content, but only the first second
+		ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -t 1 -c:a copy truncated.ts
+	`
+	run(cmd)
+
+	fname := "../transcoder/test.ts"
+	in := &TranscodeOptionsIn{Fname: fname}
+	lowfps := P144p30fps16x9
+	lowfps.Framerate = 10
+	out := []TranscodeOptions{{
+		Oname:     dir + "/out.ts",
+		Profile:   P240p30fps16x9,
+		Signature: true,
+	}, {
+		Oname:     dir + "/lowfps.ts",
+		Profile:   lowfps,
+		Signature: true,
+	}, {
+		Oname:   dir + "/nosig.ts",
+		Profile: P144p30fps16x9,
+	}}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := res.Decoded.Signature
+	if src == nil || len(src.Frames) <= 0 || res.Encoded[2].Signature != nil {
+		t.Fatal("Unexpected signatures")
+	}
+	for i := 0; i < 2; i++ {
+		sig := res.Encoded[i].Signature
+		if sig == nil || len(sig.Frames) != res.Encoded[i].Frames {
+			t.Fatal("Unexpected signature for output ", i)
+		}
+		if score := src.Compare(sig); score < SignatureMatchThreshold {
+			t.Error("Expected rendition to match source ", i, score)
+		}
+	}
+	// Framerate was reduced so fewer frames are signed
+	if len(res.Encoded[1].Signature.Frames) >= len(src.Frames) {
+		t.Error("Unexpected number of signed frames")
+	}
+
+	// Signatures read the files again, so pipes and other protocols fail
+	// before transcoding
+	piped := []TranscodeOptions{{Oname: "pipe:1", Profile: P144p30fps16x9, Signature: true}}
+	if _, err := Transcode3(in, piped); err != ErrTranscoderSig {
+		t.Error("Expected signature error for a piped output, got ", err)
+	}
+	piped[0].Oname = dir + "/piped.ts"
+	if _, err := Transcode3(&TranscodeOptionsIn{Fname: "pipe:0"}, piped); err != ErrTranscoderSig {
+		t.Error("Expected signature error for a piped input, got ", err)
+	}
+
+	ok, err := VerifyRendition(fname, dir+"/out.ts")
+	if err != nil || !ok {
+		t.Error("Expected rendition to verify ", err)
+	}
+	ok, err = VerifyRendition(fname, dir+"/flipped.ts")
+	if err != nil || ok {
+		t.Error("Expected altered rendition to fail verification ", err)
+	}
+
+	// Truncated renditions match every frame they have, but not the source
+	ok, err = VerifyRendition(fname, dir+"/truncated.ts")
+	if err != nil || ok {
+		t.Error("Expected truncated rendition to fail verification ", err)
+	}
+	truncated, err := ComputeSignature(dir+"/truncated.ts", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score := src.Compare(truncated); score >= SignatureMatchThreshold {
+		t.Error("Expected truncated rendition to score low ", score)
+	}
+	if score := truncated.Compare(src); score >= SignatureMatchThreshold {
+		t.Error("Expected comparison to be symmetric ", score)
+	}
+
+	// Sampled signatures
+	sampled, err := ComputeSignature(fname, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sampled.Frames) <= 0 || len(sampled.Frames) >= len(src.Frames) {
+		t.Error("Unexpected number of sampled frames ", len(sampled.Frames))
+	}
+	sampledOut, err := ComputeSignature(dir+"/out.ts", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sampled.Compare(sampledOut) < SignatureMatchThreshold {
+		t.Error("Expected sampled signatures to match")
+	}
+	// Sparse signatures don't cover the source
+	if src.Compare(sampled) >= SignatureMatchThreshold {
+		t.Error("Expected sampled signature not to match the full source")
+	}
+}
+
+func TestTranscoderAPI_Concat(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# segments with timestamps reset, so there are discontinuities
+		ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -c copy \
+			-f segment -segment_time 2 -reset_timestamps 1 seg%d.ts
+		[ -e seg2.ts ]
+		ls seg*.ts | wc -l > nb_segs
+	`
+	run(cmd)
+
+	nb, err := ioutil.ReadFile(dir + "/nb_segs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	fmt.Sscanf(string(nb), "%d", &n)
+	segs := make([]string, n)
+	data := make([][]byte, n)
+	for i := range segs {
+		segs[i] = fmt.Sprintf("%s/seg%d.ts", dir, i)
+		data[i], err = ioutil.ReadFile(segs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Concat(segs, dir+"/out.mp4", ConcatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConcatData(data, dir+"/data.mp4", ConcatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = Concat(segs, dir+"/out.mkv", ConcatOptions{Muxer: ComponentOptions{Name: "matroska"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = `
+		frames() {
+			ffprobe -loglevel warning -count_packets -show_streams -select_streams $2 $1 | grep nb_read_packets
+		}
+		duration() {
+			ffprobe -loglevel warning -show_entries format=duration -of csv=p=0 $1
+		}
+		for f in out.mp4 data.mp4 out.mkv; do
+			# all packets are present
+			[ "$(frames $1/../transcoder/test.ts v)" = "$(frames $f v)" ]
+			[ "$(frames $1/../transcoder/test.ts a)" = "$(frames $f a)" ]
+			# and timestamps are continuous
+			awk -v a=$(duration $1/../transcoder/test.ts) -v b=$(duration $f) \
+				'BEGIN { d = a - b; if (d < 0) d = -d; exit d > 0.1 }'
+		done
+
+		# faststart: the index precedes the media data
+		head -c 64 out.mp4 | grep -a moov
+		ffprobe -loglevel warning -show_format out.mkv | grep format_name=matroska
+		cmp out.mp4 data.mp4
+	`
+	run(cmd)
+
+	// Errors
+	if err := Concat(nil, dir+"/none.mp4", ConcatOptions{}); err != ErrTranscoderInp {
+		t.Error("Expected invalid input error, got ", err)
+	}
+	err = Concat([]string{segs[0], dir + "/nonexistent.ts"}, dir+"/missing.mp4", ConcatOptions{})
+	if err == nil || err.Error() != "No such file or directory" {
+		t.Error("Expected missing file error, got ", err)
+	}
+	err = ConcatData([][]byte{data[0], []byte("not a segment")}, dir+"/invalid.mp4", ConcatOptions{})
+	if err == nil {
+		t.Error("Expected error for invalid segment data")
+	}
+
+	// Segments that the header of the first one doesn't describe
+	cmd = `
+		ffmpeg -loglevel warning -i seg1.ts -c:v libx264 -vf scale=320:180 -c:a copy scaled.ts
+		ffmpeg -loglevel warning -i seg1.ts -c:v copy -c:a aac -ar 22050 resampled.ts
+	`
+	run(cmd)
+	for _, seg := range []string{"scaled.ts", "resampled.ts"} {
+		err = Concat([]string{segs[0], dir + "/" + seg}, dir+"/mismatched.mp4", ConcatOptions{})
+		if err == nil || err.Error() != "Invalid argument" {
+			t.Error("Expected mismatched segment error for ", seg, ", got ", err)
+		}
+	}
+}
+
+func TestTranscoderAPI_Remux(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	fname := "../transcoder/test.ts"
+	streams, err := Remux(fname, dir+"/out.mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatal("Unexpected streams ", streams)
+	}
+	vid, aud := streams[0], streams[1]
+	if vid.Type != "video" || vid.Codec != "h264" || vid.Bsf != "" || vid.Width <= 0 {
+		t.Error("Unexpected video stream ", vid)
+	}
+	if aud.Type != "audio" || aud.Codec != "aac" || aud.Bsf != "aac_adtstoasc" || aud.SampleRate <= 0 {
+		t.Error("Unexpected audio stream ", aud)
+	}
+	if vid.Packets <= 0 || vid.Duration <= 0 || aud.Packets <= 0 || aud.Duration <= 0 {
+		t.Error("Unexpected stream stats ", streams)
+	}
+
+	// Back to MPEG-TS from MP4 needs AnnexB H.264
+	ts, err := Remux(dir+"/out.mp4", dir+"/out.ts", "mpegts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || ts[0].Bsf != "h264_mp4toannexb" || ts[1].Bsf != "" {
+		t.Error("Unexpected streams ", ts)
+	}
+	if ts[0].Packets != vid.Packets || ts[1].Packets != aud.Packets {
+		t.Error("Mismatched packet counts ", ts, streams)
+	}
+
+	if _, err := Remux(fname, dir+"/out.flv", "flv"); err != nil {
+		t.Error(err)
+	}
+	if _, err := Remux(fname, dir+"/frag.mp4", "fmp4"); err != nil {
+		t.Error(err)
+	}
+
+	cmd := `
+		count() {
+			ffprobe -loglevel warning -count_packets -show_streams -select_streams $2 $1 | grep nb_read_packets
+		}
+		for f in out.mp4 out.ts out.flv frag.mp4; do
+			[ "$(count $1/../transcoder/test.ts v)" = "$(count $f v)" ]
+			[ "$(count $1/../transcoder/test.ts a)" = "$(count $f a)" ]
+		done
+		ffprobe -loglevel warning -show_format out.ts | grep format_name=mpegts
+		ffprobe -loglevel warning -show_format out.flv | grep format_name=flv
+		grep -a moof frag.mp4
+		# no fragments in the regular mp4
+		! grep -a moof out.mp4
+	`
+	run(cmd)
+
+	// Errors
+	_, err = Remux(dir+"/nonexistent.ts", dir+"/none.mp4", "")
+	if err == nil || err.Error() != "No such file or directory" {
+		t.Error("Expected missing file error, got ", err)
+	}
+	_, err = Remux(fname, dir+"/none.mp4", "nonexistent")
+	if err == nil || err.Error() != "Muxer not found" {
+		t.Error("Expected missing muxer error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_SourceRendition(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	fname := "../transcoder/test.ts"
+	in := &TranscodeOptionsIn{Fname: fname}
+	out := []TranscodeOptions{{
+		Oname:  dir + "/source.ts",
+		Source: true,
+		// ignored for source renditions
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   dir + "/source.mp4",
+		Source:  true,
+		Profile: VideoProfile{Format: FormatMP4},
+	}, {
+		Oname:   dir + "/low.ts",
+		Profile: P144p30fps16x9,
+	}}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if res.Encoded[i].Frames != res.Decoded.Frames || res.Encoded[i].Pixels != res.Decoded.Pixels {
+			t.Error("Unexpected source frame counts ", res.Encoded[i], res.Decoded)
+		}
+	}
+	if res.Encoded[2].SourceProfile != nil {
+		t.Error("Unexpected source profile for regular rendition")
+	}
+	src := res.Encoded[0].SourceProfile
+	if src == nil || src.Name != "source" || src.Framerate <= 0 {
+		t.Fatal("Unexpected source profile ", src)
+	}
+	vp := VideoProfileToVariantParams(*src)
+	if vp.Bandwidth <= 0 || vp.Resolution != src.Resolution {
+		t.Error("Unexpected variant params ", vp)
+	}
+
+	cmd := `
+		# video is copied as-is
+		ffmpeg -loglevel warning -i $1/../transcoder/test.ts -map 0:v -c copy -f md5 in.md5
+		ffmpeg -loglevel warning -i source.ts -map 0:v -c copy -f md5 out.md5
+		cmp in.md5 out.md5
+		ffprobe -loglevel warning -show_format source.mp4 | grep format_name=mov,mp4
+		# audio is still present
+		ffprobe -loglevel warning -show_streams -select_streams a source.ts | grep codec_name=aac
+		ffprobe -loglevel warning -show_entries stream=width,height -select_streams v \
+			-of csv=s=x:p=0 $1/../transcoder/test.ts > resolution
+	`
+	run(cmd)
+	resolution, err := ioutil.ReadFile(dir + "/resolution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(resolution)) != src.Resolution {
+		t.Error("Mismatched source resolution ", string(resolution), src.Resolution)
+	}
+}
+
+func TestTranscoderAPI_Segment(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	fname := "../transcoder/test.ts"
+	segs, err := Segment(fname, dir+"/seg%d.ts", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 2 {
+		t.Fatal("Expected multiple segments, got ", segs)
+	}
+	for i, seg := range segs {
+		if seg.Name != fmt.Sprintf("%s/seg%d.ts", dir, i) {
+			t.Error("Unexpected segment name ", seg.Name)
+		}
+		// all but the last segment reach the target
+		if seg.Duration <= 0 || (i < len(segs)-1 && seg.Duration < 2*time.Second) {
+			t.Error("Unexpected segment duration ", i, seg.Duration)
+		}
+		if i > 0 {
+			gap := seg.Start - (segs[i-1].Start + segs[i-1].Duration)
+			if gap > time.Millisecond || gap < -time.Millisecond {
+				t.Error("Segments are not contiguous ", segs[i-1], seg)
+			}
+		}
+	}
+
+	// Each segment is usable as transcoder input
+	in := &TranscodeOptionsIn{Fname: segs[1].Name}
+	out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}}
+	if _, err := Transcode3(in, out); err != nil {
+		t.Error(err)
+	}
+
+	fsegs, err := Segment(fname, dir+"/frag%d.mp4", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsegs) != len(segs) {
+		t.Error("Mismatched segment counts ", len(fsegs), len(segs))
+	}
+
+	cmd := `
+		count() {
+			ffprobe -loglevel warning -count_packets -show_streams -select_streams v $1 | grep nb_read_packets | cut -d= -f2
+		}
+		# segments begin with a keyframe
+		for f in seg*.ts frag*.mp4; do
+			ffprobe -loglevel warning -select_streams v -show_frames -read_intervals %+#1 $f | grep key_frame=1
+		done
+		grep -a moof frag0.mp4
+		# no video packets are lost
+		total=0
+		for f in seg*.ts; do total=$((total + $(count $f))); done
+		[ $total -eq $(count $1/../transcoder/test.ts) ]
+	`
+	run(cmd)
+
+	// Errors
+	_, err = Segment(fname, dir+"/notemplate.ts", 2*time.Second)
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected template error, got ", err)
+	}
+	_, err = Segment(fname, dir+"/seg%d.ts", 0)
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected duration error, got ", err)
+	}
+	_, err = Segment(dir+"/nonexistent.ts", dir+"/seg%d.ts", 2*time.Second)
+	if err == nil || err.Error() != "No such file or directory" {
+		t.Error("Expected missing file error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_GenerateTestMedia(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	opts := TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		GOP:        time.Second / 3, // 10 frames
+		Duration:   2 * time.Second,
+	}
+	if err := GenerateTestMedia(opts); err != nil {
+		t.Fatal(err)
+	}
+	streams, err := Remux(opts.Oname, dir+"/test.mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatal("Unexpected streams ", streams)
+	}
+	vid, aud := streams[0], streams[1]
+	if vid.Codec != "h264" || vid.Width != 320 || vid.Height != 240 || vid.Packets != 60 {
+		t.Error("Unexpected video ", vid)
+	}
+	if aud.Codec != "aac" || aud.SampleRate != 48000 || aud.Channels != 2 {
+		t.Error("Unexpected audio ", aud)
+	}
+
+	// Keyframes follow the GOP
+	segs, err := Segment(opts.Oname, dir+"/seg%d.ts", time.Second/3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 6 {
+		t.Error("Unexpected number of segments ", len(segs))
+	}
+
+	// Output is deterministic
+	opts.Oname = dir + "/again.ts"
+	if err := GenerateTestMedia(opts); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := ioutil.ReadFile(dir + "/test.ts")
+	b, _ := ioutil.ReadFile(dir + "/again.ts")
+	if len(a) == 0 || string(a) != string(b) {
+		t.Error("Expected identical test media")
+	}
+
+	// Video or audio only, with other encoders and formats
+	err = GenerateTestMedia(TestMediaOptions{
+		Oname:        dir + "/video.mp4",
+		VideoEncoder: ComponentOptions{Name: "mpeg4"},
+		AudioEncoder: ComponentOptions{Name: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams, err = Remux(dir+"/video.mp4", dir+"/video.ts", "")
+	if err != nil || len(streams) != 1 || streams[0].Codec != "mpeg4" || streams[0].Packets != 30 {
+		t.Error("Unexpected video-only media ", streams, err)
+	}
+	err = GenerateTestMedia(TestMediaOptions{
+		Oname:        dir + "/audio.ts",
+		Channels:     1,
+		VideoEncoder: ComponentOptions{Name: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams, err = Remux(dir+"/audio.ts", dir+"/audio.mp4", "")
+	if err != nil || len(streams) != 1 || streams[0].Type != "audio" || streams[0].Channels != 1 {
+		t.Error("Unexpected audio-only media ", streams, err)
+	}
+
+	// Errors
+	err = GenerateTestMedia(TestMediaOptions{Oname: dir + "/none.ts",
+		VideoEncoder: ComponentOptions{Name: "drop"},
+		AudioEncoder: ComponentOptions{Name: "drop"}})
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected error for empty media, got ", err)
+	}
+	err = GenerateTestMedia(TestMediaOptions{Oname: dir + "/none.ts", Duration: -time.Second})
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected duration error, got ", err)
+	}
+	err = GenerateTestMedia(TestMediaOptions{Oname: dir + "/none.ts",
+		VideoEncoder: ComponentOptions{Name: "nonexistent"}})
+	if err == nil || err.Error() != "Encoder not found" {
+		t.Error("Expected missing encoder error, got ", err)
+	}
+	err = GenerateTestMedia(TestMediaOptions{Oname: dir + "/none.ts", Resolution: "abc"})
+	if err != ErrTranscoderRes {
+		t.Error("Expected resolution error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_Capabilities(t *testing.T) {
+	c := Capabilities()
+	if c != Capabilities() {
+		t.Error("Expected capabilities to be cached")
+	}
+	for _, name := range []string{"libx264", "aac"} {
+		if !c.HasEncoder(name) {
+			t.Error("Missing encoder ", name)
+		}
+	}
+	for _, name := range []string{"h264", "aac"} {
+		if !c.HasDecoder(name) {
+			t.Error("Missing decoder ", name)
+		}
+	}
+	// Aliases within format names are split out
+	for _, name := range []string{"mpegts", "mp4", "mov"} {
+		if !c.HasMuxer(name) || !c.HasDemuxer(name) {
+			t.Error("Missing format ", name)
+		}
+	}
+	for _, name := range []string{"scale", "fps", "testsrc2"} {
+		if !c.HasFilter(name) {
+			t.Error("Missing filter ", name)
+		}
+	}
+	if c.HasEncoder("notanencoder") || c.HasFilter("") {
+		t.Error("Unexpected component")
+	}
+	if len(c.Encoders) != len(c.encoders) || !sort.StringsAreSorted(c.Muxers) {
+		t.Error("Unexpected component lists")
+	}
+
+	// Transcodes fail early if components are unavailable
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts"}
+	tests := []struct {
+		out  TranscodeOptions
+		kind string
+		name string
+	}{
+		{TranscodeOptions{VideoEncoder: ComponentOptions{Name: "notanencoder"}}, "Encoder", "notanencoder"},
+		{TranscodeOptions{AudioEncoder: ComponentOptions{Name: "notanencoder"}}, "Encoder", "notanencoder"},
+		{TranscodeOptions{AudioTracks: []AudioTrackOptions{{Encoder: ComponentOptions{Name: "nope"}}}}, "Encoder", "nope"},
+		{TranscodeOptions{Muxer: ComponentOptions{Name: "notamuxer"}}, "Muxer", "notamuxer"},
+	}
+	for _, tc := range tests {
+		tc.out.Oname = "/nonexistent/out.ts"
+		tc.out.Profile = P144p30fps16x9
+		_, err := Transcode3(in, []TranscodeOptions{tc.out})
+		uerr, ok := err.(*UnavailableError)
+		if !ok || uerr.Kind != tc.kind || uerr.Name != tc.name {
+			t.Error("Unexpected error ", err)
+		}
+	}
+	if !c.HasHardwareDevice("cuda") {
+		_, err := Transcode3(in, []TranscodeOptions{{Oname: "/nonexistent/out.ts", Accel: Nvidia}})
+		if err == nil || err.Error() != "Hardware device not found: cuda" {
+			t.Error("Expected missing hardware error, got ", err)
+		}
+	}
+	if filterNames("hwupload_cuda=device=1,scale_cuda@x='w=1'")[1] != "scale_cuda" {
+		t.Error("Unexpected filter names")
+	}
+	// Commas within quoted arguments don't separate filters
+	names := filterNames("scale='w=if(gte(iw,ih),256,-2)',fps=30/1")
+	if len(names) != 2 || names[0] != "scale" || names[1] != "fps" {
+		t.Error("Unexpected filter names ", names)
+	}
+
+	// Inputs without audio don't need an audio encoder
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	run(`ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -an -c:v copy noaudio.ts`)
+	_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/noaudio.ts"}, []TranscodeOptions{{
+		Oname:        dir + "/out.ts",
+		Profile:      P144p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "notanencoder"},
+	}})
+	if _, ok := err.(*UnavailableError); ok {
+		t.Error("Unexpected error for input without audio ", err)
+	}
+}
+
+func TestTranscoderAPI_DynamicRenditions(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+		cp "$1"/../transcoder/test.ts .
+		ffmpeg -loglevel warning -i test.ts -c copy -f segment test%d.ts
+	`
+	run(cmd)
+
+	out := func(name string, profile VideoProfile) TranscodeOptions {
+		return TranscodeOptions{Oname: dir + "/" + name, Profile: profile}
+	}
+	copied := TranscodeOptions{
+		Oname:        dir + "/copy2.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}
+	segments := []struct {
+		outs    []TranscodeOptions
+		decoded int
+	}{
+		{[]TranscodeOptions{out("a0.ts", P144p30fps16x9), out("b0.ts", P240p30fps16x9)}, 120},
+		// rendition removed; the remaining one changes position
+		{[]TranscodeOptions{out("b1.ts", P240p30fps16x9)}, 120},
+		// nothing to decode
+		{[]TranscodeOptions{copied}, 0},
+		// rendition added, another changed
+		{[]TranscodeOptions{out("c3.ts", P360p30fps16x9), out("b3.ts", P144p30fps16x9)}, 120},
+	}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i, seg := range segments {
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test%d.ts", dir, i)}
+		res, err := tc.Transcode(in, seg.outs)
+		if err != nil {
+			t.Fatal("Unexpected error at segment ", i, err)
+		}
+		if len(res.Encoded) != len(seg.outs) || res.Decoded.Frames != seg.decoded {
+			t.Error("Unexpected results at segment ", i, res)
+		}
+		for j, enc := range res.Encoded {
+			if seg.outs[j].VideoEncoder.Name != "copy" && enc.Frames != 60 {
+				t.Error("Unexpected encoded frames at segment ", i, j, enc.Frames)
+			}
+		}
+	}
+
+	cmd = `
+		check_res() {
+			ffprobe -loglevel warning -show_entries stream=width,height -select_streams v \
+				-of csv=s=x:p=0 $1 | grep $2
+		}
+		check_res a0.ts 256x144
+		check_res b0.ts 426x240
+		check_res b1.ts 426x240
+		check_res c3.ts 640x360
+		check_res b3.ts 256x144
+		ffprobe -loglevel warning -count_frames -show_streams -select_streams v copy2.ts | grep nb_read_frames=120
+	`
+	run(cmd)
+}
+
+func TestTranscoderAPI_DynamicContainer(t *testing.T) {
+	// Outputs that only change their container must not keep an encoder set
+	// up for the previous one, eg without global headers for mp4 or without
+	// in-band parameter sets for mpegts
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+		cp "$1"/../transcoder/test.ts .
+		ffmpeg -loglevel warning -i test.ts -c copy -f segment test%d.ts
+	`
+	run(cmd)
+
+	names := []string{"out0.ts", "out1.mp4", "out2.ts"}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i, name := range names {
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test%d.ts", dir, i)}
+		out := []TranscodeOptions{{Oname: dir + "/" + name, Profile: P144p30fps16x9}}
+		res, err := tc.Transcode(in, out)
+		if err != nil {
+			t.Fatal("Unexpected error at segment ", i, err)
+		}
+		if res.Encoded[0].Frames != 60 {
+			t.Error("Unexpected encoded frames at segment ", i, res.Encoded[0].Frames)
+		}
+	}
+
+	cmd = `
+		for f in out0.ts out1.mp4 out2.ts; do
+			ffmpeg -loglevel error -xerror -i $f -f null - 2>&1 | (! grep .)
+			ffprobe -loglevel warning -count_frames -show_streams -select_streams v $f | grep nb_read_frames=60
+		done
+		# the codec configuration is stored in the mp4 header
+		ffprobe -loglevel warning -show_entries stream=codec_tag_string,profile -select_streams v \
+			-of csv=p=0 out1.mp4 | grep avc1
+	`
+	run(cmd)
+}
+
+// Adds and drops an encoded rendition mid-session, so the decoders are
+// switched off and on again.
+func dynamicDecoding(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+		cp "$1"/../transcoder/test.ts .
+		ffmpeg -loglevel warning -i test.ts -c copy -f segment test%d.ts
+	`
+	run(cmd)
+
+	copied := func(i int) TranscodeOptions {
+		return TranscodeOptions{
+			Oname:        fmt.Sprintf("%s/copy%d.ts", dir, i),
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}
+	}
+	encoded := func(i int) TranscodeOptions {
+		return TranscodeOptions{
+			Oname:   fmt.Sprintf("%s/out%d.ts", dir, i),
+			Profile: P144p30fps16x9,
+			Accel:   accel,
+		}
+	}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i := 0; i < 4; i++ {
+		// only the odd segments are encoded
+		outs := []TranscodeOptions{copied(i)}
+		if i%2 == 1 {
+			outs = append(outs, encoded(i))
+		}
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test%d.ts", dir, i), Accel: accel}
+		res, err := tc.Transcode(in, outs)
+		if err != nil {
+			t.Fatal("Unexpected error at segment ", i, err)
+		}
+		decoded := 0
+		if i%2 == 1 {
+			decoded = 120
+			if res.Encoded[1].Frames != 60 {
+				t.Error("Unexpected encoded frames at segment ", i, res.Encoded[1].Frames)
+			}
+		}
+		if res.Decoded.Frames != decoded {
+			t.Error("Unexpected decoded frames at segment ", i, res.Decoded.Frames)
+		}
+	}
+
+	cmd = `
+		for i in 1 3; do
+			ffprobe -loglevel warning -count_frames -show_streams -select_streams v out$i.ts | grep nb_read_frames=60
+			ffprobe -loglevel warning -count_frames -show_streams -select_streams a out$i.ts | grep codec_type=audio
+		done
+	`
+	run(cmd)
+}
+
+func TestTranscoderAPI_DynamicDecoding(t *testing.T) {
+	dynamicDecoding(t, Software)
+}
+
+func TestTranscoderAPI_SegmentEncoders(t *testing.T) {
+	// Encoders are kept across segments if they can be flushed, and re-opened
+	// otherwise; either way every segment must stand on its own
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+		cp "$1"/../transcoder/test.ts .
+		ffmpeg -loglevel warning -i test.ts -c copy -f segment test%d.ts
+	`
+	run(cmd)
+
+	changed := P144p30fps16x9
+	changed.Bitrate = "200k"
+	profiles := []VideoProfile{P144p30fps16x9, P144p30fps16x9, changed, changed}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i, profile := range profiles {
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test%d.ts", dir, i)}
+		out := []TranscodeOptions{{Oname: fmt.Sprintf("%s/out%d.ts", dir, i), Profile: profile}}
+		res, err := tc.Transcode(in, out)
+		if err != nil {
+			t.Fatal("Unexpected error at segment ", i, err)
+		}
+		if res.Encoded[0].Frames != 60 {
+			t.Error("Unexpected encoded frames at segment ", i, res.Encoded[0].Frames)
+		}
+	}
+
+	cmd = `
+		for i in 0 1 2 3; do
+			# every segment decodes on its own and starts with a keyframe
+			ffmpeg -loglevel error -xerror -i out$i.ts -f null - 2>&1 | (! grep .)
+			ffprobe -loglevel warning -count_frames -show_streams -select_streams v out$i.ts | grep nb_read_frames=60
+			ffprobe -loglevel warning -show_entries frame=key_frame,pict_type -select_streams v \
+				-read_intervals "%+#1" -of csv=p=0 out$i.ts | grep -x 1,I
+		done
+	`
+	run(cmd)
+}
+
+func TestTranscoderAPI_ForceKeyframes(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.mp4",
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   4 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &TranscodeOptionsIn{Fname: dir + "/test.mp4"}
+	// Disable scene cut detection so only forced keyframes are inserted
+	encoder := ComponentOptions{Opts: map[string]string{
+		"forced-idr":  "1",
+		"x264-params": "scenecut=0",
+	}}
+	lowFps := P144p30fps16x9
+	lowFps.Framerate = 15
+	kf := KeyframeOptions{Times: []time.Duration{2 * time.Second, time.Second}}
+	out := []TranscodeOptions{
+		{Oname: dir + "/a.ts", Profile: P240p30fps16x9, VideoEncoder: encoder, Keyframes: kf},
+		{Oname: dir + "/b.ts", Profile: lowFps, VideoEncoder: encoder, Keyframes: kf},
+		{Oname: dir + "/c.ts", Profile: P144p30fps16x9, VideoEncoder: encoder,
+			Keyframes: KeyframeOptions{Expr: "gte(t,n_forced*3)"}},
+		{Oname: dir + "/d.ts", VideoEncoder: ComponentOptions{Name: "copy"}},
+	}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near := func(a, b time.Duration) bool {
+		return a-b < time.Millisecond && b-a < time.Millisecond
+	}
+	checkKeyframes := func(got []time.Duration, want ...time.Duration) {
+		if len(got) != len(want) {
+			t.Error("Unexpected keyframes ", got, want)
+			return
+		}
+		for i := range want {
+			if !near(got[i], want[i]) {
+				t.Error("Unexpected keyframes ", got, want)
+			}
+		}
+	}
+	checkKeyframes(res.Encoded[0].Keyframes, 0, time.Second, 2*time.Second)
+	checkKeyframes(res.Encoded[1].Keyframes, 0, time.Second, 2*time.Second)
+	checkKeyframes(res.Encoded[2].Keyframes, 0, 3*time.Second)
+	if len(res.Encoded[3].Keyframes) != 0 {
+		t.Error("Unexpected keyframes for copied video ", res.Encoded[3].Keyframes)
+	}
+	if res.KeyframesAligned {
+		t.Error("Expected keyframes to be misaligned")
+	}
+	if !keyframesAligned(res.Encoded[:2]) || !keyframesAligned(res.Encoded[3:]) {
+		t.Error("Expected keyframes to be aligned")
+	}
+
+	// Invalid expressions are rejected
+	out = []TranscodeOptions{{Oname: dir + "/e.ts", Profile: P144p30fps16x9,
+		Keyframes: KeyframeOptions{Expr: "gte(t,"}}}
+	_, err = Transcode3(in, out)
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected invalid expression error, got ", err)
+	}
+}
+
+func TestTranscoderAPI_SuggestLadder(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	ladder, err := SuggestLadder(VideoProfile{Resolution: "1920x1080", Framerate: 60}, LadderConstraints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range ladder {
+		names = append(names, p.Name)
+	}
+	expected := "P1080p60fps16x9,P720p60fps16x9,P480p30fps16x9,P360p30fps16x9,P240p30fps16x9,P144p30fps16x9"
+	if strings.Join(names, ",") != expected {
+		t.Error("Unexpected ladder ", names)
+	}
+	if ladder[2].Resolution != "854x480" || ladder[5].Resolution != "256x144" {
+		t.Error("Unexpected resolutions ", ladder[2].Resolution, ladder[5].Resolution)
+	}
+	prev := math.MaxInt32
+	for _, p := range ladder {
+		br, err := strconv.Atoi(strings.TrimSuffix(p.Bitrate, "k"))
+		if err != nil || br <= 0 || br >= prev {
+			t.Error("Unexpected bitrate ", p.Bitrate)
+		}
+		prev = br
+	}
+
+	// No upscaling; portrait sources; constraints. Renditions too close to
+	// the one above are skipped, eg 480p below 540p.
+	ladder, err = SuggestLadder(VideoProfile{Resolution: "540x960", Framerate: 30000, FramerateDen: 1001},
+		LadderConstraints{MaxRenditions: 2, MaxBitrate: 1000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ladder) != 2 || ladder[0].Resolution != "540x960" || ladder[1].Resolution != "360x640" {
+		t.Error("Unexpected portrait ladder ", ladder)
+	}
+	if ladder[0].Bitrate != "1000k" || ladder[0].Framerate != 30000 || ladder[0].FramerateDen != 1001 {
+		t.Error("Unexpected portrait rendition ", ladder[0])
+	}
+	ladder, err = SuggestLadder(VideoProfile{Resolution: "1280x720"}, LadderConstraints{MaxResolution: 480, MinResolution: 360})
+	if err != nil || len(ladder) != 2 || ladder[0].Resolution != "854x480" || ladder[1].Resolution != "640x360" {
+		t.Error("Unexpected constrained ladder ", ladder, err)
+	}
+	ladder, err = SuggestLadder(VideoProfile{Resolution: "160x90"}, LadderConstraints{})
+	if err != nil || len(ladder) != 1 || ladder[0].Resolution != "160x90" {
+		t.Error("Unexpected ladder for small source ", ladder, err)
+	}
+	if _, err := SuggestLadder(VideoProfile{}, LadderConstraints{}); err != ErrTranscoderRes {
+		t.Error("Expected resolution error, got ", err)
+	}
+
+	// Probe the source with a transcode, with complexity from a sample encode
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts"}
+	out := []TranscodeOptions{{Oname: dir + "/source.ts", Source: true}}
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complexity, err := MeasureComplexity(in.Fname)
+	if err != nil || complexity <= 0 {
+		t.Fatal("Unexpected complexity ", complexity, err)
+	}
+	ladder, err = SuggestLadder(*res.Encoded[0].SourceProfile, LadderConstraints{Complexity: complexity})
+	if err != nil || len(ladder) == 0 || ladder[0].Resolution != res.Encoded[0].SourceProfile.Resolution {
+		t.Error("Unexpected source ladder ", ladder, err)
+	}
+	// Renditions of the ladder can be transcoded
+	out = out[:0]
+	for i, p := range ladder {
+		out = append(out, TranscodeOptions{Oname: fmt.Sprintf("%s/out%d.ts", dir, i), Profile: p})
+	}
+	if _, err := Transcode3(in, out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranscoderAPI_InputLimits(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   4 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Jump the timestamps ahead by ten seconds after the first second
+	cmd := `
+    ffmpeg -loglevel warning -i test.ts -an -c:v libx264 -vsync passthrough \
+      -vf "setpts=PTS+gte(N\,30)*10/TB" gap.ts
+  `
+	run(cmd)
+
+	out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}}
+	transcode := func(fname string, limits InputLimits) error {
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/" + fname, Limits: limits}, out)
+		return err
+	}
+	ok := []InputLimits{
+		{},
+		{Duration: 5 * time.Second, Width: 320, Height: 240, Frames: 120,
+			PTSGap: time.Second, OutputFramesPerFrame: 2},
+	}
+	for _, l := range ok {
+		if err := transcode("test.ts", l); err != nil {
+			t.Error("Unexpected error for limits ", l, err)
+		}
+	}
+	exceeded := []InputLimits{
+		{Duration: 2 * time.Second},
+		{Width: 319},
+		{Height: 200},
+		{Frames: 60},
+	}
+	for _, l := range exceeded {
+		if err := transcode("test.ts", l); err != ErrTranscoderLimit {
+			t.Error("Expected limit error for ", l, err)
+		}
+	}
+	if err := transcode("gap.ts", InputLimits{PTSGap: time.Second}); err != ErrTranscoderLimit {
+		t.Error("Expected timestamp gap error ", err)
+	}
+	if err := transcode("gap.ts", InputLimits{OutputFramesPerFrame: 10}); err != ErrTranscoderLimit {
+		t.Error("Expected output frame ratio error ", err)
+	}
+	if err := transcode("gap.ts", InputLimits{}); err != nil {
+		t.Error("Unexpected error without limits ", err)
+	}
+	if ErrTranscoderLimit.Error() != "Input exceeds limits" {
+		t.Error("Unexpected error message ", ErrTranscoderLimit)
+	}
+	for _, e := range NonRetryableErrs {
+		if e == ErrTranscoderLimit.Error() {
+			return
+		}
+	}
+	t.Error("Expected limit error to be non-retryable")
+}
+
+func TestTranscoderAPI_Decoder(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	fname := dir + "/test.mp4"
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      fname,
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   2 * time.Second,
+		GOP:        time.Second,
+		SampleRate: 44100,
+		Channels:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll := func(d *Decoder) (video []*VideoFrame, audio []*AudioFrame) {
+		defer d.Close()
+		for {
+			f, err := d.Read()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if f.Video != nil {
+				video = append(video, f.Video)
+			} else {
+				audio = append(audio, f.Audio)
+			}
+		}
+	}
+
+	// Every frame, as RGBA
+	d, err := NewDecoder(fname, DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, audio := readAll(d)
+	if len(video) != 60 {
+		t.Error("Unexpected number of video frames ", len(video))
+	}
+	keyframes := 0
+	for i, v := range video {
+		if v.Keyframe {
+			keyframes++
+		}
+		if i > 0 && v.PTS <= video[i-1].PTS {
+			t.Error("Non-increasing video timestamps ", video[i-1].PTS, v.PTS)
+		}
+	}
+	if keyframes != 2 || !video[0].Keyframe {
+		t.Error("Unexpected keyframes ", keyframes)
+	}
+	img, ok := video[0].Image().(*image.RGBA)
+	if !ok || img.Bounds() != image.Rect(0, 0, 320, 240) {
+		t.Error("Unexpected image ", video[0].Image())
+	}
+	samples := 0
+	for _, a := range audio {
+		if a.SampleRate != 44100 || a.Channels != 1 {
+			t.Error("Unexpected audio format ", a.SampleRate, a.Channels)
+		}
+		samples += len(a.Samples)
+	}
+	if samples < 2*44100 || samples > 2*44100+2048 {
+		t.Error("Unexpected number of audio samples ", samples)
+	}
+
+	// Scaled, sampled and from a reader
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err = NewDecoderReader(f, DecoderOptions{
+		NoAudio:     true,
+		Resolution:  "160x120",
+		Framerate:   10,
+		PixelFormat: "yuv420p",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, audio = readAll(d)
+	if len(video) != 20 || len(audio) != 0 {
+		t.Error("Unexpected number of frames ", len(video), len(audio))
+	}
+	for i, v := range video {
+		if near := time.Duration(i) * 100 * time.Millisecond; v.PTS-near > time.Millisecond || near-v.PTS > time.Millisecond {
+			t.Error("Unexpected sampled timestamp ", i, v.PTS)
+		}
+	}
+	yuv, ok := video[0].Image().(*image.YCbCr)
+	if !ok || yuv.Bounds() != image.Rect(0, 0, 160, 120) || len(yuv.Cb) < 80*60 {
+		t.Error("Unexpected image ", video[0].Image())
+	}
+
+	// Reads after close and invalid inputs fail
+	if _, err := d.Read(); err != ErrTranscoderStp {
+		t.Error("Expected stopped decoder error ", err)
+	}
+	if _, err := NewDecoder(dir+"/missing.mp4", DecoderOptions{}); err == nil {
+		t.Error("Expected error for missing input")
+	}
+	if _, err := NewDecoderReader(strings.NewReader(""), DecoderOptions{}); err != ErrTranscoderInp {
+		t.Error("Expected error for empty input ", err)
+	}
+	if _, err := NewDecoder(fname, DecoderOptions{PixelFormat: "nope"}); err == nil {
+		t.Error("Expected error for invalid pixel format")
+	}
+}
+
+func TestTranscoderAPI_Encoder(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	countFrames := func(fname string) (video, audio int) {
+		d, err := NewDecoder(fname, DecoderOptions{PixelFormat: "yuv420p"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		for {
+			f, err := d.Read()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if f.Video != nil {
+				video++
+			} else {
+				audio += len(f.Audio.Samples)
+			}
+		}
+	}
+
+	// Rendered images and a tone, to a file
+	out := TranscodeOptions{Oname: dir + "/out.ts", Profile: P144p30fps16x9}
+	e, err := NewEncoder(out, EncoderOptions{Resolution: "320x240", SampleRate: 44100, Channels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	samples := make([]float32, 2*1000)
+	for i := 0; i < 60; i++ {
+		for j := range img.Pix {
+			img.Pix[j] = uint8(i * 4)
+		}
+		if err := e.WriteImage(img, time.Duration(i)*time.Second/30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 88; i++ {
+		for j := range samples {
+			samples[j] = float32(math.Sin(float64(i*1000+j/2) * 440 * 2 * math.Pi / 44100))
+		}
+		a := &AudioFrame{PTS: time.Duration(i*1000) * time.Second / 44100, SampleRate: 44100, Channels: 2, Samples: samples}
+		if err := e.WriteAudio(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Mismatched frames are rejected
+	if err := e.WriteImage(image.NewRGBA(image.Rect(0, 0, 160, 120)), 0); err != ErrTranscoderRes {
+		t.Error("Expected resolution error ", err)
+	}
+	if err := e.WriteAudio(&AudioFrame{SampleRate: 48000, Channels: 2, Samples: samples}); err != ErrTranscoderAud {
+		t.Error("Expected audio error ", err)
+	}
+	res, err := e.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Frames != 60 || res.Pixels != 60*256*144 {
+		t.Error("Unexpected encoded video ", res.Frames, res.Pixels)
+	}
+	video, audio := countFrames(out.Oname)
+	if video != 60 || audio < 2*88000 || audio > 2*88000+2*2048 {
+		t.Error("Unexpected number of frames ", video, audio)
+	}
+	if _, err := e.Close(); err != ErrTranscoderStp {
+		t.Error("Expected stopped encoder error ", err)
+	}
+
+	// Decoded frames, video only, to a writer
+	d, err := NewDecoder(out.Oname, DecoderOptions{NoAudio: true, PixelFormat: "yuv420p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var buf strings.Builder
+	out = TranscodeOptions{Oname: "out.mp4", Profile: P144p30fps16x9, AudioEncoder: ComponentOptions{Name: "drop"}}
+	out.Profile.Format = FormatMP4
+	e, err = NewEncoderWriter(&buf, out, EncoderOptions{Resolution: "256x144", PixelFormat: "yuv420p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := d.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.WriteImage(f.Video.Image(), f.Video.PTS); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fname := dir + "/writer.mp4"
+	if err := ioutil.WriteFile(fname, []byte(buf.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if video, audio := countFrames(fname); video != 60 || audio != 0 {
+		t.Error("Unexpected number of frames ", video, audio)
+	}
+
+	// Nothing to copy from
+	out = TranscodeOptions{Oname: dir + "/copy.ts", VideoEncoder: ComponentOptions{Name: "copy"}}
+	if _, err := NewEncoder(out, EncoderOptions{Resolution: "320x240"}); err == nil {
+		t.Error("Expected error when copying")
+	}
+}
+
+func TestTranscoderAPI_Analysis(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   3 * time.Second,
+		GOP:        time.Second,
+		SampleRate: 44100,
+		Channels:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Black for the first second, a cut to the negated picture at two
+	// seconds, and silence from one and a half seconds.
+	cmd := `
+    ffmpeg -loglevel warning -i test.ts -c:v libx264 -c:a aac       -vf "drawbox=c=black:t=fill:enable='lt(t,1)',negate=enable='gte(t,2)'"       -af "volume=0:enable='gte(t,1.5)'" events.mp4
+  `
+	run(cmd)
+
+	near := func(a, b time.Duration) bool {
+		return a-b < 100*time.Millisecond && b-a < 100*time.Millisecond
+	}
+	in := &TranscodeOptionsIn{
+		Fname: dir + "/events.mp4",
+		Analysis: AnalysisOptions{
+			SceneThreshold:  0.3,
+			BlackDuration:   500 * time.Millisecond,
+			SilenceDuration: time.Second,
+		},
+	}
+	check := func(out []TranscodeOptions) {
+		res, err := Transcode3(in, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := res.Analysis
+		if a == nil {
+			t.Fatal("Missing analysis")
+		}
+		if len(a.SceneChanges) != 2 || !near(a.SceneChanges[0], time.Second) ||
+			!near(a.SceneChanges[1], 2*time.Second) {
+			t.Error("Unexpected scene changes ", a.SceneChanges)
+		}
+		if len(a.Black) != 1 || !near(a.Black[0].Start, 0) || !near(a.Black[0].End, time.Second) {
+			t.Error("Unexpected black intervals ", a.Black)
+		}
+		if len(a.Silence) != 1 || !near(a.Silence[0].Start, 1500*time.Millisecond) ||
+			!near(a.Silence[0].End, 3*time.Second) {
+			t.Error("Unexpected silence ", a.Silence)
+		}
+	}
+	// While encoding, and when only copying streams
+	check([]TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}})
+	check([]TranscodeOptions{{
+		Oname:        dir + "/copy.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}})
+
+	// Nothing reported unless requested
+	in.Analysis = AnalysisOptions{}
+	res, err := Transcode3(in, []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Analysis != nil {
+		t.Error("Unexpected analysis ", res.Analysis)
+	}
+}
+
+func TestTranscoderAPI_Loudness(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   4 * time.Second,
+		SampleRate: 44100,
+		Channels:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcode := func(fname, oname string, l *LoudnessOptions) *LoudnessResults {
+		out := []TranscodeOptions{{
+			Oname:        dir + "/" + oname,
+			Profile:      P144p30fps16x9,
+			VideoEncoder: ComponentOptions{Name: "drop"},
+			Loudness:     l,
+		}}
+		res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/" + fname}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Encoded[0].Loudness
+	}
+
+	// Measured up front, with the gain to reach the default target
+	vod := transcode("test.ts", "vod.ts", &LoudnessOptions{TwoPass: true})
+	if vod == nil || vod.Integrated <= -70 || math.Abs(vod.Integrated+vod.Gain+23) > 0.01 {
+		t.Fatal("Unexpected two-pass loudness ", vod)
+	}
+	// The output is then at the target
+	res := transcode("vod.ts", "check.ts", &LoudnessOptions{TwoPass: true})
+	if res == nil || math.Abs(res.Integrated+23) > 1 || math.Abs(res.Gain) > 1 {
+		t.Error("Unexpected normalised loudness ", res)
+	}
+
+	// A steady tone settles at the same gain in the live mode
+	res = transcode("test.ts", "live.ts", &LoudnessOptions{})
+	if res == nil || math.Abs(res.Gain-vod.Gain) > 1 {
+		t.Error("Unexpected live loudness ", res, vod)
+	}
+
+	// Limited by the true peak
+	res = transcode("test.ts", "peak.ts", &LoudnessOptions{Target: -5, TruePeak: -10, TwoPass: true})
+	if res == nil || math.Abs(res.TruePeak+res.Gain+10) > 0.01 {
+		t.Error("Unexpected peak limited loudness ", res)
+	}
+
+	// Nothing measured unless requested
+	if res := transcode("test.ts", "none.ts", nil); res != nil {
+		t.Error("Unexpected loudness ", res)
+	}
+}
+
+func TestTranscoderAPI_TimedMetadata(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		GOP:        time.Second,
+		Duration:   4 * time.Second,
+		SampleRate: 44100,
+		Channels:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := P144p30fps16x9
+	prof.GOP = time.Second
+	in := &TranscodeOptionsIn{
+		Fname: dir + "/test.ts",
+		Metadata: []TimedMetadata{
+			{PTS: 500 * time.Millisecond, Data: ID3Text("lpms", "first")},
+			{PTS: 2500 * time.Millisecond, Data: ID3Text("lpms", "second")},
+		},
+	}
+	_, err = Transcode3(in, []TranscodeOptions{
+		{Oname: dir + "/out.ts", Profile: prof},
+		{Oname: dir + "/out.mp4", Profile: prof},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs, err := Segment(dir+"/out.ts", dir+"/seg%d.ts", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 2 {
+		t.Fatal("Unexpected segments ", segs)
+	}
+
+	cmd := `
+    # each payload lands in the segment covering its timestamp
+    count() {
+      ffprobe -loglevel warning -select_streams d -show_entries packet=pts -of csv=p=0 $1 | wc -l
+    }
+    [ $(count out.ts) -eq 2 ]
+    [ $(count seg0.ts) -eq 1 ]
+    [ $(count seg1.ts) -eq 1 ]
+    grep -q first seg0.ts
+    grep -q second seg1.ts
+    ffprobe -loglevel warning -show_streams seg0.ts | grep codec_name=timed_id3
+
+    # not carried by other formats
+    [ $(count out.mp4) -eq 0 ]
+  `
+	run(cmd)
+}
+
+func TestTranscoderAPI_PreserveTimestamps(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		Duration:   4 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drop half a second of frames after the first second, keeping the
+	// timestamps of the remaining frames
+	cmd := `
+    ffmpeg -loglevel warning -i test.ts -c:a copy -c:v libx264 -vsync vfr \
+      -vf "select=not(between(n\,30\,44))" gap.ts
+  `
+	run(cmd)
+
+	lowFps := P144p30fps16x9
+	lowFps.Framerate = 15
+	out := []TranscodeOptions{
+		{Oname: dir + "/a.ts", Profile: P144p30fps16x9, PreserveTimestamps: true},
+		{Oname: dir + "/b.ts", Profile: lowFps, PreserveTimestamps: true},
+		{Oname: dir + "/c.ts", VideoEncoder: ComponentOptions{Name: "copy"}},
+	}
+	res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/gap.ts"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near := func(a, b, tolerance time.Duration) bool {
+		return a-b <= tolerance && b-a <= tolerance
+	}
+	frame := time.Second / 30
+	if !near(res.Decoded.Duration, 4*time.Second, frame) {
+		t.Error("Unexpected input duration ", res.Decoded.Duration)
+	}
+	if res.Decoded.Frames != 105 {
+		t.Error("Unexpected input frames ", res.Decoded.Frames)
+	}
+	for i, fps := range []int{30, 15, 30} {
+		enc := res.Encoded[i]
+		frame := time.Second / time.Duration(fps)
+		if !near(enc.StartTime, res.Decoded.StartTime, frame) {
+			t.Error("Unexpected start time ", i, enc.StartTime, res.Decoded.StartTime)
+		}
+		if !near(enc.Duration, res.Decoded.Duration, frame) {
+			t.Error("Unexpected duration ", i, enc.Duration, res.Decoded.Duration)
+		}
+	}
+	// The gap is filled with duplicate frames
+	for i, want := range []int{120, 60} {
+		if got := res.Encoded[i].Frames; got < want-1 || got > want+1 {
+			t.Error("Unexpected encoded frames ", i, got, want)
+		}
+	}
+}
+
+func TestTranscoderAPI_ErrorTolerance(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.mp4",
+		Resolution: "320x240",
+		Duration:   2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Garble the audio packets so they fail to decode
+	cmd := `
+    ffmpeg -loglevel warning -i test.mp4 -c copy -bsf:a noise=amount=4 corrupt.mp4
+  `
+	run(cmd)
+
+	out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}}
+	transcode := func(tolerance *ErrorTolerance) (*TranscodeResults, error) {
+		in := &TranscodeOptionsIn{Fname: dir + "/corrupt.mp4", ErrorTolerance: tolerance}
+		return Transcode3(in, out)
+	}
+
+	// Intact input
+	res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.mp4"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := res.DecodeErrors; e.Packets <= 0 || e != (DecodeErrors{Packets: e.Packets}) {
+		t.Error("Unexpected decode errors ", e)
+	}
+
+	// Fails at the first error by default
+	if _, err := transcode(nil); err == nil || err == ErrTranscoderCorrupt {
+		t.Error("Expected decoding error ", err)
+	}
+
+	// Skips the corrupt packets
+	res, err = transcode(&ErrorTolerance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := res.DecodeErrors
+	if e.Skipped <= 0 || e.Skipped >= e.Packets ||
+		e.InvalidData+e.DecoderFailed != e.Skipped {
+		t.Error("Unexpected decode errors ", e)
+	}
+	if res.Decoded.Frames != 60 || res.Encoded[0].Frames != 60 {
+		t.Error("Unexpected frame counts ", res.Decoded.Frames, res.Encoded[0].Frames)
+	}
+	// Bounded by the thresholds
+	if _, err := transcode(&ErrorTolerance{MaxErrors: e.Skipped + e.Corrupted}); err != nil {
+		t.Error("Unexpected error within tolerance ", err)
+	}
+	if _, err := transcode(&ErrorTolerance{MaxErrors: 1}); err != ErrTranscoderCorrupt {
+		t.Error("Expected error count to exceed tolerance ", err)
+	}
+	if _, err := transcode(&ErrorTolerance{MaxRatio: 0.01}); err != ErrTranscoderCorrupt {
+		t.Error("Expected error ratio to exceed tolerance ", err)
+	}
+}
+
+func TestTranscoderAPI_PixelFormats(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := `
+    ffmpeg -loglevel warning -i test.ts -an -c:v libx264 -pix_fmt yuv422p10le in422p10.ts
+    ffmpeg -loglevel warning -i test.ts -an -c:v libx264 -pix_fmt yuv444p in444p.ts
+  `
+	run(cmd)
+
+	for _, in := range []string{"in422p10", "in444p"} {
+		out := []TranscodeOptions{
+			{Oname: dir + "/" + in + "-a.ts", Profile: P144p30fps16x9},
+			{Oname: dir + "/" + in + "-b.ts", Profile: P144p30fps16x9, PixelFormat: "yuv420p10le"},
+		}
+		res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/" + in + ".ts"}, out)
+		if err != nil {
+			t.Fatal(in, err)
+		}
+		if res.Decoded.Frames != 30 || res.Encoded[0].Frames != 30 || res.Encoded[1].Frames != 30 {
+			t.Error("Unexpected frame counts ", in, res.Decoded.Frames, res.Encoded)
+		}
+	}
+	cmd = `
+    pixfmt() {
+      ffprobe -loglevel warning -select_streams v -show_entries stream=pix_fmt,profile -of csv=p=0 $1
+    }
+    [ "$(pixfmt in422p10-a.ts)" = "High,yuv420p" ]
+    [ "$(pixfmt in422p10-b.ts)" = "High 10,yuv420p10le" ]
+    [ "$(pixfmt in444p-a.ts)" = "High,yuv420p" ]
+    [ "$(pixfmt in444p-b.ts)" = "High 10,yuv420p10le" ]
+  `
+	run(cmd)
+
+	// Unknown formats, or formats the encoder does not support
+	for _, pixFmt := range []string{"notapixfmt", "rgb24"} {
+		out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9, PixelFormat: pixFmt}}
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.ts"}, out)
+		if err == nil || err.Error() != "Invalid argument" {
+			t.Error("Expected invalid pixel format error ", pixFmt, err)
+		}
+	}
+}
+
+func TestTranscoderAPI_ResourceUsage(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    ffmpeg -loglevel warning -i "$1/../transcoder/test.ts" -c copy -f segment -segment_time 2 test_%d.ts
+  `
+	run(cmd)
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i := 0; i < 2; i++ {
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test_%d.ts", dir, i)}
+		out := []TranscodeOptions{
+			{Oname: fmt.Sprintf("%s/out_%d_a.ts", dir, i), Profile: P144p30fps16x9},
+			{Oname: fmt.Sprintf("%s/out_%d_b.ts", dir, i), Profile: P240p30fps16x9},
+		}
+		res, err := tc.Transcode(in, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := res.Usage
+		if u.WallTime <= 0 || u.PipelineCPUTime <= 0 || u.PeakFrameMemory <= 0 ||
+			u.ProcessCPUTime <= 0 || u.ProcessPeakMemory <= 0 {
+			t.Error("Missing resource usage ", i, u)
+		}
+		if u.PeakFrameMemory > u.ProcessPeakMemory {
+			t.Error("Frame memory exceeds the process ", i, u)
+		}
+		if res.Decoded.PipelineCPUTime != 0 {
+			t.Error("Unexpected CPU time for the decoded input ", i, res.Decoded.PipelineCPUTime)
+		}
+		var cpu time.Duration
+		if res.Decoded.Stages.Demux <= 0 || res.Decoded.Stages.Decode <= 0 {
+			t.Error("Missing input stage times ", i, res.Decoded.Stages)
+		}
+		sum := res.Decoded.Stages
+		for j, e := range res.Encoded {
+			s := e.Stages
+			if s.Filter <= 0 || s.Encode <= 0 || s.Mux <= 0 {
+				t.Error("Missing output stage times ", i, j, s)
+			}
+			if s.Demux != 0 || s.Decode != 0 {
+				t.Error("Unexpected input stage times in output ", i, j, s)
+			}
+			if e.PipelineCPUTime <= 0 {
+				t.Error("Missing output CPU time ", i, j)
+			}
+			cpu += e.PipelineCPUTime
+			sum.Filter += s.Filter
+			sum.Encode += s.Encode
+			sum.Mux += s.Mux
+		}
+		if sum != u.Stages {
+			t.Error("Mismatched stage totals ", i, sum, u.Stages)
+		}
+		if cpu > u.PipelineCPUTime {
+			t.Error("Output CPU times exceed the call ", i, cpu, u.PipelineCPUTime)
+		}
+		total := sum.Demux + sum.Decode + sum.Filter + sum.Encode + sum.Mux
+		if total > u.WallTime {
+			t.Error("Stages exceed wall time ", i, total, u.WallTime)
+		}
+	}
+}
+
+// How benchmarkSegments sets up each segment
+type segmentSetup int
+
+const (
+	// Everything is kept from the previous segment
+	reuseSession segmentSetup = iota
+	// Only the output is set up again, including its encoder
+	newEncoder
+	// A new session is opened for every segment
+	newSession
+)
+
+// Transcodes short segments to measure the per-segment setup overhead of a
+// session. Comparing newEncoder against reuseSession isolates the cost of
+// opening the encoder, since the demuxer and decoder are kept in both.
+func benchmarkSegments(b *testing.B, ext string, setup segmentSetup) {
+	_, dir := setupTest(b)
+	defer os.RemoveAll(dir)
+	err := GenerateTestMedia(TestMediaOptions{
+		Oname:      dir + "/test.ts",
+		Resolution: "320x240",
+		Framerate:  30,
+		GOP:        time.Second / 3,
+		Duration:   2 * time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	segs, err := Segment(dir+"/test.ts", dir+"/seg%d."+ext, time.Second/3)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Alternating bitrates changes the output settings every segment
+	profiles := []VideoProfile{P144p30fps16x9, P144p30fps16x9}
+	profiles[1].Bitrate = "300k"
+
+	tc := NewTranscoder()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if setup == newSession {
+			tc.StopTranscoder()
+			tc = NewTranscoder()
+		}
+		profile := profiles[0]
+		if setup == newEncoder {
+			profile = profiles[i%2]
+		}
+		in := &TranscodeOptionsIn{Fname: segs[i%len(segs)].Name}
+		out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: profile}}
+		if _, err := tc.Transcode(in, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	tc.StopTranscoder()
+}
+
+func BenchmarkTranscoder_SegmentsTS(b *testing.B) {
+	benchmarkSegments(b, "ts", reuseSession)
+}
+
+func BenchmarkTranscoder_SegmentsMP4(b *testing.B) {
+	benchmarkSegments(b, "mp4", reuseSession)
+}
+
+func BenchmarkTranscoder_SegmentsTSNewEncoder(b *testing.B) {
+	benchmarkSegments(b, "ts", newEncoder)
+}
+
+func BenchmarkTranscoder_SegmentsMP4NewEncoder(b *testing.B) {
+	benchmarkSegments(b, "mp4", newEncoder)
+}
+
+func BenchmarkTranscoder_SegmentsTSNewSession(b *testing.B) {
+	benchmarkSegments(b, "ts", newSession)
+}
+
+func BenchmarkTranscoder_SegmentsMP4NewSession(b *testing.B) {
+	benchmarkSegments(b, "mp4", newSession)
+}
@@ -0,0 +1,281 @@
+package ffmpeg
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// #cgo pkg-config: libavformat libavfilter libavcodec libavutil
+// #include <stdlib.h>
+// #include <libavformat/avformat.h>
+// #include <libavfilter/avfilter.h>
+// #include <libavutil/hwcontext.h>
+// #include "extras.h"
+import "C"
+
+// Components compiled into the linked libav* libraries. Names are sorted.
+type LibraryCapabilities struct {
+	Encoders        []string
+	Decoders        []string
+	Muxers          []string
+	Demuxers        []string
+	Filters         []string
+	HardwareDevices []string
+
+	encoders, decoders, muxers, demuxers, filters, devices map[string]bool
+}
+
+// Returned when a transcode requests a component that isn't available in the
+// linked libraries. The message begins with the corresponding FFmpeg error,
+// eg "Encoder not found", followed by the name of the component.
+type UnavailableError struct {
+	Kind string // eg "Encoder", "Filter" or "Hardware device"
+	Name string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Kind + " not found: " + e.Name
+}
+
+var (
+	caps     *LibraryCapabilities
+	capsOnce sync.Once
+)
+
+// Capabilities lists the components available in the linked libraries.
+// The result is shared and must not be modified.
+func Capabilities() *LibraryCapabilities {
+	capsOnce.Do(func() {
+		caps = probeCapabilities()
+	})
+	return caps
+}
+
+func (c *LibraryCapabilities) HasEncoder(name string) bool { return c.encoders[name] }
+func (c *LibraryCapabilities) HasDecoder(name string) bool { return c.decoders[name] }
+func (c *LibraryCapabilities) HasMuxer(name string) bool   { return c.muxers[name] }
+func (c *LibraryCapabilities) HasDemuxer(name string) bool { return c.demuxers[name] }
+func (c *LibraryCapabilities) HasFilter(name string) bool  { return c.filters[name] }
+func (c *LibraryCapabilities) HasHardwareDevice(name string) bool {
+	return c.devices[name]
+}
+
+// Format names may be comma separated lists of aliases, eg "mov,mp4,m4a",
+// any of which can be used to select the format.
+func addNames(set map[string]bool, names string) {
+	for _, n := range strings.Split(names, ",") {
+		if n != "" {
+			set[n] = true
+		}
+	}
+}
+
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func probeCapabilities() *LibraryCapabilities {
+	c := &LibraryCapabilities{
+		encoders: map[string]bool{},
+		decoders: map[string]bool{},
+		muxers:   map[string]bool{},
+		demuxers: map[string]bool{},
+		filters:  map[string]bool{},
+		devices:  map[string]bool{},
+	}
+	var opaque unsafe.Pointer
+	for codec := C.av_codec_iterate(&opaque); codec != nil; codec = C.av_codec_iterate(&opaque) {
+		name := C.GoString(codec.name)
+		if C.av_codec_is_encoder(codec) != 0 {
+			c.encoders[name] = true
+		}
+		if C.av_codec_is_decoder(codec) != 0 {
+			c.decoders[name] = true
+		}
+	}
+	opaque = nil
+	for f := C.av_muxer_iterate(&opaque); f != nil; f = C.av_muxer_iterate(&opaque) {
+		addNames(c.muxers, C.GoString(f.name))
+	}
+	opaque = nil
+	for f := C.av_demuxer_iterate(&opaque); f != nil; f = C.av_demuxer_iterate(&opaque) {
+		addNames(c.demuxers, C.GoString(f.name))
+	}
+	opaque = nil
+	for f := C.av_filter_iterate(&opaque); f != nil; f = C.av_filter_iterate(&opaque) {
+		c.filters[C.GoString(f.name)] = true
+	}
+	for t := C.av_hwdevice_iterate_types(C.AV_HWDEVICE_TYPE_NONE); t != C.AV_HWDEVICE_TYPE_NONE; t = C.av_hwdevice_iterate_types(t) {
+		c.devices[C.GoString(C.av_hwdevice_get_type_name(t))] = true
+	}
+	c.Encoders = sortedNames(c.encoders)
+	c.Decoders = sortedNames(c.decoders)
+	c.Muxers = sortedNames(c.muxers)
+	c.Demuxers = sortedNames(c.demuxers)
+	c.Filters = sortedNames(c.filters)
+	c.HardwareDevices = sortedNames(c.devices)
+	return c
+}
+
+func accelDeviceName(accel Acceleration) string {
+	switch accel {
+	case Nvidia:
+		return "cuda"
+	}
+	return ""
+}
+
+// Names of the filters within a filtergraph chain, eg "hwupload_cuda,scale_cuda".
+// Commas within quoted filter arguments don't separate filters.
+func filterNames(chain string) []string {
+	var names []string
+	quoted, start := false, 0
+	for i := 0; i <= len(chain); i++ {
+		if i < len(chain) {
+			if chain[i] == '\'' {
+				quoted = !quoted
+			}
+			if quoted || chain[i] != ',' {
+				continue
+			}
+		}
+		f := chain[start:i]
+		start = i + 1
+		if j := strings.IndexAny(f, "=@"); j >= 0 {
+			f = f[:j]
+		}
+		if f = strings.TrimSpace(f); f != "" {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+// Filters the transcode adds for the quality comparison and loudness
+// normalisation of an output.
+func featureFilters(p TranscodeOptions) []string {
+	var names []string
+	if q := p.Quality; q != nil && encodesVideo(p) {
+		if q.PSNR || !q.SSIM && !q.VMAF {
+			names = append(names, "psnr")
+		}
+		if q.SSIM || !q.PSNR && !q.VMAF {
+			names = append(names, "ssim")
+		}
+		if q.VMAF {
+			names = append(names, "libvmaf")
+		}
+	}
+	if p.Loudness != nil {
+		names = append(names, "ebur128", "volume")
+	}
+	return names
+}
+
+// Checks that the components needed for a transcode are available, so the
+// transcode can fail early with a clear error.
+func checkCapabilities(input *TranscodeOptionsIn, ps []TranscodeOptions) error {
+	c := Capabilities()
+	check := func(kind, name string, has func(string) bool) error {
+		if name == "" || has(name) {
+			return nil
+		}
+		return &UnavailableError{Kind: kind, Name: name}
+	}
+	isSpecial := func(name string) bool {
+		return name == "" || name == "copy" || name == "drop"
+	}
+	// Inputs without audio don't need an audio encoder. Only probed if an
+	// encoder is missing, and only for files, since pipes can't be read twice.
+	inputHasAudio := func() bool {
+		if !isRegularFile(input.Fname) {
+			return true
+		}
+		fname := C.CString(input.Fname)
+		defer C.free(unsafe.Pointer(fname))
+		return C.lpms_has_audio(fname) != 0
+	}
+	if err := check("Hardware device", accelDeviceName(input.Accel), c.HasHardwareDevice); err != nil {
+		return err
+	}
+	if err := check("Demuxer", input.Demuxer.Name, c.HasDemuxer); err != nil {
+		return err
+	}
+	if err := check("Decoder", input.VideoDecoder.Name, c.HasDecoder); err != nil {
+		return err
+	}
+	if err := check("Decoder", input.AudioDecoder.Name, c.HasDecoder); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if err := check("Hardware device", accelDeviceName(p.Accel), c.HasHardwareDevice); err != nil {
+			return err
+		}
+		encoder, scaleFilter := p.VideoEncoder.Name, "scale"
+		if p.Source {
+			encoder = "copy"
+		}
+		if encoder == "" {
+			// Invalid combinations are reported by the transcode itself
+			enc, filter, err := configAccel(input.Accel, p.Accel, input.Device, p.Device)
+			if err == nil {
+				encoder, scaleFilter = enc, filter
+			}
+		}
+		if !isSpecial(encoder) {
+			if err := check("Encoder", encoder, c.HasEncoder); err != nil {
+				return err
+			}
+		}
+		var filters []string
+		if encodesVideo(p) {
+			// Invalid profiles are reported by the transcode itself
+			param := p.Profile
+			if param.FramerateDen == 0 {
+				param.FramerateDen = 1
+			}
+			w, h, _ := VideoProfileResolution(param)
+			vf, swVf := videoFilters(input, p, param, scaleFilter, w, h)
+			filters = append(filterNames(vf), filterNames(swVf)...)
+		}
+		for _, f := range append(filters, featureFilters(p)...) {
+			if err := check("Filter", f, c.HasFilter); err != nil {
+				return err
+			}
+		}
+		audioEncoders := []string{p.AudioEncoder.Name}
+		if len(p.AudioTracks) > 0 {
+			audioEncoders = audioEncoders[:0]
+			for _, track := range p.AudioTracks {
+				audioEncoders = append(audioEncoders, track.Encoder.Name)
+			}
+		}
+		for _, enc := range audioEncoders {
+			if enc == "" {
+				enc = "aac"
+			}
+			if isSpecial(enc) {
+				continue
+			}
+			if err := check("Encoder", enc, c.HasEncoder); err != nil {
+				if !inputHasAudio() {
+					continue
+				}
+				return err
+			}
+		}
+		if p.Profile.Format == FormatNone {
+			if err := check("Muxer", p.Muxer.Name, c.HasMuxer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,18 +2,32 @@
 #include "decoder.h"
 #include "logging.h"
 
+#include <libavutil/avstring.h>
 #include <libavutil/pixfmt.h>
+#include <libavutil/time.h>
+
+#include <string.h>
+
+// Adds the time since start to a stage of the input, if timed
+static void add_time(int64_t *stage, int64_t start)
+{
+    if (stage) *stage += av_gettime_relative() - start;
+}
 
 static int lpms_send_packet(struct input_ctx *ictx, AVCodecContext *dec, AVPacket *pkt)
 {
+    int64_t start = av_gettime_relative();
     int ret = avcodec_send_packet(dec, pkt);
+    add_time(ictx->stages ? &ictx->stages->decode : NULL, start);
     if (ret == 0 && dec == ictx->vc) ictx->pkt_diff++; // increase buffer count for video packets
     return ret;
 }
 
 static int lpms_receive_frame(struct input_ctx *ictx, AVCodecContext *dec, AVFrame *frame)
 {
+    int64_t start = av_gettime_relative();
     int ret = avcodec_receive_frame(dec, frame);
+    add_time(ictx->stages ? &ictx->stages->decode : NULL, start);
     if (dec != ictx->vc) return ret;
     if (!ret && frame && !is_flush_frame(frame)) {
       ictx->pkt_diff--; // decrease buffer count for non-sentinel video frames
@@ -22,12 +36,55 @@ static int lpms_receive_frame(struct input_ctx *ictx, AVCodecContext *dec, AVFra
     return ret;
 }
 
+// Whether the errors of the segment exceed either threshold
+static int exceeds_tolerance(struct input_ctx *ictx)
+{
+  error_tolerance *t = &ictx->tolerance;
+  decode_stats *s = ictx->errors;
+  int errors = s->skipped + s->corrupted;
+  if (t->max_errors && errors > t->max_errors) return 1;
+  if (t->max_ratio && errors > t->max_ratio * s->packets) return 1;
+  return 0;
+}
+
+// Counts a packet that failed to decode. When tolerant, the packet is skipped
+// and only returned for stream copy.
+static int skip_packet(struct input_ctx *ictx, int err)
+{
+  decode_stats *s = ictx->errors;
+  if (!s) return err;
+  s->types[AVERROR_INVALIDDATA == err ? DECODE_ERR_INVALID_DATA : DECODE_ERR_DECODER]++;
+  if (!ictx->tolerance.enabled) return err;
+  s->skipped++;
+  if (exceeds_tolerance(ictx)) return lpms_ERR_INPUT_CORRUPT;
+  return lpms_ERR_PACKET_ONLY;
+}
+
+// Counts a decoded frame if the decoder concealed errors in it
+static int check_frame(struct input_ctx *ictx, AVFrame *frame)
+{
+  decode_stats *s = ictx->errors;
+  if (!s || is_flush_frame(frame)) return 0;
+  if (frame->decode_error_flags & FF_DECODE_ERROR_INVALID_BITSTREAM) {
+    s->types[DECODE_ERR_INVALID_BITSTREAM]++;
+  }
+  if (frame->decode_error_flags & FF_DECODE_ERROR_MISSING_REFERENCE) {
+    s->types[DECODE_ERR_MISSING_REFERENCE]++;
+  }
+  if (!frame->decode_error_flags && !(frame->flags & AV_FRAME_FLAG_CORRUPT)) return 0;
+  s->corrupted++;
+  if (ictx->tolerance.enabled && exceeds_tolerance(ictx)) return lpms_ERR_INPUT_CORRUPT;
+  return 0;
+}
+
 static int send_first_pkt(struct input_ctx *ictx)
 {
   if (ictx->flushed) return 0;
   if (!ictx->first_pkt) return lpms_ERR_INPUT_NOKF;
 
+  int64_t start = av_gettime_relative();
   int ret = avcodec_send_packet(ictx->vc, ictx->first_pkt);
+  add_time(ictx->stages ? &ictx->stages->decode : NULL, start);
   ictx->sentinel_count++;
   if (ret < 0) {
     LPMS_ERR(packet_cleanup, "Error sending flush packet");
@@ -46,30 +103,51 @@ int process_in(struct input_ctx *ictx, AVFrame *frame, AVPacket *pkt)
   while (1) {
     AVStream *ist = NULL;
     AVCodecContext *decoder = NULL;
+    int track = -1, first = 0;
+    int64_t start = av_gettime_relative();
     ret = av_read_frame(ictx->ic, pkt);
+    add_time(ictx->stages ? &ictx->stages->demux : NULL, start);
     if (ret == AVERROR_EOF) goto dec_flush;
     else if (ret < 0) LPMS_ERR(dec_cleanup, "Unable to read input");
     ist = ictx->ic->streams[pkt->stream_index];
+    track = audio_track(ictx, ist->index);
     if (ist->index == ictx->vi && ictx->vc) decoder = ictx->vc;
-    else if (ist->index == ictx->ai && ictx->ac) decoder = ictx->ac;
-    else if (pkt->stream_index == ictx->vi || pkt->stream_index == ictx->ai) break;
+    else if (track >= 0 && ictx->audio[track].ac) decoder = ictx->audio[track].ac;
+    else if (pkt->stream_index == ictx->vi || track >= 0) break;
     else goto drop_packet; // could be an extra stream; skip
 
     if (!ictx->first_pkt && pkt->flags & AV_PKT_FLAG_KEY && decoder == ictx->vc) {
       ictx->first_pkt = av_packet_clone(pkt);
       ictx->first_pkt->pts = -1;
+      first = 1;
+    }
+    if (ictx->errors) {
+      ictx->errors->packets++;
+      if (pkt->flags & AV_PKT_FLAG_CORRUPT) ictx->errors->types[DECODE_ERR_DEMUXER]++;
     }
 
     ret = lpms_send_packet(ictx, decoder, pkt);
-    if (ret < 0) LPMS_ERR(dec_cleanup, "Error sending packet to decoder");
+    if (ret < 0) {
+      // don't flush with a packet the decoder could not take
+      if (first) av_packet_free(&ictx->first_pkt);
+      ret = skip_packet(ictx, ret);
+      if (lpms_ERR_PACKET_ONLY == ret) break;
+      LPMS_ERR(dec_cleanup, "Error sending packet to decoder");
+    }
     ret = lpms_receive_frame(ictx, decoder, frame);
     if (ret == AVERROR(EAGAIN)) {
       // Distinguish from EAGAIN that may occur with
       // av_read_frame or avcodec_send_packet
       ret = lpms_ERR_PACKET_ONLY;
       break;
+    } else if (ret < 0) {
+      if (decoder == ictx->vc) ictx->pkt_diff--; // no frame for this packet
+      ret = skip_packet(ictx, ret);
+      if (lpms_ERR_PACKET_ONLY == ret) break;
+      LPMS_ERR(dec_cleanup, "Error receiving frame from decoder");
     }
-    else if (ret < 0) LPMS_ERR(dec_cleanup, "Error receiving frame from decoder");
+    ret = check_frame(ictx, frame);
+    if (ret < 0) LPMS_ERR(dec_cleanup, "Too many frames with decoding errors");
     break;
 
 drop_packet:
@@ -88,8 +166,8 @@ dec_flush:
   // Flush video decoder.
   // To accommodate CUDA, we feed the decoder sentinel (flush) frames, till we
   // get back all sent frames, or we've made SENTINEL_MAX attempts to retrieve
-  // buffered frames with no success.
-  // TODO this is unnecessary for SW decoding! SW process should match audio
+  // buffered frames with no success. This also keeps software decoders out of
+  // the draining state, so they can be reused for the next segment.
   if (ictx->vc && !ictx->flushed && ictx->pkt_diff > 0) {
     ictx->flushing = 1;
     ret = send_first_pkt(ictx);
@@ -98,6 +176,8 @@ dec_flush:
       return ret;
     }
     ret = lpms_receive_frame(ictx, ictx->vc, frame);
+    if (!ret) ret = check_frame(ictx, frame);
+    if (lpms_ERR_INPUT_CORRUPT == ret) return ret;
     pkt->stream_index = ictx->vi;
     // Keep flushing if we haven't received all frames back but stop after SENTINEL_MAX tries.
     if (ictx->pkt_diff != 0 && ictx->sentinel_count <= SENTINEL_MAX && (!ret || ret == AVERROR(EAGAIN))) {
@@ -107,16 +187,41 @@ dec_flush:
       if (!ret) return ret;
     }
   }
-  // Flush audio decoder.
-  if (ictx->ac) {
-    avcodec_send_packet(ictx->ac, NULL);
-    ret = avcodec_receive_frame(ictx->ac, frame);
-    pkt->stream_index = ictx->ai;
-    if (!ret) return ret;
+  // Flush audio decoders. Already drained decoders simply return EOF here.
+  for (int i = 0; i < ictx->nb_audio; i++) {
+    struct input_audio *ia = &ictx->audio[i];
+    if (!ia->ac) continue;
+    lpms_send_packet(ictx, ia->ac, NULL);
+    ret = lpms_receive_frame(ictx, ia->ac, frame);
+    pkt->stream_index = ia->index;
+    if (!ret) return check_frame(ictx, frame);
   }
   return AVERROR_EOF;
 }
 
+int audio_track(struct input_ctx *ictx, int stream_index)
+{
+  // Returns the position of the stream among the selected audio tracks,
+  // or -1 if the stream is not a selected audio track.
+  for (int i = 0; i < ictx->nb_audio; i++) {
+    if (ictx->audio[i].index >= 0 && ictx->audio[i].index == stream_index) return i;
+  }
+  return -1;
+}
+
+int decodes_audio(struct input_ctx *ictx, int track)
+{
+  // Selectors may resolve to the same stream. Only the first track with the
+  // stream is decoded and the rest share it (see init_output), so it is
+  // decoded if any of them needs it.
+  struct input_audio *ia = &ictx->audio[track];
+  if (ia->index < 0 || audio_track(ictx, ia->index) != track) return 0;
+  for (int i = track; i < ictx->nb_audio; i++) {
+    if (ictx->audio[i].index == ia->index && !ictx->audio[i].skip) return 1;
+  }
+  return 0;
+}
+
 // FIXME: name me and the other function better
 enum AVPixelFormat hw2pixfmt(AVCodecContext *ctx)
 {
@@ -136,6 +241,66 @@ enum AVPixelFormat hw2pixfmt(AVCodecContext *ctx)
   return AV_PIX_FMT_NONE;
 }
 
+// Wraps a buffer of a decoded frame so that it is counted until released
+struct counted_buffer {
+  struct frame_memory *mem;
+  AVBufferRef *buf;
+  int size;
+};
+
+static void free_counted_buffer(void *opaque, uint8_t *data)
+{
+  struct counted_buffer *c = opaque;
+  atomic_fetch_sub(&c->mem->current, c->size);
+  av_buffer_unref(&c->buf);
+  av_free(c);
+}
+
+static int count_buffer(struct frame_memory *mem, AVBufferRef **buf)
+{
+  struct counted_buffer *c = av_mallocz(sizeof(*c));
+  AVBufferRef *wrapped = NULL;
+  int64_t current = 0, peak = 0;
+  if (!c) return AVERROR(ENOMEM);
+  wrapped = av_buffer_create((*buf)->data, (*buf)->size, free_counted_buffer, c, 0);
+  if (!wrapped) {
+    av_free(c);
+    return AVERROR(ENOMEM);
+  }
+  c->mem = mem;
+  c->buf = *buf;
+  c->size = (*buf)->size;
+  *buf = wrapped;
+  current = atomic_fetch_add(&mem->current, c->size) + c->size;
+  peak = atomic_load(&mem->peak);
+  while (current > peak && !atomic_compare_exchange_weak(&mem->peak, &peak, current));
+  return 0;
+}
+
+/**
+ * Callback to allocate the frames of software decoders, counting their memory
+ */
+static int get_counted_buffer(AVCodecContext *dec, AVFrame *frame, int flags)
+{
+  struct input_ctx *ctx = (struct input_ctx*)dec->opaque;
+  int ret = avcodec_default_get_buffer2(dec, frame, flags);
+  if (ret < 0) return ret;
+  for (int i = 0; i < FF_ARRAY_ELEMS(frame->buf) && frame->buf[i]; i++) {
+    ret = count_buffer(&ctx->memory, &frame->buf[i]);
+    if (ret < 0) {
+      av_frame_unref(frame);
+      return ret;
+    }
+  }
+  return 0;
+}
+
+void reset_frame_memory(struct frame_memory *mem)
+{
+  // Peaks are reported per call, starting from what earlier calls still hold
+  atomic_store(&mem->peak, atomic_load(&mem->current));
+}
+
 /**
  * Callback to negotiate the pixel format for AVCodecContext.
  */
@@ -182,25 +347,107 @@ pixfmt_cleanup:
 }
 
 
+static int reusable_decoder(AVCodecContext *dec, AVCodecParameters *par)
+{
+  // Decoders are kept open across segments, as long as the stream
+  // parameters are the same as the ones the decoder was opened with.
+  if (!dec || dec->codec_id != par->codec_id) return 0;
+  if (dec->extradata_size != par->extradata_size) return 0;
+  if (par->extradata_size &&
+      memcmp(dec->extradata, par->extradata, par->extradata_size)) return 0;
+  if (AVMEDIA_TYPE_VIDEO == par->codec_type) {
+    return dec->width == par->width && dec->height == par->height &&
+      (par->format < 0 || dec->pix_fmt == par->format);
+  }
+  return dec->sample_rate == par->sample_rate && dec->channels == par->channels;
+}
+
+static int is_auto_track(track_selector *sel)
+{
+  return !sel || (!sel->track && !sel->language);
+}
+
+static int find_audio_stream(AVFormatContext *ic, track_selector *sel, AVCodec **codec)
+{
+  int track = 0;
+
+  if (is_auto_track(sel)) {
+    return av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, codec, 0);
+  }
+  for (int i = 0; i < ic->nb_streams; i++) {
+    AVStream *st = ic->streams[i];
+    AVDictionaryEntry *lang = NULL;
+    if (AVMEDIA_TYPE_AUDIO != st->codecpar->codec_type) continue;
+    track++;
+    if (sel->track && sel->track != track) continue;
+    if (!sel->track) {
+      lang = av_dict_get(st->metadata, "language", NULL, 0);
+      if (!lang || av_strcasecmp(lang->value, sel->language)) continue;
+    }
+    *codec = avcodec_find_decoder(st->codecpar->codec_id);
+    return i;
+  }
+  return AVERROR_STREAM_NOT_FOUND;
+}
+
 int open_audio_decoder(input_params *params, struct input_ctx *ctx)
 {
   int ret = 0;
-  AVCodec *codec = NULL;
   AVFormatContext *ic = ctx->ic;
 
-  // open audio decoder
-  ctx->ai = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, &codec, 0);
-  if (ctx->da) ; // skip decoding audio
-  else if (ctx->ai < 0) {
-    LPMS_INFO("No audio stream found in input");
-  } else {
+  // Always have at least a default track, even if not explicitly selected
+  ctx->nb_audio = params->nb_audio_tracks > 0 ? params->nb_audio_tracks : 1;
+  for (int i = 0; i < ctx->nb_audio; i++) {
+    struct input_audio *ia = &ctx->audio[i];
+    track_selector *sel = params->nb_audio_tracks ? &params->audio_tracks[i] : NULL;
+    AVCodec *codec = NULL;
+    ia->index = find_audio_stream(ic, sel, &codec);
+    if (ia->index < 0 && !is_auto_track(sel)) {
+      ret = ia->index;
+      LPMS_ERR(open_audio_err, "Unable to find requested audio track");
+    }
+  }
+  for (int i = 0; i < ctx->nb_audio; i++) {
+    struct input_audio *ia = &ctx->audio[i];
+    AVCodec *codec = NULL;
+    AVDictionary *opts = NULL;
+
+    // open audio decoder
+    if (ia->index < 0) {
+      LPMS_INFO("No audio stream found in input");
+      if (ia->ac) avcodec_free_context(&ia->ac);
+      continue;
+    } else if (!decodes_audio(ctx, i)) {
+      // skip decoding audio (copy / drop only, or decoded by another track)
+      if (ia->ac) avcodec_free_context(&ia->ac);
+      continue;
+    }
+    codec = avcodec_find_decoder(ic->streams[ia->index]->codecpar->codec_id);
+    if (reusable_decoder(ia->ac, ic->streams[ia->index]->codecpar)) {
+      ia->ac->pkt_timebase = ic->streams[ia->index]->time_base;
+      continue;
+    }
+    if (ia->ac) avcodec_free_context(&ia->ac);
+    if (params->audio.name) {
+      codec = avcodec_find_decoder_by_name(params->audio.name);
+    }
+    if (!codec) {
+      ret = AVERROR_DECODER_NOT_FOUND;
+      LPMS_ERR(open_audio_err, "Unable to find audio decoder");
+    }
     AVCodecContext * ac = avcodec_alloc_context3(codec);
     if (!ac) LPMS_ERR(open_audio_err, "Unable to alloc audio codec");
-    if (ctx->ac) LPMS_WARN("An audio context was already open!");
-    ctx->ac = ac;
-    ret = avcodec_parameters_to_context(ac, ic->streams[ctx->ai]->codecpar);
+    ia->ac = ac;
+    ret = avcodec_parameters_to_context(ac, ic->streams[ia->index]->codecpar);
     if (ret < 0) LPMS_ERR(open_audio_err, "Unable to assign audio params");
-    ret = avcodec_open2(ac, codec, NULL);
+    ac->opaque = (void*)ctx;
+    ac->get_buffer2 = get_counted_buffer;
+    ac->thread_safe_callbacks = 1; // only atomics; see count_buffer
+    // Decoder options are shared among tracks, so give each its own copy
+    ret = av_dict_copy(&opts, params->audio.opts, 0);
+    if (ret < 0) LPMS_ERR(open_audio_err, "Unable to copy audio decoder options");
+    ret = avcodec_open2(ac, codec, &opts);
+    av_dict_free(&opts);
     if (ret < 0) LPMS_ERR(open_audio_err, "Unable to open audio decoder");
   }
 
@@ -219,23 +466,41 @@ int open_video_decoder(input_params *params, struct input_ctx *ctx)
 
   // open video decoder
   ctx->vi = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
-  if (ctx->dv) ; // skip decoding video
-  else if (ctx->vi < 0) {
+  if (ctx->dv) {
+    // skip decoding video; outputs needing a decoder may have been removed
+    if (ctx->vc) avcodec_free_context(&ctx->vc);
+  } else if (ctx->vi < 0) {
     LPMS_WARN("No video stream found in input");
+    if (ctx->vc) avcodec_free_context(&ctx->vc);
+  } else if (reusable_decoder(ctx->vc, ic->streams[ctx->vi]->codecpar)) {
+    // software decoder kept from the previous segment
+    ctx->vc->pkt_timebase = ic->streams[ctx->vi]->time_base;
   } else {
+    if (ctx->vc) avcodec_free_context(&ctx->vc);
+    ctx->sw_decode = 0;
     if (AV_HWDEVICE_TYPE_CUDA == params->hw_type) {
       if (AV_CODEC_ID_H264 != codec->id) {
         ret = lpms_ERR_INPUT_CODEC;
         LPMS_ERR(open_decoder_err, "Non H264 codec detected in input");
       }
-      AVCodec *c = avcodec_find_decoder_by_name("h264_cuvid");
-      if (c) codec = c;
-      else LPMS_WARN("Nvidia decoder not found; defaulting to software");
+      // TODO check whether the color range is truncated if yuvj420p is used
       if (AV_PIX_FMT_YUV420P != ic->streams[ctx->vi]->codecpar->format &&
           AV_PIX_FMT_YUVJ420P != ic->streams[ctx->vi]->codecpar->format) {
-        // TODO check whether the color range is truncated if yuvj420p is used
-        ret = lpms_ERR_INPUT_PIXFMT;
-        LPMS_ERR(open_decoder_err, "Non 4:2:0 pixel format detected in input");
+        // eg 10-bit, 4:2:2 or 4:4:4; the filters upload the decoded frames
+        LPMS_INFO("Non 4:2:0 pixel format detected in input; decoding in software");
+        ctx->sw_decode = 1;
+      } else {
+        AVCodec *c = avcodec_find_decoder_by_name("h264_cuvid");
+        if (c) codec = c;
+        else LPMS_WARN("Nvidia decoder not found; defaulting to software");
+      }
+    }
+    if (params->video.name) {
+      // An explicitly requested decoder takes precedence over the defaults
+      codec = avcodec_find_decoder_by_name(params->video.name);
+      if (!codec) {
+        ret = AVERROR_DECODER_NOT_FOUND;
+        LPMS_ERR(open_decoder_err, "Unable to find requested video decoder");
       }
     }
     AVCodecContext *vc = avcodec_alloc_context3(codec);
@@ -246,15 +511,24 @@ int open_video_decoder(input_params *params, struct input_ctx *ctx)
     vc->opaque = (void*)ctx;
     // XXX Could this break if the original device falls out of scope in golang?
     if (params->hw_type != AV_HWDEVICE_TYPE_NONE) {
-      // First set the hw device then set the hw frame
+      // First set the hw device then set the hw frame. Filters of earlier
+      // segments hold their own references to any previous device.
+      av_buffer_unref(&ctx->hw_device_ctx);
       ret = av_hwdevice_ctx_create(&ctx->hw_device_ctx, params->hw_type, params->device, NULL, 0);
       if (ret < 0) LPMS_ERR(open_decoder_err, "Unable to open hardware context for decoding")
       ctx->hw_type = params->hw_type;
-      vc->hw_device_ctx = av_buffer_ref(ctx->hw_device_ctx);
-      vc->get_format = get_hw_pixfmt;
+      if (!ctx->sw_decode) {
+        vc->hw_device_ctx = av_buffer_ref(ctx->hw_device_ctx);
+        vc->get_format = get_hw_pixfmt;
+      }
+    }
+    if (!vc->hw_device_ctx) {
+      vc->get_buffer2 = get_counted_buffer;
+      // Frame threads may allocate directly; the callback only uses atomics
+      vc->thread_safe_callbacks = 1;
     }
     vc->pkt_timebase = ic->streams[ctx->vi]->time_base;
-    ret = avcodec_open2(vc, codec, NULL);
+    ret = avcodec_open2(vc, codec, &params->video.opts);
     if (ret < 0) LPMS_ERR(open_decoder_err, "Unable to open video decoder");
   }
 
@@ -265,26 +539,45 @@ open_decoder_err:
   return ret;
 }
 
+int open_demuxer(input_params *params, struct input_ctx *ctx)
+{
+  AVInputFormat *fmt = NULL;
+  int ret = 0;
+
+  // Use the requested demuxer if any; otherwise let libavformat probe
+  if (params->demuxer.name) {
+    fmt = av_find_input_format(params->demuxer.name);
+    if (!fmt) {
+      ret = AVERROR_DEMUXER_NOT_FOUND;
+      LPMS_ERR(open_demuxer_err, "Unable to find requested demuxer");
+    }
+  }
+  ret = avformat_open_input(&ctx->ic, params->fname, fmt, &params->demuxer.opts);
+  if (ret < 0) LPMS_ERR(open_demuxer_err, "demuxer: Unable to open input");
+  ret = avformat_find_stream_info(ctx->ic, NULL);
+  if (ret < 0) LPMS_ERR(open_demuxer_err, "Unable to find input info");
+
+open_demuxer_err:
+  return ret;
+}
+
 int open_input(input_params *params, struct input_ctx *ctx)
 {
-  AVFormatContext *ic   = NULL;
-  char *inp = params->fname;
   int ret = 0;
 
   // open demuxer
-  ret = avformat_open_input(&ic, inp, NULL, NULL);
-  if (ret < 0) LPMS_ERR(open_input_err, "demuxer: Unable to open input");
-  ctx->ic = ic;
-  ret = avformat_find_stream_info(ic, NULL);
-  if (ret < 0) LPMS_ERR(open_input_err, "Unable to find input info");
+  ret = open_demuxer(params, ctx);
+  if (ret < 0) LPMS_ERR(open_input_err, "Unable to open demuxer");
   ret = open_video_decoder(params, ctx);
   if (ret < 0) LPMS_ERR(open_input_err, "Unable to open video decoder")
   ret = open_audio_decoder(params, ctx);
   if (ret < 0) LPMS_ERR(open_input_err, "Unable to open audio decoder")
   ctx->last_frame_v = av_frame_alloc();
   if (!ctx->last_frame_v) LPMS_ERR(open_input_err, "Unable to alloc last_frame_v");
-  ctx->last_frame_a = av_frame_alloc();
-  if (!ctx->last_frame_a) LPMS_ERR(open_input_err, "Unable to alloc last_frame_a");
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) {
+    ctx->audio[i].last_frame = av_frame_alloc();
+    if (!ctx->audio[i].last_frame) LPMS_ERR(open_input_err, "Unable to alloc audio last_frame");
+  }
 
   return 0;
 
@@ -301,9 +594,12 @@ void free_input(struct input_ctx *inctx)
     if (inctx->vc->hw_device_ctx) av_buffer_unref(&inctx->vc->hw_device_ctx);
     avcodec_free_context(&inctx->vc);
   }
-  if (inctx->ac) avcodec_free_context(&inctx->ac);
   if (inctx->hw_device_ctx) av_buffer_unref(&inctx->hw_device_ctx);
   if (inctx->last_frame_v) av_frame_free(&inctx->last_frame_v);
-  if (inctx->last_frame_a) av_frame_free(&inctx->last_frame_a);
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) {
+    struct input_audio *ia = &inctx->audio[i];
+    if (ia->ac) avcodec_free_context(&ia->ac);
+    if (ia->last_frame) av_frame_free(&ia->last_frame);
+  }
 }
 
@@ -5,16 +5,39 @@
 #include <libavcodec/avcodec.h>
 #include "transcoder.h"
 
+#include <stdatomic.h>
+
+struct input_audio {
+  int index;           // stream index within the demuxer; negative if missing
+  int skip;            // flag whether to skip decoding (copy / drop only)
+  AVCodecContext *ac;  // audio decoder optional
+  AVFrame *last_frame; // for filter flush
+
+  // Loudness of the whole track, if measured before transcoding
+  int measured;
+  double loudness, true_peak;
+};
+
+// Memory held by the frames of software decoders, in bytes. Frames may be
+// released from codec worker threads, hence the atomics.
+struct frame_memory {
+  atomic_int_fast64_t current, peak;
+};
+
 struct input_ctx {
   AVFormatContext *ic; // demuxer required
   AVCodecContext  *vc; // video decoder optional
-  AVCodecContext  *ac; // audo  decoder optional
-  int vi, ai; // video and audio stream indices
-  int dv, da; // flags whether to drop video or audio
+  int vi; // video stream index
+  int dv; // flag whether to drop video
+
+  // Selected audio tracks. The first entry is the default track.
+  struct input_audio audio[MAX_AUDIO_TRACKS];
+  int nb_audio;
 
   // Hardware decoding support
   AVBufferRef *hw_device_ctx;
   enum AVHWDeviceType hw_type;
+  int sw_decode; // flag whether the GPU can't decode the input; see open_video_decoder
   char *device;
 
   // Decoder flush
@@ -31,17 +54,31 @@ struct input_ctx {
 #define SENTINEL_MAX 5
   uint16_t sentinel_count;
 
-  // Filter flush
-  AVFrame *last_frame_v, *last_frame_a;
+  // Filter flush; audio is kept per track
+  AVFrame *last_frame_v;
+
+  // Limits, error handling and timed metadata of the current segment
+  input_limits limits;
+  error_tolerance tolerance;
+  decode_stats *errors; // counted if set
+  stage_times *stages;  // timed if set
+  // Must outlive any frame of the decoders; see lpms_transcode_stop
+  struct frame_memory memory;
+  timed_metadata *metadata;
+  int nb_metadata;
 };
 
 // Exported methods
 int process_in(struct input_ctx *ictx, AVFrame *frame, AVPacket *pkt);
 enum AVPixelFormat hw2pixfmt(AVCodecContext *ctx);
 int open_input(input_params *params, struct input_ctx *ctx);
+int open_demuxer(input_params *params, struct input_ctx *ctx);
 int open_video_decoder(input_params *params, struct input_ctx *ctx);
 int open_audio_decoder(input_params *params, struct input_ctx *ctx);
 void free_input(struct input_ctx *inctx);
+void reset_frame_memory(struct frame_memory *mem);
+int audio_track(struct input_ctx *ictx, int stream_index);
+int decodes_audio(struct input_ctx *ictx, int track);
 
 // Utility functions
 inline int is_flush_frame(AVFrame *frame)
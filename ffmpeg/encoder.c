@@ -4,6 +4,20 @@
 #include <libavcodec/avcodec.h>
 #include <libavfilter/buffersrc.h>
 #include <libavfilter/buffersink.h>
+#include <libavutil/time.h>
+
+#include <math.h>
+
+static const char *const kf_var_names[] = {
+  "n",             // index of the frame, starting from zero
+  "n_forced",      // number of forced keyframes so far
+  "prev_forced_n", // index of the previous forced keyframe; NAN if none
+  "prev_forced_t", // time of the previous forced keyframe; NAN if none
+  "t",             // time of the frame, in seconds
+  NULL
+};
+
+enum { KF_VAR_N, KF_VAR_N_FORCED, KF_VAR_PREV_FORCED_N, KF_VAR_PREV_FORCED_T, KF_VAR_T };
 
 static int add_video_stream(struct output_ctx *octx, struct input_ctx *ictx)
 {
@@ -45,41 +59,43 @@ add_video_err:
   return ret;
 }
 
-static int add_audio_stream(struct input_ctx *ictx, struct output_ctx *octx)
+static int add_audio_stream(struct input_ctx *ictx, struct output_ctx *octx,
+  struct output_audio *oa)
 {
-  if (ictx->ai < 0 || octx->da) {
-    // Don't need to add an audio stream if no input audio exists,
-    // or we're dropping the output audio stream
-    return 0;
-  }
+  struct input_audio *ia = &ictx->audio[oa->track];
+  AVDictionaryEntry *lang = NULL;
 
   // audio stream to muxer
   int ret = 0;
   AVStream *st = avformat_new_stream(octx->oc, NULL);
   if (!st) LPMS_ERR(add_audio_err, "Unable to alloc audio stream");
-  if (is_copy(octx->audio->name)) {
-    AVStream *ist = ictx->ic->streams[ictx->ai];
-    if (ictx->ai < 0 || !ist) LPMS_ERR(add_audio_err, "Input audio stream does not exist");
+  if (is_copy(oa->opts->name)) {
+    AVStream *ist = ictx->ic->streams[ia->index];
+    if (ia->index < 0 || !ist) LPMS_ERR(add_audio_err, "Input audio stream does not exist");
     st->time_base = ist->time_base;
     ret = avcodec_parameters_copy(st->codecpar, ist->codecpar);
     if (ret < 0) LPMS_ERR(add_audio_err, "Error copying audio params from input stream");
     // Sometimes the codec tag is wonky for some reason, so correct it
     ret = av_codec_get_tag2(octx->oc->oformat->codec_tag, st->codecpar->codec_id, &st->codecpar->codec_tag);
     avformat_transfer_internal_stream_timing_info(octx->oc->oformat, st, ist, AVFMT_TBCF_DEMUXER);
-  } else if (octx->ac) {
-    st->time_base = octx->ac->time_base;
-    ret = avcodec_parameters_from_context(st->codecpar, octx->ac);
+  } else if (oa->ac) {
+    st->time_base = oa->ac->time_base;
+    ret = avcodec_parameters_from_context(st->codecpar, oa->ac);
     if (ret < 0) LPMS_ERR(add_audio_err, "Error setting audio params from encoder");
-  } else if (is_drop(octx->audio->name)) {
+  } else if (is_drop(oa->opts->name)) {
     // Supposed to exit this function early if there's a drop
     LPMS_ERR(add_audio_err, "Shouldn't ever happen here");
   } else {
     LPMS_ERR(add_audio_err, "No audio encoder; not a copy; what is this?");
   }
-  octx->ai = st->index;
+  oa->ai = st->index;
+
+  // carry over the language tag so tracks remain identifiable
+  lang = av_dict_get(ictx->ic->streams[ia->index]->metadata, "language", NULL, 0);
+  if (lang) av_dict_set(&st->metadata, "language", lang->value, 0);
 
   // signal whether to drop preroll audio
-  if (st->codecpar->initial_padding) octx->drop_ts = AV_NOPTS_VALUE;
+  if (st->codecpar->initial_padding) oa->drop_ts = AV_NOPTS_VALUE;
   return 0;
 
 add_audio_err:
@@ -91,42 +107,60 @@ static int open_audio_output(struct input_ctx *ictx, struct output_ctx *octx,
   AVOutputFormat *fmt)
 {
   int ret = 0;
-  AVCodec *codec = NULL;
-  AVCodecContext *ac = NULL;
-
-  // add audio encoder if a decoder exists and this output requires one
-  if (ictx->ac && needs_decoder(octx->audio->name)) {
-
-    // initialize audio filters
-    ret = init_audio_filters(ictx, octx);
-    if (ret < 0) LPMS_ERR(audio_output_err, "Unable to open audio filter")
-
-    // open encoder
-    codec = avcodec_find_encoder_by_name(octx->audio->name);
-    if (!codec) LPMS_ERR(audio_output_err, "Unable to find audio encoder");
-    // open audio encoder
-    ac = avcodec_alloc_context3(codec);
-    if (!ac) LPMS_ERR(audio_output_err, "Unable to alloc audio encoder");
-    octx->ac = ac;
-    ac->sample_fmt = av_buffersink_get_format(octx->af.sink_ctx);
-    ac->channel_layout = av_buffersink_get_channel_layout(octx->af.sink_ctx);
-    ac->channels = av_buffersink_get_channels(octx->af.sink_ctx);
-    ac->sample_rate = av_buffersink_get_sample_rate(octx->af.sink_ctx);
-    ac->time_base = av_buffersink_get_time_base(octx->af.sink_ctx);
-    if (fmt->flags & AVFMT_GLOBALHEADER) ac->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
-    ret = avcodec_open2(ac, codec, &octx->audio->opts);
-    if (ret < 0) LPMS_ERR(audio_output_err, "Error opening audio encoder");
-    av_buffersink_set_frame_size(octx->af.sink_ctx, ac->frame_size);
-  }
 
-  ret = add_audio_stream(ictx, octx);
-  if (ret < 0) LPMS_ERR(audio_output_err, "Error adding audio stream")
+  for (int i = 0; i < octx->nb_audio; i++) {
+    struct output_audio *oa = &octx->audio[i];
+    AVCodec *codec = NULL;
+    AVCodecContext *ac = NULL;
+
+    // add audio encoder if a decoder exists and this output requires one
+    if (ictx->audio[oa->track].ac && needs_decoder(oa->opts->name)) {
+
+      // initialize audio filters
+      ret = init_audio_filters(ictx, oa);
+      if (ret < 0) LPMS_ERR(audio_output_err, "Unable to open audio filter")
+
+      // open encoder
+      codec = avcodec_find_encoder_by_name(oa->opts->name);
+      if (!codec) LPMS_ERR(audio_output_err, "Unable to find audio encoder");
+      // open audio encoder
+      ac = avcodec_alloc_context3(codec);
+      if (!ac) LPMS_ERR(audio_output_err, "Unable to alloc audio encoder");
+      oa->ac = ac;
+      ac->sample_fmt = av_buffersink_get_format(oa->af.sink_ctx);
+      ac->channel_layout = av_buffersink_get_channel_layout(oa->af.sink_ctx);
+      ac->channels = av_buffersink_get_channels(oa->af.sink_ctx);
+      ac->sample_rate = av_buffersink_get_sample_rate(oa->af.sink_ctx);
+      ac->time_base = av_buffersink_get_time_base(oa->af.sink_ctx);
+      if (fmt->flags & AVFMT_GLOBALHEADER) ac->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+      ret = avcodec_open2(ac, codec, &oa->opts->opts);
+      if (ret < 0) LPMS_ERR(audio_output_err, "Error opening audio encoder");
+      av_buffersink_set_frame_size(oa->af.sink_ctx, ac->frame_size);
+    }
+
+    ret = add_audio_stream(ictx, octx, oa);
+    if (ret < 0) LPMS_ERR(audio_output_err, "Error adding audio stream")
+  }
 
 audio_output_err:
   // TODO clean up anything here?
   return ret;
 }
 
+static int keep_encoder(struct output_ctx *octx)
+{
+  // Whether the video encoder can stay open for the next segment. Hardware
+  // encoders are flushed without being closed. Software encoders can only be
+  // reset after draining if the library supports it for that encoder.
+  if (!octx->vc) return 0;
+  if (AV_HWDEVICE_TYPE_NONE != octx->hw_type) return 1;
+#ifdef AV_CODEC_CAP_ENCODER_FLUSH
+  return !!(octx->vc->codec->capabilities & AV_CODEC_CAP_ENCODER_FLUSH);
+#else
+  return 0;
+#endif
+}
+
 void close_output(struct output_ctx *octx)
 {
   if (octx->oc) {
@@ -136,19 +170,195 @@ void close_output(struct output_ctx *octx)
     avformat_free_context(octx->oc);
     octx->oc = NULL;
   }
-  if (octx->vc && AV_HWDEVICE_TYPE_NONE == octx->hw_type) avcodec_free_context(&octx->vc);
-  if (octx->ac) avcodec_free_context(&octx->ac);
-  octx->af.flushed = octx->vf.flushed = 0;
-  octx->af.flushing = octx->vf.flushing = 0;
+  close_quality(&octx->quality);
+  if (!keep_encoder(octx)) avcodec_free_context(&octx->vc);
+  else if (AV_HWDEVICE_TYPE_NONE == octx->hw_type) {
+    // Drained software encoder; reset it for the next segment
+    avcodec_flush_buffers(octx->vc);
+  }
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) {
+    struct output_audio *oa = &octx->audio[i];
+    if (oa->ac) avcodec_free_context(&oa->ac);
+    oa->af.flushed = oa->af.flushing = 0;
+  }
+  octx->vf.flushed = 0;
+  octx->vf.flushing = 0;
   octx->vf.pts_diff = INT64_MIN;
+  octx->vf.seg_offset = AV_NOPTS_VALUE;
 }
 
 void free_output(struct output_ctx *octx)
 {
   close_output(octx);
   if (octx->vc) avcodec_free_context(&octx->vc);
+  free_quality(&octx->quality);
   free_filter(&octx->vf);
-  free_filter(&octx->af);
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) free_filter(&octx->audio[i].af);
+  av_expr_free(octx->kf_expr);
+  octx->kf_expr = NULL;
+  av_freep(&octx->config);
+}
+
+int init_keyframes(struct output_ctx *octx, output_params *params)
+{
+  int ret = 0;
+  // Times are only valid for the current segment; the expression is kept
+  octx->kf_times = params->kf_times;
+  octx->nb_kf_times = params->nb_kf_times;
+  octx->kf_prev_pts = AV_NOPTS_VALUE;
+  if (octx->kf_expr || !params->kf_expr) return 0;
+  ret = av_expr_parse(&octx->kf_expr, params->kf_expr, kf_var_names,
+                      NULL, NULL, NULL, NULL, 0, NULL);
+  if (ret < 0) LPMS_ERR(kf_init_err, "Unable to parse keyframe expression");
+  octx->kf_vars[KF_VAR_N] = 0;
+  octx->kf_vars[KF_VAR_N_FORCED] = 0;
+  octx->kf_vars[KF_VAR_PREV_FORCED_N] = NAN;
+  octx->kf_vars[KF_VAR_PREV_FORCED_T] = NAN;
+
+kf_init_err:
+  return ret;
+}
+
+static int is_forced_keyframe(struct output_ctx *octx, AVFrame *frame, AVRational tb)
+{
+  // Checks whether a keyframe was requested at or just before this frame.
+  // Times are matched against the interval since the previous frame, so
+  // each requested time forces exactly one keyframe.
+  int force = 0;
+  for (int i = 0; i < octx->nb_kf_times; i++) {
+    int64_t pts = llrint(octx->kf_times[i] / av_q2d(tb));
+    if (pts > frame->pts) break;
+    if (octx->kf_prev_pts == AV_NOPTS_VALUE || pts > octx->kf_prev_pts) force = 1;
+  }
+  octx->kf_prev_pts = frame->pts;
+  if (octx->kf_expr) {
+    double *vars = octx->kf_vars;
+    vars[KF_VAR_T] = frame->pts * av_q2d(tb);
+    if (av_expr_eval(octx->kf_expr, vars, NULL)) {
+      vars[KF_VAR_PREV_FORCED_N] = vars[KF_VAR_N];
+      vars[KF_VAR_PREV_FORCED_T] = vars[KF_VAR_T];
+      vars[KF_VAR_N_FORCED] += 1;
+      force = 1;
+    }
+    vars[KF_VAR_N] += 1;
+  }
+  return force;
+}
+
+static int map_audio(struct input_ctx *ictx, struct output_ctx *octx, output_params *params)
+{
+  int ret = 0;
+
+  octx->nb_audio = 0;
+  if (!params->nb_audio_maps) {
+    // Only the default track, unless dropped or missing
+    if (!ictx->nb_audio || ictx->audio[0].index < 0 || is_drop(params->audio.name)) return 0;
+    octx->audio[0].track = 0;
+    octx->audio[0].opts = &params->audio;
+    octx->audio[0].loudness = &params->loudness;
+    octx->nb_audio = 1;
+    return 0;
+  }
+  if (params->nb_audio_maps > MAX_AUDIO_TRACKS) {
+    ret = lpms_ERR_OUTPUTS;
+    LPMS_ERR(map_audio_err, "Too many audio tracks in output");
+  }
+  for (int i = 0; i < params->nb_audio_maps; i++) {
+    audio_map *map = &params->audio_maps[i];
+    struct output_audio *oa = &octx->audio[octx->nb_audio];
+    if (map->track < 0 || map->track >= ictx->nb_audio) {
+      ret = AVERROR_STREAM_NOT_FOUND;
+      LPMS_ERR(map_audio_err, "Invalid audio track mapping");
+    }
+    if (ictx->audio[map->track].index < 0 || is_drop(map->encoder.name)) continue;
+    // selectors resolving to the same stream share its decoder
+    oa->track = audio_track(ictx, ictx->audio[map->track].index);
+    oa->opts = &map->encoder;
+    oa->loudness = &params->loudness;
+    octx->nb_audio++;
+  }
+
+map_audio_err:
+  return ret;
+}
+
+int init_output(struct output_ctx *octx, struct input_ctx *ictx,
+  output_params *params, output_results *res)
+{
+  int ret = 0;
+  octx->fname = params->fname;
+  octx->width = params->w;
+  octx->height = params->h;
+  octx->muxer = &params->muxer;
+  octx->video = &params->video;
+  octx->vfilters = params->vfilters;
+  octx->sw_vfilters = params->sw_vfilters;
+  octx->pix_fmt = params->pix_fmt;
+  if (params->bitrate) octx->bitrate = params->bitrate;
+  if (params->fps.den) octx->fps = params->fps;
+  if (params->gop_time) octx->gop_time = params->gop_time;
+  octx->source = params->source;
+  octx->preserve_ts = params->preserve_ts;
+  octx->start_ts = octx->end_ts = AV_NOPTS_VALUE;
+  ret = init_keyframes(octx, params);
+  if (ret < 0) LPMS_ERR(init_output_err, "Unable to set keyframes");
+  octx->dv = ictx->vi < 0 || is_drop(octx->video->name);
+  octx->res = res;
+  octx->quality.params = params->quality;
+  octx->quality.res = &res->quality;
+  ret = map_audio(ictx, octx, params);
+  if (ret < 0) LPMS_ERR(init_output_err, "Unable to map audio tracks");
+
+init_output_err:
+  return ret;
+}
+
+static int add_metadata_stream(struct output_ctx *octx, struct input_ctx *ictx)
+{
+  int ret = 0;
+  AVStream *st = NULL;
+
+  // only MPEG-TS carries timed ID3
+  octx->mi = -1;
+  if (!ictx->nb_metadata || strcmp(octx->oc->oformat->name, "mpegts")) return 0;
+  st = avformat_new_stream(octx->oc, NULL);
+  if (!st) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(add_metadata_err, "Unable to alloc timed metadata stream");
+  }
+  st->time_base = (AVRational){1, 90000};
+  st->codecpar->codec_type = AVMEDIA_TYPE_DATA;
+  st->codecpar->codec_id = AV_CODEC_ID_TIMED_ID3;
+  octx->mi = st->index;
+
+add_metadata_err:
+  return ret;
+}
+
+static int mux_metadata(struct output_ctx *octx, struct input_ctx *ictx)
+{
+  // Queued up front; the muxer interleaves them with the encoded streams
+  int ret = 0;
+  AVPacket pkt = {0};
+  AVStream *st = NULL;
+
+  if (octx->mi < 0) return 0;
+  st = octx->oc->streams[octx->mi];
+  for (int i = 0; i < ictx->nb_metadata; i++) {
+    timed_metadata *md = &ictx->metadata[i];
+    ret = av_new_packet(&pkt, md->size);
+    if (ret < 0) LPMS_ERR(mux_metadata_err, "Unable to alloc timed metadata packet");
+    memcpy(pkt.data, md->data, md->size);
+    pkt.pts = pkt.dts = av_rescale_q(llrint(md->pts * AV_TIME_BASE), AV_TIME_BASE_Q, st->time_base);
+    pkt.stream_index = st->index;
+    pkt.flags |= AV_PKT_FLAG_KEY;
+    ret = av_interleaved_write_frame(octx->oc, &pkt);
+    if (ret < 0) LPMS_ERR(mux_metadata_err, "Unable to write timed metadata");
+  }
+
+mux_metadata_err:
+  av_packet_unref(&pkt);
+  return ret;
 }
 
 int open_output(struct output_ctx *octx, struct input_ctx *ictx)
@@ -193,7 +403,7 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
         av_buffer_ref(av_buffersink_get_hw_frames_ctx(octx->vf.sink_ctx));
       if (!vc->hw_frames_ctx) LPMS_ERR(open_output_err, "Unable to alloc hardware context");
     }
-    vc->pix_fmt = av_buffersink_get_format(octx->vf.sink_ctx); // XXX select based on encoder + input support
+    vc->pix_fmt = av_buffersink_get_format(octx->vf.sink_ctx); // see output_pix_fmt
     if (fmt->flags & AVFMT_GLOBALHEADER) vc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
     ret = avcodec_open2(vc, codec, &octx->video->opts);
     if (ret < 0) LPMS_ERR(open_output_err, "Error opening video encoder");
@@ -206,18 +416,30 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
     ret = add_video_stream(octx, ictx);
     if (ret < 0) LPMS_ERR(open_output_err, "Error adding video stream");
   }
+  if (octx->vc) {
+    ret = init_quality(&octx->quality, octx->vc, av_buffersink_get_time_base(octx->vf.sink_ctx));
+    if (ret < 0) LPMS_ERR(open_output_err, "Unable to set up quality comparison");
+  }
 
   ret = open_audio_output(ictx, octx, fmt);
   if (ret < 0) LPMS_ERR(open_output_err, "Error opening audio output");
 
+  ret = add_metadata_stream(octx, ictx);
+  if (ret < 0) LPMS_ERR(open_output_err, "Error adding timed metadata stream");
+
   if (!(fmt->flags & AVFMT_NOFILE)) {
     ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
     if (ret < 0) LPMS_ERR(open_output_err, "Error opening output file");
   }
 
+  int64_t start = av_gettime_relative();
   ret = avformat_write_header(oc, &octx->muxer->opts);
+  octx->res->stages.mux += av_gettime_relative() - start;
   if (ret < 0) LPMS_ERR(open_output_err, "Error writing header");
 
+  ret = mux_metadata(octx, ictx);
+  if (ret < 0) LPMS_ERR(open_output_err, "Error writing timed metadata");
+
   return 0;
 
 open_output_err:
@@ -228,7 +450,7 @@ open_output_err:
 int reopen_output(struct output_ctx *octx, struct input_ctx *ictx)
 {
   int ret = 0;
-  // re-open muxer for HW encoding
+  // re-open muxer for a persistent encoder
   AVOutputFormat *fmt = av_guess_format(octx->muxer->name, octx->fname, NULL);
   if (!fmt) LPMS_ERR(reopen_out_err, "Unable to guess format for reopen");
   ret = avformat_alloc_output_context2(&octx->oc, fmt, NULL, octx->fname);
@@ -238,19 +460,29 @@ int reopen_output(struct output_ctx *octx, struct input_ctx *ictx)
   if (octx->vc) {
     ret = add_video_stream(octx, ictx);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add video stream");
+    ret = init_quality(&octx->quality, octx->vc, av_buffersink_get_time_base(octx->vf.sink_ctx));
+    if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to set up quality comparison");
   } else LPMS_INFO("No video stream!?");
 
   // re-attach audio encoder
   ret = open_audio_output(ictx, octx, fmt);
   if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add audio stream");
 
+  ret = add_metadata_stream(octx, ictx);
+  if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to add timed metadata stream");
+
   if (!(fmt->flags & AVFMT_NOFILE)) {
     ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Error re-opening output file");
   }
+  int64_t start = av_gettime_relative();
   ret = avformat_write_header(octx->oc, &octx->muxer->opts);
+  octx->res->stages.mux += av_gettime_relative() - start;
   if (ret < 0) LPMS_ERR(reopen_out_err, "Error re-writing header");
 
+  ret = mux_metadata(octx, ictx);
+  if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to write timed metadata");
+
 reopen_out_err:
   return ret;
 }
@@ -258,6 +490,7 @@ reopen_out_err:
 static int encode(AVCodecContext* encoder, AVFrame *frame, struct output_ctx* octx, AVStream* ost)
 {
   int ret = 0;
+  int64_t start = 0;
   AVPacket pkt = {0};
 
   if (AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type && frame) {
@@ -272,7 +505,9 @@ static int encode(AVCodecContext* encoder, AVFrame *frame, struct output_ctx* oc
   // We don't want to send NULL frames for HW encoding
   // because that closes the encoder: not something we want
   if (AV_HWDEVICE_TYPE_NONE == octx->hw_type || frame) {
+    start = av_gettime_relative();
     ret = avcodec_send_frame(encoder, frame);
+    octx->res->stages.encode += av_gettime_relative() - start;
     if (AVERROR_EOF == ret) ; // continue ; drain encoder
     else if (ret < 0) LPMS_ERR(encode_cleanup, "Error sending frame to encoder");
   }
@@ -284,9 +519,23 @@ static int encode(AVCodecContext* encoder, AVFrame *frame, struct output_ctx* oc
 
   while (1) {
     av_init_packet(&pkt);
+    start = av_gettime_relative();
     ret = avcodec_receive_packet(encoder, &pkt);
+    octx->res->stages.encode += av_gettime_relative() - start;
     if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) goto encode_cleanup;
     if (ret < 0) LPMS_ERR(encode_cleanup, "Error receiving packet from encoder");
+    if (AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type &&
+        pkt.flags & AV_PKT_FLAG_KEY) {
+      output_results *res = octx->res;
+      if (res->nb_keyframes < MAX_KEYFRAMES) {
+        res->keyframes[res->nb_keyframes] = pkt.pts * av_q2d(encoder->time_base);
+      }
+      res->nb_keyframes++;
+    }
+    if (AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type) {
+      ret = quality_add_packet(&octx->quality, &pkt);
+      if (ret < 0) LPMS_ERR(encode_cleanup, "Unable to compare encoded video");
+    }
     ret = mux(&pkt, encoder->time_base, octx, ost);
     if (ret < 0) goto encode_cleanup;
     av_packet_unref(&pkt);
@@ -297,8 +546,23 @@ encode_cleanup:
   return ret;
 }
 
+void update_extent(int64_t *start, int64_t *end, int64_t pts, int64_t duration,
+  AVRational tb)
+{
+  int64_t first, last;
+  if (AV_NOPTS_VALUE == pts) return;
+  first = av_rescale_q(pts, tb, AV_TIME_BASE_Q);
+  last = av_rescale_q(pts + duration, tb, AV_TIME_BASE_Q);
+  if (AV_NOPTS_VALUE == *start || first < *start) *start = first;
+  if (AV_NOPTS_VALUE == *end || last > *end) *end = last;
+}
+
 int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost)
 {
+  int ret = 0;
+  int64_t start = 0;
+  int primary = octx->dv ? (octx->nb_audio ? octx->audio[0].ai : -1) : octx->vi;
+
   pkt->stream_index = ost->index;
   if (av_cmp_q(tb, ost->time_base)) {
     av_packet_rescale_ts(pkt, tb, ost->time_base);
@@ -308,11 +572,46 @@ int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost)
   // XXX this breaks if preroll isn't exactly one AVPacket or drop_ts == 0
   //     hasn't been a problem in practice (so far)
   if (AVMEDIA_TYPE_AUDIO == ost->codecpar->codec_type) {
-      if (octx->drop_ts == AV_NOPTS_VALUE) octx->drop_ts = pkt->pts;
-      if (pkt->pts && pkt->pts == octx->drop_ts) return 0;
+    for (int i = 0; i < octx->nb_audio; i++) {
+      struct output_audio *oa = &octx->audio[i];
+      if (oa->ai != ost->index) continue;
+      if (oa->drop_ts == AV_NOPTS_VALUE) oa->drop_ts = pkt->pts;
+      if (pkt->pts && pkt->pts == oa->drop_ts) return 0;
+      break;
+    }
+  }
+
+  if (ost->index == primary) {
+    int64_t duration = pkt->duration;
+    if (!duration && octx->vc && octx->vc->framerate.num &&
+        AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type) {
+      // encoders generally leave the duration of video packets unset
+      duration = av_rescale_q(1, av_inv_q(octx->vc->framerate), ost->time_base);
+    }
+    update_extent(&octx->start_ts, &octx->end_ts, pkt->pts, duration, ost->time_base);
   }
 
-  return av_interleaved_write_frame(octx->oc, pkt);
+  start = av_gettime_relative();
+  ret = av_interleaved_write_frame(octx->oc, pkt);
+  octx->res->stages.mux += av_gettime_relative() - start;
+  return ret;
+}
+
+static int read_references(struct output_ctx *octx, struct filter_ctx *filter)
+{
+  // Queues the sampled input frames for the quality comparison
+  int ret = 0;
+  if (!octx->quality.frame) return 0;
+  while (1) {
+    ret = filtergraph_read_ref(octx, filter, octx->quality.frame);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) return 0;
+    else if (ret < 0) LPMS_ERR(read_refs_err, "Error reading sampled input frames");
+    ret = quality_add_reference(&octx->quality, octx->quality.frame);
+    if (ret < 0) return ret;
+  }
+
+read_refs_err:
+  return ret;
 }
 
 int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext *encoder, AVStream *ost,
@@ -328,13 +627,18 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
   }
 
   int is_video = (AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type);
+  int nb_frames = 0;
+  int64_t start = av_gettime_relative();
   ret = filtergraph_write(inf, ictx, octx, filter, is_video);
+  octx->res->stages.filter += av_gettime_relative() - start;
   if (ret < 0) goto proc_cleanup;
 
   while (1) {
     // Drain the filter. Each input frame may have multiple output frames
     AVFrame *frame = filter->frame;
+    start = av_gettime_relative();
     ret = filtergraph_read(ictx, octx, filter, is_video);
+    octx->res->stages.filter += av_gettime_relative() - start;
     if (ret == lpms_ERR_FILTER_FLUSHED) continue;
     else if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) {
       // no frame returned from filtergraph
@@ -342,12 +646,31 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
       if (inf) return ret;
       frame = NULL;
     } else if (ret < 0) goto proc_cleanup;
+    else if (is_video) {
+      // queue sampled input frames ahead of their encoded counterparts
+      ret = read_references(octx, filter);
+      if (ret < 0) goto proc_cleanup;
+    }
+
+    // Guard against frame rate conversion of timestamp jumps; the filter
+    // duplicates frames to fill the gap.
+    if (is_video && inf && ictx->limits.output_ratio &&
+        ++nb_frames > ictx->limits.output_ratio) {
+      av_frame_unref(frame);
+      ret = lpms_ERR_INPUT_LIMIT;
+      LPMS_ERR(proc_cleanup, "Too many output frames for input frame");
+    }
 
     // Set GOP interval if necessary
     if (is_video && octx->gop_pts_len && frame && frame->pts >= octx->next_kf_pts) {
         frame->pict_type = AV_PICTURE_TYPE_I;
         octx->next_kf_pts = frame->pts + octx->gop_pts_len;
     }
+    // Force keyframes at the requested times
+    if (is_video && frame &&
+        is_forced_keyframe(octx, frame, av_buffersink_get_time_base(filter->sink_ctx))) {
+      frame->pict_type = AV_PICTURE_TYPE_I;
+    }
     ret = encode(encoder, frame, octx, ost);
     av_frame_unref(frame);
     // For HW we keep the encoder open so will only get EAGAIN.
@@ -361,3 +684,34 @@ proc_cleanup:
   return ret;
 }
 
+int flush_output(struct input_ctx *ictx, struct output_ctx *octx)
+{
+  // only issue w this flushing method is it's not necessarily sequential
+  // wrt all the outputs; might want to iterate on each output per frame?
+  int ret = 0;
+  int64_t start = 0;
+  if (octx->vc) { // flush video
+    while (!ret || ret == AVERROR(EAGAIN)) {
+      ret = process_out(ictx, octx, octx->vc, octx->oc->streams[octx->vi], &octx->vf, NULL);
+    }
+    ret = read_references(octx, &octx->vf);
+    if (ret < 0) LPMS_ERR(flush_output_err, "Unable to read sampled input frames");
+    ret = finish_quality(&octx->quality);
+    if (ret < 0) LPMS_ERR(flush_output_err, "Unable to finish quality comparison");
+  }
+  for (int i = 0; i < octx->nb_audio; i++) {
+    struct output_audio *oa = &octx->audio[i];
+    if (!oa->ac) continue;
+    ret = 0; // flush audio
+    while (!ret || ret == AVERROR(EAGAIN)) {
+      ret = process_out(ictx, octx, oa->ac, octx->oc->streams[oa->ai], &oa->af, NULL);
+    }
+  }
+  start = av_gettime_relative();
+  av_interleaved_write_frame(octx->oc, NULL); // flush muxer
+  ret = av_write_trailer(octx->oc);
+  octx->res->stages.mux += av_gettime_relative() - start;
+
+flush_output_err:
+  return ret;
+}
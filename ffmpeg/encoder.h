@@ -5,12 +5,20 @@
 #include "transcoder.h"
 #include "filter.h"
 
+int init_keyframes(struct output_ctx *octx, output_params *params);
+int init_output(struct output_ctx *octx, struct input_ctx *ictx,
+  output_params *params, output_results *res);
 int open_output(struct output_ctx *octx, struct input_ctx *ictx);
 int reopen_output(struct output_ctx *octx, struct input_ctx *ictx);
+int flush_output(struct input_ctx *ictx, struct output_ctx *octx);
 void close_output(struct output_ctx *octx);
 void free_output(struct output_ctx *octx);
 int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext *encoder, AVStream *ost,
   struct filter_ctx *filter, AVFrame *inf);
 int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost);
 
+// Widens [start, end) in AV_TIME_BASE to cover the given timestamp
+void update_extent(int64_t *start, int64_t *end, int64_t pts, int64_t duration,
+  AVRational tb);
+
 #endif // _LPMS_ENCODER_H_
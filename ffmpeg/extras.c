@@ -1,107 +1,16 @@
 #include "extras.h"
+#include "logging.h"
+#include "scte35.h"
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
+#include <libavfilter/avfilter.h>
+#include <libavfilter/buffersink.h>
+#include <libavutil/avstring.h>
 
-//
-// Segmenter
-//
-
-int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char *seg_start)
-{
-#define r2h_err(str) {\
-  if (!ret) ret = 1; \
-  errstr = str; \
-  goto handle_r2h_err; \
-}
-  char *errstr          = NULL;
-  int ret               = 0;
-  AVFormatContext *ic   = NULL;
-  AVFormatContext *oc   = NULL;
-  AVOutputFormat *ofmt  = NULL;
-  AVStream *ist         = NULL;
-  AVStream *ost         = NULL;
-  AVDictionary *md      = NULL;
-  AVCodec *codec        = NULL;
-  int64_t prev_ts[2]    = {AV_NOPTS_VALUE, AV_NOPTS_VALUE};
-  int stream_map[2]     = {-1, -1};
-  int got_video_kf      = 0;
-  AVPacket pkt;
-
-  ret = avformat_open_input(&ic, listen, NULL, NULL);
-  if (ret < 0) r2h_err("segmenter: Unable to open input\n");
-  ret = avformat_find_stream_info(ic, NULL);
-  if (ret < 0) r2h_err("segmenter: Unable to find any input streams\n");
-
-  ofmt = av_guess_format(NULL, outf, NULL);
-  if (!ofmt) r2h_err("Could not deduce output format from file extension\n");
-  ret = avformat_alloc_output_context2(&oc, ofmt, NULL, outf);
-  if (ret < 0) r2h_err("Unable to allocate output context\n");
-
-  // XXX accommodate cases where audio or video is empty
-  stream_map[0] = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
-  if (stream_map[0] < 0) r2h_err("segmenter: Unable to find video stream\n");
-  stream_map[1] = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, &codec, 0);
-  if (stream_map[1] < 0) r2h_err("segmenter: Unable to find audio stream\n");
-
-  ist = ic->streams[stream_map[0]];
-  ost = avformat_new_stream(oc, NULL);
-  if (!ost) r2h_err("segmenter: Unable to allocate output video stream\n");
-  avcodec_parameters_copy(ost->codecpar, ist->codecpar);
-  ist = ic->streams[stream_map[1]];
-  ost = avformat_new_stream(oc, NULL);
-  if (!ost) r2h_err("segmenter: Unable to allocate output audio stream\n");
-  avcodec_parameters_copy(ost->codecpar, ist->codecpar);
-
-  av_dict_set(&md, "hls_time", seg_time, 0);
-  av_dict_set(&md, "hls_segment_filename", ts_tmpl, 0);
-  av_dict_set(&md, "start_number", seg_start, 0);
-  av_dict_set(&md, "hls_flags", "delete_segments", 0);
-  ret = avformat_write_header(oc, &md);
-  if (ret < 0) r2h_err("Error writing header\n");
-
-  av_init_packet(&pkt);
-  while (1) {
-    ret = av_read_frame(ic, &pkt);
-    if (ret == AVERROR_EOF) {
-      av_interleaved_write_frame(oc, NULL); // flush
-      break;
-    } else if (ret < 0) r2h_err("Error reading\n");
-    // rescale timestamps
-    if (pkt.stream_index == stream_map[0]) pkt.stream_index = 0;
-    else if (pkt.stream_index == stream_map[1]) pkt.stream_index = 1;
-    else goto r2hloop_end;
-    ist = ic->streams[stream_map[pkt.stream_index]];
-    ost = oc->streams[pkt.stream_index];
-    int64_t dts_next = pkt.dts, dts_prev = prev_ts[pkt.stream_index];
-    if (oc->streams[pkt.stream_index]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO &&
-        AV_NOPTS_VALUE == dts_prev &&
-        (pkt.flags & AV_PKT_FLAG_KEY)) got_video_kf = 1;
-    if (!got_video_kf) goto r2hloop_end; // skip everyting until first video KF
-    if (AV_NOPTS_VALUE == dts_prev) dts_prev = dts_next;
-    else if (dts_next <= dts_prev) goto r2hloop_end; // drop late packets
-    pkt.pts = av_rescale_q_rnd(pkt.pts, ist->time_base, ost->time_base,
-        AV_ROUND_NEAR_INF | AV_ROUND_PASS_MINMAX);
-    pkt.dts = av_rescale_q_rnd(pkt.dts, ist->time_base, ost->time_base,
-        AV_ROUND_NEAR_INF | AV_ROUND_PASS_MINMAX);
-    if (!pkt.duration) pkt.duration = dts_next - dts_prev;
-    pkt.duration = av_rescale_q(pkt.duration, ist->time_base, ost->time_base);
-    prev_ts[pkt.stream_index] = dts_next;
-    // write the thing
-    ret = av_interleaved_write_frame(oc, &pkt);
-    if (ret < 0) r2h_err("segmenter: Unable to write output frame\n");
-r2hloop_end:
-    av_packet_unref(&pkt);
-  }
-  ret = av_write_trailer(oc);
-  if (ret < 0) r2h_err("segmenter: Unable to write trailer\n");
-
-handle_r2h_err:
-  if (errstr) fprintf(stderr, "%s", errstr);
-  if (ic) avformat_close_input(&ic);
-  if (oc) avformat_free_context(oc);
-  if (md) av_dict_free(&md);
-  return ret == AVERROR_EOF ? 0 : ret;
-}
+#include <errno.h>
+#include <math.h>
+#include <stdio.h>
+#include <stdlib.h>
 
 //
 // Bypass Check
@@ -141,4 +50,1338 @@ close_format_context:
   return ret;
 }
 
+int lpms_has_audio(char *fname)
+{
+  // Whether the input has an audio stream; negative on error
+  AVFormatContext *ic = NULL;
+  int ret = avformat_open_input(&ic, fname, NULL, NULL);
+  if (ret < 0) goto has_audio_cleanup;
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) goto has_audio_cleanup;
+  ret = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0) >= 0;
+has_audio_cleanup:
+  if (ic) avformat_close_input(&ic);
+  return ret;
+}
+
+//
+// Concatenation
+// Stream-copies a sequence of segments into a single output. The timestamps
+// of each segment are shifted to follow on from the end of the previous one,
+// so discontinuities between segments are removed.
+//
+
+#define CONCAT_STREAMS 2 // video, audio
+
+// Rescales packet timestamps into the output timebase, shifting them by
+// `offset` (in AV_TIME_BASE) and keeping decode timestamps monotonic in case
+// the input overlaps or goes backwards.
+static void fix_timestamps(AVPacket *pkt, AVRational in_tb, AVRational out_tb,
+  int64_t offset, int64_t *last_dts)
+{
+  int64_t off = av_rescale_q(offset, AV_TIME_BASE_Q, out_tb);
+  av_packet_rescale_ts(pkt, in_tb, out_tb);
+  if (AV_NOPTS_VALUE != pkt->pts) pkt->pts += off;
+  if (AV_NOPTS_VALUE != pkt->dts) pkt->dts += off;
+  if (AV_NOPTS_VALUE != pkt->dts && AV_NOPTS_VALUE != *last_dts &&
+      pkt->dts <= *last_dts) {
+    int64_t shift = *last_dts + 1 - pkt->dts;
+    pkt->dts += shift;
+    if (AV_NOPTS_VALUE != pkt->pts) pkt->pts += shift;
+  }
+  if (AV_NOPTS_VALUE != pkt->dts) *last_dts = pkt->dts;
+}
+
+static int read_buffer(void *opaque, uint8_t *buf, int size)
+{
+  struct buffer_io *b = opaque;
+  size = FFMIN(size, b->size - b->pos);
+  if (size <= 0) return AVERROR_EOF;
+  memcpy(buf, b->data + b->pos, size);
+  b->pos += size;
+  return size;
+}
+
+static int64_t seek_buffer(void *opaque, int64_t offset, int whence)
+{
+  struct buffer_io *b = opaque;
+  switch (whence & ~AVSEEK_FORCE) {
+  case AVSEEK_SIZE: return b->size;
+  case SEEK_SET: break;
+  case SEEK_CUR: offset += b->pos; break;
+  case SEEK_END: offset += b->size; break;
+  default: return AVERROR(EINVAL);
+  }
+  if (offset < 0 || offset > b->size) return AVERROR(EINVAL);
+  b->pos = offset;
+  return offset;
+}
+
+int open_buffer_io(struct buffer_io *b, uint8_t *data, int size)
+{
+  int ret = 0;
+  uint8_t *buf = NULL;
+  const int buf_size = 4096;
+
+  b->data = data;
+  b->size = size;
+  b->pos  = 0;
+  buf = av_malloc(buf_size);
+  if (!buf) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_buffer_err, "Unable to allocate input buffer");
+  }
+  b->pb = avio_alloc_context(buf, buf_size, 0, b, read_buffer, NULL, seek_buffer);
+  if (!b->pb) {
+    av_free(buf);
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_buffer_err, "Unable to allocate input buffer context");
+  }
+
+open_buffer_err:
+  return ret;
+}
+
+void close_buffer_io(struct buffer_io *b)
+{
+  // custom IO contexts aren't freed along with the format context
+  if (b->pb) {
+    av_freep(&b->pb->buffer);
+    avio_context_free(&b->pb);
+  }
+}
+
+static int open_concat_input(concat_input *inp, struct buffer_io *b,
+  AVFormatContext **ic)
+{
+  int ret = 0;
+
+  *ic = avformat_alloc_context();
+  if (!*ic) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_concat_err, "Unable to allocate concat input");
+  }
+  if (!inp->fname) {
+    ret = open_buffer_io(b, inp->data, inp->size);
+    if (ret < 0) LPMS_ERR(open_concat_err, "Unable to open concat input buffer");
+    (*ic)->pb = b->pb;
+  }
+  ret = avformat_open_input(ic, inp->fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(open_concat_err, "Unable to open concat input");
+  ret = avformat_find_stream_info(*ic, NULL);
+  if (ret < 0) LPMS_ERR(open_concat_err, "Unable to find concat input streams");
+  return 0;
+
+open_concat_err:
+  return ret;
+}
+
+static int same_concat_params(AVCodecParameters *a, AVCodecParameters *b)
+{
+  // The output header is written from the first segment, so the streams of
+  // the other segments must be described by it too
+  if (a->extradata_size != b->extradata_size) return 0;
+  if (a->extradata_size && memcmp(a->extradata, b->extradata, a->extradata_size)) return 0;
+  if (AVMEDIA_TYPE_VIDEO == a->codec_type) {
+    return a->width == b->width && a->height == b->height && a->format == b->format;
+  }
+  return a->sample_rate == b->sample_rate && a->channels == b->channels;
+}
+
+static void close_concat_input(AVFormatContext **ic, struct buffer_io *b)
+{
+  if (*ic) avformat_close_input(ic);
+  close_buffer_io(b);
+}
+
+int lpms_concat(concat_params *params)
+{
+  int ret = 0;
+  AVFormatContext *ic = NULL, *oc = NULL;
+  AVOutputFormat *ofmt = NULL;
+  AVDictionary *md = NULL;
+  AVPacket pkt = {0};
+  struct buffer_io buf = {0};
+  enum AVMediaType types[CONCAT_STREAMS] = { AVMEDIA_TYPE_VIDEO, AVMEDIA_TYPE_AUDIO };
+  int ostreams[CONCAT_STREAMS] = { -1, -1 };  // output index for each type
+  int64_t last_dts[CONCAT_STREAMS] = { AV_NOPTS_VALUE, AV_NOPTS_VALUE };
+  int64_t end = 0; // end of all written segments, in AV_TIME_BASE
+
+  if (params->nb_inputs <= 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(concat_cleanup, "No inputs to concatenate");
+  }
+  if (params->muxer.name) {
+    ofmt = av_guess_format(params->muxer.name, NULL, NULL);
+  } else {
+    ofmt = av_guess_format("mp4", NULL, NULL);
+    if (!av_dict_get(params->muxer.opts, "movflags", NULL, 0)) {
+      av_dict_set(&params->muxer.opts, "movflags", "+faststart", 0);
+    }
+  }
+  if (!ofmt) {
+    ret = AVERROR_MUXER_NOT_FOUND;
+    LPMS_ERR(concat_cleanup, "Unable to find concat muxer");
+  }
+  av_init_packet(&pkt);
+
+  for (int i = 0; i < params->nb_inputs; i++) {
+    int istreams[CONCAT_STREAMS] = { -1, -1 };
+    int64_t start = 0, offset = 0;
+
+    ret = open_concat_input(&params->inputs[i], &buf, &ic);
+    if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to open concat segment");
+    for (int t = 0; t < CONCAT_STREAMS; t++) {
+      int idx = av_find_best_stream(ic, types[t], -1, -1, NULL, 0);
+      if (idx < 0) continue;
+      istreams[t] = idx;
+    }
+
+    if (!oc) {
+      // Set up the output from the streams of the first segment
+      ret = avformat_alloc_output_context2(&oc, ofmt, NULL, params->fname);
+      if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to allocate concat output");
+      for (int t = 0; t < CONCAT_STREAMS; t++) {
+        AVStream *ist = NULL, *ost = NULL;
+        if (istreams[t] < 0) continue;
+        ist = ic->streams[istreams[t]];
+        ost = avformat_new_stream(oc, NULL);
+        if (!ost) {
+          ret = AVERROR(ENOMEM);
+          LPMS_ERR(concat_cleanup, "Unable to allocate concat output stream");
+        }
+        ret = avcodec_parameters_copy(ost->codecpar, ist->codecpar);
+        if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to copy concat stream parameters");
+        ost->codecpar->codec_tag = 0;
+        ost->time_base = ist->time_base;
+        ostreams[t] = ost->index;
+      }
+      if (!oc->nb_streams) {
+        ret = AVERROR_STREAM_NOT_FOUND;
+        LPMS_ERR(concat_cleanup, "No audio or video to concatenate");
+      }
+      if (!(ofmt->flags & AVFMT_NOFILE)) {
+        ret = avio_open(&oc->pb, params->fname, AVIO_FLAG_WRITE);
+        if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to open concat output");
+      }
+      av_dict_copy(&md, params->muxer.opts, 0);
+      ret = avformat_write_header(oc, &md);
+      if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to write concat header");
+    }
+
+    // Codecs and their parameters can't change within the output
+    for (int t = 0; t < CONCAT_STREAMS; t++) {
+      AVCodecParameters *ipar = NULL, *opar = NULL;
+      if (istreams[t] < 0 || ostreams[t] < 0) continue;
+      ipar = ic->streams[istreams[t]]->codecpar;
+      opar = oc->streams[ostreams[t]]->codecpar;
+      if (ipar->codec_id != opar->codec_id) {
+        ret = lpms_ERR_INPUT_CODEC;
+        LPMS_ERR(concat_cleanup, "Mismatched codecs between concat segments");
+      }
+      if (!same_concat_params(ipar, opar)) {
+        ret = AVERROR(EINVAL);
+        LPMS_ERR(concat_cleanup, "Mismatched stream parameters between concat segments");
+      }
+    }
+
+    // Shift this segment to start where the previous one ended
+    if (AV_NOPTS_VALUE != ic->start_time) start = ic->start_time;
+    offset = end - start;
+
+    while (1) {
+      AVStream *ist = NULL, *ost = NULL;
+      int t = 0;
+      ret = av_read_frame(ic, &pkt);
+      if (AVERROR_EOF == ret) break;
+      else if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to read concat segment");
+      for (t = 0; t < CONCAT_STREAMS; t++) {
+        if (pkt.stream_index == istreams[t] && ostreams[t] >= 0) break;
+      }
+      if (t >= CONCAT_STREAMS) goto concat_loop_end; // not mapped
+      ist = ic->streams[pkt.stream_index];
+      ost = oc->streams[ostreams[t]];
+      fix_timestamps(&pkt, ist->time_base, ost->time_base, offset, &last_dts[t]);
+      if (AV_NOPTS_VALUE != pkt.dts) {
+        int64_t pkt_end = av_rescale_q(pkt.dts + pkt.duration, ost->time_base, AV_TIME_BASE_Q);
+        end = FFMAX(end, pkt_end);
+      }
+      pkt.stream_index = ost->index;
+      pkt.pos = -1;
+      ret = av_interleaved_write_frame(oc, &pkt);
+      if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to write concat packet");
+concat_loop_end:
+      av_packet_unref(&pkt);
+    }
+    close_concat_input(&ic, &buf);
+  }
+  ret = av_write_trailer(oc);
+  if (ret < 0) LPMS_ERR(concat_cleanup, "Unable to write concat trailer");
+
+concat_cleanup:
+  av_packet_unref(&pkt);
+  close_concat_input(&ic, &buf);
+  if (oc) {
+    if (!(oc->oformat->flags & AVFMT_NOFILE) && oc->pb) avio_closep(&oc->pb);
+    avformat_free_context(oc);
+  }
+  if (md) av_dict_free(&md);
+  return ret;
+}
+
+//
+// Remuxing
+// Copies the audio and video of the input into another container without
+// decoding. Bitstream filters are inserted where the container requires a
+// different packaging of the same codec, eg AnnexB H.264 for MPEG-TS or
+// ASC-style AAC for MP4 and FLV.
+//
+
+struct remux_stream {
+  int ist, ost;
+  AVBSFContext *bsf;
+  int64_t last_dts;
+  int64_t start, end; // AV_TIME_BASE
+};
+
+static const char* remux_bsf(AVCodecParameters *par, AVOutputFormat *ofmt)
+{
+  int annexb = !strcmp(ofmt->name, "mpegts") || !strcmp(ofmt->name, "h264") ||
+               !strcmp(ofmt->name, "hevc");
+  // avcC / hvcC extradata starts with a version of 1; AnnexB with a start code
+  int mp4_nals = par->extradata_size > 0 && par->extradata[0] == 1;
+  switch (par->codec_id) {
+  case AV_CODEC_ID_H264: return annexb && mp4_nals ? "h264_mp4toannexb" : NULL;
+  case AV_CODEC_ID_HEVC: return annexb && mp4_nals ? "hevc_mp4toannexb" : NULL;
+  case AV_CODEC_ID_AAC:
+    // ADTS streams have no extradata, which global header formats need
+    return (ofmt->flags & AVFMT_GLOBALHEADER) && !par->extradata_size ?
+      "aac_adtstoasc" : NULL;
+  default: return NULL;
+  }
+}
+
+static int write_remuxed(AVFormatContext *oc, struct remux_stream *rs,
+  AVPacket *pkt, AVRational tb, remux_stream_info *info)
+{
+  AVStream *ost = oc->streams[rs->ost];
+  fix_timestamps(pkt, tb, ost->time_base, 0, &rs->last_dts);
+  if (AV_NOPTS_VALUE != pkt->dts) {
+    int64_t dts = av_rescale_q(pkt->dts, ost->time_base, AV_TIME_BASE_Q);
+    int64_t end = av_rescale_q(pkt->dts + pkt->duration, ost->time_base, AV_TIME_BASE_Q);
+    if (AV_NOPTS_VALUE == rs->start) rs->start = dts;
+    rs->end = FFMAX(rs->end, end);
+  }
+  pkt->stream_index = ost->index;
+  pkt->pos = -1;
+  info->packets++;
+  return av_interleaved_write_frame(oc, pkt);
+}
+
+static int remux_packet(AVFormatContext *oc, AVStream *ist,
+  struct remux_stream *rs, AVPacket *pkt, remux_stream_info *info)
+{
+  int ret = 0;
+  AVPacket out = {0};
+
+  if (!rs->bsf) return write_remuxed(oc, rs, pkt, ist->time_base, info);
+  ret = av_bsf_send_packet(rs->bsf, pkt); // flushes if pkt is NULL
+  if (ret < 0) LPMS_ERR(remux_packet_err, "Unable to send packet to bitstream filter");
+  av_init_packet(&out);
+  while (1) {
+    ret = av_bsf_receive_packet(rs->bsf, &out);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(remux_packet_err, "Unable to receive filtered packet");
+    ret = write_remuxed(oc, rs, &out, rs->bsf->time_base_out, info);
+    av_packet_unref(&out);
+    if (ret < 0) LPMS_ERR(remux_packet_err, "Unable to write remuxed packet");
+  }
+  ret = 0;
+
+remux_packet_err:
+  av_packet_unref(&out);
+  return ret;
+}
+
+// Whether the input stream is timed ID3 metadata that the format can carry.
+static int is_timed_id3(AVStream *ist, AVOutputFormat *ofmt)
+{
+  return AVMEDIA_TYPE_DATA == ist->codecpar->codec_type &&
+         AV_CODEC_ID_TIMED_ID3 == ist->codecpar->codec_id &&
+         !strcmp(ofmt->name, "mpegts");
+}
+
+// Returns the muxer name to use, translating "fmp4" into mp4 with the
+// fragmentation flags set in the muxer options.
+static const char* remux_format(component_opts *muxer)
+{
+  if (!muxer->name || strcmp(muxer->name, "fmp4")) return muxer->name;
+  if (!av_dict_get(muxer->opts, "movflags", NULL, 0)) {
+    av_dict_set(&muxer->opts, "movflags",
+                "+frag_keyframe+empty_moov+default_base_moof", 0);
+  }
+  return "mp4";
+}
+
+// Sets up any bitstream filter needed to copy the input stream into the
+// given format, and describes the stream.
+static int init_remux_stream(AVStream *ist, AVOutputFormat *ofmt,
+  struct remux_stream *rs, remux_stream_info *info)
+{
+  int ret = 0;
+  AVCodecParameters *par = ist->codecpar;
+  const char *bsf_name = remux_bsf(par, ofmt);
+
+  if (bsf_name) {
+    const AVBitStreamFilter *filter = av_bsf_get_by_name(bsf_name);
+    if (!filter) {
+      ret = AVERROR_BSF_NOT_FOUND;
+      LPMS_ERR(init_remux_err, "Unable to find bitstream filter");
+    }
+    ret = av_bsf_alloc(filter, &rs->bsf);
+    if (ret < 0) LPMS_ERR(init_remux_err, "Unable to allocate bitstream filter");
+    ret = avcodec_parameters_copy(rs->bsf->par_in, par);
+    if (ret < 0) LPMS_ERR(init_remux_err, "Unable to copy bitstream filter parameters");
+    rs->bsf->time_base_in = ist->time_base;
+    ret = av_bsf_init(rs->bsf);
+    if (ret < 0) LPMS_ERR(init_remux_err, "Unable to initialize bitstream filter");
+    par = rs->bsf->par_out;
+    av_strlcpy(info->bsf, bsf_name, sizeof info->bsf);
+  }
+
+  rs->ist = ist->index;
+  rs->last_dts = rs->start = AV_NOPTS_VALUE;
+  info->index = ist->index;
+  info->type = par->codec_type;
+  av_strlcpy(info->codec, avcodec_get_name(par->codec_id), sizeof info->codec);
+  info->width = par->width;
+  info->height = par->height;
+  info->sample_rate = par->sample_rate;
+  info->channels = par->channels;
+  return 0;
+
+init_remux_err:
+  return ret;
+}
+
+// Adds an output stream for an initialized remux stream.
+static int add_remux_output(AVFormatContext *oc, AVStream *ist,
+  struct remux_stream *rs)
+{
+  int ret = 0;
+  AVStream *ost = avformat_new_stream(oc, NULL);
+  AVCodecParameters *par = rs->bsf ? rs->bsf->par_out : ist->codecpar;
+
+  if (!ost) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(add_remux_err, "Unable to allocate remux stream");
+  }
+  ost->time_base = rs->bsf ? rs->bsf->time_base_out : ist->time_base;
+  ret = avcodec_parameters_copy(ost->codecpar, par);
+  if (ret < 0) LPMS_ERR(add_remux_err, "Unable to copy remux stream parameters");
+  ost->codecpar->codec_tag = 0;
+  ost->disposition = ist->disposition;
+  av_dict_copy(&ost->metadata, ist->metadata, 0);
+  rs->ost = ost->index;
+  return 0;
+
+add_remux_err:
+  return ret;
+}
+
+static int add_remux_stream(AVFormatContext *oc, AVStream *ist,
+  struct remux_stream *rs, remux_stream_info *info)
+{
+  int ret = init_remux_stream(ist, oc->oformat, rs, info);
+  if (ret < 0) return ret;
+  return add_remux_output(oc, ist, rs);
+}
+
+int lpms_remux(remux_params *params, remux_results *res)
+{
+  int ret = 0, nb_av = 0;
+  AVFormatContext *ic = NULL, *oc = NULL;
+  AVDictionary *md = NULL;
+  AVPacket pkt = {0};
+  struct remux_stream streams[MAX_REMUX_STREAMS];
+  const char *fmt = NULL;
+
+  memset(streams, 0, sizeof streams);
+  memset(res, 0, sizeof *res);
+  av_init_packet(&pkt);
+
+  ret = avformat_open_input(&ic, params->fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to open remux input");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to find remux input streams");
+
+  fmt = remux_format(&params->muxer);
+  if (fmt && !av_guess_format(fmt, NULL, NULL)) {
+    ret = AVERROR_MUXER_NOT_FOUND;
+    LPMS_ERR(remux_cleanup, "Unable to find remux muxer");
+  }
+  ret = avformat_alloc_output_context2(&oc, NULL, fmt, params->oname);
+  if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to allocate remux output");
+
+  for (int i = 0; i < ic->nb_streams; i++) {
+    AVStream *ist = ic->streams[i];
+    enum AVMediaType type = ist->codecpar->codec_type;
+    int id3 = is_timed_id3(ist, oc->oformat);
+    if (!id3 && AVMEDIA_TYPE_VIDEO != type && AVMEDIA_TYPE_AUDIO != type) continue;
+    if (ist->disposition & AV_DISPOSITION_ATTACHED_PIC) continue;
+    if (res->nb_streams >= MAX_REMUX_STREAMS) {
+      LPMS_WARN("Too many streams to remux; dropping the rest");
+      break;
+    }
+    ret = add_remux_stream(oc, ist, &streams[res->nb_streams],
+                           &res->streams[res->nb_streams]);
+    res->nb_streams++; // always, so the bitstream filter is freed
+    if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to add remux stream");
+    if (!id3) nb_av++;
+  }
+  if (!nb_av) {
+    ret = AVERROR_STREAM_NOT_FOUND;
+    LPMS_ERR(remux_cleanup, "No audio or video to remux");
+  }
+
+  if (!(oc->oformat->flags & AVFMT_NOFILE)) {
+    ret = avio_open(&oc->pb, params->oname, AVIO_FLAG_WRITE);
+    if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to open remux output");
+  }
+  av_dict_copy(&md, params->muxer.opts, 0);
+  ret = avformat_write_header(oc, &md);
+  if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to write remux header");
+
+  while (1) {
+    int s = 0;
+    ret = av_read_frame(ic, &pkt);
+    if (AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to read remux input");
+    for (s = 0; s < res->nb_streams; s++) {
+      if (streams[s].ist == pkt.stream_index) break;
+    }
+    if (s < res->nb_streams) {
+      ret = remux_packet(oc, ic->streams[pkt.stream_index], &streams[s],
+                         &pkt, &res->streams[s]);
+      if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to remux packet");
+    }
+    av_packet_unref(&pkt);
+  }
+  for (int s = 0; s < res->nb_streams; s++) {
+    if (!streams[s].bsf) continue;
+    ret = remux_packet(oc, ic->streams[streams[s].ist], &streams[s], NULL,
+                       &res->streams[s]);
+    if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to flush remuxed stream");
+  }
+  ret = av_write_trailer(oc);
+  if (ret < 0) LPMS_ERR(remux_cleanup, "Unable to write remux trailer");
+
+  for (int s = 0; s < res->nb_streams; s++) {
+    if (AV_NOPTS_VALUE == streams[s].start) continue;
+    res->streams[s].duration = streams[s].end - streams[s].start;
+  }
+
+remux_cleanup:
+  av_packet_unref(&pkt);
+  for (int s = 0; s < res->nb_streams; s++) av_bsf_free(&streams[s].bsf);
+  if (ic) avformat_close_input(&ic);
+  if (oc) {
+    if (!(oc->oformat->flags & AVFMT_NOFILE) && oc->pb) avio_closep(&oc->pb);
+    avformat_free_context(oc);
+  }
+  if (md) av_dict_free(&md);
+  return ret;
+}
+
+//
+// Segmenting
+// Splits the input into standalone segments without decoding. Segments
+// begin on a keyframe of the primary stream (video, or audio if there is no
+// video) and are cut at the first keyframe after the target duration. Input
+// timestamps are preserved across segments.
+//
+
+static int open_segment(AVFormatContext **oc, char *name, AVOutputFormat *ofmt,
+  AVFormatContext *ic, struct remux_stream *streams, int nb_streams,
+  AVDictionary *opts)
+{
+  int ret = 0;
+  AVDictionary *md = NULL;
+
+  ret = avformat_alloc_output_context2(oc, ofmt, NULL, name);
+  if (ret < 0) LPMS_ERR(open_segment_err, "Unable to allocate segment output");
+  for (int s = 0; s < nb_streams; s++) {
+    ret = add_remux_output(*oc, ic->streams[streams[s].ist], &streams[s]);
+    if (ret < 0) LPMS_ERR(open_segment_err, "Unable to add segment stream");
+  }
+  if (!(ofmt->flags & AVFMT_NOFILE)) {
+    ret = avio_open(&(*oc)->pb, name, AVIO_FLAG_WRITE);
+    if (ret < 0) LPMS_ERR(open_segment_err, "Unable to open segment output");
+  }
+  av_dict_copy(&md, opts, 0);
+  ret = avformat_write_header(*oc, &md);
+  if (ret < 0) LPMS_ERR(open_segment_err, "Unable to write segment header");
 
+open_segment_err:
+  if (md) av_dict_free(&md);
+  return ret;
+}
+
+static int close_segment(AVFormatContext **oc, int write_trailer)
+{
+  int ret = 0;
+  if (!*oc) return 0;
+  if (write_trailer) ret = av_write_trailer(*oc);
+  if (!((*oc)->oformat->flags & AVFMT_NOFILE) && (*oc)->pb) avio_closep(&(*oc)->pb);
+  avformat_free_context(*oc);
+  *oc = NULL;
+  return ret;
+}
+
+static int add_segment(segment_params *params, segment_results *res,
+  char *name, int size)
+{
+  int ret = 0;
+  segment_info *seg = NULL;
+
+  ret = av_reallocp_array(&res->segments, res->nb_segments + 1, sizeof(segment_info));
+  if (ret < 0) {
+    res->nb_segments = 0;
+    LPMS_ERR(add_segment_err, "Unable to allocate segment info");
+  }
+  seg = &res->segments[res->nb_segments];
+  memset(seg, 0, sizeof *seg);
+  if (av_get_frame_filename2(name, size, params->tmpl, res->nb_segments, 0) < 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(add_segment_err, "Segment template needs a %d for the number");
+  }
+  av_strlcpy(seg->name, name, sizeof seg->name);
+  res->nb_segments++;
+
+add_segment_err:
+  return ret;
+}
+
+int lpms_segment(segment_params *params, segment_results *res)
+{
+  int ret = 0, nb_streams = 0, primary = -1, fallback = -1;
+  AVFormatContext *ic = NULL, *oc = NULL;
+  AVOutputFormat *ofmt = NULL;
+  AVPacket pkt = {0};
+  struct remux_stream streams[MAX_REMUX_STREAMS];
+  remux_stream_info infos[MAX_REMUX_STREAMS];
+  const char *fmt = NULL;
+  char name[sizeof res->segments->name] = {0};
+  int64_t target = params->target_duration * AV_TIME_BASE;
+  int64_t seg_start = AV_NOPTS_VALUE; // AV_TIME_BASE
+
+  memset(streams, 0, sizeof streams);
+  memset(infos, 0, sizeof infos);
+  memset(res, 0, sizeof *res);
+  av_init_packet(&pkt);
+
+  if (target <= 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(segment_cleanup, "Invalid segment duration");
+  }
+  ret = avformat_open_input(&ic, params->fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to open segmenter input");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to find segmenter input streams");
+
+  fmt = remux_format(&params->muxer);
+  if (av_get_frame_filename2(name, sizeof name, params->tmpl, 0, 0) < 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(segment_cleanup, "Segment template needs a %d for the number");
+  }
+  ofmt = av_guess_format(fmt, fmt ? NULL : name, NULL);
+  if (!ofmt) {
+    ret = AVERROR_MUXER_NOT_FOUND;
+    LPMS_ERR(segment_cleanup, "Unable to find segment muxer");
+  }
+
+  for (int i = 0; i < ic->nb_streams && nb_streams < MAX_REMUX_STREAMS; i++) {
+    AVStream *ist = ic->streams[i];
+    enum AVMediaType type = ist->codecpar->codec_type;
+    int id3 = is_timed_id3(ist, ofmt);
+    if (!id3 && AVMEDIA_TYPE_VIDEO != type && AVMEDIA_TYPE_AUDIO != type) continue;
+    if (ist->disposition & AV_DISPOSITION_ATTACHED_PIC) continue;
+    ret = init_remux_stream(ist, ofmt, &streams[nb_streams], &infos[nb_streams]);
+    nb_streams++; // always, so the bitstream filter is freed
+    if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to set up segment stream");
+    if (id3) continue;
+    if (AVMEDIA_TYPE_VIDEO == type && primary < 0) primary = nb_streams - 1;
+    if (fallback < 0) fallback = nb_streams - 1;
+  }
+  if (fallback < 0) {
+    ret = AVERROR_STREAM_NOT_FOUND;
+    LPMS_ERR(segment_cleanup, "No audio or video to segment");
+  }
+  // segment on the first audio stream if there is no video
+  if (primary < 0) primary = fallback;
+
+  while (1) {
+    int s = 0;
+    AVStream *ist = NULL;
+    ret = av_read_frame(ic, &pkt);
+    if (AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to read segmenter input");
+    for (s = 0; s < nb_streams; s++) {
+      if (streams[s].ist == pkt.stream_index) break;
+    }
+    if (s >= nb_streams) goto segment_loop_end;
+    ist = ic->streams[pkt.stream_index];
+
+    if (s == primary && AV_NOPTS_VALUE != pkt.pts && (pkt.flags & AV_PKT_FLAG_KEY)) {
+      int64_t t = av_rescale_q(pkt.pts, ist->time_base, AV_TIME_BASE_Q);
+      if (oc && t - seg_start >= target) {
+        segment_info *seg = &res->segments[res->nb_segments - 1];
+        seg->duration = (double)(t - seg_start) / AV_TIME_BASE;
+        ret = close_segment(&oc, 1);
+        if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to close segment");
+      }
+      if (!oc) {
+        segment_info *seg = NULL;
+        ret = add_segment(params, res, name, sizeof name);
+        if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to add segment");
+        ret = open_segment(&oc, name, ofmt, ic, streams, nb_streams, params->muxer.opts);
+        if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to open segment");
+        seg = &res->segments[res->nb_segments - 1];
+        seg->start_pts = pkt.pts;
+        seg->time_base = ist->time_base;
+        seg_start = t;
+      }
+    }
+    // skip everything until the first keyframe of the primary stream
+    if (!oc) goto segment_loop_end;
+
+    ret = remux_packet(oc, ist, &streams[s], &pkt, &infos[s]);
+    if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to write segment packet");
+segment_loop_end:
+    av_packet_unref(&pkt);
+  }
+  if (!oc) {
+    ret = lpms_ERR_INPUT_NOKF;
+    LPMS_ERR(segment_cleanup, "No keyframes in input to segment");
+  }
+
+  // Finish off the last segment
+  for (int s = 0; s < nb_streams; s++) {
+    if (streams[s].bsf) {
+      ret = remux_packet(oc, ic->streams[streams[s].ist], &streams[s], NULL, &infos[s]);
+      if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to flush segment stream");
+    }
+  }
+  {
+    int64_t end = seg_start;
+    segment_info *seg = &res->segments[res->nb_segments - 1];
+    for (int s = 0; s < nb_streams; s++) {
+      if (AV_NOPTS_VALUE != streams[s].start) end = FFMAX(end, streams[s].end);
+    }
+    seg->duration = (double)(end - seg_start) / AV_TIME_BASE;
+  }
+  ret = close_segment(&oc, 1);
+  if (ret < 0) LPMS_ERR(segment_cleanup, "Unable to close last segment");
+
+segment_cleanup:
+  av_packet_unref(&pkt);
+  close_segment(&oc, 0); // only left open on error
+  for (int s = 0; s < nb_streams; s++) av_bsf_free(&streams[s].bsf);
+  if (ic) avformat_close_input(&ic);
+  if (ret < 0) lpms_segment_free(res);
+  return ret;
+}
+
+void lpms_segment_free(segment_results *res)
+{
+  av_freep(&res->segments);
+  res->nb_segments = 0;
+}
+
+//
+// Test media
+// Generates media from the libavfilter test sources: a test pattern with a
+// frame counter for video, and a sine tone for audio. Output is bitexact so
+// the same parameters always produce the same file.
+//
+
+struct test_stream {
+  AVFilterGraph *graph;
+  AVFilterContext *sink;
+  AVCodecContext *enc;
+  AVStream *st;
+  int64_t next_pts; // in the encoder timebase
+  int eof;
+};
+
+static int open_test_source(struct test_stream *ts, const char *descr)
+{
+  int ret = 0;
+  const AVCodecContext *enc = ts->enc;
+  int is_video = AVMEDIA_TYPE_VIDEO == enc->codec_type;
+  AVFilterInOut *inputs = avfilter_inout_alloc();
+
+  ts->graph = avfilter_graph_alloc();
+  if (!ts->graph || !inputs) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(test_source_err, "Unable to allocate test source");
+  }
+  ret = avfilter_graph_create_filter(&ts->sink,
+    avfilter_get_by_name(is_video ? "buffersink" : "abuffersink"), "out",
+    NULL, NULL, ts->graph);
+  if (ret < 0) LPMS_ERR(test_source_err, "Unable to create test source sink");
+  inputs->name       = av_strdup("out");
+  inputs->filter_ctx = ts->sink;
+  inputs->pad_idx    = 0;
+  inputs->next       = NULL;
+  ret = avfilter_graph_parse_ptr(ts->graph, descr, &inputs, NULL, NULL);
+  if (ret < 0) LPMS_ERR(test_source_err, "Unable to parse test source");
+  ret = avfilter_graph_config(ts->graph, NULL);
+  if (ret < 0) LPMS_ERR(test_source_err, "Unable to configure test source");
+  if (!is_video && !(enc->codec->capabilities & AV_CODEC_CAP_VARIABLE_FRAME_SIZE)) {
+    av_buffersink_set_frame_size(ts->sink, enc->frame_size);
+  }
+
+test_source_err:
+  avfilter_inout_free(&inputs);
+  return ret;
+}
+
+static int open_test_encoder(struct test_stream *ts, AVFormatContext *oc,
+  component_opts *opts, const char *default_name, test_media_params *params)
+{
+  int ret = 0;
+  char descr[512];
+  AVDictionary *copts = NULL;
+  const char *name = opts->name ? opts->name : default_name;
+  AVCodec *codec = avcodec_find_encoder_by_name(name);
+
+  if (!codec) {
+    ret = AVERROR_ENCODER_NOT_FOUND;
+    LPMS_ERR(test_encoder_err, "Unable to find test media encoder");
+  }
+  ts->enc = avcodec_alloc_context3(codec);
+  if (!ts->enc) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(test_encoder_err, "Unable to allocate test media encoder");
+  }
+  if (AVMEDIA_TYPE_VIDEO == codec->type) {
+    AVRational fps = params->fps;
+    enum AVPixelFormat fmt = codec->pix_fmts ? codec->pix_fmts[0] : AV_PIX_FMT_YUV420P;
+    ts->enc->width = params->w;
+    ts->enc->height = params->h;
+    ts->enc->pix_fmt = fmt;
+    ts->enc->framerate = fps;
+    ts->enc->time_base = av_inv_q(fps);
+    if (params->gop > 0) ts->enc->gop_size = params->gop;
+    snprintf(descr, sizeof descr,
+      "testsrc2=size=%dx%d:rate=%d/%d:duration=%f,format=%s[out]",
+      params->w, params->h, fps.num, fps.den, params->duration,
+      av_get_pix_fmt_name(fmt));
+  } else if (AVMEDIA_TYPE_AUDIO == codec->type) {
+    enum AVSampleFormat fmt = codec->sample_fmts ? codec->sample_fmts[0] : AV_SAMPLE_FMT_FLTP;
+    ts->enc->sample_rate = params->sample_rate;
+    ts->enc->channels = params->channels;
+    ts->enc->channel_layout = av_get_default_channel_layout(params->channels);
+    ts->enc->sample_fmt = fmt;
+    ts->enc->time_base = (AVRational){1, params->sample_rate};
+    snprintf(descr, sizeof descr,
+      "sine=frequency=440:sample_rate=%d:duration=%f,"
+      "aformat=sample_fmts=%s:channel_layouts=%dc[out]",
+      params->sample_rate, params->duration, av_get_sample_fmt_name(fmt),
+      params->channels);
+  } else {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(test_encoder_err, "Test media encoder is not audio or video");
+  }
+  ts->enc->flags |= AV_CODEC_FLAG_BITEXACT;
+  if (oc->oformat->flags & AVFMT_GLOBALHEADER) ts->enc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+  av_dict_copy(&copts, opts->opts, 0);
+  ret = avcodec_open2(ts->enc, codec, &copts);
+  if (ret < 0) LPMS_ERR(test_encoder_err, "Unable to open test media encoder");
+
+  ts->st = avformat_new_stream(oc, NULL);
+  if (!ts->st) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(test_encoder_err, "Unable to allocate test media stream");
+  }
+  ts->st->time_base = ts->enc->time_base;
+  ts->st->avg_frame_rate = ts->enc->framerate;
+  ret = avcodec_parameters_from_context(ts->st->codecpar, ts->enc);
+  if (ret < 0) LPMS_ERR(test_encoder_err, "Unable to set test media stream params");
+
+  ret = open_test_source(ts, descr);
+  if (ret < 0) LPMS_ERR(test_encoder_err, "Unable to open test source");
+
+test_encoder_err:
+  if (copts) av_dict_free(&copts);
+  return ret;
+}
+
+static int encode_test_frame(struct test_stream *ts, AVFormatContext *oc,
+  AVFrame *frame)
+{
+  int ret = 0;
+  AVPacket pkt = {0};
+
+  if (frame) ts->next_pts = frame->pts + (frame->nb_samples ? frame->nb_samples : 1);
+  ret = avcodec_send_frame(ts->enc, frame);
+  if (ret < 0) LPMS_ERR(encode_test_err, "Unable to send test media frame");
+  while (1) {
+    av_init_packet(&pkt);
+    ret = avcodec_receive_packet(ts->enc, &pkt);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(encode_test_err, "Unable to receive test media packet");
+    av_packet_rescale_ts(&pkt, ts->enc->time_base, ts->st->time_base);
+    pkt.stream_index = ts->st->index;
+    ret = av_interleaved_write_frame(oc, &pkt);
+    if (ret < 0) LPMS_ERR(encode_test_err, "Unable to write test media packet");
+  }
+  ret = 0;
+
+encode_test_err:
+  av_packet_unref(&pkt);
+  return ret;
+}
+
+int lpms_generate_test_media(test_media_params *params)
+{
+  int ret = 0, nb_streams = 0;
+  AVFormatContext *oc = NULL;
+  AVDictionary *md = NULL;
+  AVFrame *frame = NULL;
+  struct test_stream streams[2]; // video, audio
+  component_opts *encoders[2] = { &params->video, &params->audio };
+  const char *defaults[2] = { "libx264", "aac" };
+
+  memset(streams, 0, sizeof streams);
+  if (params->duration <= 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(test_media_cleanup, "Invalid test media duration");
+  }
+  if (params->muxer.name && !av_guess_format(params->muxer.name, NULL, NULL)) {
+    ret = AVERROR_MUXER_NOT_FOUND;
+    LPMS_ERR(test_media_cleanup, "Unable to find test media muxer");
+  }
+  ret = avformat_alloc_output_context2(&oc, NULL, params->muxer.name, params->fname);
+  if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to allocate test media output");
+  oc->flags |= AVFMT_FLAG_BITEXACT;
+
+  for (int i = 0; i < 2; i++) {
+    // unset names mean the default encoder rather than dropping
+    if (encoders[i]->name && !strcmp("drop", encoders[i]->name)) continue;
+    ret = open_test_encoder(&streams[nb_streams], oc, encoders[i], defaults[i], params);
+    nb_streams++; // always, so the stream is freed
+    if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to set up test media stream");
+  }
+  if (!nb_streams) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(test_media_cleanup, "Test media needs audio or video");
+  }
+
+  if (!(oc->oformat->flags & AVFMT_NOFILE)) {
+    ret = avio_open(&oc->pb, params->fname, AVIO_FLAG_WRITE);
+    if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to open test media output");
+  }
+  av_dict_copy(&md, params->muxer.opts, 0);
+  ret = avformat_write_header(oc, &md);
+  if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to write test media header");
+
+  frame = av_frame_alloc();
+  if (!frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(test_media_cleanup, "Unable to allocate test media frame");
+  }
+  while (1) {
+    // Generate from whichever stream is furthest behind
+    struct test_stream *ts = NULL;
+    for (int i = 0; i < nb_streams; i++) {
+      if (streams[i].eof) continue;
+      if (!ts || av_compare_ts(streams[i].next_pts, streams[i].enc->time_base,
+                               ts->next_pts, ts->enc->time_base) < 0) {
+        ts = &streams[i];
+      }
+    }
+    if (!ts) break;
+    ret = av_buffersink_get_frame(ts->sink, frame);
+    if (AVERROR_EOF == ret) {
+      ts->eof = 1;
+      ret = encode_test_frame(ts, oc, NULL); // flush
+      if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to flush test media encoder");
+      continue;
+    } else if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to generate test media frame");
+    frame->pts = av_rescale_q(frame->pts, av_buffersink_get_time_base(ts->sink),
+                              ts->enc->time_base);
+    frame->pict_type = AV_PICTURE_TYPE_NONE;
+    ret = encode_test_frame(ts, oc, frame);
+    av_frame_unref(frame);
+    if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to encode test media frame");
+  }
+  ret = av_write_trailer(oc);
+  if (ret < 0) LPMS_ERR(test_media_cleanup, "Unable to write test media trailer");
+
+test_media_cleanup:
+  for (int i = 0; i < nb_streams; i++) {
+    if (streams[i].graph) avfilter_graph_free(&streams[i].graph);
+    if (streams[i].enc) avcodec_free_context(&streams[i].enc);
+  }
+  if (frame) av_frame_free(&frame);
+  if (oc) {
+    if (!(oc->oformat->flags & AVFMT_NOFILE) && oc->pb) avio_closep(&oc->pb);
+    avformat_free_context(oc);
+  }
+  if (md) av_dict_free(&md);
+  return ret;
+}
+
+//
+// Live HLS
+// Segments an RTMP ingest (or any other input) into MPEG-TS while keeping a
+// sliding window playlist up to date. Segments are cut on the first video
+// keyframe after the target duration, as well as on the first keyframe at a
+// splice point signalled by the input, through SCTE-35 PIDs or RTMP
+// onCuePoint messages. The playlist marks breaks with EXT-X-CUE-OUT,
+// EXT-X-CUE-OUT-CONT and EXT-X-CUE-IN tags.
+//
+
+// Default number of segments in the playlist, as with FFmpeg's hls muxer
+#define HLS_LIST_SIZE 5
+
+// Keyframes this close to a splice point are taken to be at it
+#define HLS_CUE_TOLERANCE (AV_TIME_BASE / 1000)
+
+enum hls_cue_type { HLS_CUE_NONE, HLS_CUE_OUT, HLS_CUE_CONT, HLS_CUE_IN };
+
+struct hls_entry {
+  char name[1024];
+  int seq;
+  double duration; // seconds
+  enum hls_cue_type cue;
+  double break_duration, elapsed; // seconds
+  char scte35[AV_BASE64_SIZE(MAX_SCTE35_SIZE)];
+};
+
+struct hls_ctx {
+  char *fname; // playlist
+  char *tmpl;  // segment names; %d is replaced with the sequence number
+  int seq;     // of the next segment
+  int64_t target; // AV_TIME_BASE
+  int target_duration; // seconds, as listed; only ever increases
+
+  AVFormatContext *oc;    // current segment
+  struct hls_entry cur;   // current segment
+  int64_t start, end;     // AV_TIME_BASE; end is where the next cut is due
+
+  // One more than is listed, so the segment that just left the playlist is
+  // still there for players working from the previous playlist
+  struct hls_entry *entries;
+  int nb_entries, list_size;
+
+  // Cue waiting for a keyframe, and the break in progress
+  struct splice_cue cue, brk;
+  int has_cue, in_break;
+  int64_t cue_time, break_start, break_end; // AV_TIME_BASE
+};
+
+static int write_hls_playlist(struct hls_ctx *h, int final)
+{
+  int ret = 0, first = FFMAX(0, h->nb_entries - h->list_size);
+  char tmp[1024] = {0};
+  FILE *f = NULL;
+
+  // written aside and moved into place so readers never see a partial file
+  snprintf(tmp, sizeof tmp, "%s.tmp", h->fname);
+  f = fopen(tmp, "w");
+  if (!f) {
+    ret = AVERROR(errno);
+    LPMS_ERR(write_playlist_err, "Unable to open playlist");
+  }
+  fprintf(f, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n"
+             "#EXT-X-MEDIA-SEQUENCE:%d\n", h->target_duration,
+             h->nb_entries ? h->entries[first].seq : h->seq);
+  for (int i = first; i < h->nb_entries; i++) {
+    struct hls_entry *e = &h->entries[i];
+    switch (e->cue) {
+    case HLS_CUE_OUT:
+      if (e->scte35[0]) fprintf(f, "#EXT-OATCLS-SCTE35:%s\n", e->scte35);
+      fprintf(f, "#EXT-X-CUE-OUT:%g\n", e->break_duration);
+      break;
+    case HLS_CUE_CONT:
+      fprintf(f, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%g,Duration=%g",
+              e->elapsed, e->break_duration);
+      if (e->scte35[0]) fprintf(f, ",SCTE35=%s", e->scte35);
+      fprintf(f, "\n");
+      break;
+    case HLS_CUE_IN:
+      fprintf(f, "#EXT-X-CUE-IN\n");
+      break;
+    default: break;
+    }
+    fprintf(f, "#EXTINF:%f,\n%s\n", e->duration, av_basename(e->name));
+  }
+  if (final) fprintf(f, "#EXT-X-ENDLIST\n");
+  ret = fclose(f);
+  f = NULL;
+  if (ret) {
+    ret = AVERROR(errno);
+    LPMS_ERR(write_playlist_err, "Unable to write playlist");
+  }
+  if (rename(tmp, h->fname)) {
+    ret = AVERROR(errno);
+    LPMS_ERR(write_playlist_err, "Unable to replace playlist");
+  }
+
+write_playlist_err:
+  if (f) fclose(f);
+  return ret;
+}
+
+// Lists the current segment, deleting the oldest one if it is out of the window
+static int add_hls_entry(struct hls_ctx *h, int64_t end, int final)
+{
+  if (h->nb_entries > h->list_size) {
+    if (remove(h->entries[0].name)) LPMS_WARN("Unable to delete old segment");
+    memmove(h->entries, h->entries + 1, h->list_size * sizeof *h->entries);
+    h->nb_entries--;
+  }
+  h->cur.duration = (double)(end - h->start) / AV_TIME_BASE;
+  // players may rely on the target duration not changing, so it is only
+  // raised if a segment runs long, eg waiting for a late keyframe
+  h->target_duration = FFMAX(h->target_duration, (int)ceil(h->cur.duration));
+  h->entries[h->nb_entries++] = h->cur;
+  return write_hls_playlist(h, final);
+}
+
+static void read_hls_cue(struct hls_ctx *h, AVStream *ist, AVPacket *pkt,
+  int64_t now)
+{
+  struct splice_cue cue;
+  enum AVMediaType type = ist->codecpar->codec_type;
+  int ret = 0;
+
+  if (AV_CODEC_ID_SCTE_35 == ist->codecpar->codec_id) {
+    ret = parse_scte35(pkt->data, pkt->size, &cue);
+  } else if (AVMEDIA_TYPE_DATA == type || AVMEDIA_TYPE_SUBTITLE == type) {
+    ret = parse_cue_point(pkt->data, pkt->size, &cue);
+  }
+  if (ret < 0) LPMS_WARN("Unable to parse splice signal");
+  if (ret <= 0) return;
+
+  if (cue.cancel) {
+    if (h->has_cue && h->cue.id == cue.id) h->has_cue = 0;
+    return;
+  }
+  // nothing to return from
+  if (!cue.out && !h->in_break && !(h->has_cue && h->cue.out)) return;
+  if (h->has_cue) LPMS_WARN("Replacing pending splice signal");
+  h->cue = cue;
+  h->has_cue = 1;
+  if (AV_NOPTS_VALUE != cue.pts) {
+    h->cue_time = av_rescale_q(cue.pts, (AVRational){1, 90000}, AV_TIME_BASE_Q);
+  } else if (AV_NOPTS_VALUE != pkt->pts) {
+    h->cue_time = av_rescale_q(pkt->pts, ist->time_base, AV_TIME_BASE_Q);
+  } else h->cue_time = now;
+}
+
+static int hls_cue_due(struct hls_ctx *h, int64_t t)
+{
+  return (h->has_cue && t + HLS_CUE_TOLERANCE >= h->cue_time) ||
+         (h->in_break && AV_NOPTS_VALUE != h->break_end &&
+          t + HLS_CUE_TOLERANCE >= h->break_end);
+}
+
+// Marks the segment starting at t with any splice point due there, or as
+// part of the break in progress.
+static void start_hls_cue(struct hls_ctx *h, int64_t t)
+{
+  struct hls_entry *e = &h->cur;
+  if (h->has_cue && t + HLS_CUE_TOLERANCE >= h->cue_time) {
+    h->has_cue = 0;
+    if (h->cue.out) {
+      h->brk = h->cue;
+      h->in_break = 1;
+      h->break_start = h->cue_time;
+      h->break_end = h->brk.duration > 0 ?
+        h->cue_time + llrint(h->brk.duration * AV_TIME_BASE) : AV_NOPTS_VALUE;
+      e->cue = HLS_CUE_OUT;
+    } else if (h->in_break) {
+      h->in_break = 0;
+      e->cue = HLS_CUE_IN;
+    }
+  } else if (h->in_break && AV_NOPTS_VALUE != h->break_end &&
+             t + HLS_CUE_TOLERANCE >= h->break_end) {
+    h->in_break = 0; // returns automatically once the duration is up
+    e->cue = HLS_CUE_IN;
+  } else if (h->in_break) {
+    e->cue = HLS_CUE_CONT;
+  }
+  if (HLS_CUE_OUT == e->cue || HLS_CUE_CONT == e->cue) {
+    e->break_duration = h->brk.duration;
+    e->elapsed = FFMAX(0, (double)(t - h->break_start) / AV_TIME_BASE);
+    av_strlcpy(e->scte35, h->brk.scte35, sizeof e->scte35);
+  }
+}
+
+// Starts a new segment at the video keyframe at t if one is due
+static int cut_hls_segment(struct hls_ctx *h, int64_t t, AVOutputFormat *ofmt,
+  AVFormatContext *ic, struct remux_stream *streams, int nb_streams)
+{
+  int ret = 0, cue = hls_cue_due(h, t);
+
+  if (h->oc && t > h->start && (cue || t >= h->end)) {
+    ret = close_segment(&h->oc, 1);
+    if (ret < 0) LPMS_ERR(cut_hls_err, "Unable to close segment");
+    ret = add_hls_entry(h, t, 0);
+    if (ret < 0) LPMS_ERR(cut_hls_err, "Unable to update playlist");
+  }
+  if (h->oc) return 0;
+
+  memset(&h->cur, 0, sizeof h->cur);
+  h->cur.seq = h->seq++;
+  if (av_get_frame_filename2(h->cur.name, sizeof h->cur.name, h->tmpl, h->cur.seq, 0) < 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(cut_hls_err, "Segment template needs a %d for the number");
+  }
+  start_hls_cue(h, t);
+  ret = open_segment(&h->oc, h->cur.name, ofmt, ic, streams, nb_streams, NULL);
+  if (ret < 0) LPMS_ERR(cut_hls_err, "Unable to open segment");
+  // cuts stay on a grid of target durations unless moved by a splice point
+  h->end = cue || AV_NOPTS_VALUE == h->end ? t + h->target : h->end + h->target;
+  h->start = t;
+
+cut_hls_err:
+  return ret;
+}
+
+int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char *seg_start,
+  int list_size)
+{
+  int ret               = 0;
+  AVFormatContext *ic   = NULL;
+  AVOutputFormat *ofmt  = NULL;
+  AVCodec *codec        = NULL;
+  struct hls_ctx *h     = NULL;
+  int64_t prev_ts[2]    = {AV_NOPTS_VALUE, AV_NOPTS_VALUE};
+  int stream_map[2]     = {-1, -1};
+  int got_video_kf      = 0;
+  int64_t last          = AV_NOPTS_VALUE; // video, AV_TIME_BASE
+  struct remux_stream streams[2];
+  remux_stream_info infos[2];
+  AVPacket pkt;
+
+  memset(streams, 0, sizeof streams);
+  memset(infos, 0, sizeof infos);
+  av_init_packet(&pkt);
+
+  h = av_mallocz(sizeof *h);
+  if (!h) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(r2h_cleanup, "segmenter: Unable to allocate playlist");
+  }
+  h->fname = outf;
+  h->tmpl = ts_tmpl;
+  h->seq = atoi(seg_start);
+  h->target = llrint(atof(seg_time) * AV_TIME_BASE);
+  h->end = AV_NOPTS_VALUE;
+  if (h->target <= 0) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(r2h_cleanup, "segmenter: Invalid segment duration");
+  }
+  h->target_duration = ceil((double)h->target / AV_TIME_BASE);
+  h->list_size = list_size > 0 ? list_size : HLS_LIST_SIZE;
+  h->entries = av_malloc_array(h->list_size + 1, sizeof *h->entries);
+  if (!h->entries) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(r2h_cleanup, "segmenter: Unable to allocate playlist entries");
+  }
+
+  ret = avformat_open_input(&ic, listen, NULL, NULL);
+  if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to open input");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to find any input streams");
+
+  ofmt = av_guess_format("mpegts", NULL, NULL);
+  if (!ofmt) {
+    ret = AVERROR_MUXER_NOT_FOUND;
+    LPMS_ERR(r2h_cleanup, "segmenter: Unable to find segment muxer");
+  }
+
+  // XXX accommodate cases where audio or video is empty
+  stream_map[0] = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
+  if (stream_map[0] < 0) {
+    ret = stream_map[0];
+    LPMS_ERR(r2h_cleanup, "segmenter: Unable to find video stream");
+  }
+  stream_map[1] = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, &codec, 0);
+  if (stream_map[1] < 0) {
+    ret = stream_map[1];
+    LPMS_ERR(r2h_cleanup, "segmenter: Unable to find audio stream");
+  }
+  for (int s = 0; s < 2; s++) {
+    ret = init_remux_stream(ic->streams[stream_map[s]], ofmt, &streams[s], &infos[s]);
+    if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to set up output stream");
+  }
+
+  while (1) {
+    AVStream *ist = NULL;
+    int64_t dts_next = 0, dts_prev = 0;
+    int s = 0;
+    ret = av_read_frame(ic, &pkt);
+    if (AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Error reading");
+    ist = ic->streams[pkt.stream_index];
+    if (pkt.stream_index == stream_map[0]) s = 0;
+    else if (pkt.stream_index == stream_map[1]) s = 1;
+    else {
+      read_hls_cue(h, ist, &pkt, last);
+      goto r2hloop_end;
+    }
+    dts_next = pkt.dts;
+    dts_prev = prev_ts[s];
+    if (!s && AV_NOPTS_VALUE == dts_prev && (pkt.flags & AV_PKT_FLAG_KEY)) got_video_kf = 1;
+    if (!got_video_kf) goto r2hloop_end; // skip everyting until first video KF
+    if (AV_NOPTS_VALUE == dts_prev) dts_prev = dts_next;
+    else if (dts_next <= dts_prev) goto r2hloop_end; // drop late packets
+    if (!pkt.duration) pkt.duration = dts_next - dts_prev;
+    prev_ts[s] = dts_next;
+
+    if (!s && AV_NOPTS_VALUE != pkt.pts) {
+      last = av_rescale_q(pkt.pts, ist->time_base, AV_TIME_BASE_Q);
+      if (pkt.flags & AV_PKT_FLAG_KEY) {
+        ret = cut_hls_segment(h, last, ofmt, ic, streams, 2);
+        if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to start segment");
+      }
+    }
+    if (!h->oc) goto r2hloop_end;
+    ret = remux_packet(h->oc, ist, &streams[s], &pkt, &infos[s]);
+    if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to write output frame");
+r2hloop_end:
+    av_packet_unref(&pkt);
+  }
+  ret = 0;
+
+  // Finish off the last segment
+  if (h->oc) {
+    int64_t end = h->start;
+    for (int s = 0; s < 2; s++) {
+      if (streams[s].bsf) {
+        ret = remux_packet(h->oc, ic->streams[streams[s].ist], &streams[s], NULL, &infos[s]);
+        if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to flush output stream");
+      }
+      if (AV_NOPTS_VALUE != streams[s].start) end = FFMAX(end, streams[s].end);
+    }
+    ret = close_segment(&h->oc, 1);
+    if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to write trailer");
+    ret = add_hls_entry(h, end, 1);
+    if (ret < 0) LPMS_ERR(r2h_cleanup, "segmenter: Unable to finish playlist");
+  }
+
+r2h_cleanup:
+  av_packet_unref(&pkt);
+  if (h) close_segment(&h->oc, 0); // only left open on error
+  for (int s = 0; s < 2; s++) av_bsf_free(&streams[s].bsf);
+  if (ic) avformat_close_input(&ic);
+  if (h) av_free(h->entries);
+  av_free(h);
+  return ret;
+}
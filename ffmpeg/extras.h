@@ -1,7 +1,99 @@
 #ifndef _LPMS_EXTRAS_H_
 #define _LPMS_EXTRAS_H_
 
-int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char *seg_time, char *seg_start);
+#include "transcoder.h"
+
+typedef struct {
+  char *fname;   // read from this file if set
+  uint8_t *data; // otherwise, read from this buffer
+  int size;
+} concat_input;
+
+typedef struct {
+  concat_input *inputs;
+  int nb_inputs;
+  char *fname;
+  component_opts muxer; // defaults to faststart mp4
+} concat_params;
+
+#define MAX_REMUX_STREAMS 16
+
+typedef struct {
+  char *fname;
+  char *oname;
+  // Guessed from the output name if unset. "fmp4" selects fragmented mp4.
+  component_opts muxer;
+} remux_params;
+
+typedef struct {
+  int index; // within the input
+  int type;  // AVMediaType
+  char codec[32];
+  char bsf[32]; // bitstream filter applied, if any
+  int width, height;
+  int sample_rate, channels;
+  int packets;
+  int64_t duration; // AV_TIME_BASE
+} remux_stream_info;
+
+typedef struct {
+  int nb_streams;
+  remux_stream_info streams[MAX_REMUX_STREAMS];
+} remux_results;
+
+typedef struct {
+  char *fname;
+  char *tmpl; // output names; %d is replaced with the segment number
+  double target_duration; // seconds
+  // Guessed from the template if unset. "fmp4" selects fragmented mp4.
+  component_opts muxer;
+} segment_params;
+
+typedef struct {
+  char name[1024];
+  int64_t start_pts; // of the first keyframe, in time_base
+  AVRational time_base;
+  double duration; // seconds
+} segment_info;
+
+typedef struct {
+  segment_info *segments;
+  int nb_segments;
+} segment_results;
+
+typedef struct {
+  char *fname;
+  component_opts muxer; // guessed from the file name if unset
+  component_opts video; // encoder; "drop" for no video
+  component_opts audio; // encoder; "drop" for no audio
+
+  int w, h;
+  AVRational fps;
+  int gop; // frames between keyframes; encoder default if zero
+  int sample_rate, channels;
+  double duration; // seconds
+} test_media_params;
+
+// Reads an input from memory through a custom IO context
+struct buffer_io {
+  uint8_t *data;
+  int size;
+  int pos;
+  AVIOContext *pb; // owned here rather than by the format context
+};
+
+int  open_buffer_io(struct buffer_io *b, uint8_t *data, int size);
+void close_buffer_io(struct buffer_io *b);
+
+// Lists the latest list_size segments in the playlist, or 5 if zero
+int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char *seg_time, char *seg_start,
+  int list_size);
 int lpms_is_bypass_needed(char *fname);
+int lpms_has_audio(char *fname);
+int lpms_concat(concat_params *params);
+int lpms_remux(remux_params *params, remux_results *res);
+int lpms_segment(segment_params *params, segment_results *res);
+void lpms_segment_free(segment_results *res);
+int lpms_generate_test_media(test_media_params *params);
 
 #endif // _LPMS_EXTRAS_H_
@@ -4,11 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -27,6 +30,8 @@ var ErrTranscoderFmt = errors.New("TranscoderUnrecognizedFormat")
 var ErrTranscoderPrf = errors.New("TranscoderUnrecognizedProfile")
 var ErrTranscoderGOP = errors.New("TranscoderInvalidGOP")
 var ErrTranscoderDev = errors.New("TranscoderIncompatibleDevices")
+var ErrTranscoderAud = errors.New("TranscoderInvalidAudioTracks")
+var ErrTranscoderSig = errors.New("TranscoderSignatureRequiresFiles")
 
 type Acceleration int
 
@@ -41,6 +46,139 @@ type ComponentOptions struct {
 	Opts map[string]string
 }
 
+// Selects an audio track from the input. Tracks are numbered starting from 1
+// in the order they appear among the input's audio streams. If Track is unset,
+// the first track with a matching Language tag is used. If both are unset,
+// the default audio track is selected automatically.
+type AudioSelector struct {
+	Track    int
+	Language string
+}
+
+// Maps an input audio track into an output with its own encoder settings.
+type AudioTrackOptions struct {
+	Input   AudioSelector
+	Encoder ComponentOptions
+}
+
+// Limits to reject pathological inputs, eg segments from untrusted sources.
+// Transcoding stops with ErrTranscoderLimit once any limit is exceeded.
+// Zero values mean no limit.
+type InputLimits struct {
+	// Between the first and last timestamps of the input
+	Duration time.Duration
+
+	// Of the decoded video
+	Width, Height int
+
+	// Number of decoded video frames
+	Frames int
+
+	// Between consecutive video packets, by decode timestamp
+	PTSGap time.Duration
+
+	// Encoded frames per decoded frame for any output, eg as duplicated by
+	// frame rate conversion across a timestamp jump
+	OutputFramesPerFrame int
+}
+
+// Analysis of the decoded input during a transcode, eg for chaptering or
+// detecting dead feeds. Zero values disable each kind of analysis.
+type AnalysisOptions struct {
+	// Minimum scene change score from 0 to 1, eg 0.4
+	SceneThreshold float64
+
+	// Minimum duration of black video to report
+	BlackDuration time.Duration
+
+	// Fraction of pixels that must be black for a picture to be black.
+	// Defaults to 0.98.
+	BlackRatio float64
+
+	// Minimum duration of silence in the default audio track to report
+	SilenceDuration time.Duration
+
+	// Maximum volume of silence in dB. Defaults to -60.
+	SilenceNoise float64
+}
+
+// Tolerance of corrupt input, eg from lossy uplinks. Packets that fail to
+// decode are skipped, though still copied into outputs that copy their stream,
+// and frames in which the decoder concealed errors are kept. Transcoding
+// fails with ErrTranscoderCorrupt once the errors in a segment exceed either
+// limit. Without a tolerance, the first packet that fails to decode fails
+// the segment.
+type ErrorTolerance struct {
+	// Maximum number of skipped packets and concealed frames per segment.
+	// Zero for no limit.
+	MaxErrors int
+
+	// Maximum fraction of skipped packets and concealed frames to all
+	// packets decoded in the segment. Zero for no limit.
+	MaxRatio float64
+}
+
+// Decoding errors in the input segment, whether or not they were tolerated.
+type DecodeErrors struct {
+	Packets   int // sent to the decoders
+	Skipped   int // packets that failed to decode; only with ErrorTolerance
+	Corrupted int // frames decoded with errors concealed
+
+	// Occurrences of each kind of error
+	DemuxerCorrupt    int // packets flagged as corrupt, eg MPEG-TS continuity errors
+	InvalidData       int // packets rejected by a decoder as invalid
+	DecoderFailed     int // packets rejected by a decoder otherwise
+	InvalidBitstream  int // frames decoded from an invalid bitstream
+	MissingReferences int // frames decoded with missing references
+}
+
+// Wall time spent in each stage of the pipeline. The decoded input covers
+// demuxing and decoding; each output covers its filtering, encoding and muxing.
+type StageTimes struct {
+	Demux, Decode, Filter, Encode, Mux time.Duration
+}
+
+// Compute used by a single Transcode call, measured within the pipeline.
+// Covers the loudness measuring pass, if any, but not Quality or Signature,
+// which are computed afterwards.
+type ResourceUsage struct {
+	WallTime time.Duration
+
+	// CPU time of the thread running the pipeline during this call. Not
+	// affected by other sessions, but excludes the worker threads of the
+	// codecs, where most encoding happens, so it is only a lower bound on
+	// the cost of the call. See MediaInfo.PipelineCPUTime per output.
+	PipelineCPUTime time.Duration
+
+	// Peak memory held by the frames of the software decoders of this
+	// session during this call, in bytes. Frames still held from earlier
+	// calls are included; copies made by filters and encoders are not.
+	PeakFrameMemory int64
+
+	// CPU time of the whole process during this call, including the codec
+	// worker threads but also anything else the process does concurrently
+	ProcessCPUTime time.Duration
+
+	// Peak resident memory of the process since it started, in bytes. Never
+	// decreases and covers every session of the process.
+	ProcessPeakMemory int64
+
+	// Sum of the stages of the decoded input and of all outputs
+	Stages StageTimes
+}
+
+type Interval struct {
+	Start, End time.Duration
+}
+
+// Events found by the analysis, on the timeline of the input. At most the
+// first 128 of each kind are listed.
+type AnalysisResults struct {
+	SceneChanges []time.Duration
+	Black        []Interval
+	Silence      []Interval
+}
+
 type Transcoder struct {
 	handle  *C.struct_transcode_thread
 	stopped bool
@@ -52,6 +190,26 @@ type TranscodeOptionsIn struct {
 	Fname  string
 	Accel  Acceleration
 	Device string
+
+	// Optional; leave empty to autodetect the input format and decoders
+	Demuxer      ComponentOptions
+	VideoDecoder ComponentOptions
+	AudioDecoder ComponentOptions
+
+	// Optional; the default audio track for outputs without AudioTracks
+	Audio AudioSelector
+
+	// Optional; sanity limits on the input
+	Limits InputLimits
+
+	// Optional; analysis of the decoded input
+	Analysis AnalysisOptions
+
+	// Optional; skips corrupt packets rather than failing the segment
+	ErrorTolerance *ErrorTolerance
+
+	// Optional; timed ID3 metadata for MPEG-TS outputs
+	Metadata []TimedMetadata
 }
 
 type TranscodeOptions struct {
@@ -63,25 +221,184 @@ type TranscodeOptions struct {
 	Muxer        ComponentOptions
 	VideoEncoder ComponentOptions
 	AudioEncoder ComponentOptions
+
+	// Copies the input video as-is rather than encoding it, while audio
+	// is still encoded per AudioEncoder or AudioTracks. Profile fields other
+	// than Format are ignored.
+	Source bool
+
+	// Optional; maps these input audio tracks into the output, in order,
+	// instead of the default audio track. AudioEncoder is then ignored.
+	AudioTracks []AudioTrackOptions
+
+	// Optional; compares the encoded video against the input. Computed while
+	// transcoding on sampled frames, so it is not available for Source or
+	// copied video.
+	Quality *QualityOptions
+
+	// Optional; computes a perceptual signature of the output and the input.
+	// Both are read again and decoded after transcoding, so they must be
+	// regular files; otherwise ErrTranscoderSig is returned up front.
+	Signature bool
+
+	// Optional; forces video keyframes in addition to those set by the GOP
+	Keyframes KeyframeOptions
+
+	// Optional; normalises the loudness of the encoded audio tracks
+	Loudness *LoudnessOptions
+
+	// Optional pixel format of the encoded video, eg "yuv420p10le" for HEVC
+	// Main10. Inputs in other formats, such as 10-bit, 4:2:2 or 4:4:4, are
+	// converted to it. Defaults to yuv420p, or to the closest format the
+	// encoder supports. Video decoded on the GPU keeps its decoded format.
+	PixelFormat string
+
+	// Keeps the video on the timeline of the input when the frame rate is
+	// converted: the output starts at the first timestamp of the input and
+	// lasts as long as the input, to within a frame, even if the input has
+	// a variable frame rate or dropped frames. Renditions of the same
+	// segment then stay aligned with each other.
+	PreserveTimestamps bool
+}
+
+// EBU R128 loudness normalisation. A single gain is applied to each audio
+// track without compressing its dynamics or adding latency.
+type LoudnessOptions struct {
+	// Integrated loudness to reach in LUFS. Defaults to -23.
+	Target float64
+
+	// Maximum true peak in dBTP; the gain is reduced to stay below this.
+	// Defaults to -1.
+	TruePeak float64
+
+	// Measures each input in full before transcoding it, for inputs that
+	// can be read twice such as VOD files. Otherwise the gain follows the
+	// loudness measured so far, which is safe for live streams but takes a
+	// few seconds to settle at the start of a session.
+	TwoPass bool
+}
+
+// Loudness of the input audio as measured for normalisation.
+type LoudnessResults struct {
+	Integrated float64 // LUFS
+	TruePeak   float64 // dBTP
+	Gain       float64 // applied to reach the target, in dB
+}
+
+// Forces keyframes at the same timestamps in every rendition, eg to allow
+// seamless switching between renditions. Times are presentation timestamps of
+// the input, so they carry over between the segments of a stream. The first
+// frame of every segment is always a keyframe.
+type KeyframeOptions struct {
+	// Forces a keyframe at the first frame at or after each of these times
+	Times []time.Duration
+
+	// Forces a keyframe at every frame for which the expression is nonzero,
+	// as with the expr: form of ffmpeg's -force_key_frames option. Available
+	// variables are t, n, n_forced, prev_forced_n and prev_forced_t.
+	// Eg "gte(t,n_forced*2)" forces a keyframe every two seconds.
+	Expr string
 }
 
 type MediaInfo struct {
 	Frames int
 	Pixels int64
+
+	// Only set for Source outputs. Describes the copied video, eg for use
+	// with VideoProfileToVariantParams alongside the other renditions.
+	SourceProfile *VideoProfile
+
+	// Only set for outputs with TranscodeOptions.Quality that encode video.
+	// Frame times are on the input timeline.
+	Quality *QualityResults
+
+	// Only set if TranscodeOptions.Signature is requested. The decoded input
+	// is signed if any output is.
+	Signature *Signature
+
+	// Presentation timestamps of the encoded video keyframes, on the same
+	// timeline as the input. At most the first 128 are listed.
+	Keyframes []time.Duration
+
+	// Only set for outputs with TranscodeOptions.Loudness, for the first
+	// audio track. Live measurements cover the session so far; two-pass
+	// measurements cover the whole segment.
+	Loudness *LoudnessResults
+
+	// First timestamp and duration of the video, or of the first audio
+	// track if there is no video, on the timeline of the input
+	StartTime time.Duration
+	Duration  time.Duration
+
+	Stages StageTimes
+
+	// CPU time the pipeline thread spent on this output, including setting
+	// it up. Excludes codec worker threads, so it is not the full cost of
+	// the output. Only set for outputs.
+	PipelineCPUTime time.Duration
+}
+
+type AudioTrackInfo struct {
+	Track      int // as numbered by AudioSelector
+	Index      int // stream index within the input
+	Language   string
+	Codec      string
+	Channels   int
+	SampleRate int
 }
 
 type TranscodeResults struct {
 	Decoded MediaInfo
 	Encoded []MediaInfo
+
+	// Audio tracks available in the input. At most the first 8 are listed;
+	// later tracks can still be selected by AudioSelector.
+	AudioTracks []AudioTrackInfo
+
+	// Whether all outputs with encoded video have keyframes at the same
+	// timestamps. Always true if there are fewer than two such outputs.
+	KeyframesAligned bool
+
+	// Only set if TranscodeOptionsIn.Analysis enables any analysis
+	Analysis *AnalysisResults
+
+	DecodeErrors DecodeErrors
+
+	Usage ResourceUsage
 }
 
+// RTMPToHLS segments the input into MPEG-TS, named by replacing the %d in tmpl
+// with the sequence number, and keeps a playlist of the latest segments in
+// outM3U8. Splice points signalled by SCTE-35 splice_insert commands (on
+// MPEG-TS PIDs) or by RTMP onCuePoint messages start a new segment at the
+// next keyframe, and breaks are marked in the playlist with EXT-X-CUE-OUT,
+// EXT-X-CUE-OUT-CONT and EXT-X-CUE-IN tags.
+//
+// onCuePoint messages either carry a base64 splice_info_section in the
+// "scte35" parameter, or are named "cue-out" (with an optional "duration"
+// parameter in seconds) or "cue-in".
 func RTMPToHLS(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs string, seg_start int) error {
+	return RTMPToHLS2(localRTMPUrl, outM3U8, tmpl, seglen_secs, seg_start, HLSOptions{})
+}
+
+type HLSOptions struct {
+	// Optional; number of segments listed in the playlist. Segments are
+	// deleted once they have been out of the playlist for one segment.
+	// Defaults to 5.
+	ListSize int
+}
+
+// RTMPToHLS2 is RTMPToHLS with additional options for the playlist.
+func RTMPToHLS2(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs string, seg_start int, opts HLSOptions) error {
+	if opts.ListSize < 0 {
+		return ErrTranscoderInp
+	}
 	inp := C.CString(localRTMPUrl)
 	outp := C.CString(outM3U8)
 	ts_tmpl := C.CString(tmpl)
 	seglen := C.CString(seglen_secs)
 	segstart := C.CString(fmt.Sprintf("%v", seg_start))
-	ret := int(C.lpms_rtmp2hls(inp, outp, ts_tmpl, seglen, segstart))
+	ret := int(C.lpms_rtmp2hls(inp, outp, ts_tmpl, seglen, segstart, C.int(opts.ListSize)))
 	C.free(unsafe.Pointer(inp))
 	C.free(unsafe.Pointer(outp))
 	C.free(unsafe.Pointer(ts_tmpl))
@@ -94,6 +411,246 @@ func RTMPToHLS(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs str
 	return nil
 }
 
+type ConcatOptions struct {
+	// Optional; defaults to an MP4 with the index moved to the front
+	Muxer ComponentOptions
+}
+
+// Concat stream-copies a sequence of segments, such as MPEG-TS segments from
+// the segmenter or Transcode, into a single output file. Timestamps of each
+// segment are shifted to follow on from the previous segment.
+func Concat(inputs []string, out string, opts ConcatOptions) error {
+	ins := make([]C.concat_input, len(inputs))
+	for i, fname := range inputs {
+		ins[i].fname = C.CString(fname)
+		defer C.free(unsafe.Pointer(ins[i].fname))
+	}
+	return concat(ins, out, opts)
+}
+
+// ConcatData is like Concat but reads the segments from memory.
+func ConcatData(inputs [][]byte, out string, opts ConcatOptions) error {
+	ins := make([]C.concat_input, len(inputs))
+	for i, data := range inputs {
+		ins[i].data = (*C.uint8_t)(C.CBytes(data))
+		ins[i].size = C.int(len(data))
+		defer C.free(unsafe.Pointer(ins[i].data))
+	}
+	return concat(ins, out, opts)
+}
+
+func concat(ins []C.concat_input, out string, opts ConcatOptions) error {
+	if len(ins) <= 0 {
+		return ErrTranscoderInp
+	}
+	// The inputs are referenced from the params struct, so must be C memory
+	inputs := (*C.concat_input)(C.calloc(C.size_t(len(ins)), C.sizeof_concat_input))
+	defer C.free(unsafe.Pointer(inputs))
+	copy((*[1 << 20]C.concat_input)(unsafe.Pointer(inputs))[:len(ins):len(ins)], ins)
+	fname := C.CString(out)
+	defer C.free(unsafe.Pointer(fname))
+	params := &C.concat_params{inputs: inputs, nb_inputs: C.int(len(ins)),
+		fname: fname, muxer: newComponentOpts(opts.Muxer)}
+	defer freeComponentOpts(&params.muxer)
+	ret := int(C.lpms_concat(params))
+	if 0 != ret {
+		glog.Error("Concat Return : ", ErrorMap[ret])
+		return ErrorMap[ret]
+	}
+	return nil
+}
+
+type StreamInfo struct {
+	Index      int    // within the input
+	Type       string // "video" or "audio"
+	Codec      string
+	Bsf        string // bitstream filter applied while remuxing, if any
+	Width      int
+	Height     int
+	SampleRate int
+	Channels   int
+	Packets    int
+	Duration   time.Duration
+}
+
+// Remux copies the audio and video of the input into a new container without
+// decoding, eg MPEG-TS to MP4 or FLV. Format is a muxer name, or "fmp4" for
+// fragmented MP4; if empty, it is guessed from the output name. Returns the
+// streams written to the output.
+func Remux(in, out, format string) ([]StreamInfo, error) {
+	params := &C.remux_params{
+		fname: C.CString(in),
+		oname: C.CString(out),
+		muxer: newComponentOpts(ComponentOptions{Name: format}),
+	}
+	defer C.free(unsafe.Pointer(params.fname))
+	defer C.free(unsafe.Pointer(params.oname))
+	defer freeComponentOpts(&params.muxer)
+	res := &C.remux_results{}
+	ret := int(C.lpms_remux(params, res))
+	if 0 != ret {
+		glog.Error("Remux Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	streams := make([]StreamInfo, int(res.nb_streams))
+	for i := range streams {
+		info := &res.streams[i]
+		streams[i] = StreamInfo{
+			Index:      int(info.index),
+			Codec:      C.GoString(&info.codec[0]),
+			Bsf:        C.GoString(&info.bsf[0]),
+			Width:      int(info.width),
+			Height:     int(info.height),
+			SampleRate: int(info.sample_rate),
+			Channels:   int(info.channels),
+			Packets:    int(info.packets),
+			Duration:   time.Duration(info.duration) * time.Microsecond,
+		}
+		switch info._type {
+		case C.AVMEDIA_TYPE_VIDEO:
+			streams[i].Type = "video"
+		case C.AVMEDIA_TYPE_AUDIO:
+			streams[i].Type = "audio"
+		}
+	}
+	return streams, nil
+}
+
+type SegmentInfo struct {
+	Name     string
+	Duration time.Duration
+
+	// Timestamp of the first keyframe in the segment, in the timebase of
+	// the input's video stream (or audio if there is no video)
+	StartPTS int64
+	Start    time.Duration
+}
+
+// Segment splits the input into keyframe-aligned segments of roughly the
+// target duration, without decoding. Segments are named by replacing the %d
+// in outTemplate with the segment number, starting from zero. Templates
+// ending in .mp4 or .m4s produce fragmented MP4; otherwise the format is
+// guessed from the name, eg MPEG-TS for .ts.
+func Segment(input, outTemplate string, targetDuration time.Duration) ([]SegmentInfo, error) {
+	var format string
+	switch filepath.Ext(outTemplate) {
+	case ".mp4", ".m4s":
+		format = "fmp4"
+	}
+	params := &C.segment_params{
+		fname:           C.CString(input),
+		tmpl:            C.CString(outTemplate),
+		target_duration: C.double(targetDuration.Seconds()),
+		muxer:           newComponentOpts(ComponentOptions{Name: format}),
+	}
+	defer C.free(unsafe.Pointer(params.fname))
+	defer C.free(unsafe.Pointer(params.tmpl))
+	defer freeComponentOpts(&params.muxer)
+	res := &C.segment_results{}
+	ret := int(C.lpms_segment(params, res))
+	defer C.lpms_segment_free(res)
+	if 0 != ret {
+		glog.Error("Segmenter Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	n := int(res.nb_segments)
+	segs := make([]SegmentInfo, n)
+	if n > 0 {
+		infos := (*[1 << 20]C.segment_info)(unsafe.Pointer(res.segments))[:n:n]
+		for i, info := range infos {
+			tb := float64(info.time_base.num) / float64(info.time_base.den)
+			segs[i] = SegmentInfo{
+				Name:     C.GoString(&info.name[0]),
+				Duration: time.Duration(float64(info.duration) * float64(time.Second)),
+				StartPTS: int64(info.start_pts),
+				Start:    time.Duration(float64(info.start_pts) * tb * float64(time.Second)),
+			}
+		}
+	}
+	return segs, nil
+}
+
+type TestMediaOptions struct {
+	Oname string
+
+	Duration     time.Duration // defaults to one second
+	Resolution   string        // defaults to 256x144
+	Framerate    uint          // defaults to 30
+	FramerateDen uint
+	GOP          time.Duration // keyframe interval; encoder default if unset
+	SampleRate   int           // defaults to 48000
+	Channels     int           // defaults to stereo
+
+	// Optional; the format is guessed from Oname by default
+	Muxer ComponentOptions
+	// Default to libx264 and aac. Use "drop" to omit a stream.
+	VideoEncoder ComponentOptions
+	AudioEncoder ComponentOptions
+}
+
+// GenerateTestMedia writes a file made from synthetic sources: a test pattern
+// with a frame counter for video, and a sine tone for audio. The output is
+// deterministic for a given set of options.
+func GenerateTestMedia(opts TestMediaOptions) error {
+	if opts.Duration == 0 {
+		opts.Duration = time.Second
+	}
+	if opts.Resolution == "" {
+		opts.Resolution = P144p30fps16x9.Resolution
+	}
+	if opts.Framerate == 0 {
+		opts.Framerate = 30
+	}
+	if opts.FramerateDen == 0 {
+		opts.FramerateDen = 1
+	}
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 48000
+	}
+	if opts.Channels == 0 {
+		opts.Channels = 2
+	}
+	w, h, err := VideoProfileResolution(VideoProfile{Resolution: opts.Resolution})
+	if err != nil {
+		return err
+	}
+	gop := 0
+	if opts.GOP == GOPIntraOnly {
+		gop = 1
+	} else if opts.GOP < 0 {
+		return ErrTranscoderGOP
+	} else if opts.GOP > 0 {
+		fps := float64(opts.Framerate) / float64(opts.FramerateDen)
+		gop = int(opts.GOP.Seconds()*fps + 0.5)
+		if gop < 1 {
+			gop = 1
+		}
+	}
+	params := &C.test_media_params{
+		fname:       C.CString(opts.Oname),
+		muxer:       newComponentOpts(opts.Muxer),
+		video:       newComponentOpts(opts.VideoEncoder),
+		audio:       newComponentOpts(opts.AudioEncoder),
+		w:           C.int(w),
+		h:           C.int(h),
+		fps:         C.AVRational{num: C.int(opts.Framerate), den: C.int(opts.FramerateDen)},
+		gop:         C.int(gop),
+		sample_rate: C.int(opts.SampleRate),
+		channels:    C.int(opts.Channels),
+		duration:    C.double(opts.Duration.Seconds()),
+	}
+	defer C.free(unsafe.Pointer(params.fname))
+	defer freeComponentOpts(&params.muxer)
+	defer freeComponentOpts(&params.video)
+	defer freeComponentOpts(&params.audio)
+	ret := int(C.lpms_generate_test_media(params))
+	if 0 != ret {
+		glog.Error("Test Media Return : ", ErrorMap[ret])
+		return ErrorMap[ret]
+	}
+	return nil
+}
+
 func Transcode(input string, workDir string, ps []VideoProfile) error {
 
 	opts := make([]TranscodeOptions, len(ps))
@@ -125,6 +682,54 @@ func newAVOpts(opts map[string]string) *C.AVDictionary {
 	return dict
 }
 
+// Allocates C options for the given component. Empty names are left as NULL.
+// Must be released with freeComponentOpts.
+func newComponentOpts(opts ComponentOptions) C.component_opts {
+	var c C.component_opts
+	if opts.Name != "" {
+		c.name = C.CString(opts.Name)
+	}
+	if len(opts.Opts) > 0 {
+		c.opts = newAVOpts(opts.Opts)
+	}
+	return c
+}
+
+func freeComponentOpts(opts *C.component_opts) {
+	if opts.name != nil {
+		C.free(unsafe.Pointer(opts.name))
+		opts.name = nil
+	}
+	if opts.opts != nil {
+		C.av_dict_free(&opts.opts)
+	}
+}
+
+// Describes the input video as a profile, for source renditions.
+func sourceProfile(res *C.input_results) *VideoProfile {
+	p := &VideoProfile{
+		Name:       "source",
+		Resolution: fmt.Sprintf("%dx%d", int(res.width), int(res.height)),
+		Bitrate:    fmt.Sprintf("%dk", int64(res.bit_rate)/1000),
+	}
+	if res.framerate.num > 0 && res.framerate.den > 0 {
+		p.Framerate = uint(res.framerate.num)
+		p.FramerateDen = uint(res.framerate.den)
+	}
+	return p
+}
+
+// Returns the position of the selector in the list, appending it if needed.
+func audioTrackIndex(sels *[]AudioSelector, sel AudioSelector) int {
+	for i, s := range *sels {
+		if s == sel {
+			return i
+		}
+	}
+	*sels = append(*sels, sel)
+	return len(*sels) - 1
+}
+
 // return encoding specific options for the given accel
 func configAccel(inAcc, outAcc Acceleration, inDev, outDev string) (string, string, error) {
 	switch inAcc {
@@ -164,6 +769,269 @@ func accelDeviceType(accel Acceleration) (C.enum_AVHWDeviceType, error) {
 	return C.AV_HWDEVICE_TYPE_NONE, ErrTranscoderHw
 }
 
+// Whether FFmpeg opens the name as a regular file, rather than a pipe, a
+// device or another protocol such as a network URL. Names that don't exist
+// yet, such as outputs, only need to be plain paths.
+func isRegularFile(name string) bool {
+	if i := strings.IndexAny(name, ":/\\"); i > 1 && name[i] == ':' {
+		if name[:i] != "file" {
+			return false
+		}
+		name = name[i+1:]
+	}
+	fi, err := os.Stat(name)
+	return os.IsNotExist(err) || (err == nil && fi.Mode().IsRegular())
+}
+
+// Whether the output re-encodes the input video rather than copying or dropping it.
+func encodesVideo(p TranscodeOptions) bool {
+	return !p.Source && "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name
+}
+
+// Video filters of an output, and the ones used instead if the input is
+// decoded in software despite a hardware accelerated input.
+func videoFilters(input *TranscodeOptionsIn, p TranscodeOptions, param VideoProfile, scale_filter string, w, h int) (string, string) {
+	// preserve aspect ratio along the larger dimension when rescaling
+	var filters, swFilters string
+	scale := fmt.Sprintf("='w=if(gte(iw,ih),%d,-2):h=if(lt(iw,ih),%d,-2)'", w, h)
+	filters = scale_filter + scale
+	if input.Accel != Software && p.Accel == Software {
+		// needed for hw dec -> hw rescale -> sw enc
+		filters = filters + ",hwdownload,format=nv12"
+		// inputs the GPU can't decode stay off the GPU entirely
+		swFilters = "scale" + scale
+	}
+	// Add fps filter *after* scale filter because otherwise we could
+	// be scaling duplicate frames unnecessarily. This becomes a DoS vector
+	// when a user submits two frames that are "far apart" in pts and
+	// the fps filter duplicates frames to fill out the difference to maintain
+	// a consistent frame rate.
+	// Once we allow for alternating segments, this issue should be mitigated
+	// and the fps filter can come *before* the scale filter to minimize work
+	// when going from high fps to low fps (much more common when transcoding
+	// than going from low fps to high fps)
+	if param.Framerate > 0 {
+		filters += fmt.Sprintf(",fps=%d/%d", param.Framerate, param.FramerateDen)
+		if swFilters != "" {
+			swFilters += fmt.Sprintf(",fps=%d/%d", param.Framerate, param.FramerateDen)
+		}
+	}
+	return filters, swFilters
+}
+
+// Converts the options of an output into C params. The returned function
+// frees the params once they are no longer needed, apart from the option
+// dictionaries which are freed by freeOutputOpts. New input audio tracks
+// mapped by the output are appended to audioSels.
+func newOutputParams(input *TranscodeOptionsIn, p TranscodeOptions, audioSels *[]AudioSelector) (C.output_params, func(), error) {
+	var frees []func()
+	free := func() {
+		for i := len(frees) - 1; i >= 0; i-- {
+			frees[i]()
+		}
+	}
+	fail := func(err error) (C.output_params, func(), error) {
+		free()
+		return C.output_params{}, nil, err
+	}
+	oname := C.CString(p.Oname)
+	frees = append(frees, func() { C.free(unsafe.Pointer(oname)) })
+
+	if p.Source {
+		// Only the container settings of the profile apply
+		p.VideoEncoder = ComponentOptions{Name: "copy"}
+		p.Profile.Framerate, p.Profile.FramerateDen, p.Profile.GOP = 0, 0, 0
+	}
+	param := p.Profile
+	w, h, err := VideoProfileResolution(param)
+	if err != nil {
+		if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
+			return fail(err)
+		}
+	}
+	br := strings.Replace(param.Bitrate, "k", "000", 1)
+	bitrate, err := strconv.Atoi(br)
+	if err != nil {
+		if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
+			return fail(err)
+		}
+	}
+	encoder, scale_filter := p.VideoEncoder.Name, "scale"
+	if encoder == "" {
+		encoder, scale_filter, err = configAccel(input.Accel, p.Accel, input.Device, p.Device)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	// set FPS denominator to 1 if unset by user
+	if param.FramerateDen == 0 {
+		param.FramerateDen = 1
+	}
+	filters, swFilters := videoFilters(input, p, param, scale_filter, w, h)
+	var fps C.AVRational
+	if param.Framerate > 0 {
+		fps = C.AVRational{num: C.int(param.Framerate), den: C.int(param.FramerateDen)}
+	}
+	var muxOpts C.component_opts
+	var muxName string
+	switch p.Profile.Format {
+	case FormatNone:
+		muxOpts = C.component_opts{
+			// don't free this bc of avformat_write_header API
+			opts: newAVOpts(p.Muxer.Opts),
+		}
+		muxName = p.Muxer.Name
+	case FormatMPEGTS:
+		muxName = "mpegts"
+	case FormatMP4:
+		muxName = "mp4"
+		muxOpts = C.component_opts{
+			opts: newAVOpts(map[string]string{"movflags": "faststart"}),
+		}
+	default:
+		return fail(ErrTranscoderFmt)
+	}
+	if muxName != "" {
+		muxOpts.name = C.CString(muxName)
+		frees = append(frees, func() { C.free(unsafe.Pointer(muxOpts.name)) })
+	}
+	// Set video encoder options
+	if len(p.VideoEncoder.Name) <= 0 && len(p.VideoEncoder.Opts) <= 0 {
+		p.VideoEncoder.Opts = map[string]string{
+			"forced-idr": "1",
+		}
+		switch p.Profile.Profile {
+		case ProfileH264Baseline, ProfileH264Main, ProfileH264High:
+			p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
+		case ProfileH264ConstrainedHigh:
+			p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
+			p.VideoEncoder.Opts["bf"] = "0"
+		case ProfileNone:
+			// Do nothing, the encoder will use default profile
+		default:
+			return fail(ErrTranscoderPrf)
+		}
+	}
+	gopMs := 0
+	if param.GOP != 0 {
+		if param.GOP <= GOPInvalid {
+			return fail(ErrTranscoderGOP)
+		}
+		// Check for intra-only
+		if param.GOP == GOPIntraOnly {
+			p.VideoEncoder.Opts["g"] = "0"
+		} else {
+			if param.Framerate > 0 {
+				gop := param.GOP.Seconds()
+				interval := strconv.Itoa(int(gop * float64(param.Framerate)))
+				p.VideoEncoder.Opts["g"] = interval
+			} else {
+				gopMs = int(param.GOP.Milliseconds())
+			}
+		}
+	}
+	vidOpts := C.component_opts{
+		name: C.CString(encoder),
+		opts: newAVOpts(p.VideoEncoder.Opts),
+	}
+	audioEncoder := p.AudioEncoder.Name
+	if audioEncoder == "" {
+		audioEncoder = "aac"
+	}
+	audioOpts := C.component_opts{
+		name: C.CString(audioEncoder),
+		opts: newAVOpts(p.AudioEncoder.Opts),
+	}
+	vfilt := C.CString(filters)
+	frees = append(frees, func() { C.free(unsafe.Pointer(vidOpts.name)) })
+	frees = append(frees, func() { C.free(unsafe.Pointer(audioOpts.name)) })
+	frees = append(frees, func() { C.free(unsafe.Pointer(vfilt)) })
+	var audioMaps *C.audio_map
+	if len(p.AudioTracks) > C.MAX_AUDIO_TRACKS {
+		return fail(ErrTranscoderAud)
+	} else if len(p.AudioTracks) > 0 {
+		// Needs to be C memory since it is referenced from output_params
+		audioMaps = (*C.audio_map)(C.calloc(C.size_t(len(p.AudioTracks)), C.sizeof_audio_map))
+		frees = append(frees, func() { C.free(unsafe.Pointer(audioMaps)) })
+		maps := (*[C.MAX_AUDIO_TRACKS]C.audio_map)(unsafe.Pointer(audioMaps))[:len(p.AudioTracks):len(p.AudioTracks)]
+		for j, track := range p.AudioTracks {
+			encoder := track.Encoder
+			if encoder.Name == "" {
+				encoder.Name = "aac"
+			}
+			maps[j] = C.audio_map{
+				track:   C.int(audioTrackIndex(audioSels, track.Input)),
+				encoder: newComponentOpts(encoder),
+			}
+			enc := &maps[j].encoder
+			frees = append(frees, func() { freeComponentOpts(enc) })
+		}
+	}
+	out := C.output_params{fname: oname, fps: fps,
+		w: C.int(w), h: C.int(h), bitrate: C.int(bitrate),
+		gop_time: C.int(gopMs),
+		muxer:    muxOpts, audio: audioOpts, video: vidOpts, vfilters: vfilt,
+		audio_maps: audioMaps, nb_audio_maps: C.int(len(p.AudioTracks))}
+	if p.Source {
+		out.source = 1
+	}
+	if p.PreserveTimestamps {
+		out.preserve_ts = 1
+	}
+	if swFilters != "" {
+		out.sw_vfilters = C.CString(swFilters)
+		frees = append(frees, func() { C.free(unsafe.Pointer(out.sw_vfilters)) })
+	}
+	if p.PixelFormat != "" {
+		out.pix_fmt = C.CString(p.PixelFormat)
+		frees = append(frees, func() { C.free(unsafe.Pointer(out.pix_fmt)) })
+	}
+	if n := len(p.Keyframes.Times); n > 0 {
+		kfTimes := append([]time.Duration{}, p.Keyframes.Times...)
+		sort.Slice(kfTimes, func(a, b int) bool { return kfTimes[a] < kfTimes[b] })
+		// Needs to be C memory since it is referenced from output_params
+		out.kf_times = (*C.double)(C.calloc(C.size_t(n), C.sizeof_double))
+		frees = append(frees, func() { C.free(unsafe.Pointer(out.kf_times)) })
+		times := (*[1 << 20]C.double)(unsafe.Pointer(out.kf_times))[:n:n]
+		for j, t := range kfTimes {
+			times[j] = C.double(t.Seconds())
+		}
+		out.nb_kf_times = C.int(n)
+	}
+	if p.Keyframes.Expr != "" {
+		out.kf_expr = C.CString(p.Keyframes.Expr)
+		frees = append(frees, func() { C.free(unsafe.Pointer(out.kf_expr)) })
+	}
+	if l := p.Loudness; l != nil {
+		out.loudness = C.loudness_params{target: -23, true_peak: -1}
+		if l.Target != 0 {
+			out.loudness.target = C.double(l.Target)
+		}
+		if l.TruePeak != 0 {
+			out.loudness.true_peak = C.double(l.TruePeak)
+		}
+		if l.TwoPass {
+			out.loudness.two_pass = 1
+		}
+	}
+	return out, free, nil
+}
+
+// Work around the ownership rules:
+// ffmpeg normally takes ownership of the following AVDictionary options
+// However, if we don't pass these opts to ffmpeg, then we need to free
+func freeOutputOpts(param *C.output_params) {
+	if param.muxer.opts != nil {
+		C.av_dict_free(&param.muxer.opts)
+	}
+	if param.audio.opts != nil {
+		C.av_dict_free(&param.audio.opts)
+	}
+	if param.video.opts != nil {
+		C.av_dict_free(&param.video.opts)
+	}
+}
+
 func Transcode2(input *TranscodeOptionsIn, ps []TranscodeOptions) error {
 	_, err := Transcode3(input, ps)
 	return err
@@ -175,6 +1043,10 @@ func Transcode3(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeRes
 	return t.Transcode(input, ps)
 }
 
+// Transcode processes the next segment of the session. The outputs may change
+// between calls: renditions whose settings are unchanged keep their encoders
+// and filters from earlier segments, new or changed renditions are set up as
+// needed, and removed renditions are freed.
 func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -188,6 +1060,15 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkCapabilities(input, ps); err != nil {
+		glog.Error("Transcoder capability check : ", err)
+		return nil, err
+	}
+	for _, p := range ps {
+		if p.Signature && (!isRegularFile(input.Fname) || !isRegularFile(p.Oname)) {
+			return nil, ErrTranscoderSig
+		}
+	}
 	fname := C.CString(input.Fname)
 	defer C.free(unsafe.Pointer(fname))
 	if !t.started {
@@ -200,159 +1081,89 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 			return nil, ErrTranscoderVid
 		}
 	}
+	// The default audio track is always first; other tracks are decoded
+	// as needed by the outputs that map them
+	audioSels := []AudioSelector{input.Audio}
 	params := make([]C.output_params, len(ps))
+	vmafLogs := make([]string, len(ps))
 	for i, p := range ps {
-		oname := C.CString(p.Oname)
-		defer C.free(unsafe.Pointer(oname))
-
-		param := p.Profile
-		w, h, err := VideoProfileResolution(param)
-		if err != nil {
-			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
-			}
-		}
-		br := strings.Replace(param.Bitrate, "k", "000", 1)
-		bitrate, err := strconv.Atoi(br)
+		param, free, err := newOutputParams(input, p, &audioSels)
 		if err != nil {
-			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
-			}
+			return nil, err
 		}
-		encoder, scale_filter := p.VideoEncoder.Name, "scale"
-		if encoder == "" {
-			encoder, scale_filter, err = configAccel(input.Accel, p.Accel, input.Device, p.Device)
+		defer free()
+		params[i] = param
+		defer freeOutputOpts(&params[i])
+		if p.Quality != nil && encodesVideo(p) {
+			quality, logName, freeQuality, err := newQualityParams(*p.Quality)
 			if err != nil {
 				return nil, err
 			}
+			defer freeQuality()
+			params[i].quality = quality
+			vmafLogs[i] = logName
 		}
-		// preserve aspect ratio along the larger dimension when rescaling
-		var filters string
-		filters = fmt.Sprintf("%s='w=if(gte(iw,ih),%d,-2):h=if(lt(iw,ih),%d,-2)'", scale_filter, w, h)
-		if input.Accel != Software && p.Accel == Software {
-			// needed for hw dec -> hw rescale -> sw enc
-			filters = filters + ",hwdownload,format=nv12"
-		}
-		// set FPS denominator to 1 if unset by user
-		if param.FramerateDen == 0 {
-			param.FramerateDen = 1
-		}
-		// Add fps filter *after* scale filter because otherwise we could
-		// be scaling duplicate frames unnecessarily. This becomes a DoS vector
-		// when a user submits two frames that are "far apart" in pts and
-		// the fps filter duplicates frames to fill out the difference to maintain
-		// a consistent frame rate.
-		// Once we allow for alternating segments, this issue should be mitigated
-		// and the fps filter can come *before* the scale filter to minimize work
-		// when going from high fps to low fps (much more common when transcoding
-		// than going from low fps to high fps)
-		var fps C.AVRational
-		if param.Framerate > 0 {
-			filters += fmt.Sprintf(",fps=%d/%d", param.Framerate, param.FramerateDen)
-			fps = C.AVRational{num: C.int(param.Framerate), den: C.int(param.FramerateDen)}
-		}
-		var muxOpts C.component_opts
-		var muxName string
-		switch p.Profile.Format {
-		case FormatNone:
-			muxOpts = C.component_opts{
-				// don't free this bc of avformat_write_header API
-				opts: newAVOpts(p.Muxer.Opts),
-			}
-			muxName = p.Muxer.Name
-		case FormatMPEGTS:
-			muxName = "mpegts"
-		case FormatMP4:
-			muxName = "mp4"
-			muxOpts = C.component_opts{
-				opts: newAVOpts(map[string]string{"movflags": "faststart"}),
-			}
-		default:
-			return nil, ErrTranscoderFmt
-		}
-		if muxName != "" {
-			muxOpts.name = C.CString(muxName)
-			defer C.free(unsafe.Pointer(muxOpts.name))
-		}
-		// Set video encoder options
-		if len(p.VideoEncoder.Name) <= 0 && len(p.VideoEncoder.Opts) <= 0 {
-			p.VideoEncoder.Opts = map[string]string{
-				"forced-idr": "1",
-			}
-			switch p.Profile.Profile {
-			case ProfileH264Baseline, ProfileH264Main, ProfileH264High:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-			case ProfileH264ConstrainedHigh:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-				p.VideoEncoder.Opts["bf"] = "0"
-			case ProfileNone:
-				// Do nothing, the encoder will use default profile
-			default:
-				return nil, ErrTranscoderPrf
-			}
-		}
-		gopMs := 0
-		if param.GOP != 0 {
-			if param.GOP <= GOPInvalid {
-				return nil, ErrTranscoderGOP
-			}
-			// Check for intra-only
-			if param.GOP == GOPIntraOnly {
-				p.VideoEncoder.Opts["g"] = "0"
-			} else {
-				if param.Framerate > 0 {
-					gop := param.GOP.Seconds()
-					interval := strconv.Itoa(int(gop * float64(param.Framerate)))
-					p.VideoEncoder.Opts["g"] = interval
-				} else {
-					gopMs = int(param.GOP.Milliseconds())
-				}
-			}
+	}
+	if len(audioSels) > C.MAX_AUDIO_TRACKS {
+		return nil, ErrTranscoderAud
+	}
+	audioTracks := (*C.track_selector)(C.calloc(C.size_t(len(audioSels)), C.sizeof_track_selector))
+	defer C.free(unsafe.Pointer(audioTracks))
+	tracks := (*[C.MAX_AUDIO_TRACKS]C.track_selector)(unsafe.Pointer(audioTracks))[:len(audioSels):len(audioSels)]
+	for i, sel := range audioSels {
+		tracks[i].track = C.int(sel.Track)
+		if sel.Language != "" {
+			tracks[i].language = C.CString(sel.Language)
+			defer C.free(unsafe.Pointer(tracks[i].language))
 		}
-		vidOpts := C.component_opts{
-			name: C.CString(encoder),
-			opts: newAVOpts(p.VideoEncoder.Opts),
-		}
-		audioEncoder := p.AudioEncoder.Name
-		if audioEncoder == "" {
-			audioEncoder = "aac"
-		}
-		audioOpts := C.component_opts{
-			name: C.CString(audioEncoder),
-			opts: newAVOpts(p.AudioEncoder.Opts),
-		}
-		vfilt := C.CString(filters)
-		defer C.free(unsafe.Pointer(vidOpts.name))
-		defer C.free(unsafe.Pointer(audioOpts.name))
-		defer C.free(unsafe.Pointer(vfilt))
-		params[i] = C.output_params{fname: oname, fps: fps,
-			w: C.int(w), h: C.int(h), bitrate: C.int(bitrate),
-			gop_time: C.int(gopMs),
-			muxer:    muxOpts, audio: audioOpts, video: vidOpts, vfilters: vfilt}
-		defer func(param *C.output_params) {
-			// Work around the ownership rules:
-			// ffmpeg normally takes ownership of the following AVDictionary options
-			// However, if we don't pass these opts to ffmpeg, then we need to free
-			if param.muxer.opts != nil {
-				C.av_dict_free(&param.muxer.opts)
-			}
-			if param.audio.opts != nil {
-				C.av_dict_free(&param.audio.opts)
-			}
-			if param.video.opts != nil {
-				C.av_dict_free(&param.video.opts)
-			}
-		}(&params[i])
 	}
 	var device *C.char
 	if input.Device != "" {
 		device = C.CString(input.Device)
 		defer C.free(unsafe.Pointer(device))
 	}
+	metadata, freeMetadata := newTimedMetadata(input.Metadata)
+	defer freeMetadata()
 	inp := &C.input_params{fname: fname, hw_type: hw_type, device: device,
-		handle: t.handle}
+		handle:       t.handle,
+		demuxer:      newComponentOpts(input.Demuxer),
+		video:        newComponentOpts(input.VideoDecoder),
+		audio:        newComponentOpts(input.AudioDecoder),
+		audio_tracks: audioTracks, nb_audio_tracks: C.int(len(audioSels)),
+		limits: C.input_limits{
+			duration:     C.double(input.Limits.Duration.Seconds()),
+			width:        C.int(input.Limits.Width),
+			height:       C.int(input.Limits.Height),
+			frames:       C.int(input.Limits.Frames),
+			pts_gap:      C.double(input.Limits.PTSGap.Seconds()),
+			output_ratio: C.int(input.Limits.OutputFramesPerFrame),
+		},
+		analysis: C.analysis_params{
+			scene_threshold:  C.double(input.Analysis.SceneThreshold),
+			black_duration:   C.double(input.Analysis.BlackDuration.Seconds()),
+			black_ratio:      C.double(input.Analysis.BlackRatio),
+			silence_duration: C.double(input.Analysis.SilenceDuration.Seconds()),
+			silence_noise:    C.double(input.Analysis.SilenceNoise),
+		},
+		metadata: metadata, nb_metadata: C.int(len(input.Metadata))}
+	if e := input.ErrorTolerance; e != nil {
+		inp.errors = C.error_tolerance{enabled: 1,
+			max_errors: C.int(e.MaxErrors), max_ratio: C.double(e.MaxRatio)}
+	}
+	defer func() {
+		// ffmpeg replaces the input dictionaries with any unused options,
+		// so free whatever is left over after transcoding
+		freeComponentOpts(&inp.demuxer)
+		freeComponentOpts(&inp.video)
+		freeComponentOpts(&inp.audio)
+	}()
 	results := make([]C.output_results, len(ps))
-	decoded := &C.output_results{}
+	defer func() {
+		for i := range results {
+			C.lpms_quality_free(&results[i].quality)
+		}
+	}()
+	decoded := &C.input_results{}
 	var (
 		paramsPointer  *C.output_params
 		resultsPointer *C.output_results
@@ -367,17 +1178,180 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 		return nil, ErrorMap[ret]
 	}
 	tr := make([]MediaInfo, len(ps))
-	for i, r := range results {
-		tr[i] = MediaInfo{
-			Frames: int(r.frames),
-			Pixels: int64(r.pixels),
+	for i := range results {
+		tr[i] = newMediaInfo(&results[i])
+		if ps[i].Source {
+			tr[i].SourceProfile = sourceProfile(decoded)
+		}
+		if params[i].quality != nil {
+			q, err := newQualityResults(&results[i].quality, params[i].quality, vmafLogs[i])
+			if err != nil {
+				return nil, err
+			}
+			tr[i].Quality = q
+		}
+		if ps[i].Signature {
+			sig, err := ComputeSignature(ps[i].Oname, 0)
+			if err != nil {
+				return nil, err
+			}
+			tr[i].Signature = sig
 		}
 	}
 	dec := MediaInfo{
-		Frames: int(decoded.frames),
-		Pixels: int64(decoded.pixels),
+		Frames:    int(decoded.frames),
+		Pixels:    int64(decoded.pixels),
+		StartTime: seconds(decoded.start_time),
+		Duration:  seconds(decoded.duration),
+		Stages:    newStageTimes(&decoded.usage.stages),
+	}
+	for _, p := range ps {
+		if p.Signature {
+			sig, err := ComputeSignature(input.Fname, 0)
+			if err != nil {
+				return nil, err
+			}
+			dec.Signature = sig
+			break
+		}
+	}
+	audioInfo := make([]AudioTrackInfo, int(decoded.nb_audio_tracks))
+	for i := range audioInfo {
+		info := &decoded.audio_tracks[i]
+		audioInfo[i] = AudioTrackInfo{
+			Track:      int(info.track),
+			Index:      int(info.index),
+			Language:   C.GoString(&info.language[0]),
+			Codec:      C.GoString(&info.codec[0]),
+			Channels:   int(info.channels),
+			SampleRate: int(info.sample_rate),
+		}
+	}
+	return &TranscodeResults{Encoded: tr, Decoded: dec, AudioTracks: audioInfo,
+		KeyframesAligned: keyframesAligned(tr),
+		Analysis:         newAnalysisResults(input.Analysis, decoded),
+		DecodeErrors:     newDecodeErrors(&decoded.errors),
+		Usage:            newResourceUsage(&decoded.usage, dec, tr)}, nil
+}
+
+func microseconds(t C.int64_t) time.Duration {
+	return time.Duration(t) * time.Microsecond
+}
+
+func newStageTimes(s *C.stage_times) StageTimes {
+	return StageTimes{
+		Demux:  microseconds(s.demux),
+		Decode: microseconds(s.decode),
+		Filter: microseconds(s.filter),
+		Encode: microseconds(s.encode),
+		Mux:    microseconds(s.mux),
+	}
+}
+
+func newResourceUsage(u *C.resource_usage, dec MediaInfo, enc []MediaInfo) ResourceUsage {
+	stages := dec.Stages
+	for _, e := range enc {
+		stages.Filter += e.Stages.Filter
+		stages.Encode += e.Stages.Encode
+		stages.Mux += e.Stages.Mux
+	}
+	return ResourceUsage{
+		WallTime:          microseconds(u.wall_time),
+		PipelineCPUTime:   microseconds(u.pipeline_cpu_time),
+		PeakFrameMemory:   int64(u.peak_frame_memory),
+		ProcessCPUTime:    microseconds(u.process_cpu_time),
+		ProcessPeakMemory: int64(u.process_peak_memory),
+		Stages:            stages,
+	}
+}
+
+func newDecodeErrors(s *C.decode_stats) DecodeErrors {
+	return DecodeErrors{
+		Packets:           int(s.packets),
+		Skipped:           int(s.skipped),
+		Corrupted:         int(s.corrupted),
+		DemuxerCorrupt:    int(s.types[C.DECODE_ERR_DEMUXER]),
+		InvalidData:       int(s.types[C.DECODE_ERR_INVALID_DATA]),
+		DecoderFailed:     int(s.types[C.DECODE_ERR_DECODER]),
+		InvalidBitstream:  int(s.types[C.DECODE_ERR_INVALID_BITSTREAM]),
+		MissingReferences: int(s.types[C.DECODE_ERR_MISSING_REFERENCE]),
+	}
+}
+
+func newAnalysisResults(opts AnalysisOptions, r *C.input_results) *AnalysisResults {
+	if opts.SceneThreshold <= 0 && opts.BlackDuration <= 0 && opts.SilenceDuration <= 0 {
+		return nil
+	}
+	intervals := func(list []C.time_interval) []Interval {
+		var res []Interval
+		for _, i := range list {
+			res = append(res, Interval{Start: seconds(i.start), End: seconds(i.end)})
+		}
+		return res
+	}
+	res := &AnalysisResults{
+		Black:   intervals(r.black[:int(r.nb_black)]),
+		Silence: intervals(r.silence[:int(r.nb_silence)]),
+	}
+	for _, t := range r.scenes[:int(r.nb_scenes)] {
+		res.SceneChanges = append(res.SceneChanges, seconds(t))
+	}
+	return res
+}
+
+func newMediaInfo(r *C.output_results) MediaInfo {
+	info := MediaInfo{
+		Frames:          int(r.frames),
+		Pixels:          int64(r.pixels),
+		StartTime:       seconds(r.start_time),
+		Duration:        seconds(r.duration),
+		Stages:          newStageTimes(&r.stages),
+		PipelineCPUTime: microseconds(r.pipeline_cpu_time),
+	}
+	nbKeyframes := int(r.nb_keyframes)
+	if nbKeyframes > C.MAX_KEYFRAMES {
+		nbKeyframes = C.MAX_KEYFRAMES
+	}
+	for _, t := range r.keyframes[:nbKeyframes] {
+		info.Keyframes = append(info.Keyframes, seconds(t))
+	}
+	if r.loudness_measured != 0 {
+		info.Loudness = &LoudnessResults{
+			Integrated: float64(r.loudness),
+			TruePeak:   float64(r.true_peak),
+			Gain:       float64(r.gain),
+		}
+	}
+	return info
+}
+
+func seconds(t C.double) time.Duration {
+	return time.Duration(float64(t) * float64(time.Second))
+}
+
+// Checks whether all outputs with keyframes have them at the same timestamps.
+// Timestamps are compared to the millisecond, to allow for rounding between
+// the time bases of different frame rates.
+func keyframesAligned(infos []MediaInfo) bool {
+	var ref []time.Duration
+	for _, info := range infos {
+		if len(info.Keyframes) == 0 {
+			continue // no encoded video
+		}
+		if ref == nil {
+			ref = info.Keyframes
+			continue
+		}
+		if len(info.Keyframes) != len(ref) {
+			return false
+		}
+		for i, t := range info.Keyframes {
+			if d := t - ref[i]; d >= time.Millisecond || d <= -time.Millisecond {
+				return false
+			}
+		}
 	}
-	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
+	return true
 }
 
 func NewTranscoder() *Transcoder {
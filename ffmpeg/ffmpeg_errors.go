@@ -19,6 +19,8 @@ var lpmsErrors = []struct {
 	{Code: C.lpms_ERR_OUTPUTS, Desc: "Too many outputs"},
 	{Code: C.lpms_ERR_INPUT_CODEC, Desc: "Unsupported input codec"},
 	{Code: C.lpms_ERR_INPUT_NOKF, Desc: "No keyframes in input"},
+	{Code: C.lpms_ERR_INPUT_LIMIT, Desc: "Input exceeds limits"},
+	{Code: C.lpms_ERR_INPUT_CORRUPT, Desc: "Too many errors in input"},
 }
 
 func error_map() map[int]error {
@@ -49,6 +51,12 @@ func error_map() map[int]error {
 
 var ErrorMap = error_map()
 
+// Returned when the input exceeds TranscodeOptionsIn.Limits
+var ErrTranscoderLimit = ErrorMap[int(C.lpms_ERR_INPUT_LIMIT)]
+
+// Returned when decoding errors exceed TranscodeOptionsIn.ErrorTolerance
+var ErrTranscoderCorrupt = ErrorMap[int(C.lpms_ERR_INPUT_CORRUPT)]
+
 func non_retryable_errs() []string {
 	errs := []string{}
 	// Add in Cgo LPMS specific errors
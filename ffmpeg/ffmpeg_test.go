@@ -2,14 +2,17 @@ package ffmpeg
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 )
 
-func setupTest(t *testing.T) (func(cmd string), string) {
+func setupTest(t testing.TB) (func(cmd string), string) {
 	dir, err := ioutil.TempDir("", t.Name())
 	if err != nil {
 		t.Fatal(err)
@@ -61,6 +64,23 @@ func TestSegmenter_DeleteSegments(t *testing.T) {
 		[ $(ls out_*.ts | wc -l) -eq 6 ]
 	`
 	run(cmd)
+
+	// shorter playlists keep fewer segments
+	err = RTMPToHLS2(dir+"/long.ts", dir+"/short.m3u8", dir+"/short_%d.ts", "1", 0, HLSOptions{ListSize: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	cmd = `
+		[ $(ls short_*.ts | wc -l) -eq 3 ]
+		[ $(grep -c EXTINF short.m3u8) -eq 2 ]
+	`
+	run(cmd)
+
+	// invalid segment durations fail
+	err = RTMPToHLS(dir+"/long.ts", dir+"/none.m3u8", dir+"/none_%d.ts", "0", 0)
+	if err == nil || err.Error() != "Invalid argument" {
+		t.Error("Expected duration error, got ", err)
+	}
 }
 
 func TestSegmenter_StreamOrdering(t *testing.T) {
@@ -148,6 +168,89 @@ func TestSegmenter_DropLatePackets(t *testing.T) {
 	run(cmd)
 }
 
+func TestSegmenter_CuePoints(t *testing.T) {
+	// Ensure RTMP onCuePoint messages cut segments and mark the break
+
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# keyframes every second, without b-frames so pts == dts
+		ffmpeg -loglevel warning -f lavfi -i testsrc=size=320x240:rate=30 -f lavfi -i sine -t 10 -c:v libx264 -bf 0 -g 30 -keyint_min 30 -sc_threshold 0 -c:a aac test.flv
+	`
+	run(cmd)
+
+	amfString := func(s string) []byte {
+		return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+	}
+	amfNumber := func(f float64) []byte {
+		b := make([]byte, 9)
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+		return b
+	}
+	body := append([]byte{2}, amfString("onCuePoint")...)
+	body = append(body, 3)
+	body = append(append(body, amfString("name")...), 2)
+	body = append(body, amfString("cue-out")...)
+	body = append(append(body, amfString("type")...), 2)
+	body = append(body, amfString("event")...)
+	body = append(append(body, amfString("parameters")...), 3)
+	body = append(append(body, amfString("duration")...), amfNumber(4)...)
+	body = append(body, 0, 0, 9, 0, 0, 9) // end of parameters, end of message
+
+	// Insert the script tag in front of the first video tag from 3s
+	flv, err := ioutil.ReadFile(dir + "/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := 9 + 4 // header and the first previous tag size
+	for pos+11 < len(flv) {
+		size := int(flv[pos+1])<<16 | int(flv[pos+2])<<8 | int(flv[pos+3])
+		ts := int(flv[pos+7])<<24 | int(flv[pos+4])<<16 | int(flv[pos+5])<<8 | int(flv[pos+6])
+		if flv[pos] == 9 && ts >= 3000 {
+			n := len(body)
+			tag := []byte{18, byte(n >> 16), byte(n >> 8), byte(n),
+				byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24), 0, 0, 0}
+			tag = append(tag, body...)
+			tag = append(tag, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(tag[len(tag)-4:], uint32(11+n))
+			flv = append(flv[:pos], append(tag, flv[pos:]...)...)
+			break
+		}
+		pos += 11 + size + 4
+	}
+	if err := ioutil.WriteFile(dir+"/cue.flv", flv, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = RTMPToHLS(dir+"/cue.flv", dir+"/out.m3u8", dir+"/out_%d.ts", "100", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := ioutil.ReadFile(dir + "/out.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut at the cue, and again at the end of the break
+	expected := `#EXTINF:3.000000,
+out_0.ts
+#EXT-X-CUE-OUT:4
+#EXTINF:4.000000,
+out_1.ts
+#EXT-X-CUE-IN
+#EXTINF:`
+	if !strings.Contains(string(pl), expected) {
+		t.Errorf("Unexpected playlist %s", pl)
+	}
+	if !strings.HasSuffix(string(pl), "out_2.ts\n#EXT-X-ENDLIST\n") {
+		t.Errorf("Unexpected end of playlist %s", pl)
+	}
+	// The configured segment duration, even though the segments are shorter
+	if !strings.Contains(string(pl), "#EXT-X-TARGETDURATION:100\n") {
+		t.Errorf("Unexpected target duration %s", pl)
+	}
+}
+
 func TestTranscoder_UnevenRes(t *testing.T) {
 	// Ensure transcoding still works on input with uneven resolutions
 	// and that aspect ratio is maintained
@@ -1,10 +1,77 @@
 #include "filter.h"
+#include "loudness.h"
 #include "logging.h"
 
 #include <libavfilter/buffersrc.h>
 #include <libavfilter/buffersink.h>
 
+#include <libavutil/bprint.h>
 #include <libavutil/opt.h>
+#include <libavutil/pixdesc.h>
+#include <math.h>
+
+// Selects the pixel format of software frames out of the filtergraph. Inputs
+// in other formats, eg 10-bit or 4:2:2, are converted to it.
+static int output_pix_fmt(struct output_ctx *octx, enum AVPixelFormat in_pix_fmt,
+  enum AVPixelFormat *out)
+{
+  const AVCodec *codec = avcodec_find_encoder_by_name(octx->video->name);
+  const enum AVPixelFormat *p = NULL;
+  int ret = 0;
+
+  *out = AV_PIX_FMT_YUV420P;
+  if (octx->pix_fmt) {
+    *out = av_get_pix_fmt(octx->pix_fmt);
+    if (AV_PIX_FMT_NONE == *out) {
+      ret = AVERROR(EINVAL);
+      LPMS_ERR(pix_fmt_err, "Unknown output pixel format");
+    }
+  }
+  if (!codec || !codec->pix_fmts) return 0;
+  for (p = codec->pix_fmts; *p != AV_PIX_FMT_NONE; p++) {
+    if (*p == *out) return 0;
+  }
+  if (octx->pix_fmt) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(pix_fmt_err, "Output pixel format not supported by the encoder");
+  }
+  *out = avcodec_find_best_pix_fmt_of_list(codec->pix_fmts, in_pix_fmt, 0, NULL);
+
+pix_fmt_err:
+  return ret;
+}
+
+// Describes the video filters of an output that is compared against its
+// input. The input is split ahead of the output's filters, then converted to
+// the output frame rate and sampled, so each sampled frame has the timestamp
+// of an encoded frame. Frames decoded on the GPU are only downloaded once
+// sampled.
+static char *quality_filters(struct input_ctx *ictx, struct output_ctx *octx,
+  const char *filters_descr)
+{
+  AVBPrint bp;
+  char *descr = NULL;
+  int n = 0;
+  quality_params *params = octx->quality.params;
+
+  av_bprint_init(&bp, 0, AV_BPRINT_SIZE_UNLIMITED);
+  av_bprintf(&bp, "[in]split[enc][ref_in];[enc]%s[out];[ref_in]", filters_descr);
+  if (octx->fps.den) {
+    av_bprintf(&bp, "fps=%d/%d", octx->fps.num, octx->fps.den);
+    n++;
+  }
+  if (params->sample_interval > 0) {
+    av_bprintf(&bp, "%sselect='isnan(prev_selected_t)+gte(t-prev_selected_t\\,%f)'",
+      n++ ? "," : "", params->sample_interval);
+  }
+  if (ictx->vc->hw_device_ctx) {
+    av_bprintf(&bp, "%shwdownload,format=nv12|p010le|p016le|yuv444p|yuv444p16le",
+      n++ ? "," : "");
+  }
+  av_bprintf(&bp, "%s[ref]", n ? "" : "null");
+  av_bprint_finalize(&bp, &descr);
+  return descr;
+}
 
 int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
 {
@@ -15,9 +82,10 @@ int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
     AVFilterInOut *outputs = NULL;
     AVFilterInOut *inputs  = NULL;
     AVRational time_base = ictx->ic->streams[ictx->vi]->time_base;
-    enum AVPixelFormat pix_fmts[] = { AV_PIX_FMT_YUV420P, AV_PIX_FMT_CUDA, AV_PIX_FMT_NONE }; // XXX ensure the encoder allows this
+    enum AVPixelFormat pix_fmts[] = { AV_PIX_FMT_YUV420P, AV_PIX_FMT_CUDA, AV_PIX_FMT_NONE };
     struct filter_ctx *vf = &octx->vf;
     char *filters_descr = octx->vfilters;
+    char *upload_descr = NULL, *quality_descr = NULL;
     enum AVPixelFormat in_pix_fmt = ictx->vc->pix_fmt;
 
     // no need for filters with the following conditions
@@ -28,11 +96,37 @@ int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
     inputs = avfilter_inout_alloc();
     vf->graph = avfilter_graph_alloc();
     vf->pts_diff = INT64_MIN;
+    vf->seg_offset = AV_NOPTS_VALUE;
     if (!outputs || !inputs || !vf->graph) {
       ret = AVERROR(ENOMEM);
       LPMS_ERR(vf_init_cleanup, "Unable to allocate filters");
     }
     if (ictx->vc->hw_device_ctx) in_pix_fmt = hw2pixfmt(ictx->vc);
+    ret = output_pix_fmt(octx, ictx->vc->hw_device_ctx ? ictx->vc->sw_pix_fmt : in_pix_fmt, &pix_fmts[0]);
+    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to select output pixel format");
+    if (ictx->sw_decode && octx->sw_vfilters) {
+      // Decoded in software as the GPU can't decode the input pixel format,
+      // and nothing else of this output needs the GPU either
+      filters_descr = octx->sw_vfilters;
+    } else if (ictx->sw_decode) {
+      // Decoded in software as the GPU can't decode the input pixel format;
+      // convert and upload the frames for filters that expect them on the GPU
+      upload_descr = av_asprintf("format=%s,hwupload,%s",
+        av_get_pix_fmt_name(pix_fmts[0]), filters_descr);
+      if (!upload_descr) {
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(vf_init_cleanup, "Unable to allocate video filters desc");
+      }
+      filters_descr = upload_descr;
+    }
+    if (octx->quality.params) {
+      quality_descr = quality_filters(ictx, octx, filters_descr);
+      if (!quality_descr) {
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(vf_init_cleanup, "Unable to allocate video filters desc");
+      }
+      filters_descr = quality_descr;
+    }
 
     /* buffer video source: the decoded frames from the decoder will be inserted here. */
     snprintf(args, sizeof args,
@@ -89,10 +183,38 @@ int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
     inputs->pad_idx    = 0;
     inputs->next       = NULL;
 
+    if (quality_descr) {
+      // sink for the sampled input frames; see quality_filters
+      AVFilterInOut *ref = avfilter_inout_alloc();
+      if (!ref) {
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(vf_init_cleanup, "Unable to allocate filters");
+      }
+      inputs->next = ref;
+      ret = avfilter_graph_create_filter(&vf->ref_ctx, buffersink,
+                                         "ref", NULL, NULL, vf->graph);
+      if (ret < 0) LPMS_ERR(vf_init_cleanup, "Cannot create comparison buffer sink");
+      ref->name       = av_strdup("ref");
+      ref->filter_ctx = vf->ref_ctx;
+      ref->pad_idx    = 0;
+      ref->next       = NULL;
+    }
+
     ret = avfilter_graph_parse_ptr(vf->graph, filters_descr,
                                     &inputs, &outputs, NULL);
     if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to parse video filters desc");
 
+    if (upload_descr) {
+      for (int i = 0; i < vf->graph->nb_filters; i++) {
+        AVFilterContext *f = vf->graph->filters[i];
+        f->hw_device_ctx = av_buffer_ref(ictx->hw_device_ctx);
+        if (!f->hw_device_ctx) {
+          ret = AVERROR(ENOMEM);
+          LPMS_ERR(vf_init_cleanup, "Unable to set filter hardware device");
+        }
+      }
+    }
+
     ret = avfilter_graph_config(vf->graph, NULL);
     if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable configure video filtergraph");
 
@@ -104,26 +226,29 @@ int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
 vf_init_cleanup:
     avfilter_inout_free(&inputs);
     avfilter_inout_free(&outputs);
+    av_free(upload_descr);
+    av_free(quality_descr);
 
     return ret;
 }
 
 
-int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
+int init_audio_filters(struct input_ctx *ictx, struct output_audio *oa)
 {
   int ret = 0;
   char args[512];
-  char filters_descr[256];
+  char filters_descr[512] = "";
   const AVFilter *buffersrc  = avfilter_get_by_name("abuffer");
   const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
   AVFilterInOut *outputs = NULL;
   AVFilterInOut *inputs  = NULL;
-  struct filter_ctx *af = &octx->af;
-  AVRational time_base = ictx->ic->streams[ictx->ai]->time_base;
+  struct filter_ctx *af = &oa->af;
+  struct input_audio *ia = &ictx->audio[oa->track];
+  AVRational time_base = ictx->ic->streams[ia->index]->time_base;
 
   // no need for filters with the following conditions
   if (af->active) goto af_init_cleanup; // already initialized
-  if (!needs_decoder(octx->audio->name)) goto af_init_cleanup;
+  if (!needs_decoder(oa->opts->name)) goto af_init_cleanup;
 
   outputs = avfilter_inout_alloc();
   inputs = avfilter_inout_alloc();
@@ -138,13 +263,23 @@ int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
   snprintf(args, sizeof args,
       "sample_rate=%d:sample_fmt=%d:channel_layout=0x%"PRIx64":channels=%d:"
       "time_base=%d/%d",
-      ictx->ac->sample_rate, ictx->ac->sample_fmt, ictx->ac->channel_layout,
-      ictx->ac->channels, time_base.num, time_base.den);
+      ia->ac->sample_rate, ia->ac->sample_fmt, ia->ac->channel_layout,
+      ia->ac->channels, time_base.num, time_base.den);
+
+  if (oa->loudness && oa->loudness->target) {
+    // Start from the measured gain in the two-pass mode; see loudness.c
+    struct loudness_stats stats = { ia->loudness, ia->true_peak };
+    oa->gain = oa->loudness->two_pass && ia->measured ?
+      loudness_gain(oa->loudness, &stats) : 0;
+    av_strlcatf(filters_descr, sizeof filters_descr,
+      "ebur128=peak=true:metadata=1,volume=volume=%fdB,", oa->gain);
+  }
 
   // TODO set sample format and rate based on encoder support,
   //      rather than hardcoding
-  snprintf(filters_descr, sizeof filters_descr,
-    "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100");
+  av_strlcat(filters_descr,
+    "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100",
+    sizeof filters_descr);
 
   ret = avfilter_graph_create_filter(&af->src_ctx, buffersrc,
                                      "in", args, NULL, af->graph);
@@ -201,6 +336,17 @@ af_init_cleanup:
   return ret;
 }
 
+static AVFrame *flush_frame(struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video)
+{
+  // Returns the last input frame seen by this filter's input stream
+  if (is_video) return ictx->last_frame_v;
+  for (int i = 0; i < octx->nb_audio; i++) {
+    struct output_audio *oa = &octx->audio[i];
+    if (&oa->af == filter) return ictx->audio[oa->track].last_frame;
+  }
+  return NULL;
+}
+
 int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video)
 {
   int ret = 0;
@@ -218,15 +364,21 @@ int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *o
   AVStream *vst = ictx->ic->streams[ictx->vi];
   if (inf) { // Non-Flush Frame
     inf->opaque = (void *) inf->pts; // Store original PTS for calc later
-    if (is_video && octx->fps.den) {
+    if (is_video && octx->fps.den && octx->preserve_ts) {
+      // Continue from the previous segment, then follow the input spacing
+      int64_t next = filter->custom_pts + av_rescale_q(1, av_inv_q(vst->r_frame_rate), vst->time_base);
+      if (AV_NOPTS_VALUE == filter->seg_offset) filter->seg_offset = next - inf->pts;
+      filter->custom_pts = FFMAX(inf->pts + filter->seg_offset, filter->custom_pts + 1);
+    } else if (is_video && octx->fps.den) {
       // Custom PTS set when FPS filter is used
       filter->custom_pts += av_rescale_q(1, av_inv_q(vst->r_frame_rate), vst->time_base);
     } else {
       filter->custom_pts = inf->pts;
     }
   } else if (!filter->flushed) { // Flush Frame
-    int ts_step;
-    inf = (is_video) ? ictx->last_frame_v : ictx->last_frame_a;
+    int ts_step, first_flush = !filter->flushing;
+    inf = flush_frame(ictx, octx, filter, is_video);
+    if (!inf) LPMS_ERR(fg_write_cleanup, "No frame available to flush the filtergraph");
     inf->opaque = (void *) (INT64_MIN); // Store INT64_MIN as pts for flush frames
     filter->flushing = 1;
     if (is_video) {
@@ -236,8 +388,10 @@ int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *o
         ts_step = av_rescale_q(ts_step, vst->r_frame_rate, octx->fps);
       }
     }
-    if (!is_video || !octx->fps.den) {
+    if (!is_video || !octx->fps.den || (octx->preserve_ts && first_flush)) {
       // FPS Passthrough or Audio case - use packet duration instead of custom duration
+      // When preserving timestamps, the first flush frame marks the end of
+      // the last input frame, so the fps filter covers exactly that long
       ts_step = inf->pkt_duration;
     }
     filter->custom_pts += ts_step;
@@ -255,6 +409,46 @@ fg_write_cleanup:
   return ret;
 }
 
+static int update_loudness(struct input_ctx *ictx, struct output_ctx *octx,
+  struct filter_ctx *filter, AVFrame *frame)
+{
+  int ret = 0;
+  char arg[32];
+  struct loudness_stats stats;
+  struct output_audio *oa = NULL;
+  struct input_audio *ia = NULL;
+  double gain = 0;
+
+  for (int i = 0; i < octx->nb_audio; i++) {
+    if (&octx->audio[i].af == filter) oa = &octx->audio[i];
+  }
+  if (!oa || !oa->loudness || !oa->loudness->target) return 0;
+  if (!read_loudness(frame, &stats)) return 0;
+  ia = &ictx->audio[oa->track];
+  if (oa->loudness->two_pass && ia->measured) {
+    // measured ahead of the segment, so the gain stays fixed throughout
+    stats.loudness = ia->loudness;
+    stats.true_peak = ia->true_peak;
+  }
+  gain = loudness_gain(oa->loudness, &stats);
+  if (fabs(gain - oa->gain) >= 0.1) {
+    // applies from the next frame on
+    snprintf(arg, sizeof arg, "%fdB", gain);
+    ret = avfilter_graph_send_command(filter->graph, "volume", "volume", arg, NULL, 0, 0);
+    if (ret < 0) LPMS_ERR(update_loudness_err, "Unable to update loudness gain");
+    oa->gain = gain;
+  }
+  if (oa == &octx->audio[0] && octx->res) {
+    octx->res->loudness_measured = 1;
+    octx->res->loudness = stats.loudness;
+    octx->res->true_peak = stats.true_peak;
+    octx->res->gain = oa->gain;
+  }
+
+update_loudness_err:
+  return ret;
+}
+
 int filtergraph_read(struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video)
 {
     AVFrame *frame = filter->frame;
@@ -281,14 +475,79 @@ int filtergraph_read(struct input_ctx *ictx, struct output_ctx *octx, struct fil
         filter->pts_diff = pts - frame->pts;
       }
       frame->pts += filter->pts_diff; // Re-calculate by adding back this segment's difference calculated at start
+    } else if (frame && !is_video) {
+      ret = update_loudness(ictx, octx, filter, frame);
     }
 fg_read_cleanup:
     return ret;
 }
 
+int filtergraph_read_ref(struct output_ctx *octx, struct filter_ctx *filter, AVFrame *frame)
+{
+  // Reads a sampled input frame for the quality comparison, on the same
+  // timeline as the frames read from the main output of the filtergraph
+  int ret = 0;
+  while (1) {
+    // wait for the main output to set the timestamp offset of the segment
+    if (!filter->ref_ctx || (octx->fps.den && filter->pts_diff == INT64_MIN)) {
+      return AVERROR(EAGAIN);
+    }
+    ret = av_buffersink_get_frame(filter->ref_ctx, frame);
+    if (ret < 0) return ret;
+    if ((int64_t) frame->opaque != INT64_MIN) break;
+    av_frame_unref(frame); // flush frame
+  }
+  if (octx->fps.den) frame->pts += filter->pts_diff;
+  return 0;
+}
+
 void free_filter(struct filter_ctx *filter)
 {
   if (filter->frame) av_frame_free(&filter->frame);
   if (filter->graph) avfilter_graph_free(&filter->graph);
   memset(filter, 0, sizeof(struct filter_ctx));
 }
+
+int init_frame_graph(struct frame_graph *g, const char *src, const char *args,
+  const char *sink, const char *descr)
+{
+  int ret = 0;
+  AVFilterInOut *outputs = avfilter_inout_alloc();
+  AVFilterInOut *inputs = avfilter_inout_alloc();
+
+  g->graph = avfilter_graph_alloc();
+  if (!g->graph || !outputs || !inputs) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(init_frame_graph_cleanup, "Unable to allocate frame filtergraph");
+  }
+  ret = avfilter_graph_create_filter(&g->src, avfilter_get_by_name(src),
+                                     "in", args, NULL, g->graph);
+  if (ret < 0) LPMS_ERR(init_frame_graph_cleanup, "Cannot create frame source");
+  ret = avfilter_graph_create_filter(&g->sink, avfilter_get_by_name(sink),
+                                     "out", NULL, NULL, g->graph);
+  if (ret < 0) LPMS_ERR(init_frame_graph_cleanup, "Cannot create frame sink");
+
+  outputs->name       = av_strdup("in");
+  outputs->filter_ctx = g->src;
+  outputs->pad_idx    = 0;
+  outputs->next       = NULL;
+  inputs->name        = av_strdup("out");
+  inputs->filter_ctx  = g->sink;
+  inputs->pad_idx     = 0;
+  inputs->next        = NULL;
+  ret = avfilter_graph_parse_ptr(g->graph, descr, &inputs, &outputs, NULL);
+  if (ret < 0) LPMS_ERR(init_frame_graph_cleanup, "Unable to parse frame filters desc");
+  ret = avfilter_graph_config(g->graph, NULL);
+  if (ret < 0) LPMS_ERR(init_frame_graph_cleanup, "Unable to configure frame filtergraph");
+
+init_frame_graph_cleanup:
+  avfilter_inout_free(&inputs);
+  avfilter_inout_free(&outputs);
+  return ret;
+}
+
+void free_frame_graph(struct frame_graph *g)
+{
+  if (g->graph) avfilter_graph_free(&g->graph);
+  g->src = g->sink = NULL;
+}
@@ -2,6 +2,7 @@
 #define _LPMS_FILTER_H_
 
 #include <libavfilter/avfilter.h>
+#include <libavutil/eval.h>
 #include "decoder.h"
 
 struct filter_ctx {
@@ -10,6 +11,7 @@ struct filter_ctx {
   AVFrame *frame;
   AVFilterContext *sink_ctx;
   AVFilterContext *src_ctx;
+  AVFilterContext *ref_ctx; // sampled input for the quality comparison
 
   uint8_t *hwframes; // GPU frame pool data
 
@@ -26,6 +28,12 @@ struct filter_ctx {
   // every subsequent frame in the segment.
   int64_t pts_diff;
 
+  // When preserving timestamps, the custom PTS follows the spacing of the
+  // input PTS within each segment rather than the nominal frame rate, so
+  // the fps filter fills or drops frames to cover the actual duration.
+  // This is the offset from the input PTS for the current segment.
+  int64_t seg_offset;
+
   // When draining the filtergraph, we inject fake frames.
   // These frames have monotonically increasing timestamps at the same interval
   // as a normal stream of frames. The custom_pts is set to more than usual jump
@@ -36,17 +44,35 @@ struct filter_ctx {
   int flushing;
 };
 
+struct output_audio {
+  int track;            // index into input_ctx.audio
+  int ai;               // output stream index
+  AVCodecContext *ac;   // audio encoder optional
+  struct filter_ctx af;
+  component_opts *opts; // encoder information (name + options)
+  int64_t drop_ts;      // preroll audio ts to drop
+
+  loudness_params *loudness; // normalisation settings; see loudness.c
+  double gain;               // currently applied, in dB
+};
+
 struct output_ctx {
   char *fname;         // required output file name
   char *vfilters;      // required output video filters
+  char *sw_vfilters;   // optional filters for software decoded GPU input
+  char *pix_fmt;       // output pixel format optional
   int width, height, bitrate; // w, h, br required
   AVRational fps;
   AVFormatContext *oc; // muxer required
   AVCodecContext  *vc; // video decoder optional
-  AVCodecContext  *ac; // audo  decoder optional
-  int vi, ai; // video and audio stream indices
-  int dv, da; // flags whether to drop video or audio
-  struct filter_ctx vf, af;
+  int vi; // video stream index
+  int dv; // flag whether to drop video
+  int mi; // timed metadata stream index; negative if none
+  struct filter_ctx vf;
+
+  // Audio tracks mapped into this output; none if dropping audio
+  struct output_audio audio[MAX_AUDIO_TRACKS];
+  int nb_audio;
 
   // Optional hardware encoding support
   enum AVHWDeviceType hw_type;
@@ -54,21 +80,48 @@ struct output_ctx {
   // muxer and encoder information (name + options)
   component_opts *muxer;
   component_opts *video;
-  component_opts *audio;
-
-  int64_t drop_ts;     // preroll audio ts to drop
 
   int64_t gop_time, gop_pts_len, next_kf_pts; // for gop reset
 
+  // Forced keyframes; see output_params
+  double *kf_times;
+  int nb_kf_times;
+  AVExpr *kf_expr;
+  double kf_vars[5]; // expression variables; see kf_var_names
+  int64_t kf_prev_pts; // pts of the previous frame of this segment
+
+  int source; // flag whether copied video is counted in the results
+  int preserve_ts; // flag whether to keep the video on the input timeline
+
+  // Extent of the primary stream of this segment in AV_TIME_BASE; see
+  // output_results.start_time
+  int64_t start_ts, end_ts;
+
+  char *config; // settings kept across segments; see output_config
+
+  struct quality_ctx quality; // optional comparison against the input
+
   output_results  *res; // data to return for this output
 
 };
 
+// A standalone filtergraph with a single source and sink, eg for converting
+// or analysing decoded frames outside of an output.
+struct frame_graph {
+  AVFilterGraph *graph;
+  AVFilterContext *src;
+  AVFilterContext *sink;
+};
+
 int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx);
-int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx);
+int init_audio_filters(struct input_ctx *ictx, struct output_audio *oa);
 int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
 int filtergraph_read(struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
+int filtergraph_read_ref(struct output_ctx *octx, struct filter_ctx *filter, AVFrame *frame);
 void free_filter(struct filter_ctx *filter);
+int init_frame_graph(struct frame_graph *g, const char *src, const char *args,
+  const char *sink, const char *descr);
+void free_frame_graph(struct frame_graph *g);
 
 // UTILS
 inline int is_copy(char *encoder) {
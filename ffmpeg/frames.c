@@ -0,0 +1,464 @@
+#include "frames.h"
+#include "decoder.h"
+#include "encoder.h"
+#include "extras.h"
+#include "logging.h"
+
+#include <libavfilter/avfilter.h>
+#include <libavfilter/buffersrc.h>
+#include <libavfilter/buffersink.h>
+#include <libavutil/avstring.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/imgutils.h>
+#include <libavutil/pixdesc.h>
+
+//
+// Raw frame access
+//
+// Frames are decoded as for transcoding, then converted by a small
+// filtergraph per media type:
+//
+//   video: (fps), (scale), format -> sink
+//   audio: aformat=flt -> sink
+//
+// Graphs are set up from the first decoded frame of each type. Converted
+// frames are handed out one at a time and are only valid until the next call.
+//
+// Frames supplied for encoding go through the same output path as decoded
+// frames when transcoding. The input context is populated to describe the
+// supplied frames as if they had been decoded, without a demuxer or decoders.
+//
+
+struct decode_ctx {
+  struct input_ctx ictx;
+  struct buffer_io buf;
+  struct frame_graph video;
+  struct frame_graph audio;
+
+  int w, h;
+  AVRational fps;
+  int pix_fmt;
+
+  AVFrame *frame; // decoded
+  AVFrame *out;   // converted; returned to the caller
+  AVPacket pkt;
+  int eof;
+};
+
+static int init_video_graph(struct decode_ctx *ctx, AVStream *ist, AVFrame *frame)
+{
+  char args[512], descr[512] = "[in]";
+  AVRational tb = ist->time_base;
+
+  snprintf(args, sizeof args,
+    "video_size=%dx%d:pix_fmt=%d:time_base=%d/%d:pixel_aspect=%d/%d",
+    frame->width, frame->height, frame->format, tb.num, tb.den,
+    frame->sample_aspect_ratio.num, frame->sample_aspect_ratio.den);
+  if (ctx->fps.num && ctx->fps.den) {
+    av_strlcatf(descr, sizeof descr, "fps=%d/%d,", ctx->fps.num, ctx->fps.den);
+  }
+  if (ctx->w && ctx->h) {
+    av_strlcatf(descr, sizeof descr, "scale=%d:%d,", ctx->w, ctx->h);
+  }
+  av_strlcatf(descr, sizeof descr, "format=%s[out]", av_get_pix_fmt_name(ctx->pix_fmt));
+  return init_frame_graph(&ctx->video, "buffer", args, "buffersink", descr);
+}
+
+static int init_audio_graph(struct decode_ctx *ctx, AVStream *ist, AVFrame *frame)
+{
+  char args[512];
+  AVRational tb = ist->time_base;
+  uint64_t layout = frame->channel_layout;
+
+  if (!layout) layout = av_get_default_channel_layout(frame->channels);
+  snprintf(args, sizeof args,
+    "time_base=%d/%d:sample_rate=%d:sample_fmt=%s:channel_layout=0x%"PRIx64,
+    tb.num, tb.den, frame->sample_rate,
+    av_get_sample_fmt_name(frame->format), layout);
+  return init_frame_graph(&ctx->audio, "abuffer", args, "abuffersink",
+                    "[in]aformat=sample_fmts=flt[out]");
+}
+
+// Decodes the next packet and sends any decoded frame into its filtergraph
+static int feed_frame(struct decode_ctx *ctx)
+{
+  int ret = 0, track = -1;
+  struct input_ctx *ictx = &ctx->ictx;
+  AVFrame *frame = ctx->frame;
+  AVStream *ist = NULL;
+  struct frame_graph *g = NULL;
+
+  av_frame_unref(frame);
+  ret = process_in(ictx, frame, &ctx->pkt);
+  if (AVERROR_EOF == ret) {
+    // signal EOF to the graphs to drain any buffered frames
+    ctx->eof = 1;
+    if (ctx->video.graph) av_buffersrc_add_frame(ctx->video.src, NULL);
+    if (ctx->audio.graph) av_buffersrc_add_frame(ctx->audio.src, NULL);
+    ret = 0;
+    goto feed_cleanup;
+  } else if (lpms_ERR_PACKET_ONLY == ret) {
+    ret = 0; // no frame yet
+    goto feed_cleanup;
+  } else if (ret < 0) LPMS_ERR(feed_cleanup, "Could not decode; stopping");
+
+  ist = ictx->ic->streams[ctx->pkt.stream_index];
+  track = audio_track(ictx, ist->index);
+  if (ist->index == ictx->vi && ictx->vc && frame->width && !is_flush_frame(frame)) {
+    if (!ctx->video.graph) ret = init_video_graph(ctx, ist, frame);
+    g = &ctx->video;
+  } else if (0 == track && ictx->audio[0].ac && frame->nb_samples) {
+    if (!ctx->audio.graph) ret = init_audio_graph(ctx, ist, frame);
+    g = &ctx->audio;
+  } else goto feed_cleanup; // skipped stream or decoder flush
+  if (ret < 0) LPMS_ERR(feed_cleanup, "Unable to initialize frame filters");
+
+  frame->pts = frame->best_effort_timestamp;
+  ret = av_buffersrc_write_frame(g->src, frame);
+  if (ret < 0) LPMS_ERR(feed_cleanup, "Error feeding the frame filtergraph");
+
+feed_cleanup:
+  av_packet_unref(&ctx->pkt);
+  return ret;
+}
+
+static void fill_frame(struct frame_graph *g, AVFrame *f, int type, raw_frame *out)
+{
+  out->type = type;
+  out->pts = f->pts * av_q2d(av_buffersink_get_time_base(g->sink));
+  out->key = f->key_frame || AVMEDIA_TYPE_AUDIO == type;
+  for (int i = 0; i < 4 && f->data[i]; i++) {
+    out->data[i] = f->data[i];
+    out->linesize[i] = f->linesize[i];
+  }
+  if (AVMEDIA_TYPE_VIDEO == type) {
+    const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(f->format);
+    out->width = f->width;
+    out->height = f->height;
+    for (int i = 0; i < 4 && f->data[i]; i++) {
+      int h = f->height;
+      if (1 == i || 2 == i) h = AV_CEIL_RSHIFT(h, desc->log2_chroma_h);
+      out->size[i] = f->linesize[i] * h;
+    }
+  } else {
+    out->nb_samples = f->nb_samples;
+    out->channels = f->channels;
+    out->sample_rate = f->sample_rate;
+    out->size[0] = f->nb_samples * f->channels * sizeof(float);
+  }
+}
+
+int lpms_decode_next(struct decode_ctx *ctx, raw_frame *frame)
+{
+  int ret = 0;
+
+  memset(frame, 0, sizeof *frame);
+  av_frame_unref(ctx->out);
+  while (1) {
+    // Hand out converted frames before decoding more
+    struct frame_graph *graphs[] = { &ctx->video, &ctx->audio };
+    int types[] = { AVMEDIA_TYPE_VIDEO, AVMEDIA_TYPE_AUDIO };
+    for (int i = 0; i < 2; i++) {
+      if (!graphs[i]->graph) continue;
+      ret = av_buffersink_get_frame(graphs[i]->sink, ctx->out);
+      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) continue;
+      else if (ret < 0) LPMS_ERR(decode_next_cleanup, "Error reading converted frame");
+      fill_frame(graphs[i], ctx->out, types[i], frame);
+      return 0;
+    }
+    if (ctx->eof) return AVERROR_EOF;
+    ret = feed_frame(ctx);
+    if (ret < 0) LPMS_ERR(decode_next_cleanup, "Unable to decode frame");
+  }
+
+decode_next_cleanup:
+  return ret;
+}
+
+int lpms_decode_open(decode_params *params, struct decode_ctx **pctx)
+{
+  int ret = 0;
+  struct decode_ctx *ctx = av_mallocz(sizeof *ctx);
+
+  *pctx = NULL;
+  if (!ctx) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(decode_open_err, "Unable to allocate decoder");
+  }
+  ctx->w = params->w;
+  ctx->h = params->h;
+  ctx->fps = params->fps;
+  ctx->pix_fmt = params->pix_fmt;
+  ctx->frame = av_frame_alloc();
+  ctx->out = av_frame_alloc();
+  if (!ctx->frame || !ctx->out) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(decode_open_err, "Unable to allocate decoder frames");
+  }
+  if (!av_pix_fmt_desc_get(params->pix_fmt)) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(decode_open_err, "Invalid pixel format for decoded frames");
+  }
+  av_init_packet(&ctx->pkt);
+
+  // Only the default audio track is decoded
+  params->in.hw_type = AV_HWDEVICE_TYPE_NONE;
+  ctx->ictx.dv = !params->video;
+  ctx->ictx.audio[0].skip = !params->audio;
+  if (!params->in.fname) {
+    ret = open_buffer_io(&ctx->buf, params->data, params->size);
+    if (ret < 0) LPMS_ERR(decode_open_err, "Unable to open decoder input buffer");
+    ctx->ictx.ic = avformat_alloc_context();
+    if (!ctx->ictx.ic) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(decode_open_err, "Unable to allocate decoder input");
+    }
+    ctx->ictx.ic->pb = ctx->buf.pb;
+  }
+  ret = open_input(&params->in, &ctx->ictx);
+  if (ret < 0) LPMS_ERR(decode_open_err, "Unable to open decoder input");
+
+  *pctx = ctx;
+  return 0;
+
+decode_open_err:
+  lpms_decode_close(ctx);
+  return ret;
+}
+
+void lpms_decode_close(struct decode_ctx *ctx)
+{
+  if (!ctx) return;
+  free_frame_graph(&ctx->video);
+  free_frame_graph(&ctx->audio);
+  av_packet_unref(&ctx->pkt);
+  if (ctx->frame) av_frame_free(&ctx->frame);
+  if (ctx->out) av_frame_free(&ctx->out);
+  if (ctx->ictx.first_pkt) av_packet_free(&ctx->ictx.first_pkt);
+  free_input(&ctx->ictx);
+  close_buffer_io(&ctx->buf);
+  av_free(ctx);
+}
+
+struct encode_ctx {
+  struct input_ctx ictx; // describes the supplied frames
+  struct output_ctx octx;
+  encode_params params;  // referenced by the output
+  output_results res;
+  AVFrame *frame;
+};
+
+static int init_frame_input(struct encode_ctx *ctx)
+{
+  int ret = 0;
+  encode_params *p = &ctx->params;
+  struct input_ctx *ictx = &ctx->ictx;
+  AVStream *st = NULL;
+
+  ictx->vi = -1;
+  ictx->audio[0].index = -1;
+  ictx->ic = avformat_alloc_context();
+  if (!ictx->ic) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(frame_input_err, "Unable to allocate encoder input");
+  }
+  if (p->w > 0 && p->h > 0) {
+    if (!av_pix_fmt_desc_get(p->pix_fmt) || p->fps.num <= 0 || p->fps.den <= 0) {
+      ret = AVERROR(EINVAL);
+      LPMS_ERR(frame_input_err, "Invalid video frame parameters");
+    }
+    st = avformat_new_stream(ictx->ic, NULL);
+    ictx->vc = avcodec_alloc_context3(NULL);
+    if (!st || !ictx->vc) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(frame_input_err, "Unable to allocate encoder video input");
+    }
+    st->time_base = (AVRational){1, 90000};
+    st->r_frame_rate = st->avg_frame_rate = p->fps;
+    st->codecpar->codec_type = AVMEDIA_TYPE_VIDEO;
+    st->codecpar->width = p->w;
+    st->codecpar->height = p->h;
+    st->codecpar->format = p->pix_fmt;
+    ictx->vc->width = p->w;
+    ictx->vc->height = p->h;
+    ictx->vc->pix_fmt = p->pix_fmt;
+    ictx->vc->framerate = p->fps;
+    ictx->vc->time_base = st->time_base;
+    ictx->vi = st->index;
+  }
+  if (p->sample_rate > 0) {
+    struct input_audio *ia = &ictx->audio[0];
+    if (p->channels <= 0) {
+      ret = AVERROR(EINVAL);
+      LPMS_ERR(frame_input_err, "Invalid audio frame parameters");
+    }
+    st = avformat_new_stream(ictx->ic, NULL);
+    ia->ac = avcodec_alloc_context3(NULL);
+    if (!st || !ia->ac) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(frame_input_err, "Unable to allocate encoder audio input");
+    }
+    st->time_base = (AVRational){1, p->sample_rate};
+    st->codecpar->codec_type = AVMEDIA_TYPE_AUDIO;
+    st->codecpar->sample_rate = p->sample_rate;
+    st->codecpar->channels = p->channels;
+    ia->ac->sample_fmt = AV_SAMPLE_FMT_FLT;
+    ia->ac->sample_rate = p->sample_rate;
+    ia->ac->channels = p->channels;
+    ia->ac->channel_layout = av_get_default_channel_layout(p->channels);
+    ia->index = st->index;
+    ictx->nb_audio = 1;
+  }
+  ictx->last_frame_v = av_frame_alloc();
+  ictx->audio[0].last_frame = av_frame_alloc();
+  if (!ictx->last_frame_v || !ictx->audio[0].last_frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(frame_input_err, "Unable to allocate encoder flush frames");
+  }
+
+frame_input_err:
+  return ret;
+}
+
+int lpms_encode_open(encode_params *params, struct encode_ctx **pctx)
+{
+  int ret = 0;
+  struct encode_ctx *ctx = av_mallocz(sizeof *ctx);
+  struct output_ctx *octx = NULL;
+
+  *pctx = NULL;
+  if (!ctx) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(encode_open_err, "Unable to allocate encoder");
+  }
+  ctx->params = *params;
+  octx = &ctx->octx;
+  ctx->frame = av_frame_alloc();
+  if (!ctx->frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(encode_open_err, "Unable to allocate encoder frame");
+  }
+  ret = init_frame_input(ctx);
+  if (ret < 0) LPMS_ERR(encode_open_err, "Unable to set up encoder input");
+  ret = init_output(octx, &ctx->ictx, &ctx->params.out, &ctx->res);
+  if (ret < 0) LPMS_ERR(encode_open_err, "Unable to set up encoder output");
+
+  // There is no input stream to copy from
+  if (!octx->dv && is_copy(octx->video->name)) ret = AVERROR(EINVAL);
+  for (int i = 0; i < octx->nb_audio; i++) {
+    if (is_copy(octx->audio[i].opts->name)) ret = AVERROR(EINVAL);
+  }
+  if (ret < 0) LPMS_ERR(encode_open_err, "Unable to copy streams of raw frames");
+
+  ret = open_output(octx, &ctx->ictx);
+  if (ret < 0) LPMS_ERR(encode_open_err, "Unable to open encoder output");
+
+  *pctx = ctx;
+  return 0;
+
+encode_open_err:
+  lpms_encode_free(ctx);
+  return ret;
+}
+
+int lpms_encode_frame(struct encode_ctx *ctx, raw_frame *f)
+{
+  int ret = 0;
+  struct input_ctx *ictx = &ctx->ictx;
+  struct output_ctx *octx = &ctx->octx;
+  AVFrame *frame = ctx->frame;
+  AVFrame *last_frame = NULL;
+  AVStream *ist = NULL;
+
+  av_frame_unref(frame);
+  if (AVMEDIA_TYPE_VIDEO == f->type) {
+    if (ictx->vi < 0 || f->width != ictx->vc->width || f->height != ictx->vc->height) {
+      ret = AVERROR(EINVAL);
+      LPMS_ERR(encode_frame_cleanup, "Unexpected video frame for encoder");
+    }
+    ist = ictx->ic->streams[ictx->vi];
+    frame->width = ictx->vc->width;
+    frame->height = ictx->vc->height;
+    frame->format = ictx->vc->pix_fmt;
+    ret = av_frame_get_buffer(frame, 0);
+    if (ret < 0) LPMS_ERR(encode_frame_cleanup, "Unable to allocate video frame");
+    av_image_copy(frame->data, frame->linesize, (const uint8_t **)f->data,
+                  f->linesize, frame->format, frame->width, frame->height);
+    frame->pkt_duration = av_rescale_q(1, av_inv_q(ist->r_frame_rate), ist->time_base);
+    last_frame = ictx->last_frame_v;
+  } else if (AVMEDIA_TYPE_AUDIO == f->type) {
+    struct input_audio *ia = &ictx->audio[0];
+    if (ia->index < 0 || f->channels != ia->ac->channels || f->nb_samples <= 0) {
+      ret = AVERROR(EINVAL);
+      LPMS_ERR(encode_frame_cleanup, "Unexpected audio frame for encoder");
+    }
+    ist = ictx->ic->streams[ia->index];
+    frame->format = ia->ac->sample_fmt;
+    frame->sample_rate = ia->ac->sample_rate;
+    frame->channels = ia->ac->channels;
+    frame->channel_layout = ia->ac->channel_layout;
+    frame->nb_samples = f->nb_samples;
+    ret = av_frame_get_buffer(frame, 0);
+    if (ret < 0) LPMS_ERR(encode_frame_cleanup, "Unable to allocate audio frame");
+    memcpy(frame->data[0], f->data[0], f->nb_samples * f->channels * sizeof(float));
+    frame->pkt_duration = f->nb_samples;
+    last_frame = ia->last_frame;
+  } else {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(encode_frame_cleanup, "Unknown frame type for encoder");
+  }
+  frame->pts = llrint(f->pts / av_q2d(ist->time_base));
+  av_frame_unref(last_frame);
+  av_frame_ref(last_frame, frame);
+
+  if (ist->index == ictx->vi) {
+    if (!octx->dv) {
+      ret = process_out(ictx, octx, octx->vc, octx->oc->streams[octx->vi], &octx->vf, frame);
+    }
+  } else {
+    for (int i = 0; i < octx->nb_audio && ret >= 0; i++) {
+      struct output_audio *oa = &octx->audio[i];
+      ret = process_out(ictx, octx, oa->ac, octx->oc->streams[oa->ai], &oa->af, frame);
+      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) ret = 0;
+    }
+  }
+  if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) ret = 0;
+  if (ret < 0) LPMS_ERR(encode_frame_cleanup, "Error encoding");
+
+encode_frame_cleanup:
+  return ret;
+}
+
+int lpms_encode_finish(struct encode_ctx *ctx, output_results *res)
+{
+  int ret = 0;
+  struct output_ctx *octx = &ctx->octx;
+  // Filters are flushed with the last supplied frame, so skip filters of
+  // streams without any frames and only drain their encoders.
+  if (!ctx->ictx.last_frame_v || !ctx->ictx.last_frame_v->buf[0]) octx->vf.flushed = 1;
+  if (!ctx->ictx.audio[0].last_frame || !ctx->ictx.audio[0].last_frame->buf[0]) {
+    for (int i = 0; i < octx->nb_audio; i++) octx->audio[i].af.flushed = 1;
+  }
+  ret = flush_output(&ctx->ictx, octx);
+  if (ret < 0) LPMS_ERR(encode_finish_err, "Unable to fully flush encoder");
+  *res = ctx->res;
+
+encode_finish_err:
+  return ret;
+}
+
+void lpms_encode_free(struct encode_ctx *ctx)
+{
+  if (!ctx) return;
+  free_output(&ctx->octx);
+  // not opened as a demuxer, so there's nothing to close
+  if (ctx->ictx.ic) avformat_free_context(ctx->ictx.ic);
+  ctx->ictx.ic = NULL;
+  free_input(&ctx->ictx);
+  if (ctx->frame) av_frame_free(&ctx->frame);
+  // options left over by the muxer and encoders
+  av_dict_free(&ctx->params.out.muxer.opts);
+  av_dict_free(&ctx->params.out.video.opts);
+  av_dict_free(&ctx->params.out.audio.opts);
+  av_free(ctx);
+}
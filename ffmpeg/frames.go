@@ -0,0 +1,513 @@
+package ffmpeg
+
+import (
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// #cgo pkg-config: libavformat libavfilter libavcodec libavutil
+// #include <stdlib.h>
+// #include <libavutil/pixdesc.h>
+// #include "frames.h"
+import "C"
+
+type DecoderOptions struct {
+	// Optional; leave empty to autodetect the input format and decoders
+	Demuxer      ComponentOptions
+	VideoDecoder ComponentOptions
+	AudioDecoder ComponentOptions
+
+	// Optional; the audio track to decode
+	Audio AudioSelector
+
+	// Skips decoding video or audio
+	NoVideo bool
+	NoAudio bool
+
+	// Optional; scales video to this resolution, eg "320x240"
+	Resolution string
+
+	// Optional; samples video at this frame rate rather than returning
+	// every decoded frame
+	Framerate    uint
+	FramerateDen uint
+
+	// Layout of video frames as named by FFmpeg, eg "yuv420p".
+	// Defaults to "rgba".
+	PixelFormat string
+}
+
+type VideoFrame struct {
+	PTS      time.Duration // input presentation timestamp
+	Keyframe bool
+
+	Width, Height int
+	PixelFormat   string
+
+	// Image data of each plane, with Strides bytes per row
+	Planes  [][]byte
+	Strides []int
+}
+
+type AudioFrame struct {
+	PTS time.Duration // input presentation timestamp
+
+	SampleRate int
+	Channels   int
+	Samples    []float32 // interleaved by channel
+}
+
+// A decoded frame; exactly one of Video or Audio is set.
+type Frame struct {
+	Video *VideoFrame
+	Audio *AudioFrame
+}
+
+// Image returns the frame as an *image.RGBA or *image.YCbCr, sharing the
+// frame data, or nil for other pixel formats.
+func (f *VideoFrame) Image() image.Image {
+	rect := image.Rect(0, 0, f.Width, f.Height)
+	switch f.PixelFormat {
+	case "rgba":
+		return &image.RGBA{Pix: f.Planes[0], Stride: f.Strides[0], Rect: rect}
+	case "yuv420p", "yuvj420p":
+		return &image.YCbCr{
+			Y: f.Planes[0], Cb: f.Planes[1], Cr: f.Planes[2],
+			YStride: f.Strides[0], CStride: f.Strides[1],
+			SubsampleRatio: image.YCbCrSubsampleRatio420,
+			Rect:           rect,
+		}
+	}
+	return nil
+}
+
+// Decoder yields the raw decoded frames of an input, for analysis in Go.
+type Decoder struct {
+	handle *C.struct_decode_ctx
+	data   unsafe.Pointer // input buffer when reading from memory
+	pixFmt string
+	mu     sync.Mutex
+}
+
+// NewDecoder opens the given file for decoding.
+func NewDecoder(fname string, opts DecoderOptions) (*Decoder, error) {
+	return newDecoder(fname, nil, opts)
+}
+
+// NewDecoderReader reads the whole input from r into memory, then opens
+// it for decoding. Suitable for segments rather than long running streams.
+func NewDecoderReader(r io.Reader, opts DecoderOptions) (*Decoder, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return newDecoder("", data, opts)
+}
+
+func newDecoder(fname string, data []byte, opts DecoderOptions) (*Decoder, error) {
+	if fname == "" && len(data) == 0 {
+		return nil, ErrTranscoderInp
+	}
+	pixFmt := opts.PixelFormat
+	if pixFmt == "" {
+		pixFmt = "rgba"
+	}
+	params := C.decode_params{
+		video: C.int(1), audio: C.int(1),
+		fps: C.AVRational{num: C.int(opts.Framerate), den: C.int(opts.FramerateDen)},
+	}
+	if opts.NoVideo {
+		params.video = 0
+	}
+	if opts.NoAudio {
+		params.audio = 0
+	}
+	if opts.Framerate > 0 && opts.FramerateDen == 0 {
+		params.fps.den = 1
+	}
+	if opts.Resolution != "" {
+		w, h, err := VideoProfileResolution(VideoProfile{Resolution: opts.Resolution})
+		if err != nil {
+			return nil, err
+		}
+		params.w, params.h = C.int(w), C.int(h)
+	}
+	cPixFmt := C.CString(pixFmt)
+	params.pix_fmt = C.int(C.av_get_pix_fmt(cPixFmt))
+	C.free(unsafe.Pointer(cPixFmt))
+
+	d := &Decoder{pixFmt: pixFmt}
+	if fname != "" {
+		params.in.fname = C.CString(fname)
+		defer C.free(unsafe.Pointer(params.in.fname))
+	} else {
+		// kept until the decoder is closed since the input is read lazily
+		d.data = C.CBytes(data)
+		params.data = (*C.uint8_t)(d.data)
+		params.size = C.int(len(data))
+	}
+	params.in.demuxer = newComponentOpts(opts.Demuxer)
+	params.in.video = newComponentOpts(opts.VideoDecoder)
+	params.in.audio = newComponentOpts(opts.AudioDecoder)
+	defer func() {
+		freeComponentOpts(&params.in.demuxer)
+		freeComponentOpts(&params.in.video)
+		freeComponentOpts(&params.in.audio)
+	}()
+	sel := (*C.track_selector)(C.calloc(1, C.sizeof_track_selector))
+	defer C.free(unsafe.Pointer(sel))
+	sel.track = C.int(opts.Audio.Track)
+	if opts.Audio.Language != "" {
+		sel.language = C.CString(opts.Audio.Language)
+		defer C.free(unsafe.Pointer(sel.language))
+	}
+	params.in.audio_tracks, params.in.nb_audio_tracks = sel, 1
+
+	ret := int(C.lpms_decode_open(&params, &d.handle))
+	if ret != 0 {
+		glog.Error("Decoder Return : ", ErrorMap[ret])
+		d.Close()
+		return nil, ErrorMap[ret]
+	}
+	return d, nil
+}
+
+// Read returns the next frame, or io.EOF once the input is exhausted.
+// Video and audio frames are returned roughly in decoding order.
+func (d *Decoder) Read() (*Frame, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	var f C.raw_frame
+	ret := int(C.lpms_decode_next(d.handle, &f))
+	if ret == C.AVERROR_EOF {
+		return nil, io.EOF
+	} else if ret != 0 {
+		glog.Error("Decoder Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	pts := time.Duration(float64(f.pts) * float64(time.Second))
+	if f._type == C.AVMEDIA_TYPE_AUDIO {
+		n := int(f.nb_samples * f.channels)
+		samples := make([]float32, n)
+		copy(samples, (*[1 << 28]float32)(unsafe.Pointer(f.data[0]))[:n:n])
+		return &Frame{Audio: &AudioFrame{
+			PTS:        pts,
+			SampleRate: int(f.sample_rate),
+			Channels:   int(f.channels),
+			Samples:    samples,
+		}}, nil
+	}
+	v := &VideoFrame{
+		PTS:         pts,
+		Keyframe:    f.key != 0,
+		Width:       int(f.width),
+		Height:      int(f.height),
+		PixelFormat: d.pixFmt,
+	}
+	for i := 0; i < len(f.data) && f.data[i] != nil; i++ {
+		v.Planes = append(v.Planes, C.GoBytes(unsafe.Pointer(f.data[i]), f.size[i]))
+		v.Strides = append(v.Strides, int(f.linesize[i]))
+	}
+	return &Frame{Video: v}, nil
+}
+
+// Close releases the decoder. Safe to call multiple times.
+func (d *Decoder) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handle != nil {
+		C.lpms_decode_close(d.handle)
+		d.handle = nil
+	}
+	if d.data != nil {
+		C.free(d.data)
+		d.data = nil
+	}
+}
+
+type EncoderOptions struct {
+	// Size of the supplied video frames, eg "1280x720". Leave empty to
+	// encode audio only.
+	Resolution string
+
+	// Layout of the supplied video frames as named by FFmpeg, eg "yuv420p".
+	// Defaults to "rgba".
+	PixelFormat string
+
+	// Nominal rate of the supplied video frames; defaults to 30fps.
+	Framerate    uint
+	FramerateDen uint
+
+	// Format of the supplied audio samples. Leave the sample rate unset to
+	// encode video only.
+	SampleRate int
+	Channels   int
+}
+
+// Encoder encodes raw frames produced in Go, eg by a Decoder or a renderer,
+// into a single output. Frames of each type must be written in presentation
+// order; video and audio may be interleaved.
+type Encoder struct {
+	handle     *C.struct_encode_ctx
+	free       func() // output params referenced by the handle
+	pixFmt     string
+	w, h       int
+	sampleRate int
+	channels   int
+
+	// Output is copied here on Close when writing to a temporary file
+	writer io.Writer
+	tmpDir string
+	oname  string
+
+	mu sync.Mutex
+}
+
+// NewEncoder opens an encoder that writes to out.Oname. Options are as for
+// transcoding, except that streams cannot be copied since there is no input.
+func NewEncoder(out TranscodeOptions, opts EncoderOptions) (*Encoder, error) {
+	return newEncoder(out, opts, nil)
+}
+
+// NewEncoderWriter opens an encoder that writes to w. The output is buffered
+// in a temporary file named after out.Oname, which may be just a file name
+// to select the format, and copied to w on Close.
+func NewEncoderWriter(w io.Writer, out TranscodeOptions, opts EncoderOptions) (*Encoder, error) {
+	return newEncoder(out, opts, w)
+}
+
+func newEncoder(out TranscodeOptions, opts EncoderOptions, w io.Writer) (*Encoder, error) {
+	e := &Encoder{pixFmt: opts.PixelFormat, writer: w,
+		sampleRate: opts.SampleRate, channels: opts.Channels}
+	if e.pixFmt == "" {
+		e.pixFmt = "rgba"
+	}
+	if w != nil {
+		dir, err := ioutil.TempDir("", "lpms-encoder")
+		if err != nil {
+			return nil, err
+		}
+		e.tmpDir = dir
+		out.Oname = filepath.Join(dir, "out"+filepath.Ext(out.Oname))
+	}
+	e.oname = out.Oname
+	params := C.encode_params{
+		fps:         C.AVRational{num: C.int(opts.Framerate), den: C.int(opts.FramerateDen)},
+		sample_rate: C.int(opts.SampleRate),
+		channels:    C.int(opts.Channels),
+	}
+	if opts.Framerate == 0 {
+		params.fps = C.AVRational{num: 30, den: 1}
+	} else if opts.FramerateDen == 0 {
+		params.fps.den = 1
+	}
+	if opts.Resolution != "" {
+		w, h, err := VideoProfileResolution(VideoProfile{Resolution: opts.Resolution})
+		if err != nil {
+			os.RemoveAll(e.tmpDir)
+			return nil, err
+		}
+		e.w, e.h = w, h
+		params.w, params.h = C.int(w), C.int(h)
+	}
+	cPixFmt := C.CString(e.pixFmt)
+	params.pix_fmt = C.int(C.av_get_pix_fmt(cPixFmt))
+	C.free(unsafe.Pointer(cPixFmt))
+
+	audioSels := []AudioSelector{{}}
+	out.Source = false
+	param, free, err := newOutputParams(&TranscodeOptionsIn{}, out, &audioSels)
+	if err != nil {
+		os.RemoveAll(e.tmpDir)
+		return nil, err
+	}
+	// The option dictionaries are owned by the handle from here on
+	params.out = param
+	e.free = free
+	ret := int(C.lpms_encode_open(&params, &e.handle))
+	if ret != 0 {
+		glog.Error("Encoder Return : ", ErrorMap[ret])
+		e.cleanup()
+		os.RemoveAll(e.tmpDir)
+		return nil, ErrorMap[ret]
+	}
+	return e, nil
+}
+
+// WriteImage encodes img as a video frame presented at pts. Images are
+// converted to the pixel format of the encoder if it is "rgba"; otherwise
+// only an *image.YCbCr with 4:2:0 subsampling can be written to a "yuv420p"
+// encoder. The image bounds must match the encoder resolution.
+func (e *Encoder) WriteImage(img image.Image, pts time.Duration) error {
+	b := img.Bounds()
+	if b.Dx() != e.w || b.Dy() != e.h {
+		return ErrTranscoderRes
+	}
+	f := &VideoFrame{PTS: pts, Width: e.w, Height: e.h, PixelFormat: e.pixFmt}
+	switch e.pixFmt {
+	case "rgba":
+		rgba, ok := img.(*image.RGBA)
+		if !ok || b.Min != (image.Point{}) {
+			rgba = image.NewRGBA(image.Rect(0, 0, e.w, e.h))
+			draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+		}
+		f.Planes, f.Strides = [][]byte{rgba.Pix}, []int{rgba.Stride}
+	case "yuv420p", "yuvj420p":
+		ycc, ok := img.(*image.YCbCr)
+		if !ok || ycc.SubsampleRatio != image.YCbCrSubsampleRatio420 || b.Min != (image.Point{}) {
+			return ErrTranscoderVid
+		}
+		f.Planes = [][]byte{ycc.Y, ycc.Cb, ycc.Cr}
+		f.Strides = []int{ycc.YStride, ycc.CStride, ycc.CStride}
+	default:
+		return ErrTranscoderVid
+	}
+	return e.WriteVideo(f)
+}
+
+// Number of rows of each plane of a video frame, or nil for pixel formats
+// that are not known.
+func planeRows(pixFmt string, h int) []int {
+	cPixFmt := C.CString(pixFmt)
+	defer C.free(unsafe.Pointer(cPixFmt))
+	pixFmt := C.av_get_pix_fmt(cPixFmt)
+	desc := C.av_pix_fmt_desc_get(pixFmt)
+	if desc == nil {
+		return nil
+	}
+	n := int(C.av_pix_fmt_count_planes(pixFmt))
+	chromaH := -((-h) >> uint(desc.log2_chroma_h))
+	rows := make([]int, n)
+	for i := range rows {
+		rows[i] = h
+		// chroma planes, other than for planar RGB
+		if (i == 1 || i == 2) && desc.flags&C.AV_PIX_FMT_FLAG_RGB == 0 {
+			rows[i] = chromaH
+		}
+	}
+	return rows
+}
+
+// WriteVideo encodes a video frame, eg as returned by a Decoder. The frame
+// must match the resolution and pixel format of the encoder.
+func (e *Encoder) WriteVideo(v *VideoFrame) error {
+	if v.Width != e.w || v.Height != e.h || v.PixelFormat != e.pixFmt {
+		return ErrTranscoderVid
+	}
+	rows := planeRows(v.PixelFormat, v.Height)
+	if rows == nil || len(v.Planes) < len(rows) || len(v.Strides) < len(rows) {
+		return ErrTranscoderVid
+	}
+	f := C.raw_frame{
+		_type:  C.AVMEDIA_TYPE_VIDEO,
+		pts:    C.double(v.PTS.Seconds()),
+		width:  C.int(v.Width),
+		height: C.int(v.Height),
+	}
+	for i, n := range rows {
+		if v.Strides[i] <= 0 || len(v.Planes[i]) < v.Strides[i]*n {
+			return ErrTranscoderVid
+		}
+	}
+	// Copied since Go memory can't be retained by C
+	for i := range rows {
+		f.data[i] = (*C.uint8_t)(C.CBytes(v.Planes[i]))
+		defer C.free(unsafe.Pointer(f.data[i]))
+		f.linesize[i] = C.int(v.Strides[i])
+		f.size[i] = C.int(len(v.Planes[i]))
+	}
+	return e.write(&f)
+}
+
+// WriteAudio encodes audio samples. The frame must match the sample rate
+// and channel count of the encoder.
+func (e *Encoder) WriteAudio(a *AudioFrame) error {
+	if a.SampleRate != e.sampleRate || a.Channels != e.channels || a.Channels <= 0 ||
+		len(a.Samples) == 0 || len(a.Samples)%a.Channels != 0 {
+		return ErrTranscoderAud
+	}
+	f := C.raw_frame{
+		_type:       C.AVMEDIA_TYPE_AUDIO,
+		pts:         C.double(a.PTS.Seconds()),
+		nb_samples:  C.int(len(a.Samples) / a.Channels),
+		channels:    C.int(a.Channels),
+		sample_rate: C.int(a.SampleRate),
+	}
+	size := len(a.Samples) * 4
+	data := C.malloc(C.size_t(size))
+	defer C.free(data)
+	copy((*[1 << 28]float32)(data)[:len(a.Samples):len(a.Samples)], a.Samples)
+	f.data[0], f.size[0] = (*C.uint8_t)(data), C.int(size)
+	return e.write(&f)
+}
+
+func (e *Encoder) write(f *C.raw_frame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.handle == nil {
+		return ErrTranscoderStp
+	}
+	ret := int(C.lpms_encode_frame(e.handle, f))
+	if ret != 0 {
+		glog.Error("Encoder Return : ", ErrorMap[ret])
+		return ErrorMap[ret]
+	}
+	return nil
+}
+
+// Close flushes the encoder and finalizes the output, returning what was
+// encoded. The encoder can't be used afterwards.
+func (e *Encoder) Close() (*MediaInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	var res C.output_results
+	ret := int(C.lpms_encode_finish(e.handle, &res))
+	// closes the output file
+	e.cleanup()
+	if e.tmpDir != "" {
+		defer os.RemoveAll(e.tmpDir)
+	}
+	if ret != 0 {
+		glog.Error("Encoder Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	if e.writer != nil {
+		f, err := os.Open(e.oname)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(e.writer, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	info := newMediaInfo(&res)
+	return &info, nil
+}
+
+func (e *Encoder) cleanup() {
+	if e.handle != nil {
+		C.lpms_encode_free(e.handle)
+		e.handle = nil
+	}
+	if e.free != nil {
+		e.free()
+		e.free = nil
+	}
+}
@@ -0,0 +1,64 @@
+#ifndef _LPMS_FRAMES_H_
+#define _LPMS_FRAMES_H_
+
+#include "transcoder.h"
+
+struct decode_ctx;
+
+typedef struct {
+  // Demuxer, decoders and audio track selection. Only the default audio
+  // track is decoded, and hardware decoding is not supported.
+  input_params in;
+
+  // Read from this buffer if in.fname is unset
+  uint8_t *data;
+  int size;
+
+  int video, audio; // flags whether to decode each
+
+  int w, h;        // scale video to this size if set
+  AVRational fps;  // sample video at this rate if set
+  int pix_fmt;     // of video frames, eg rgba or yuv420p
+} decode_params;
+
+// Raw frame data, as decoded or to be encoded
+typedef struct {
+  int type;   // AVMediaType
+  double pts; // seconds
+  int key;    // flag whether decoded from a keyframe
+
+  // Video planes according to the pixel format of the decoder or encoder.
+  // Audio samples are interleaved 32-bit floats in data[0].
+  uint8_t *data[4];
+  int linesize[4];
+  int size[4]; // bytes of each plane
+
+  int width, height;
+  int nb_samples, channels, sample_rate;
+} raw_frame;
+
+int  lpms_decode_open(decode_params *params, struct decode_ctx **ctx);
+int  lpms_decode_next(struct decode_ctx *ctx, raw_frame *frame);
+void lpms_decode_close(struct decode_ctx *ctx);
+
+struct encode_ctx;
+
+typedef struct {
+  // As for transcoding, except that nothing can be copied
+  output_params out;
+
+  // Properties of the supplied video frames; no video if the size is unset
+  int w, h;
+  int pix_fmt;
+  AVRational fps; // nominal frame rate
+
+  // Properties of the supplied audio; no audio if the sample rate is unset
+  int sample_rate, channels;
+} encode_params;
+
+int  lpms_encode_open(encode_params *params, struct encode_ctx **ctx);
+int  lpms_encode_frame(struct encode_ctx *ctx, raw_frame *frame);
+int  lpms_encode_finish(struct encode_ctx *ctx, output_results *res);
+void lpms_encode_free(struct encode_ctx *ctx);
+
+#endif // _LPMS_FRAMES_H_
@@ -0,0 +1,201 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Limits for SuggestLadder. Zero values mean no limit or the default.
+type LadderConstraints struct {
+	// Maximum number of renditions; the highest ones are kept
+	MaxRenditions int
+
+	// Resolutions apply to the shorter side, eg 720 for both 1280x720 and
+	// 720x1280. MinResolution defaults to 144.
+	MaxResolution int
+	MinResolution int
+
+	// Bitrate caps in bits per second
+	MaxBitrate int
+
+	// Renditions never exceed the source frame rate or this rate
+	MaxFramerate uint
+
+	// Relative complexity of the content, eg from MeasureComplexity.
+	// Bitrates scale with this; defaults to 1 for typical content.
+	Complexity float64
+}
+
+// Standard resolutions of the shorter side, from highest to lowest
+var ladderResolutions = []int{2160, 1440, 1080, 720, 480, 360, 240, 144}
+
+// Bitrate of the reference encode, 1280x720 at 30fps, for typical content.
+// Other resolutions scale sublinearly with the number of pixels.
+const (
+	ladderRefPixels  = 1280 * 720
+	ladderRefBitrate = 4000000
+	ladderRefFPS     = 30.0
+
+	// Typical content encoded at the constant quality of MeasureComplexity
+	// needs around this fraction of the ladder bitrate.
+	complexityRefRatio = 0.6
+)
+
+func ladderBitrate(w, h int, fps, complexity float64) int {
+	pixels := float64(w*h) / ladderRefPixels
+	rate := ladderRefBitrate * math.Pow(pixels, 0.75) * math.Sqrt(fps/ladderRefFPS)
+	return int(rate * complexity)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Rounds to the nearest even number, as required by most encoders
+func evenDimension(v float64) int {
+	return 2 * int(math.Round(v/2))
+}
+
+// SuggestLadder returns a bitrate ladder for the source described by probe,
+// eg MediaInfo.SourceProfile, from the highest rendition to the lowest.
+// Renditions are never upscaled, keep the aspect ratio of the source, and
+// use half the frame rate below 720p for high frame rate sources. The probe
+// must have a resolution; its frame rate defaults to 30fps if unset.
+func SuggestLadder(probe VideoProfile, c LadderConstraints) ([]VideoProfile, error) {
+	srcW, srcH, err := VideoProfileResolution(probe)
+	if err != nil {
+		return nil, err
+	}
+	if srcW <= 0 || srcH <= 0 {
+		return nil, ErrTranscoderRes
+	}
+	num, den := probe.Framerate, probe.FramerateDen
+	if num == 0 {
+		num, den = 30, 1
+	} else if den == 0 {
+		den = 1
+	}
+	if c.MaxFramerate > 0 && float64(num)/float64(den) > float64(c.MaxFramerate) {
+		num, den = c.MaxFramerate, 1
+	}
+	complexity := c.Complexity
+	if complexity <= 0 {
+		complexity = 1
+	}
+	minRes := c.MinResolution
+	if minRes <= 0 {
+		minRes = 144
+	}
+	g := gcd(srcW, srcH)
+	aspectW, aspectH := srcW/g, srcH/g
+	short, long := srcH, srcW
+	portrait := srcW < srcH
+	if portrait {
+		short, long = srcW, srcH
+	}
+
+	// The top rendition is the source resolution unless capped; lower ones
+	// follow the standard resolutions. Sources below the minimum resolution
+	// still get a single rendition.
+	top := short
+	if c.MaxResolution > 0 && top > c.MaxResolution {
+		top = c.MaxResolution
+	}
+	sizes := []int{top}
+	for _, r := range ladderResolutions {
+		if r < top && r >= minRes && float64(r) <= 0.85*float64(sizes[len(sizes)-1]) {
+			sizes = append(sizes, r)
+		}
+	}
+	if c.MaxRenditions > 0 && len(sizes) > c.MaxRenditions {
+		sizes = sizes[:c.MaxRenditions]
+	}
+
+	ladder := make([]VideoProfile, 0, len(sizes))
+	for _, s := range sizes {
+		sw := s
+		if s != short {
+			sw = evenDimension(float64(s))
+		}
+		lw := evenDimension(float64(s) * float64(long) / float64(short))
+		if s == short {
+			lw = long
+		}
+		w, h := lw, sw
+		if portrait {
+			w, h = sw, lw
+		}
+		fn, fd := num, den
+		if s < 720 && float64(num)/float64(den) > 30 {
+			// eg 60fps to 30fps and 50fps to 25fps
+			if fn%2 == 0 {
+				fn /= 2
+			} else {
+				fd *= 2
+			}
+		}
+		fps := float64(fn) / float64(fd)
+		bitrate := ladderBitrate(w, h, fps, complexity)
+		if c.MaxBitrate > 0 && bitrate > c.MaxBitrate {
+			bitrate = c.MaxBitrate
+		}
+		p := VideoProfile{
+			Name:        fmt.Sprintf("P%dp%gfps%dx%d", s, math.Round(fps*100)/100, aspectW, aspectH),
+			Bitrate:     fmt.Sprintf("%dk", bitrate/1000),
+			Framerate:   fn,
+			Resolution:  fmt.Sprintf("%dx%d", w, h),
+			AspectRatio: fmt.Sprintf("%d:%d", aspectW, aspectH),
+			Format:      probe.Format,
+			Profile:     probe.Profile,
+			GOP:         probe.GOP,
+		}
+		if fd != 1 {
+			p.FramerateDen = fd
+		}
+		ladder = append(ladder, p)
+	}
+	return ladder, nil
+}
+
+// MeasureComplexity estimates the relative complexity of the video in the
+// given file for LadderConstraints.Complexity, by encoding it at constant
+// quality and comparing the resulting bitrate with that of typical content.
+// Short samples of a few seconds are sufficient.
+func MeasureComplexity(fname string) (float64, error) {
+	dir, err := ioutil.TempDir("", "lpms-complexity")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	sample := VideoProfile{Name: "complexity", Resolution: "640x360", Bitrate: "0", Framerate: 30}
+	out := TranscodeOptions{
+		Oname:        filepath.Join(dir, "sample.ts"),
+		Profile:      sample,
+		VideoEncoder: ComponentOptions{Name: "libx264", Opts: map[string]string{"crf": "23", "preset": "veryfast"}},
+		AudioEncoder: ComponentOptions{Name: "drop"},
+	}
+	res, err := Transcode3(&TranscodeOptionsIn{Fname: fname}, []TranscodeOptions{out})
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(out.Oname)
+	if err != nil {
+		return 0, err
+	}
+	enc := res.Encoded[0]
+	if enc.Frames <= 0 {
+		return 0, ErrTranscoderVid
+	}
+	// Dimensions of the sample vary with the aspect ratio of the input
+	pixelsPerFrame := float64(enc.Pixels) / float64(enc.Frames)
+	seconds := float64(enc.Frames) / float64(sample.Framerate)
+	rate := float64(info.Size()) * 8 / seconds
+	ref := ladderRefBitrate * math.Pow(pixelsPerFrame/ladderRefPixels, 0.75) * complexityRefRatio
+	return rate / ref, nil
+}
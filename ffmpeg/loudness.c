@@ -0,0 +1,168 @@
+#include "loudness.h"
+#include "filter.h"
+#include "logging.h"
+
+#include <libavfilter/buffersrc.h>
+#include <libavfilter/buffersink.h>
+#include <libavutil/channel_layout.h>
+#include <math.h>
+
+//
+// Loudness normalisation
+//
+// Audio is measured by ebur128 ahead of a gain stage in the audio filters of
+// each output, and normalised with a single gain rather than dynamically so
+// there is no lookahead:
+//
+//   ebur128 -> volume -> aformat -> sink
+//
+// In the live mode the gain follows the integrated loudness of the input as
+// measured so far. In the two-pass mode each input is first decoded once to
+// measure the whole of each audio track, and the gain is fixed from the start.
+// The gain is limited so the true peak stays below the configured maximum.
+//
+
+int read_loudness(AVFrame *frame, struct loudness_stats *stats)
+{
+  // Returns whether the frame carries measurements
+  AVDictionaryEntry *e = av_dict_get(frame->metadata, "lavfi.r128.I", NULL, 0);
+  double peak = 0;
+  char key[64];
+  if (!e) return 0;
+  stats->loudness = strtod(e->value, NULL);
+  for (int ch = 0; ch < frame->channels; ch++) {
+    snprintf(key, sizeof key, "lavfi.r128.true_peaks_ch%d", ch);
+    e = av_dict_get(frame->metadata, key, NULL, 0);
+    if (e) peak = FFMAX(peak, strtod(e->value, NULL));
+  }
+  stats->true_peak = peak > 0 ? 20 * log10(peak) : MIN_LOUDNESS;
+  return 1;
+}
+
+double loudness_gain(loudness_params *params, struct loudness_stats *stats)
+{
+  // Gain in dB to reach the target, or none until there's enough to measure
+  double gain = 0;
+  if (stats->loudness <= MIN_LOUDNESS) return 0;
+  gain = params->target - stats->loudness;
+  if (stats->true_peak + gain > params->true_peak) {
+    gain = params->true_peak - stats->true_peak;
+  }
+  return gain;
+}
+
+int needs_loudness_pass(output_params *params, int nb_outputs)
+{
+  for (int i = 0; i < nb_outputs; i++) {
+    if (params[i].loudness.target && params[i].loudness.two_pass) return 1;
+  }
+  return 0;
+}
+
+static int init_measurement(struct frame_graph *g, AVStream *ist, AVFrame *frame)
+{
+  char args[512];
+  AVRational tb = ist->time_base;
+  uint64_t layout = frame->channel_layout;
+
+  if (!layout) layout = av_get_default_channel_layout(frame->channels);
+  snprintf(args, sizeof args,
+    "time_base=%d/%d:sample_rate=%d:sample_fmt=%s:channel_layout=0x%"PRIx64,
+    tb.num, tb.den, frame->sample_rate,
+    av_get_sample_fmt_name(frame->format), layout);
+  return init_frame_graph(g, "abuffer", args, "abuffersink",
+                          "[in]ebur128=peak=true:metadata=1[out]");
+}
+
+static int drain_measurement(struct frame_graph *g, AVFrame *frame, struct input_audio *ia)
+{
+  int ret = 0;
+  struct loudness_stats stats;
+
+  while (1) {
+    av_frame_unref(frame);
+    ret = av_buffersink_get_frame(g->sink, frame);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) return 0;
+    if (ret < 0) LPMS_ERR(drain_measurement_err, "Error consuming the loudness filtergraph");
+    if (read_loudness(frame, &stats)) {
+      // measurements are cumulative, so the last ones cover the whole track
+      ia->loudness = stats.loudness;
+      ia->true_peak = stats.true_peak;
+      ia->measured = 1;
+    }
+  }
+
+drain_measurement_err:
+  return ret;
+}
+
+int measure_loudness(input_params *params, struct input_ctx *ictx)
+{
+  int ret = 0, track = -1;
+  input_params inp = *params;
+  struct input_ctx m;
+  struct frame_graph graphs[MAX_AUDIO_TRACKS];
+  AVFrame *frame = NULL, *out = NULL;
+  AVPacket pkt = {0};
+
+  memset(&m, 0, sizeof m);
+  memset(graphs, 0, sizeof graphs);
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) ictx->audio[i].measured = 0;
+
+  // Only audio is measured, in software. Demuxer options are consumed when
+  // opening the input so leave the originals for the transcode.
+  inp.hw_type = AV_HWDEVICE_TYPE_NONE;
+  inp.device = NULL;
+  inp.demuxer.opts = NULL;
+  ret = av_dict_copy(&inp.demuxer.opts, params->demuxer.opts, 0);
+  if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to copy demuxer options");
+  m.dv = 1;
+  ret = open_input(&inp, &m);
+  if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to open input to measure loudness");
+
+  frame = av_frame_alloc();
+  out = av_frame_alloc();
+  if (!frame || !out) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(measure_cleanup, "Unable to allocate loudness frames");
+  }
+  av_init_packet(&pkt);
+  while (1) {
+    AVStream *ist = NULL;
+    av_frame_unref(frame);
+    ret = process_in(&m, frame, &pkt);
+    if (AVERROR_EOF == ret) break;
+    else if (lpms_ERR_PACKET_ONLY == ret) goto next_packet;
+    else if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to decode input to measure loudness");
+    ist = m.ic->streams[pkt.stream_index];
+    track = audio_track(&m, ist->index);
+    if (track < 0 || !frame->nb_samples) goto next_packet;
+    if (!graphs[track].graph) {
+      ret = init_measurement(&graphs[track], ist, frame);
+      if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to set up loudness filtergraph");
+    }
+    ret = av_buffersrc_write_frame(graphs[track].src, frame);
+    if (ret < 0) LPMS_ERR(measure_cleanup, "Error feeding the loudness filtergraph");
+    ret = drain_measurement(&graphs[track], out, &ictx->audio[track]);
+    if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to measure loudness");
+next_packet:
+    av_packet_unref(&pkt);
+  }
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) {
+    if (!graphs[i].graph) continue;
+    ret = av_buffersrc_write_frame(graphs[i].src, NULL);
+    if (ret < 0) LPMS_ERR(measure_cleanup, "Error flushing the loudness filtergraph");
+    ret = drain_measurement(&graphs[i], out, &ictx->audio[i]);
+    if (ret < 0) LPMS_ERR(measure_cleanup, "Unable to measure loudness");
+  }
+
+measure_cleanup:
+  for (int i = 0; i < MAX_AUDIO_TRACKS; i++) free_frame_graph(&graphs[i]);
+  if (frame) av_frame_free(&frame);
+  if (out) av_frame_free(&out);
+  av_packet_unref(&pkt);
+  if (m.first_pkt) av_packet_free(&m.first_pkt);
+  free_input(&m);
+  av_dict_free(&inp.demuxer.opts);
+  return ret == AVERROR_EOF ? 0 : ret;
+}
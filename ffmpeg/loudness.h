@@ -0,0 +1,20 @@
+#ifndef _LPMS_LOUDNESS_H_
+#define _LPMS_LOUDNESS_H_
+
+#include "decoder.h"
+
+// Loudness below this is silence or too short to measure
+#define MIN_LOUDNESS -70.0
+
+// Integrated loudness and true peak read from ebur128 frame metadata
+struct loudness_stats {
+  double loudness;  // LUFS
+  double true_peak; // dBTP
+};
+
+int    read_loudness(AVFrame *frame, struct loudness_stats *stats);
+double loudness_gain(loudness_params *params, struct loudness_stats *stats);
+int    needs_loudness_pass(output_params *params, int nb_outputs);
+int    measure_loudness(input_params *params, struct input_ctx *ictx);
+
+#endif // _LPMS_LOUDNESS_H_
@@ -0,0 +1,62 @@
+package ffmpeg
+
+import (
+	"time"
+	"unsafe"
+)
+
+// #cgo pkg-config: libavformat libavfilter libavcodec libavutil
+// #include <stdlib.h>
+// #include "transcoder.h"
+import "C"
+
+// A timed metadata payload, such as an ID3 tag, presented at the given
+// timestamp of the input. Transcode muxes these as a timed ID3 stream into
+// every MPEG-TS output; other formats ignore them. The segmenter keeps the
+// stream when splitting MPEG-TS.
+type TimedMetadata struct {
+	PTS  time.Duration
+	Data []byte
+}
+
+// ID3Text returns an ID3v2.4 tag with a single user defined text (TXXX)
+// frame, suitable as the Data of a TimedMetadata.
+func ID3Text(desc, value string) []byte {
+	// UTF-8 encoding byte, then the NUL terminated description and the value
+	body := append([]byte{3}, desc...)
+	body = append(body, 0)
+	body = append(body, value...)
+
+	frame := append([]byte("TXXX"), syncsafe(len(body))...)
+	frame = append(frame, 0, 0) // frame flags
+	frame = append(frame, body...)
+
+	tag := append([]byte("ID3"), 4, 0, 0) // version 2.4.0, no flags
+	tag = append(tag, syncsafe(len(frame))...)
+	return append(tag, frame...)
+}
+
+// ID3v2 sizes are stored with 7 bits per byte.
+func syncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// Copies the metadata into C memory, which the input params can reference.
+func newTimedMetadata(md []TimedMetadata) (*C.timed_metadata, func()) {
+	if len(md) <= 0 {
+		return nil, func() {}
+	}
+	ptr := (*C.timed_metadata)(C.calloc(C.size_t(len(md)), C.sizeof_timed_metadata))
+	arr := (*[1 << 20]C.timed_metadata)(unsafe.Pointer(ptr))[:len(md):len(md)]
+	for i, m := range md {
+		arr[i].pts = C.double(m.PTS.Seconds())
+		arr[i].data = (*C.uint8_t)(C.CBytes(m.Data))
+		arr[i].size = C.int(len(m.Data))
+	}
+	return ptr, func() {
+		for i := range arr {
+			C.free(unsafe.Pointer(arr[i].data))
+		}
+		C.free(unsafe.Pointer(ptr))
+	}
+}
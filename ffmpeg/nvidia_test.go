@@ -136,7 +136,7 @@ func TestNvidia_BadCodecs(t *testing.T) {
 func TestNvidia_Pixfmts(t *testing.T) {
 
 	// Following test case validates pixel format at the decoding end
-	// Currently only YUV 4:2:0 is supported
+	// Only YUV 4:2:0 is decoded on the GPU; other formats fall back to software
 	run, dir := setupTest(t)
 	defer os.RemoveAll(dir)
 
@@ -179,14 +179,22 @@ func TestNvidia_Pixfmts(t *testing.T) {
 			Profile: prof,
 			Accel:   Software,
 		},
+		{
+			Oname:   dir + "/out422p-nv.mp4",
+			Profile: prof,
+			Accel:   Nvidia,
+		},
 	})
-	if err == nil || err.Error() != "Unsupported input pixel format" {
+	if err != nil {
 		t.Error(err)
 	}
 
 	cmd = `
     # Check that 420p input produces 420p output for hw -> hw
     ffprobe -loglevel warning out420p.mp4  -show_streams -select_streams v | grep pix_fmt=yuv420p
+    # Check that 422p input is converted to 420p
+    ffprobe -loglevel warning out422p.mp4  -show_streams -select_streams v | grep pix_fmt=yuv420p
+    ffprobe -loglevel warning out422p-nv.mp4  -show_streams -select_streams v | grep pix_fmt=yuv420p
   `
 	run(cmd)
 
@@ -788,6 +796,10 @@ func TestNvidia_AudioOnly(t *testing.T) {
 	audioOnlySegment(t, Nvidia)
 }
 
+func TestNvidia_DynamicDecoding(t *testing.T) {
+	dynamicDecoding(t, Nvidia)
+}
+
 /*
 func TestNvidia_NoKeyframe(t *testing.T) {
 	noKeyframeSegment(t, Nvidia)
@@ -0,0 +1,714 @@
+#include "quality.h"
+#include "decoder.h"
+#include "logging.h"
+
+#include <libavfilter/avfilter.h>
+#include <libavfilter/buffersrc.h>
+#include <libavfilter/buffersink.h>
+#include <libavutil/avstring.h>
+
+//
+// Quality comparison
+//
+// Both inputs are fed into a single filtergraph:
+//
+//   [dist] -> (setpts), scale, format, (select), split -> [d0] [d1] ...
+//   [ref]  -> (setpts), scale, format, (select), split -> [r0] [r1] ...
+//   [d0][r0] -> psnr -> sink ; [d1][r1] -> ssim -> sink ; ...
+//
+// The metric filters pair up frames by timestamp. Per-frame scores are read
+// back from the frame metadata set by each metric filter. libvmaf doesn't set
+// frame metadata so VMAF scores are written to a log which is read by the
+// caller.
+//
+// When comparing files, both are decoded and their timestamps are reset to
+// start at zero. When comparing an output while transcoding, the reference
+// frames come from a branch of the output's video filtergraph that samples
+// the input after any frame rate conversion, so each has the timestamp of an
+// encoded frame. The encoded packets are decoded back, and only the frames
+// matching a sampled reference are compared.
+//
+
+struct quality_input {
+  struct input_ctx ictx;
+  AVFilterContext *src;
+  int eof;
+  double last_ts; // seconds; used to keep both inputs roughly in step
+};
+
+static int create_source(AVFilterContext **src, const char *name, int w, int h,
+  int pix_fmt, AVRational sar, AVRational tb, AVFilterGraph *graph,
+  AVFilterInOut **outputs)
+{
+  char args[512];
+  int ret = 0;
+  AVFilterInOut *out = avfilter_inout_alloc();
+
+  if (!out) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(create_source_err, "Unable to allocate comparison source");
+  }
+  snprintf(args, sizeof args,
+    "video_size=%dx%d:pix_fmt=%d:time_base=%d/%d:pixel_aspect=%d/%d",
+    w, h, pix_fmt, tb.num, tb.den, sar.num, sar.den);
+  ret = avfilter_graph_create_filter(src, avfilter_get_by_name("buffer"),
+                                     name, args, NULL, graph);
+  if (ret < 0) LPMS_ERR(create_source_err, "Cannot create comparison source");
+
+  out->name       = av_strdup(name);
+  out->filter_ctx = *src;
+  out->pad_idx    = 0;
+  out->next       = *outputs;
+  *outputs = out;
+  return 0;
+
+create_source_err:
+  avfilter_inout_free(&out);
+  return ret;
+}
+
+static int create_input_source(struct quality_input *in, const char *name,
+  AVFilterGraph *graph, AVFilterInOut **outputs)
+{
+  AVCodecContext *vc = in->ictx.vc;
+  AVRational tb = in->ictx.ic->streams[in->ictx.vi]->time_base;
+  return create_source(&in->src, name, vc->width, vc->height, vc->pix_fmt,
+    vc->sample_aspect_ratio, tb, graph, outputs);
+}
+
+static int create_sink(struct quality_sink *sink, int idx,
+  AVFilterGraph *graph, AVFilterInOut **inputs)
+{
+  char name[16];
+  int ret = 0;
+  AVFilterInOut *in = avfilter_inout_alloc();
+
+  if (!in) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(create_sink_err, "Unable to allocate comparison sink");
+  }
+  snprintf(name, sizeof name, "m%d", idx);
+  ret = avfilter_graph_create_filter(&sink->ctx, avfilter_get_by_name("buffersink"),
+                                     name, NULL, NULL, graph);
+  if (ret < 0) LPMS_ERR(create_sink_err, "Cannot create comparison sink");
+
+  in->name       = av_strdup(name);
+  in->filter_ctx = sink->ctx;
+  in->pad_idx    = 0;
+  in->next       = *inputs;
+  *inputs = in;
+  return 0;
+
+create_sink_err:
+  avfilter_inout_free(&in);
+  return ret;
+}
+
+// Lists the requested metrics. Returns their number, or a negative error.
+static int init_sinks(struct quality_sink *sinks, quality_params *params)
+{
+  int ret = 0, nb_sinks = 0;
+
+  memset(sinks, 0, MAX_QUALITY_METRICS * sizeof *sinks);
+  if (params->psnr) sinks[nb_sinks++].metric = METRIC_PSNR;
+  if (params->ssim) sinks[nb_sinks++].metric = METRIC_SSIM;
+  if (params->vmaf) {
+    if (!avfilter_get_by_name("libvmaf")) {
+      ret = AVERROR_FILTER_NOT_FOUND;
+      LPMS_ERR(init_sinks_err, "VMAF requested but libvmaf is not available");
+    }
+    sinks[nb_sinks++].metric = METRIC_VMAF;
+  }
+  if (!nb_sinks) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(init_sinks_err, "No quality metrics requested");
+  }
+  return nb_sinks;
+
+init_sinks_err:
+  return ret;
+}
+
+static size_t append_input_chain(char *descr, size_t size, const char *name,
+  char prefix, double sample_interval, int w, int h, int nb_metrics)
+{
+  // Sampling is left to the transcode when comparing while transcoding
+  av_strlcatf(descr, size, "[%s]", name);
+  if (sample_interval >= 0) av_strlcat(descr, "setpts=PTS-STARTPTS,", size);
+  av_strlcatf(descr, size, "scale=%d:%d,format=yuv420p", w, h);
+  if (sample_interval > 0) {
+    av_strlcatf(descr, size,
+      ",select='isnan(prev_selected_t)+gte(t-prev_selected_t\\,%f)'",
+      sample_interval);
+  }
+  av_strlcatf(descr, size, ",split=%d", nb_metrics);
+  for (int i = 0; i < nb_metrics; i++) av_strlcatf(descr, size, "[%c%d]", prefix, i);
+  return av_strlcat(descr, ";", size);
+}
+
+// Links the sources, which must be named "dist" and "ref", to the metrics.
+// A negative sample interval leaves the input timestamps and sampling as-is.
+static int init_comparison(AVFilterGraph *graph, AVFilterInOut **outputs,
+  struct quality_sink *sinks, int nb_sinks, quality_params *params,
+  double sample_interval, int w, int h)
+{
+  int ret = 0;
+  size_t len = 0;
+  char descr[4096] = {0};
+  AVFilterInOut *ins = NULL;
+
+  append_input_chain(descr, sizeof descr, "dist", 'd', sample_interval, w, h, nb_sinks);
+  append_input_chain(descr, sizeof descr, "ref", 'r', sample_interval, w, h, nb_sinks);
+  for (int i = 0; i < nb_sinks; i++) {
+    ret = create_sink(&sinks[i], i, graph, &ins);
+    if (ret < 0) LPMS_ERR(init_comparison_err, "Unable to create comparison sink");
+    av_strlcatf(descr, sizeof descr, "%s[d%d][r%d]", i ? ";" : "", i, i);
+    switch (sinks[i].metric) {
+    case METRIC_PSNR: av_strlcat(descr, "psnr", sizeof descr); break;
+    case METRIC_SSIM: av_strlcat(descr, "ssim", sizeof descr); break;
+    case METRIC_VMAF: av_strlcatf(descr, sizeof descr, "libvmaf=%s", params->vmaf); break;
+    }
+    len = av_strlcatf(descr, sizeof descr, "[m%d]", i);
+  }
+  if (len >= sizeof descr) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR(init_comparison_err, "Comparison filtergraph description is too long");
+  }
+  ret = avfilter_graph_parse_ptr(graph, descr, &ins, outputs, NULL);
+  if (ret < 0) LPMS_ERR(init_comparison_err, "Unable to parse comparison filters desc");
+  ret = avfilter_graph_config(graph, NULL);
+  if (ret < 0) LPMS_ERR(init_comparison_err, "Unable to configure comparison filtergraph");
+
+init_comparison_err:
+  avfilter_inout_free(&ins);
+  avfilter_inout_free(outputs);
+  return ret;
+}
+
+static int record_frame(struct quality_sink *sink, AVFrame *frame,
+  quality_results *res, int *cap)
+{
+  int idx = sink->count++;
+  AVDictionaryEntry *e = NULL;
+  double tb = av_q2d(av_buffersink_get_time_base(sink->ctx));
+
+  if (idx >= *cap) {
+    int n = *cap ? *cap * 2 : 64;
+    if (av_reallocp_array(&res->time, n, sizeof(double)) < 0 ||
+        av_reallocp_array(&res->psnr, n, sizeof(double)) < 0 ||
+        av_reallocp_array(&res->ssim, n, sizeof(double)) < 0) {
+      return AVERROR(ENOMEM);
+    }
+    *cap = n;
+  }
+  res->time[idx] = frame->pts * tb;
+  switch (sink->metric) {
+  case METRIC_PSNR:
+    e = av_dict_get(frame->metadata, "lavfi.psnr.psnr_avg", NULL, 0);
+    if (e) res->psnr[idx] = strtod(e->value, NULL);
+    break;
+  case METRIC_SSIM:
+    e = av_dict_get(frame->metadata, "lavfi.ssim.All", NULL, 0);
+    if (e) res->ssim[idx] = strtod(e->value, NULL);
+    break;
+  case METRIC_VMAF:
+    break; // read from the log by the caller
+  }
+  return 0;
+}
+
+static int drain_sinks(struct quality_sink *sinks, int nb_sinks, AVFrame *frame,
+  quality_results *res, int *cap)
+{
+  int ret = 0;
+  for (int i = 0; i < nb_sinks; i++) {
+    while (1) {
+      ret = av_buffersink_get_frame(sinks[i].ctx, frame);
+      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) break;
+      else if (ret < 0) LPMS_ERR(drain_cleanup, "Error reading comparison results");
+      ret = record_frame(&sinks[i], frame, res, cap);
+      av_frame_unref(frame);
+      if (ret < 0) LPMS_ERR(drain_cleanup, "Unable to store comparison results");
+    }
+  }
+  ret = 0;
+
+drain_cleanup:
+  return ret;
+}
+
+static void finish_results(struct quality_sink *sinks, int nb_sinks,
+  quality_params *params, quality_results *res)
+{
+  // Only report frames that have scores for every metric
+  res->nb_frames = sinks[0].count;
+  for (int i = 1; i < nb_sinks; i++) {
+    res->nb_frames = FFMIN(res->nb_frames, sinks[i].count);
+  }
+  if (!params->psnr) av_freep(&res->psnr);
+  if (!params->ssim) av_freep(&res->ssim);
+}
+
+static int feed_input(struct quality_input *in, AVFrame *frame, AVPacket *pkt)
+{
+  int ret = 0;
+  AVRational tb = in->ictx.ic->streams[in->ictx.vi]->time_base;
+
+  while (1) {
+    av_frame_unref(frame);
+    ret = process_in(&in->ictx, frame, pkt);
+    if (AVERROR_EOF == ret) {
+      in->eof = 1;
+      ret = av_buffersrc_add_frame(in->src, NULL); // signal EOF to the graph
+      if (ret < 0) LPMS_ERR(feed_cleanup, "Unable to close comparison input");
+      break;
+    } else if (lpms_ERR_PACKET_ONLY == ret) ; // no frame yet
+    else if (ret < 0) LPMS_ERR(feed_cleanup, "Unable to decode comparison input");
+    else if (pkt->stream_index == in->ictx.vi && frame->width &&
+             !is_flush_frame(frame)) {
+      frame->pts = frame->best_effort_timestamp;
+      in->last_ts = frame->pts * av_q2d(tb);
+      ret = av_buffersrc_write_frame(in->src, frame);
+      if (ret < 0) LPMS_ERR(feed_cleanup, "Error feeding the comparison filtergraph");
+      break;
+    }
+    av_packet_unref(pkt);
+  }
+
+feed_cleanup:
+  av_packet_unref(pkt);
+  return ret;
+}
+
+int lpms_compare_quality(quality_params *params, quality_results *res)
+{
+  int ret = 0, nb_sinks = 0, cap = 0, w = params->w, h = params->h;
+  struct quality_input inputs[2]; // distorted, reference
+  struct quality_sink sinks[MAX_QUALITY_METRICS];
+  char *fnames[2] = { params->distorted, params->reference };
+  const char *names[2] = { "dist", "ref" };
+  AVFilterGraph *graph = NULL;
+  AVFilterInOut *outputs = NULL;
+  AVFrame *frame = NULL;
+  AVPacket pkt = {0};
+
+  memset(res, 0, sizeof *res);
+  memset(inputs, 0, sizeof inputs);
+  ret = nb_sinks = init_sinks(sinks, params);
+  if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to select quality metrics");
+
+  // Open inputs. Only video is compared, so skip decoding audio
+  for (int i = 0; i < 2; i++) {
+    input_params inp = {0};
+    inp.fname = fnames[i];
+    inp.hw_type = AV_HWDEVICE_TYPE_NONE;
+    inputs[i].ictx.audio[0].skip = 1;
+    ret = open_input(&inp, &inputs[i].ictx);
+    if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to open comparison input");
+    if (!inputs[i].ictx.vc) {
+      ret = AVERROR_STREAM_NOT_FOUND;
+      LPMS_ERR(quality_cleanup, "No video to compare in input");
+    }
+  }
+  if (!w || !h) {
+    w = inputs[1].ictx.vc->width;
+    h = inputs[1].ictx.vc->height;
+  }
+
+  // Set up the filtergraph
+  graph = avfilter_graph_alloc();
+  if (!graph) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(quality_cleanup, "Unable to allocate comparison filtergraph");
+  }
+  for (int i = 0; i < 2; i++) {
+    ret = create_input_source(&inputs[i], names[i], graph, &outputs);
+    if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to create comparison source");
+  }
+  ret = init_comparison(graph, &outputs, sinks, nb_sinks, params,
+    params->sample_interval, w, h);
+  if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to set up comparison filters");
+
+  frame = av_frame_alloc();
+  if (!frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(quality_cleanup, "Unable to allocate comparison frame");
+  }
+  av_init_packet(&pkt);
+  while (!inputs[0].eof || !inputs[1].eof) {
+    // Feed whichever input is behind to limit buffering within the metrics
+    struct quality_input *in = &inputs[0];
+    if (in->eof || (!inputs[1].eof && inputs[1].last_ts < in->last_ts)) {
+      in = &inputs[1];
+    }
+    ret = feed_input(in, frame, &pkt);
+    if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to feed comparison input");
+    ret = drain_sinks(sinks, nb_sinks, frame, res, &cap);
+    if (ret < 0) LPMS_ERR(quality_cleanup, "Unable to drain comparison filters");
+  }
+  finish_results(sinks, nb_sinks, params, res);
+
+quality_cleanup:
+  avfilter_inout_free(&outputs);
+  // libvmaf writes out its log when the graph is freed
+  if (graph) avfilter_graph_free(&graph);
+  if (frame) av_frame_free(&frame);
+  av_packet_unref(&pkt);
+  for (int i = 0; i < 2; i++) {
+    if (inputs[i].ictx.first_pkt) av_packet_free(&inputs[i].ictx.first_pkt);
+    free_input(&inputs[i].ictx);
+  }
+  if (ret < 0) lpms_quality_free(res);
+  return ret;
+}
+
+void lpms_quality_free(quality_results *res)
+{
+  av_freep(&res->time);
+  av_freep(&res->psnr);
+  av_freep(&res->ssim);
+  res->nb_frames = 0;
+}
+
+//
+// Comparison while transcoding
+//
+
+int init_quality(struct quality_ctx *q, AVCodecContext *encoder, AVRational tb)
+{
+  int ret = 0;
+  const AVCodec *codec = NULL;
+  AVCodecParameters *par = NULL;
+
+  if (!q->params) return 0;
+  q->tb = tb;
+  if (!q->frame) q->frame = av_frame_alloc();
+  if (!q->frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(init_quality_err, "Unable to allocate comparison frame");
+  }
+  ret = q->nb_sinks = init_sinks(q->sinks, q->params);
+  if (ret < 0) LPMS_ERR(init_quality_err, "Unable to select quality metrics");
+  ret = 0;
+  if (q->dec && q->encoder == encoder) return 0; // kept from the last segment
+
+  // Decode the encoded video in software, whatever encoded it
+  avcodec_free_context(&q->dec);
+  codec = avcodec_find_decoder(encoder->codec_id);
+  if (!codec) {
+    ret = AVERROR_DECODER_NOT_FOUND;
+    LPMS_ERR(init_quality_err, "Unable to find decoder for the compared output");
+  }
+  q->dec = avcodec_alloc_context3(codec);
+  par = avcodec_parameters_alloc();
+  if (!q->dec || !par) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(init_quality_err, "Unable to allocate decoder for the compared output");
+  }
+  ret = avcodec_parameters_from_context(par, encoder);
+  if (ret < 0) LPMS_ERR(init_quality_err, "Unable to read parameters of the compared output");
+  ret = avcodec_parameters_to_context(q->dec, par);
+  if (ret < 0) LPMS_ERR(init_quality_err, "Unable to set parameters of the compared output");
+  q->dec->pkt_timebase = tb;
+  ret = avcodec_open2(q->dec, codec, NULL);
+  if (ret < 0) LPMS_ERR(init_quality_err, "Unable to open decoder for the compared output");
+  q->encoder = encoder;
+
+init_quality_err:
+  avcodec_parameters_free(&par);
+  if (ret < 0) avcodec_free_context(&q->dec);
+  return ret;
+}
+
+int quality_add_reference(struct quality_ctx *q, AVFrame *frame)
+{
+  // Takes over the frame
+  int ret = 0;
+  AVFrame *ref = NULL;
+
+  if (q->nb_refs >= q->refs_cap) {
+    int n = q->refs_cap ? q->refs_cap * 2 : 8;
+    ret = av_reallocp_array(&q->refs, n, sizeof *q->refs);
+    if (ret < 0) LPMS_ERR(add_ref_err, "Unable to queue comparison frame");
+    q->refs_cap = n;
+  }
+  ref = av_frame_alloc();
+  if (!ref) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(add_ref_err, "Unable to allocate comparison frame");
+  }
+  av_frame_move_ref(ref, frame);
+  q->refs[q->nb_refs++] = ref;
+
+add_ref_err:
+  av_frame_unref(frame);
+  return ret;
+}
+
+static void pop_reference(struct quality_ctx *q, AVFrame **ref)
+{
+  AVFrame *first = q->refs[0];
+  memmove(q->refs, q->refs + 1, --q->nb_refs * sizeof *q->refs);
+  if (ref) *ref = first;
+  else av_frame_free(&first);
+}
+
+static int open_comparison(struct quality_ctx *q, AVFrame *dist, AVFrame *ref)
+{
+  int ret = 0;
+  int w = q->params->w ? q->params->w : ref->width;
+  int h = q->params->h ? q->params->h : ref->height;
+  AVFilterInOut *outputs = NULL;
+
+  q->graph = avfilter_graph_alloc();
+  if (!q->graph) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_comparison_err, "Unable to allocate comparison filtergraph");
+  }
+  ret = create_source(&q->dist, "dist", dist->width, dist->height, dist->format,
+    dist->sample_aspect_ratio, q->tb, q->graph, &outputs);
+  if (ret < 0) LPMS_ERR(open_comparison_err, "Unable to create comparison source");
+  ret = create_source(&q->ref, "ref", ref->width, ref->height, ref->format,
+    ref->sample_aspect_ratio, q->tb, q->graph, &outputs);
+  if (ret < 0) LPMS_ERR(open_comparison_err, "Unable to create comparison source");
+  ret = init_comparison(q->graph, &outputs, q->sinks, q->nb_sinks, q->params, -1, w, h);
+  if (ret < 0) LPMS_ERR(open_comparison_err, "Unable to set up comparison filters");
+
+open_comparison_err:
+  avfilter_inout_free(&outputs);
+  return ret;
+}
+
+// Compares a frame decoded from the output if its input frame was sampled
+static int compare_frame(struct quality_ctx *q, AVFrame *dist)
+{
+  int ret = 0;
+  AVFrame *ref = NULL;
+  int64_t pts = dist->best_effort_timestamp;
+
+  // Sampled frames that were never encoded can't be compared
+  while (q->nb_refs && q->refs[0]->pts < pts) pop_reference(q, NULL);
+  if (!q->nb_refs || q->refs[0]->pts != pts) return 0; // not sampled
+  pop_reference(q, &ref);
+
+  if (!q->graph) {
+    ret = open_comparison(q, dist, ref);
+    if (ret < 0) LPMS_ERR(compare_frame_err, "Unable to open comparison");
+  }
+  dist->pts = pts;
+  ret = av_buffersrc_write_frame(q->dist, dist);
+  if (ret < 0) LPMS_ERR(compare_frame_err, "Error feeding the compared output");
+  ret = av_buffersrc_write_frame(q->ref, ref);
+  if (ret < 0) LPMS_ERR(compare_frame_err, "Error feeding the compared input");
+  ret = drain_sinks(q->sinks, q->nb_sinks, q->frame, q->res, &q->cap);
+
+compare_frame_err:
+  av_frame_free(&ref);
+  return ret;
+}
+
+static int decode_output(struct quality_ctx *q, AVPacket *pkt)
+{
+  int ret = avcodec_send_packet(q->dec, pkt);
+  if (ret < 0) LPMS_ERR(decode_output_err, "Error decoding the compared output");
+  while (1) {
+    AVFrame *frame = q->frame;
+    ret = avcodec_receive_frame(q->dec, frame);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) return 0;
+    if (ret < 0) LPMS_ERR(decode_output_err, "Error decoding the compared output");
+    ret = compare_frame(q, frame);
+    av_frame_unref(frame);
+    if (ret < 0) return ret;
+  }
+
+decode_output_err:
+  return ret;
+}
+
+int quality_add_packet(struct quality_ctx *q, AVPacket *pkt)
+{
+  // Packets are in the time base of the reference frames
+  if (!q->params || !q->dec) return 0;
+  return decode_output(q, pkt);
+}
+
+int finish_quality(struct quality_ctx *q)
+{
+  // Compares what remains of the segment and completes its results
+  int ret = 0;
+
+  if (!q->params || !q->dec) return 0;
+  ret = decode_output(q, NULL);
+  if (ret < 0) LPMS_ERR(finish_quality_err, "Unable to drain the compared output");
+  if (q->graph) {
+    ret = av_buffersrc_add_frame(q->dist, NULL);
+    if (ret >= 0) ret = av_buffersrc_add_frame(q->ref, NULL);
+    if (ret < 0) LPMS_ERR(finish_quality_err, "Unable to close comparison inputs");
+    ret = drain_sinks(q->sinks, q->nb_sinks, q->frame, q->res, &q->cap);
+    if (ret < 0) LPMS_ERR(finish_quality_err, "Unable to drain comparison filters");
+    finish_results(q->sinks, q->nb_sinks, q->params, q->res);
+  }
+
+finish_quality_err:
+  return ret;
+}
+
+void close_quality(struct quality_ctx *q)
+{
+  // Ends the segment. The decoder is kept along with the encoder.
+  // libvmaf writes out its log when the graph is freed
+  if (q->graph) avfilter_graph_free(&q->graph);
+  q->dist = q->ref = NULL;
+  while (q->nb_refs) pop_reference(q, NULL);
+  if (q->dec) avcodec_flush_buffers(q->dec);
+  q->cap = 0;
+  q->res = NULL;
+  q->params = NULL;
+}
+
+void free_quality(struct quality_ctx *q)
+{
+  close_quality(q);
+  avcodec_free_context(&q->dec);
+  av_frame_free(&q->frame);
+  av_freep(&q->refs);
+  q->refs_cap = 0;
+  q->encoder = NULL;
+}
+
+//
+// Frame signatures
+//
+// Each frame is reduced to a 9x8 grayscale thumbnail and hashed by comparing
+// horizontally adjacent pixels, giving one bit per comparison. This is known
+// as a difference hash. Since the thumbnail is tiny, the hash is largely
+// independent of the resolution, bitrate and codec of the input, so
+// renditions of the same content produce hashes within a few bits of each
+// other while unrelated content does not.
+//
+
+#define SIG_W 9
+#define SIG_H 8
+
+static uint64_t frame_hash(AVFrame *frame)
+{
+  uint64_t hash = 0;
+  for (int y = 0; y < SIG_H; y++) {
+    uint8_t *row = frame->data[0] + y * frame->linesize[0];
+    for (int x = 0; x < SIG_W - 1; x++) {
+      hash = (hash << 1) | (row[x] < row[x + 1]);
+    }
+  }
+  return hash;
+}
+
+static int drain_signatures(struct quality_sink *sink, AVFrame *frame,
+  signature_results *res, int *cap)
+{
+  int ret = 0;
+  double tb = av_q2d(av_buffersink_get_time_base(sink->ctx));
+
+  while (1) {
+    ret = av_buffersink_get_frame(sink->ctx, frame);
+    if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) break;
+    else if (ret < 0) LPMS_ERR(drain_sig_cleanup, "Error reading frame signatures");
+    if (res->nb_frames >= *cap) {
+      int n = *cap ? *cap * 2 : 64;
+      if (av_reallocp_array(&res->time, n, sizeof(double)) < 0 ||
+          av_reallocp_array(&res->hash, n, sizeof(uint64_t)) < 0) {
+        av_frame_unref(frame);
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(drain_sig_cleanup, "Unable to store frame signatures");
+      }
+      *cap = n;
+    }
+    res->time[res->nb_frames] = frame->pts * tb;
+    res->hash[res->nb_frames] = frame_hash(frame);
+    res->nb_frames++;
+    av_frame_unref(frame);
+  }
+  ret = 0;
+
+drain_sig_cleanup:
+  return ret;
+}
+
+int lpms_frame_signatures(char *fname, double sample_interval, signature_results *res)
+{
+  int ret = 0, cap = 0;
+  struct quality_input input;
+  struct quality_sink sink;
+  input_params inp = {0};
+  char descr[512] = {0};
+  AVFilterGraph *graph = NULL;
+  AVFilterInOut *outputs = NULL, *ins = NULL;
+  AVFrame *frame = NULL;
+  AVPacket pkt = {0};
+
+  memset(res, 0, sizeof *res);
+  memset(&input, 0, sizeof input);
+  memset(&sink, 0, sizeof sink);
+
+  // Only video is hashed, so skip decoding audio
+  inp.fname = fname;
+  inp.hw_type = AV_HWDEVICE_TYPE_NONE;
+  input.ictx.audio[0].skip = 1;
+  ret = open_input(&inp, &input.ictx);
+  if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to open signature input");
+  if (!input.ictx.vc) {
+    ret = AVERROR_STREAM_NOT_FOUND;
+    LPMS_ERR(sig_cleanup, "No video to sign in input");
+  }
+
+  graph = avfilter_graph_alloc();
+  if (!graph) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(sig_cleanup, "Unable to allocate signature filtergraph");
+  }
+  ret = create_input_source(&input, "in", graph, &outputs);
+  if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to create signature source");
+  ret = create_sink(&sink, 0, graph, &ins);
+  if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to create signature sink");
+  av_strlcat(descr, "[in]setpts=PTS-STARTPTS", sizeof descr);
+  if (sample_interval > 0) {
+    av_strlcatf(descr, sizeof descr,
+      ",select='isnan(prev_selected_t)+gte(t-prev_selected_t\\,%f)'",
+      sample_interval);
+  }
+  av_strlcatf(descr, sizeof descr, ",scale=%d:%d:flags=area,format=gray[m0]", SIG_W, SIG_H);
+  ret = avfilter_graph_parse_ptr(graph, descr, &ins, &outputs, NULL);
+  if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to parse signature filters desc");
+  ret = avfilter_graph_config(graph, NULL);
+  if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to configure signature filtergraph");
+
+  frame = av_frame_alloc();
+  if (!frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(sig_cleanup, "Unable to allocate signature frame");
+  }
+  av_init_packet(&pkt);
+  while (!input.eof) {
+    ret = feed_input(&input, frame, &pkt);
+    if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to feed signature input");
+    ret = drain_signatures(&sink, frame, res, &cap);
+    if (ret < 0) LPMS_ERR(sig_cleanup, "Unable to drain signature filters");
+  }
+
+sig_cleanup:
+  avfilter_inout_free(&ins);
+  avfilter_inout_free(&outputs);
+  if (graph) avfilter_graph_free(&graph);
+  if (frame) av_frame_free(&frame);
+  av_packet_unref(&pkt);
+  if (input.ictx.first_pkt) av_packet_free(&input.ictx.first_pkt);
+  free_input(&input.ictx);
+  if (ret < 0) lpms_signatures_free(res);
+  return ret;
+}
+
+void lpms_signatures_free(signature_results *res)
+{
+  av_freep(&res->time);
+  av_freep(&res->hash);
+  res->nb_frames = 0;
+}
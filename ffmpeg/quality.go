@@ -0,0 +1,203 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// #cgo pkg-config: libavformat libavfilter libavcodec libavutil
+// #include <stdlib.h>
+// #include "quality.h"
+import "C"
+
+type QualityOptions struct {
+	// Resolution to compare at, eg "1280x720". Defaults to the reference's.
+	Resolution string
+
+	// Metrics to compute. If none are set, PSNR and SSIM are computed.
+	PSNR bool
+	SSIM bool
+	VMAF bool // requires FFmpeg built with libvmaf
+
+	// Path to the libvmaf model; uses the library default if empty
+	VMAFModel string
+
+	// Only compare frames this far apart; compares every frame if zero
+	SampleInterval time.Duration
+}
+
+type QualityFrame struct {
+	Time time.Duration // since the start of the comparison
+	PSNR float64
+	SSIM float64
+	VMAF float64
+}
+
+type QualityResults struct {
+	Frames []QualityFrame
+
+	// Mean of the per-frame scores
+	PSNR float64
+	SSIM float64
+	VMAF float64
+}
+
+type vmafLog struct {
+	Frames []struct {
+		Metrics struct {
+			VMAF float64 `json:"vmaf"`
+		} `json:"metrics"`
+	} `json:"frames"`
+}
+
+// CompareQuality computes objective quality metrics of the video in the
+// distorted file against the video in the reference file. The distorted
+// video is rescaled to match the reference, and timestamps of both are
+// aligned to start at zero.
+func CompareQuality(reference, distorted string, opts QualityOptions) (*QualityResults, error) {
+	params, logName, free, err := newQualityParams(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer free()
+	params.reference = C.CString(reference)
+	defer C.free(unsafe.Pointer(params.reference))
+	params.distorted = C.CString(distorted)
+	defer C.free(unsafe.Pointer(params.distorted))
+
+	var res C.quality_results
+	ret := int(C.lpms_compare_quality(params, &res))
+	defer C.lpms_quality_free(&res)
+	if ret != 0 {
+		glog.Error("Quality comparison failed : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	return newQualityResults(&res, params, logName)
+}
+
+// Sets up the comparison in C memory, so output params can reference it.
+// Returns the file that VMAF scores are logged to, if requested.
+var (
+	filterOptionEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	filterGraphEscaper  = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`,
+		`]`, `\]`, `,`, `\,`, `;`, `\;`)
+)
+
+// Escapes the value of a filter option, first for the option list of the
+// filter and then for the filtergraph description it is embedded in.
+func escapeFilterOption(v string) string {
+	return filterGraphEscaper.Replace(filterOptionEscaper.Replace(v))
+}
+
+func newQualityParams(opts QualityOptions) (*C.quality_params, string, func(), error) {
+	var frees []func()
+	free := func() {
+		for i := len(frees) - 1; i >= 0; i-- {
+			frees[i]()
+		}
+	}
+	params := (*C.quality_params)(C.calloc(1, C.sizeof_quality_params))
+	frees = append(frees, func() { C.free(unsafe.Pointer(params)) })
+	if !opts.PSNR && !opts.SSIM && !opts.VMAF {
+		opts.PSNR, opts.SSIM = true, true
+	}
+	params.sample_interval = C.double(opts.SampleInterval.Seconds())
+	if opts.PSNR {
+		params.psnr = 1
+	}
+	if opts.SSIM {
+		params.ssim = 1
+	}
+	if opts.Resolution != "" {
+		w, h, err := VideoProfileResolution(VideoProfile{Resolution: opts.Resolution})
+		if err != nil {
+			free()
+			return nil, "", nil, err
+		}
+		params.w, params.h = C.int(w), C.int(h)
+	}
+
+	var logName string
+	if opts.VMAF {
+		f, err := ioutil.TempFile("", "lpms-vmaf-*.json")
+		if err != nil {
+			free()
+			return nil, "", nil, err
+		}
+		logName = f.Name()
+		f.Close()
+		frees = append(frees, func() { os.Remove(logName) })
+		vmafOpts := "log_fmt=json:log_path=" + escapeFilterOption(logName)
+		if opts.VMAFModel != "" {
+			vmafOpts += ":model_path=" + escapeFilterOption(opts.VMAFModel)
+		}
+		params.vmaf = C.CString(vmafOpts)
+		frees = append(frees, func() { C.free(unsafe.Pointer(params.vmaf)) })
+	}
+	return params, logName, free, nil
+}
+
+func newQualityResults(res *C.quality_results, params *C.quality_params, logName string) (*QualityResults, error) {
+	n := int(res.nb_frames)
+	frames := make([]QualityFrame, n)
+	if n > 0 {
+		times := (*[1 << 28]C.double)(unsafe.Pointer(res.time))[:n:n]
+		for i := range frames {
+			frames[i].Time = time.Duration(float64(times[i]) * float64(time.Second))
+		}
+		if res.psnr != nil {
+			psnr := (*[1 << 28]C.double)(unsafe.Pointer(res.psnr))[:n:n]
+			for i := range frames {
+				frames[i].PSNR = float64(psnr[i])
+			}
+		}
+		if res.ssim != nil {
+			ssim := (*[1 << 28]C.double)(unsafe.Pointer(res.ssim))[:n:n]
+			for i := range frames {
+				frames[i].SSIM = float64(ssim[i])
+			}
+		}
+	}
+	if logName != "" {
+		data, err := ioutil.ReadFile(logName)
+		if err != nil {
+			return nil, err
+		}
+		var vl vmafLog
+		if err := json.Unmarshal(data, &vl); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(frames) && i < len(vl.Frames); i++ {
+			frames[i].VMAF = vl.Frames[i].Metrics.VMAF
+		}
+	}
+
+	results := &QualityResults{Frames: frames}
+	if n > 0 {
+		for _, f := range frames {
+			results.PSNR += f.PSNR
+			results.SSIM += f.SSIM
+			results.VMAF += f.VMAF
+		}
+		results.PSNR /= float64(n)
+		results.SSIM /= float64(n)
+		results.VMAF /= float64(n)
+	}
+	if params.psnr == 0 {
+		results.PSNR = math.NaN()
+	}
+	if params.ssim == 0 {
+		results.SSIM = math.NaN()
+	}
+	if logName == "" {
+		results.VMAF = math.NaN()
+	}
+	return results, nil
+}
@@ -0,0 +1,84 @@
+#ifndef _LPMS_QUALITY_H_
+#define _LPMS_QUALITY_H_
+
+#include <stdint.h>
+#include <libavcodec/avcodec.h>
+#include <libavfilter/avfilter.h>
+
+typedef struct {
+  // Files to compare; unused when comparing an output while transcoding
+  char *reference;
+  char *distorted;
+
+  // Resolution to compare at; defaults to that of the reference
+  int w, h;
+
+  // Metrics to compute. `vmaf` holds the libvmaf filter options, if any.
+  int psnr, ssim;
+  char *vmaf;
+
+  // Seconds between sampled frames; compare every frame if zero
+  double sample_interval;
+} quality_params;
+
+typedef struct {
+  int nb_frames;
+  double *time; // seconds from the start of the comparison, or on the
+                // timeline of the input when compared while transcoding
+  double *psnr; // NULL if not computed
+  double *ssim; // NULL if not computed
+} quality_results;
+
+#define MAX_QUALITY_METRICS 3
+
+enum quality_metric { METRIC_PSNR, METRIC_SSIM, METRIC_VMAF };
+
+struct quality_sink {
+  enum quality_metric metric;
+  AVFilterContext *ctx;
+  int count; // frames received
+};
+
+// Compares the video of an output against its input while transcoding.
+// Sampled input frames are paired by timestamp with the frames decoded back
+// from the encoded output; see quality.c
+struct quality_ctx {
+  quality_params *params; // comparison disabled if NULL
+  quality_results *res;   // of the current segment
+
+  AVCodecContext *dec;     // decodes the encoded video
+  AVCodecContext *encoder; // that `dec` was set up for
+  AVRational tb;           // of the frames of both inputs
+
+  AVFilterGraph *graph;
+  AVFilterContext *dist, *ref;
+  struct quality_sink sinks[MAX_QUALITY_METRICS];
+  int nb_sinks, cap;
+
+  // Sampled input frames awaiting their encoded counterparts
+  AVFrame **refs;
+  int nb_refs, refs_cap;
+
+  AVFrame *frame;
+};
+
+typedef struct {
+  int nb_frames;
+  double *time;   // seconds from the start of the input
+  uint64_t *hash; // 64-bit difference hash of each frame
+} signature_results;
+
+int  lpms_compare_quality(quality_params *params, quality_results *res);
+void lpms_quality_free(quality_results *res);
+
+int  init_quality(struct quality_ctx *q, AVCodecContext *encoder, AVRational tb);
+int  quality_add_reference(struct quality_ctx *q, AVFrame *frame);
+int  quality_add_packet(struct quality_ctx *q, AVPacket *pkt);
+int  finish_quality(struct quality_ctx *q);
+void close_quality(struct quality_ctx *q);
+void free_quality(struct quality_ctx *q);
+
+int  lpms_frame_signatures(char *fname, double sample_interval, signature_results *res);
+void lpms_signatures_free(signature_results *res);
+
+#endif // _LPMS_QUALITY_H_
@@ -0,0 +1,283 @@
+#include "scte35.h"
+
+#include <string.h>
+#include <libavutil/avstring.h>
+#include <libavutil/avutil.h>
+#include <libavutil/common.h>
+#include <libavutil/error.h>
+#include <libavutil/intfloat.h>
+#include <libavutil/intreadwrite.h>
+
+//
+// Splice signals
+//
+// SCTE-35 splice_info_sections, as carried on their own MPEG-TS PIDs, and
+// AMF0 onCuePoint messages from RTMP. Only splice_insert commands describe a
+// break; other commands such as time_signal are ignored.
+//
+// onCuePoint messages are recognized in either of two forms:
+//
+//   { name: "scte35", parameters: { scte35: <base64 splice_info_section> } }
+//   { name: "cue-out" | "cue-in", parameters: { duration: <seconds> } }
+//
+// The payload may also be under "cue", and name under "type". Timestamps
+// within a splice_info_section from RTMP are not on the RTMP timeline, so
+// the caller uses the time of the message instead.
+//
+
+#define SCTE35_TABLE_ID 0xFC
+#define SPLICE_INSERT   0x05
+#define PTS_MASK        ((1LL << 33) - 1)
+#define MAX_AMF_DEPTH   8
+
+// A 33 bit timestamp following 7 bits of flags
+static int64_t read_pts33(const uint8_t *p)
+{
+  return ((int64_t)(p[0] & 1) << 32) | AV_RB32(p + 1);
+}
+
+// Reads a splice_time(), leaving pts unset if it is not specified
+static const uint8_t* read_splice_time(const uint8_t *p, const uint8_t *end,
+  int64_t adjustment, int64_t *pts)
+{
+  if (p >= end) return NULL;
+  if (!(*p & 0x80)) return p + 1;
+  if (end - p < 5) return NULL;
+  if (AV_NOPTS_VALUE == *pts) *pts = (read_pts33(p) + adjustment) & PTS_MASK;
+  return p + 5;
+}
+
+int parse_scte35(const uint8_t *data, int size, struct splice_cue *cue)
+{
+  const uint8_t *p = NULL, *end = NULL;
+  int section_size = 0, flags = 0;
+  int64_t adjustment = 0;
+
+  memset(cue, 0, sizeof *cue);
+  cue->pts = AV_NOPTS_VALUE;
+  if (size < 14 || SCTE35_TABLE_ID != data[0]) return AVERROR_INVALIDDATA;
+  section_size = 3 + (AV_RB16(data + 1) & 0xFFF);
+  if (section_size > size || section_size < 14) return AVERROR_INVALIDDATA;
+  end = data + section_size;
+  if (data[4] & 0x80) return 0; // encrypted
+  adjustment = read_pts33(data + 4);
+  if (SPLICE_INSERT != data[13]) return 0;
+
+  p = data + 14;
+  if (end - p < 5) return AVERROR_INVALIDDATA;
+  cue->id = AV_RB32(p);
+  cue->cancel = !!(p[4] & 0x80);
+  p += 5;
+  if (!cue->cancel) {
+    int program, has_duration, immediate;
+    if (p >= end) return AVERROR_INVALIDDATA;
+    flags = *p++;
+    cue->out = !!(flags & 0x80);
+    program = flags & 0x40;
+    has_duration = flags & 0x20;
+    immediate = flags & 0x10;
+    if (program && !immediate) {
+      p = read_splice_time(p, end, adjustment, &cue->pts);
+    } else if (!program) {
+      // per component splices; the earliest time given is used for all
+      int count = p < end ? *p++ : -1;
+      if (count < 0) return AVERROR_INVALIDDATA;
+      for (int i = 0; i < count && p; i++) {
+        p++; // component_tag
+        if (!immediate) p = read_splice_time(p, end, adjustment, &cue->pts);
+        else if (p > end) p = NULL;
+      }
+    }
+    if (!p) return AVERROR_INVALIDDATA;
+    if (has_duration) {
+      if (end - p < 5) return AVERROR_INVALIDDATA;
+      cue->duration = read_pts33(p) / 90000.0;
+    }
+  }
+  if (section_size <= MAX_SCTE35_SIZE) {
+    av_base64_encode(cue->scte35, sizeof cue->scte35, data, section_size);
+  }
+  return 1;
+}
+
+enum {
+  AMF_NUMBER       = 0x00,
+  AMF_BOOL         = 0x01,
+  AMF_STRING       = 0x02,
+  AMF_OBJECT       = 0x03,
+  AMF_NULL         = 0x05,
+  AMF_UNDEFINED    = 0x06,
+  AMF_ECMA_ARRAY   = 0x08,
+  AMF_OBJECT_END   = 0x09,
+  AMF_STRICT_ARRAY = 0x0A,
+  AMF_DATE         = 0x0B,
+  AMF_LONG_STRING  = 0x0C,
+};
+
+struct amf_reader {
+  const uint8_t *p, *end;
+};
+
+// Fields of interest from the onCuePoint message
+struct cue_point {
+  char name[32];
+  char scte35[AV_BASE64_SIZE(MAX_SCTE35_SIZE)];
+  double duration;
+};
+
+static int amf_read_string(struct amf_reader *r, int long_string,
+  const uint8_t **str, int *len)
+{
+  int header = long_string ? 4 : 2;
+  if (r->end - r->p < header) return AVERROR_INVALIDDATA;
+  *len = long_string ? AV_RB32(r->p) : AV_RB16(r->p);
+  r->p += header;
+  if (*len < 0 || r->end - r->p < *len) return AVERROR_INVALIDDATA;
+  *str = r->p;
+  r->p += *len;
+  return 0;
+}
+
+// AMF strings are not NUL terminated
+static void amf_copy(char *dst, int size, const uint8_t *str, int len)
+{
+  len = FFMIN(len, size - 1);
+  memcpy(dst, str, len);
+  dst[len] = 0;
+}
+
+static int amf_skip_object(struct amf_reader *r, int depth);
+
+static int amf_skip_value(struct amf_reader *r, int type, int depth)
+{
+  const uint8_t *str = NULL;
+  int len = 0;
+  uint32_t count = 0;
+
+  if (depth > MAX_AMF_DEPTH) return AVERROR_INVALIDDATA;
+  switch (type) {
+  case AMF_NUMBER: len = 8; break;
+  case AMF_BOOL: len = 1; break;
+  case AMF_DATE: len = 10; break;
+  case AMF_NULL:
+  case AMF_UNDEFINED: return 0;
+  case AMF_STRING: return amf_read_string(r, 0, &str, &len);
+  case AMF_LONG_STRING: return amf_read_string(r, 1, &str, &len);
+  case AMF_OBJECT: return amf_skip_object(r, depth);
+  case AMF_ECMA_ARRAY:
+    if (r->end - r->p < 4) return AVERROR_INVALIDDATA;
+    r->p += 4; // count is only a hint; the array is terminated like an object
+    return amf_skip_object(r, depth);
+  case AMF_STRICT_ARRAY:
+    if (r->end - r->p < 4) return AVERROR_INVALIDDATA;
+    count = AV_RB32(r->p);
+    r->p += 4;
+    for (uint32_t i = 0; i < count; i++) {
+      int ret = 0;
+      if (r->p >= r->end) return AVERROR_INVALIDDATA;
+      ret = amf_skip_value(r, *r->p++, depth + 1);
+      if (ret < 0) return ret;
+    }
+    return 0;
+  default: return AVERROR_INVALIDDATA;
+  }
+  if (r->end - r->p < len) return AVERROR_INVALIDDATA;
+  r->p += len;
+  return 0;
+}
+
+// Reads the properties of an object or ECMA array up to its end marker,
+// collecting the cue point fields from the top level and from "parameters".
+static int amf_read_object(struct amf_reader *r, int depth, struct cue_point *cp)
+{
+  while (1) {
+    const uint8_t *key = NULL, *str = NULL;
+    int key_len = 0, len = 0, type = 0, ret = 0;
+    char name[32] = {0};
+
+    ret = amf_read_string(r, 0, &key, &key_len);
+    if (ret < 0) return ret;
+    if (r->p >= r->end) return AVERROR_INVALIDDATA;
+    type = *r->p++;
+    if (!key_len && AMF_OBJECT_END == type) return 0;
+    amf_copy(name, sizeof name, key, key_len);
+
+    if (AMF_NUMBER == type && !strcmp(name, "duration")) {
+      if (r->end - r->p < 8) return AVERROR_INVALIDDATA;
+      cp->duration = av_int2double(AV_RB64(r->p));
+      r->p += 8;
+    } else if (AMF_STRING == type &&
+               (!strcmp(name, "name") || !strcmp(name, "type"))) {
+      ret = amf_read_string(r, 0, &str, &len);
+      // a recognized name takes precedence over a generic type such as "event"
+      if (!ret && (!cp->name[0] || !strcmp(name, "name"))) {
+        amf_copy(cp->name, sizeof cp->name, str, len);
+      }
+    } else if ((AMF_STRING == type || AMF_LONG_STRING == type) &&
+               (!strcmp(name, "scte35") || !strcmp(name, "cue"))) {
+      ret = amf_read_string(r, AMF_LONG_STRING == type, &str, &len);
+      if (!ret) amf_copy(cp->scte35, sizeof cp->scte35, str, len);
+    } else if (!depth && (AMF_OBJECT == type || AMF_ECMA_ARRAY == type) &&
+               !strcmp(name, "parameters")) {
+      if (AMF_ECMA_ARRAY == type) {
+        if (r->end - r->p < 4) return AVERROR_INVALIDDATA;
+        r->p += 4;
+      }
+      ret = amf_read_object(r, depth + 1, cp);
+    } else {
+      ret = amf_skip_value(r, type, depth + 1);
+    }
+    if (ret < 0) return ret;
+  }
+}
+
+static int amf_skip_object(struct amf_reader *r, int depth)
+{
+  while (1) {
+    const uint8_t *key = NULL;
+    int key_len = 0, type = 0, ret = 0;
+    ret = amf_read_string(r, 0, &key, &key_len);
+    if (ret < 0) return ret;
+    if (r->p >= r->end) return AVERROR_INVALIDDATA;
+    type = *r->p++;
+    if (!key_len && AMF_OBJECT_END == type) return 0;
+    ret = amf_skip_value(r, type, depth + 1);
+    if (ret < 0) return ret;
+  }
+}
+
+int parse_cue_point(const uint8_t *data, int size, struct splice_cue *cue)
+{
+  static const char handler[] = "onCuePoint";
+  struct amf_reader r = { .p = data, .end = data + size };
+  struct cue_point cp = {0};
+  const uint8_t *str = NULL;
+  int len = 0, type = 0, ret = 0;
+
+  memset(cue, 0, sizeof *cue);
+  cue->pts = AV_NOPTS_VALUE;
+  if (r.p >= r.end || AMF_STRING != *r.p++) return 0;
+  ret = amf_read_string(&r, 0, &str, &len);
+  if (ret < 0 || len != sizeof handler - 1 || memcmp(str, handler, len)) return 0;
+  if (r.p >= r.end) return AVERROR_INVALIDDATA;
+  type = *r.p++;
+  if (AMF_ECMA_ARRAY == type) {
+    if (r.end - r.p < 4) return AVERROR_INVALIDDATA;
+    r.p += 4;
+  } else if (AMF_OBJECT != type) return AVERROR_INVALIDDATA;
+  ret = amf_read_object(&r, 0, &cp);
+  if (ret < 0) return ret;
+
+  if (cp.scte35[0]) {
+    uint8_t section[MAX_SCTE35_SIZE];
+    int section_size = av_base64_decode(section, cp.scte35, sizeof section);
+    if (section_size < 0) return AVERROR_INVALIDDATA;
+    ret = parse_scte35(section, section_size, cue);
+    cue->pts = AV_NOPTS_VALUE;
+    return ret;
+  }
+  if (!av_strcasecmp(cp.name, "cue-out")) cue->out = 1;
+  else if (av_strcasecmp(cp.name, "cue-in")) return 0;
+  cue->duration = cue->out ? FFMAX(cp.duration, 0) : 0;
+  return 1;
+}
@@ -0,0 +1,26 @@
+#ifndef _LPMS_SCTE35_H_
+#define _LPMS_SCTE35_H_
+
+#include <stdint.h>
+#include <libavutil/base64.h>
+
+// Larger splice sections are still honored, but not passed through
+#define MAX_SCTE35_SIZE 1024
+
+// A splice point signalled by the input, either by an SCTE-35 splice_insert
+// or by an RTMP onCuePoint message.
+struct splice_cue {
+  uint32_t id;     // splice_event_id
+  int cancel;      // flag whether an earlier cue with the id is withdrawn
+  int out;         // 1 for the start of a break, 0 for the return from it
+  int64_t pts;     // 90kHz; AV_NOPTS_VALUE if immediate
+  double duration; // of the break in seconds; 0 if unknown
+  char scte35[AV_BASE64_SIZE(MAX_SCTE35_SIZE)]; // base64 splice_info_section
+};
+
+// Both return 1 if a cue was read, 0 if the data holds no usable splice
+// point (eg other splice commands), or a negative error.
+int parse_scte35(const uint8_t *data, int size, struct splice_cue *cue);
+int parse_cue_point(const uint8_t *data, int size, struct splice_cue *cue);
+
+#endif // _LPMS_SCTE35_H_
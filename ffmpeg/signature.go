@@ -0,0 +1,160 @@
+package ffmpeg
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// #cgo pkg-config: libavformat libavfilter libavcodec libavutil
+// #include <stdlib.h>
+// #include "quality.h"
+import "C"
+
+// Maximum number of differing bits for two frame hashes to be considered
+// the same picture. Encoding artifacts and rescaling typically flip a handful
+// of bits, while unrelated pictures differ in around half of them.
+const SignatureMaxDistance = 10
+
+// Minimum fraction of matching frames for VerifyRendition to succeed.
+const SignatureMatchThreshold = 0.9
+
+// Maximum fraction by which the duration and frame count of a rendition may
+// differ from the source for VerifyRendition to succeed.
+const SignatureMaxMismatch = 0.05
+
+type FrameSignature struct {
+	Time time.Duration // since the start of the input
+	Hash uint64
+}
+
+// Compact perceptual signature of the video in a segment.
+type Signature struct {
+	Frames []FrameSignature
+}
+
+// ComputeSignature hashes the video frames of the given file. If interval is
+// nonzero, only frames at least that far apart are hashed.
+func ComputeSignature(fname string, interval time.Duration) (*Signature, error) {
+	f := C.CString(fname)
+	defer C.free(unsafe.Pointer(f))
+	var res C.signature_results
+	ret := int(C.lpms_frame_signatures(f, C.double(interval.Seconds()), &res))
+	defer C.lpms_signatures_free(&res)
+	if ret != 0 {
+		glog.Error("Signature computation failed : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	n := int(res.nb_frames)
+	sig := &Signature{Frames: make([]FrameSignature, n)}
+	if n > 0 {
+		times := (*[1 << 28]C.double)(unsafe.Pointer(res.time))[:n:n]
+		hashes := (*[1 << 28]C.uint64_t)(unsafe.Pointer(res.hash))[:n:n]
+		for i := range sig.Frames {
+			sig.Frames[i] = FrameSignature{
+				Time: time.Duration(float64(times[i]) * float64(time.Second)),
+				Hash: uint64(hashes[i]),
+			}
+		}
+	}
+	return sig, nil
+}
+
+// Compare returns how closely the two signatures match: the fraction of
+// frames in either signature that match a frame of the other, whichever is
+// lower, so a truncated or padded signature scores low. Frames are paired by
+// timestamp, so signatures taken at different frame rates can be compared,
+// but both should be taken with the same interval. To allow for slight
+// timing differences, a frame also matches the neighbours of its nearest
+// frame.
+func (s *Signature) Compare(other *Signature) float64 {
+	if s == nil || other == nil || len(s.Frames) == 0 || len(other.Frames) == 0 {
+		return 0
+	}
+	return math.Min(s.matches(other), other.matches(s))
+}
+
+// Fraction of frames in the other signature that match a frame of this one.
+func (s *Signature) matches(other *Signature) float64 {
+	matched := 0
+	for _, f := range other.Frames {
+		i := sort.Search(len(s.Frames), func(i int) bool {
+			return s.Frames[i].Time >= f.Time
+		})
+		// Check the frames on either side of the insertion point
+		for j := i - 2; j <= i+1; j++ {
+			if j < 0 || j >= len(s.Frames) {
+				continue
+			}
+			if bits.OnesCount64(s.Frames[j].Hash^f.Hash) <= SignatureMaxDistance {
+				matched++
+				break
+			}
+		}
+	}
+	return float64(matched) / float64(len(other.Frames))
+}
+
+// Duration spanned by the signed frames, including the last one.
+func (s *Signature) Duration() time.Duration {
+	n := len(s.Frames)
+	if n == 0 {
+		return 0
+	}
+	d := s.Frames[n-1].Time - s.Frames[0].Time
+	if n > 1 {
+		d += d / time.Duration(n-1)
+	}
+	return d
+}
+
+// Whether the other signature spans the same frames as this one, to within
+// SignatureMaxMismatch. Checks the durations, and the number of frames of
+// this signature that fall within the time span of the other.
+func (s *Signature) covers(other *Signature) bool {
+	n := len(s.Frames)
+	if n == 0 || len(other.Frames) == 0 {
+		return false
+	}
+	dur, otherDur := s.Duration(), other.Duration()
+	interval := dur / time.Duration(n)
+	diff := otherDur - dur
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > time.Duration(SignatureMaxMismatch*float64(dur))+interval {
+		return false
+	}
+	first := other.Frames[0].Time - interval
+	last := other.Frames[len(other.Frames)-1].Time + interval
+	covered := 0
+	for _, f := range s.Frames {
+		if f.Time >= first && f.Time <= last {
+			covered++
+		}
+	}
+	return float64(n-covered) <= SignatureMaxMismatch*float64(n)
+}
+
+// VerifyRendition checks whether the rendition has the same content as the
+// source, regardless of differences in resolution, frame rate or encoding.
+// The rendition must also cover the whole source, so truncated or padded
+// renditions fail.
+func VerifyRendition(source, rendition string) (bool, error) {
+	src, err := ComputeSignature(source, 0)
+	if err != nil {
+		return false, err
+	}
+	out, err := ComputeSignature(rendition, 0)
+	if err != nil {
+		return false, err
+	}
+	if !src.covers(out) {
+		return false, nil
+	}
+	return src.Compare(out) >= SignatureMatchThreshold, nil
+}
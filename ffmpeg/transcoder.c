@@ -2,10 +2,17 @@
 #include "decoder.h"
 #include "filter.h"
 #include "encoder.h"
+#include "analysis.h"
+#include "loudness.h"
 #include "logging.h"
 
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
+#include <libavutil/avstring.h>
+#include <libavutil/bprint.h>
+#include <libavutil/time.h>
+#include <sys/resource.h>
+#include <time.h>
 
 // Not great to appropriate internal API like this...
 const int lpms_ERR_INPUT_PIXFMT = FFERRTAG('I','N','P','X');
@@ -15,6 +22,8 @@ const int lpms_ERR_FILTERS = FFERRTAG('F','L','T','R');
 const int lpms_ERR_PACKET_ONLY = FFERRTAG('P','K','O','N');
 const int lpms_ERR_FILTER_FLUSHED = FFERRTAG('F','L','F','L');
 const int lpms_ERR_OUTPUTS = FFERRTAG('O','U','T','P');
+const int lpms_ERR_INPUT_LIMIT = FFERRTAG('I','N','L','M');
+const int lpms_ERR_INPUT_CORRUPT = FFERRTAG('I','N','C','R');
 
 //
 //  Notes on transcoder internals:
@@ -38,12 +47,13 @@ const int lpms_ERR_OUTPUTS = FFERRTAG('O','U','T','P');
 //
 
 // MOVED TO decoder.[ch]
-//  Decoder: For audio, we pay the price of closing and re-opening the decoder.
-//           For video, we cache the first packet we read (input_ctx.first_pkt).
-//           The pts is set to a sentinel value and fed to the decoder. Once we
-//           receive all frames from the decoder OR have sent too many sentinel
-//           pkts without receiving anything, then we know the decoder has been
-//           fully flushed.
+//  Decoder: For audio, we drain the decoder and reset it with
+//           avcodec_flush_buffers. For video, we cache the first packet we
+//           read (input_ctx.first_pkt). The pts is set to a sentinel value and
+//           fed to the decoder. Once we receive all frames from the decoder OR
+//           have sent too many sentinel pkts without receiving anything, then
+//           we know the decoder has been fully flushed. Software decoders are
+//           only reopened if the stream parameters change between segments.
 
 // MOVED TO filter.[ch]
 //  Filter:  The challenge here is around fps filter adding and dropping frames.
@@ -61,9 +71,15 @@ const int lpms_ERR_OUTPUTS = FFERRTAG('O','U','T','P');
 //           process segments out of order, due to the monotonicity requirement.
 
 // MOVED TO encoder.[ch]
-// Encoder:  For software encoding, we close the encoder and re-open.
-//           For Nvidia encoding, there is luckily an API available via
-//           avcodec_flush_buffers to flush the encoder.
+// Encoder:  For Nvidia encoding, there is luckily an API available via
+//           avcodec_flush_buffers to flush the encoder. Software encoders are
+//           drained and reset the same way if the library supports it for
+//           that encoder; otherwise we close the encoder and re-open.
+//
+// Outputs:  The set of outputs may change between segments. Each output is
+//           matched with the state of an earlier output that has the same
+//           settings (see output_config). Unmatched outputs are freed, and
+//           new outputs are initialized at their first segment.
 //
 
 #define MAX_OUTPUT_SIZE 10
@@ -91,29 +107,164 @@ static int is_mpegts(AVFormatContext *ic) {
   return !strcmp("mpegts", ic->iformat->name);
 }
 
-static int flush_outputs(struct input_ctx *ictx, struct output_ctx *octx)
+static void probe_audio_tracks(AVFormatContext *ic, input_results *res)
+{
+  int track = 0;
+  res->nb_audio_tracks = 0;
+  for (int i = 0; i < ic->nb_streams; i++) {
+    AVCodecParameters *par = ic->streams[i]->codecpar;
+    AVDictionaryEntry *lang = NULL;
+    audio_track_info *info = &res->audio_tracks[res->nb_audio_tracks];
+    if (AVMEDIA_TYPE_AUDIO != par->codec_type) continue;
+    if (res->nb_audio_tracks >= MAX_AUDIO_TRACKS) {
+      LPMS_WARN("Too many audio tracks in input; not listing the rest");
+      break;
+    }
+    memset(info, 0, sizeof *info);
+    info->index = i;
+    info->track = ++track;
+    info->channels = par->channels;
+    info->sample_rate = par->sample_rate;
+    av_strlcpy(info->codec, avcodec_get_name(par->codec_id), sizeof info->codec);
+    lang = av_dict_get(ic->streams[i]->metadata, "language", NULL, 0);
+    if (lang) av_strlcpy(info->language, lang->value, sizeof info->language);
+    res->nb_audio_tracks++;
+  }
+}
+
+static void probe_video(struct input_ctx *ictx, input_results *res)
+{
+  AVStream *st = NULL;
+  res->width = res->height = 0;
+  res->framerate = (AVRational){0, 0};
+  res->bit_rate = ictx->ic->bit_rate;
+  if (ictx->vi < 0) return;
+  st = ictx->ic->streams[ictx->vi];
+  res->width = st->codecpar->width;
+  res->height = st->codecpar->height;
+  res->framerate = st->avg_frame_rate.num ? st->avg_frame_rate : st->r_frame_rate;
+}
+
+static int check_resolution(input_limits *l, int w, int h)
+{
+  return (!l->width || w <= l->width) && (!l->height || h <= l->height);
+}
+
+// Checks the limits of the input against the current packet and decoded frame.
+// Timestamps are tracked in AV_TIME_BASE across all streams of the segment.
+static int check_limits(struct input_ctx *ictx, AVStream *ist, AVPacket *pkt,
+  AVFrame *frame, input_results *decoded, int64_t *first_ts, int64_t *last_dts)
 {
-  // only issue w this flushing method is it's not necessarily sequential
-  // wrt all the outputs; might want to iterate on each output per frame?
   int ret = 0;
-  if (octx->vc) { // flush video
-    while (!ret || ret == AVERROR(EAGAIN)) {
-      ret = process_out(ictx, octx, octx->vc, octx->oc->streams[octx->vi], &octx->vf, NULL);
+  input_limits *l = &ictx->limits;
+  int64_t ts = pkt->pts != AV_NOPTS_VALUE ? pkt->pts : pkt->dts;
+  int64_t dts = pkt->dts != AV_NOPTS_VALUE ? pkt->dts : pkt->pts;
+  int is_video = AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type;
+
+  if (frame && is_video && !check_resolution(l, frame->width, frame->height)) {
+    ret = lpms_ERR_INPUT_LIMIT;
+    LPMS_ERR(limits_cleanup, "Input resolution exceeds limit");
+  }
+  if (l->frames && decoded->frames > l->frames) {
+    ret = lpms_ERR_INPUT_LIMIT;
+    LPMS_ERR(limits_cleanup, "Input frame count exceeds limit");
+  }
+  if (l->duration && ts != AV_NOPTS_VALUE) {
+    ts = av_rescale_q(ts, ist->time_base, AV_TIME_BASE_Q);
+    if (AV_NOPTS_VALUE == *first_ts || ts < *first_ts) *first_ts = ts;
+    if (ts - *first_ts > l->duration * AV_TIME_BASE) {
+      ret = lpms_ERR_INPUT_LIMIT;
+      LPMS_ERR(limits_cleanup, "Input duration exceeds limit");
+    }
+  }
+  if (l->pts_gap && is_video && dts != AV_NOPTS_VALUE) {
+    dts = av_rescale_q(dts, ist->time_base, AV_TIME_BASE_Q);
+    if (AV_NOPTS_VALUE != *last_dts &&
+        FFABS(dts - *last_dts) > l->pts_gap * AV_TIME_BASE) {
+      ret = lpms_ERR_INPUT_LIMIT;
+      LPMS_ERR(limits_cleanup, "Input timestamp gap exceeds limit");
     }
+    *last_dts = dts;
   }
-  ret = 0;
-  if (octx->ac) { // flush audio
-    while (!ret || ret == AVERROR(EAGAIN)) {
-      ret = process_out(ictx, octx, octx->ac, octx->oc->streams[octx->ai], &octx->af, NULL);
+
+limits_cleanup:
+  return ret;
+}
+
+// Converts an extent from update_extent into seconds
+static void set_extent(double *start, double *duration, int64_t start_ts, int64_t end_ts)
+{
+  if (AV_NOPTS_VALUE == start_ts) return;
+  *start = start_ts / (double) AV_TIME_BASE;
+  *duration = (end_ts - start_ts) / (double) AV_TIME_BASE;
+}
+
+// CPU time of the calling thread, in microseconds
+static int64_t thread_cpu_time()
+{
+  struct timespec ts = {0};
+  clock_gettime(CLOCK_THREAD_CPUTIME_ID, &ts);
+  return ts.tv_sec * 1000000LL + ts.tv_nsec / 1000;
+}
+
+// CPU time of the whole process, in microseconds
+static int64_t process_cpu_time()
+{
+  struct rusage ru = {0};
+  getrusage(RUSAGE_SELF, &ru);
+  return (ru.ru_utime.tv_sec + ru.ru_stime.tv_sec) * 1000000LL +
+    ru.ru_utime.tv_usec + ru.ru_stime.tv_usec;
+}
+
+static int process_stream(struct input_ctx *ictx, struct output_ctx *octx,
+  AVStream *ist, AVStream *ost, AVCodecContext *encoder,
+  struct filter_ctx *filter, AVPacket *ipkt, AVFrame *dframe)
+{
+  int ret = 0;
+  int64_t start = thread_cpu_time();
+
+  if (!encoder && ost) {
+    // stream copy
+    AVPacket *pkt;
+
+    // we hit this case when decoder is flushing; will be no input packet
+    // (we don't need decoded frames since this stream is doing a copy)
+    if (ipkt->pts == AV_NOPTS_VALUE) goto proc_stream_cleanup;
+
+    pkt = av_packet_clone(ipkt);
+    if (!pkt) LPMS_ERR(proc_stream_cleanup, "Error allocating packet for copy");
+    if (octx->source && AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type) {
+      // count copied source video like encoded video
+      octx->res->frames++;
+      octx->res->pixels += ost->codecpar->width * ost->codecpar->height;
     }
+    ret = mux(pkt, ist->time_base, octx, ost);
+    av_packet_free(&pkt);
+  } else if (dframe) {
+    ret = process_out(ictx, octx, encoder, ost, filter, dframe);
   }
-  av_interleaved_write_frame(octx->oc, NULL); // flush muxer
-  return av_write_trailer(octx->oc);
+  if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) ret = 0;
+
+proc_stream_cleanup:
+  octx->res->pipeline_cpu_time += thread_cpu_time() - start;
+  return ret;
+}
+
+static int decoders_changed(struct input_ctx *ictx)
+{
+  // Whether the open decoders no longer match what the outputs need, eg if
+  // an encoded rendition was added to a session that only copied so far.
+  if (ictx->vi >= 0 && ictx->dv == !!ictx->vc) return 1;
+  for (int i = 0; i < ictx->nb_audio; i++) {
+    struct input_audio *ia = &ictx->audio[i];
+    if (ia->index >= 0 && decodes_audio(ictx, i) != !!ia->ac) return 1;
+  }
+  return 0;
 }
 
 int transcode(struct transcode_thread *h,
   input_params *inp, output_params *params,
-  output_results *results, output_results *decoded_results)
+  output_results *results, input_results *decoded_results)
 {
   int ret = 0, i = 0;
   int reopen_decoders = 1;
@@ -122,61 +273,67 @@ int transcode(struct transcode_thread *h,
   int nb_outputs = h->nb_outputs;
   AVPacket ipkt = {0};
   AVFrame *dframe = NULL;
+  int64_t first_ts = AV_NOPTS_VALUE, last_dts = AV_NOPTS_VALUE; // for limits
+  int64_t start_ts = AV_NOPTS_VALUE, end_ts = AV_NOPTS_VALUE; // for results
+  struct analysis_ctx actx = {0};
 
   if (!inp) LPMS_ERR(transcode_cleanup, "Missing input params")
+  ictx->limits = inp->limits;
+  ictx->tolerance = inp->errors;
+  ictx->errors = &decoded_results->errors;
+  ictx->stages = &decoded_results->usage.stages;
+  ictx->metadata = inp->metadata;
+  ictx->nb_metadata = inp->nb_metadata;
+  ret = init_analysis(&actx, &inp->analysis, decoded_results);
+  if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to set up analysis");
 
   // by default we re-use decoder between segments of same stream
-  // unless we are using SW deocder and had to re-open IO or demuxer
+  // unless we had to re-open IO or demuxer and the stream has changed
   if (!ictx->ic) {
     // reopen demuxer for the input segment if needed
-    // XXX could open_input() be re-used here?
-    ret = avformat_open_input(&ictx->ic, inp->fname, NULL, NULL);
+    ret = open_demuxer(inp, ictx);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen demuxer");
-    ret = avformat_find_stream_info(ictx->ic, NULL);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to find info for reopened stream")
   } else if (!ictx->ic->pb) {
     // reopen input segment file IO context if needed
     ret = avio_open(&ictx->ic->pb, inp->fname, AVIO_FLAG_READ);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen file");
-  } else reopen_decoders = 0;
+  } else reopen_decoders = decoders_changed(ictx);
   if (reopen_decoders) {
-    // XXX check to see if we can also reuse decoder for sw decoding
-    if (AV_HWDEVICE_TYPE_CUDA != ictx->hw_type) {
+    // software decoders are only reopened if the stream parameters changed,
+    // the Nvidia decoder only if video decoding was switched on or off
+    if (AV_HWDEVICE_TYPE_CUDA != ictx->hw_type || ictx->sw_decode ||
+        ictx->dv == !!ictx->vc) {
       ret = open_video_decoder(inp, ictx);
       if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen video decoder");
     }
     ret = open_audio_decoder(inp, ictx);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen audio decoder")
   }
+  probe_audio_tracks(ictx->ic, decoded_results);
+  probe_video(ictx, decoded_results);
+  if (!check_resolution(&ictx->limits, decoded_results->width, decoded_results->height)) {
+    ret = lpms_ERR_INPUT_LIMIT;
+    LPMS_ERR(transcode_cleanup, "Input resolution exceeds limit");
+  }
 
   // populate output contexts
   for (i = 0; i <  nb_outputs; i++) {
       struct output_ctx *octx = &outputs[i];
-      octx->fname = params[i].fname;
-      octx->width = params[i].w;
-      octx->height = params[i].h;
-      octx->muxer = &params[i].muxer;
-      octx->audio = &params[i].audio;
-      octx->video = &params[i].video;
-      octx->vfilters = params[i].vfilters;
-      if (params[i].bitrate) octx->bitrate = params[i].bitrate;
-      if (params[i].fps.den) octx->fps = params[i].fps;
-      if (params[i].gop_time) octx->gop_time = params[i].gop_time;
-      octx->dv = ictx->vi < 0 || is_drop(octx->video->name);
-      octx->da = ictx->ai < 0 || is_drop(octx->audio->name);
-      octx->res = &results[i];
-
-      // first segment of a stream, need to initalize output HW context
+      int64_t start = thread_cpu_time();
+      ret = init_output(octx, ictx, &params[i], &results[i]);
+      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to set up output");
+
+      // first segment of a stream, or the encoder could not be kept open
       // XXX valgrind this line up
-      if (!h->initialized || AV_HWDEVICE_TYPE_NONE == octx->hw_type) {
+      if (!h->initialized || !octx->vc) {
         ret = open_output(octx, ictx);
         if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to open output");
-        continue;
+      } else {
+        // non-first segment with a persistent encoder
+        ret = reopen_output(octx, ictx);
+        if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to re-open output");
       }
-
-      // non-first segment of a HW session
-      ret = reopen_output(octx, ictx);
-      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to re-open output for HW session");
+      results[i].pipeline_cpu_time += thread_cpu_time() - start;
   }
 
   av_init_packet(&ipkt);
@@ -185,7 +342,7 @@ int transcode(struct transcode_thread *h,
 
   while (1) {
     // DEMUXING & DECODING
-    int has_frame = 0;
+    int has_frame = 0, packet_only = 0, track = -1;
     AVStream *ist = NULL;
     AVFrame *last_frame = NULL;
     av_frame_unref(dframe);
@@ -195,9 +352,13 @@ int transcode(struct transcode_thread *h,
     else if (lpms_ERR_PACKET_ONLY == ret) ; // keep going for stream copy
     else if (lpms_ERR_INPUT_NOKF == ret) {
       LPMS_ERR(transcode_cleanup, "Could not decode; No keyframes in input");
+    } else if (lpms_ERR_INPUT_CORRUPT == ret) {
+      LPMS_ERR(transcode_cleanup, "Could not decode; Too many errors in input");
     } else if (ret < 0) LPMS_ERR(transcode_cleanup, "Could not decode; stopping");
     ist = ictx->ic->streams[ipkt.stream_index];
-    has_frame = lpms_ERR_PACKET_ONLY != ret;
+    track = audio_track(ictx, ist->index);
+    packet_only = lpms_ERR_PACKET_ONLY == ret;
+    has_frame = !packet_only;
 
     if (AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type) {
       if (is_flush_frame(dframe)) goto whileloop_end;
@@ -207,9 +368,12 @@ int transcode(struct transcode_thread *h,
       has_frame = has_frame && dframe->width && dframe->height;
       if (has_frame) last_frame = ictx->last_frame_v;
     } else if (AVMEDIA_TYPE_AUDIO == ist->codecpar->codec_type) {
-      has_frame = has_frame && dframe->nb_samples;
-      if (has_frame) last_frame = ictx->last_frame_a;
+      has_frame = has_frame && dframe->nb_samples && track >= 0;
+      if (has_frame) last_frame = ictx->audio[track].last_frame;
     }
+    ret = check_limits(ictx, ist, &ipkt, has_frame ? dframe : NULL,
+      decoded_results, &first_ts, &last_dts);
+    if (ret < 0) LPMS_ERR(transcode_cleanup, "Input exceeds limits");
     if (has_frame) {
       int64_t dur = 0;
       if (dframe->pkt_duration) dur = dframe->pkt_duration;
@@ -222,49 +386,43 @@ int transcode(struct transcode_thread *h,
       dframe->pkt_duration = dur;
       av_frame_unref(last_frame);
       av_frame_ref(last_frame, dframe);
+      if (ist->index == ictx->vi || !track) {
+        ret = analyze_frame(&actx, ist, dframe);
+        if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to analyze frame");
+      }
+    }
+    if (ist->index == ictx->vi || (ictx->vi < 0 && !track)) {
+      // extent of the video, or of the default audio track without video
+      if (has_frame) {
+        update_extent(&start_ts, &end_ts, dframe->pts, dframe->pkt_duration, ist->time_base);
+      } else if (packet_only) {
+        update_extent(&start_ts, &end_ts, ipkt.pts, ipkt.duration, ist->time_base);
+      }
     }
 
     // ENCODING & MUXING OF ALL OUTPUT RENDITIONS
     for (i = 0; i < nb_outputs; i++) {
       struct output_ctx *octx = &outputs[i];
-      struct filter_ctx *filter = NULL;
-      AVStream *ost = NULL;
-      AVCodecContext *encoder = NULL;
       ret = 0; // reset to avoid any carry-through
 
       if (ist->index == ictx->vi) {
         if (octx->dv) continue; // drop video stream for this output
-        ost = octx->oc->streams[0];
-        if (ictx->vc) {
-          encoder = octx->vc;
-          filter = &octx->vf;
-        }
-      } else if (ist->index == ictx->ai) {
-        if (octx->da) continue; // drop audio stream for this output
-        ost = octx->oc->streams[!octx->dv]; // depends on whether video exists
-        if (ictx->ac) {
-          encoder = octx->ac;
-          filter = &octx->af;
+        ret = process_stream(ictx, octx, ist, octx->oc->streams[0],
+          ictx->vc ? octx->vc : NULL, ictx->vc ? &octx->vf : NULL,
+          &ipkt, has_frame ? dframe : NULL);
+        if (ret < 0) LPMS_ERR(transcode_cleanup, "Error encoding");
+      } else if (track >= 0) {
+        // an input track may be mapped multiple times into the same output
+        for (int j = 0; j < octx->nb_audio; j++) {
+          struct output_audio *oa = &octx->audio[j];
+          int decoded = !!ictx->audio[track].ac;
+          if (oa->track != track) continue;
+          ret = process_stream(ictx, octx, ist, octx->oc->streams[oa->ai],
+            decoded ? oa->ac : NULL, decoded ? &oa->af : NULL,
+            &ipkt, has_frame ? dframe : NULL);
+          if (ret < 0) LPMS_ERR(transcode_cleanup, "Error encoding");
         }
-      } else continue; // dropped or unrecognized stream
-
-      if (!encoder && ost) {
-        // stream copy
-        AVPacket *pkt;
-
-        // we hit this case when decoder is flushing; will be no input packet
-        // (we don't need decoded frames since this stream is doing a copy)
-        if (ipkt.pts == AV_NOPTS_VALUE) continue;
-
-        pkt = av_packet_clone(&ipkt);
-        if (!pkt) LPMS_ERR(transcode_cleanup, "Error allocating packet for copy");
-        ret = mux(pkt, ist->time_base, octx, ost);
-        av_packet_free(&pkt);
-      } else if (has_frame) {
-        ret = process_out(ictx, octx, encoder, ost, filter, dframe);
-      }
-      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) continue;
-      else if (ret < 0) LPMS_ERR(transcode_cleanup, "Error encoding");
+      } // else dropped or unrecognized stream
     }
 whileloop_end:
     av_packet_unref(&ipkt);
@@ -272,9 +430,16 @@ whileloop_end:
 
   // flush outputs
   for (i = 0; i < nb_outputs; i++) {
-    ret = flush_outputs(ictx, &outputs[i]);
+    int64_t start = thread_cpu_time();
+    ret = flush_output(ictx, &outputs[i]);
+    results[i].pipeline_cpu_time += thread_cpu_time() - start;
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to fully flush outputs")
+    set_extent(&results[i].start_time, &results[i].duration,
+      outputs[i].start_ts, outputs[i].end_ts);
   }
+  set_extent(&decoded_results->start_time, &decoded_results->duration, start_ts, end_ts);
+  ret = finish_analysis(&actx);
+  if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to finish analysis");
 
 transcode_cleanup:
   if (ictx->ic) {
@@ -290,39 +455,160 @@ transcode_cleanup:
     }
   }
   if (dframe) av_frame_free(&dframe);
+  free_analysis(&actx);
+  ictx->metadata = NULL; // only valid for this call
+  ictx->errors = NULL;
+  ictx->stages = NULL;
+  ictx->nb_metadata = 0;
   ictx->flushed = 0;
   ictx->flushing = 0;
   ictx->pkt_diff = 0;
   ictx->sentinel_count = 0;
   av_packet_unref(&ipkt);  // needed for early exits
   if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
-  if (ictx->ac) avcodec_free_context(&ictx->ac);
-  if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
+  // Keep decoders for the next segment, discarding anything still buffered
+  for (i = 0; i < ictx->nb_audio; i++) {
+    if (ictx->audio[i].ac) avcodec_flush_buffers(ictx->audio[i].ac);
+  }
+  if (ictx->vc && (AV_HWDEVICE_TYPE_NONE == ictx->hw_type || ictx->sw_decode)) {
+    avcodec_flush_buffers(ictx->vc);
+  }
   for (i = 0; i < nb_outputs; i++) close_output(&outputs[i]);
   return ret == AVERROR_EOF ? 0 : ret;
 }
 
-int lpms_transcode(input_params *inp, output_params *params,
-  output_results *results, int nb_outputs, output_results *decoded_results)
+static char *output_config(output_params *params)
 {
-  int ret = 0;
-  struct transcode_thread *h = inp->handle;
+  // Describes the settings that an output keeps across segments, such as
+  // filters and encoders. Returns NULL if out of memory.
+  AVBPrint bp;
+  char *opts = NULL, *config = NULL;
+  // encoders are set up for the container, eg with global headers for mp4
+  AVOutputFormat *fmt = av_guess_format(params->muxer.name, params->fname, NULL);
+  av_bprint_init(&bp, 0, AV_BPRINT_SIZE_UNLIMITED);
+  if (params->video.opts) av_dict_get_string(params->video.opts, &opts, '=', ':');
+  av_bprintf(&bp, "%s|%s|%s|%dx%d|%d|%d/%d|%d|%d|%s|%s",
+    params->video.name ? params->video.name : "", opts ? opts : "",
+    params->vfilters ? params->vfilters : "", params->w, params->h,
+    params->bitrate, params->fps.num, params->fps.den, params->gop_time,
+    params->source, params->kf_expr ? params->kf_expr : "",
+    params->audio.name ? params->audio.name : "");
+  for (int i = 0; i < params->nb_audio_maps; i++) {
+    audio_map *map = &params->audio_maps[i];
+    av_bprintf(&bp, "|%d:%s", map->track, map->encoder.name ? map->encoder.name : "");
+  }
+  av_bprintf(&bp, "|%g/%g/%d", params->loudness.target,
+    params->loudness.true_peak, params->loudness.two_pass);
+  av_bprintf(&bp, "|%s", params->pix_fmt ? params->pix_fmt : "");
+  av_bprintf(&bp, "|%s", params->sw_vfilters ? params->sw_vfilters : "");
+  // the video filters sample the input for the quality comparison
+  av_bprintf(&bp, "|%g", params->quality ? params->quality->sample_interval : -1);
+  av_bprintf(&bp, "|%s", fmt ? fmt->name : "");
+  av_free(opts);
+  av_bprint_finalize(&bp, &config);
+  return config;
+}
 
-  if (!h->initialized) {
-    int i = 0;
-    int decode_a = 0, decode_v = 0;
-    if (nb_outputs > MAX_OUTPUT_SIZE) {
-      return lpms_ERR_OUTPUTS;
+static int update_outputs(struct transcode_thread *h, output_params *params, int nb_outputs)
+{
+  // Matches the requested outputs with the outputs of the previous segment.
+  // Outputs with unchanged settings keep their state; the rest are freed.
+  struct output_ctx prev[MAX_OUTPUT_SIZE];
+  int matched[MAX_OUTPUT_SIZE] = {0};
+  int ret = 0, i, j;
+
+  memcpy(prev, h->outputs, sizeof prev);
+  memset(h->outputs, 0, sizeof h->outputs);
+  for (i = 0; i < nb_outputs; i++) {
+    char *config = output_config(&params[i]);
+    if (!config) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(update_outputs_err, "Unable to describe output");
     }
+    for (j = 0; j < h->nb_outputs; j++) {
+      if (matched[j] || !prev[j].config || strcmp(prev[j].config, config)) continue;
+      h->outputs[i] = prev[j];
+      matched[j] = 1;
+      break;
+    }
+    if (h->outputs[i].config) av_free(config);
+    else h->outputs[i].config = config;
+  }
 
-    // Check to see if we can skip decoding
-    for (i = 0; i < nb_outputs; i++) {
-      if (!needs_decoder(params[i].video.name)) h->ictx.dv = ++decode_v == nb_outputs;
-      if (!needs_decoder(params[i].audio.name)) h->ictx.da = ++decode_a == nb_outputs;
+update_outputs_err:
+  for (j = 0; j < MAX_OUTPUT_SIZE; j++) {
+    if (!matched[j]) free_output(&prev[j]);
+  }
+  h->nb_outputs = ret < 0 ? 0 : nb_outputs;
+  if (ret < 0) {
+    for (i = 0; i < MAX_OUTPUT_SIZE; i++) free_output(&h->outputs[i]);
+  }
+  return ret;
+}
+
+static int audio_needs_decoder(output_params *params, int nb_outputs, int track)
+{
+  // Checks whether any output needs to encode the given input audio track
+  for (int i = 0; i < nb_outputs; i++) {
+    if (!params[i].nb_audio_maps) {
+      if (!track && needs_decoder(params[i].audio.name)) return 1;
+      continue;
+    }
+    for (int j = 0; j < params[i].nb_audio_maps; j++) {
+      audio_map *map = &params[i].audio_maps[j];
+      if (map->track == track && needs_decoder(map->encoder.name)) return 1;
     }
+  }
+  return 0;
+}
 
-    h->nb_outputs = nb_outputs;
+static void finish_usage(resource_usage *usage, struct frame_memory *mem,
+  int64_t wall_start, int64_t cpu_start, int64_t process_start)
+{
+  struct rusage ru = {0};
+  usage->wall_time = av_gettime_relative() - wall_start;
+  usage->pipeline_cpu_time = thread_cpu_time() - cpu_start;
+  usage->process_cpu_time = process_cpu_time() - process_start;
+  usage->peak_frame_memory = atomic_load(&mem->peak);
+  getrusage(RUSAGE_SELF, &ru);
+#ifdef __APPLE__
+  usage->process_peak_memory = ru.ru_maxrss; // already in bytes
+#else
+  usage->process_peak_memory = ru.ru_maxrss * 1024LL;
+#endif
+}
 
+int lpms_transcode(input_params *inp, output_params *params,
+  output_results *results, int nb_outputs, input_results *decoded_results)
+{
+  int ret = 0, i = 0;
+  int decode_v = 0;
+  struct transcode_thread *h = inp->handle;
+  int64_t wall_start = av_gettime_relative(), cpu_start = thread_cpu_time();
+  int64_t process_start = process_cpu_time();
+
+  reset_frame_memory(&h->ictx.memory);
+
+  if (nb_outputs > MAX_OUTPUT_SIZE || inp->nb_audio_tracks > MAX_AUDIO_TRACKS) {
+    return lpms_ERR_OUTPUTS;
+  }
+
+  // Check to see if we can skip decoding. Outputs may change between
+  // segments, so decoders are opened or closed as needed; see transcode.
+  h->ictx.dv = 0;
+  for (i = 0; i < nb_outputs; i++) {
+    if (!needs_decoder(params[i].video.name)) h->ictx.dv = ++decode_v == nb_outputs;
+  }
+  if (analysis_needs_video(&inp->analysis)) h->ictx.dv = 0;
+  for (i = 0; i < MAX_AUDIO_TRACKS; i++) {
+    h->ictx.audio[i].skip = nb_outputs && !audio_needs_decoder(params, nb_outputs, i);
+  }
+  if (analysis_needs_audio(&inp->analysis)) h->ictx.audio[0].skip = 0;
+
+  ret = update_outputs(h, params, nb_outputs);
+  if (ret < 0) return ret;
+
+  if (!h->initialized) {
     // populate input context
     ret = open_input(inp, &h->ictx);
     if (ret < 0) {
@@ -330,12 +616,15 @@ int lpms_transcode(input_params *inp, output_params *params,
     }
   }
 
-  if (h->nb_outputs != nb_outputs) {
-    return lpms_ERR_OUTPUTS; // Not the most accurate error...
+  if (needs_loudness_pass(params, nb_outputs)) {
+    ret = measure_loudness(inp, &h->ictx);
+    if (ret < 0) return ret;
   }
 
   ret = transcode(h, inp, params, results, decoded_results);
   h->initialized = 1;
+  finish_usage(&decoded_results->usage, &h->ictx.memory, wall_start,
+    cpu_start, process_start);
 
   return ret;
 }
@@ -5,6 +5,7 @@
 #include <libavutil/rational.h>
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
+#include "quality.h"
 
 // LPMS specific errors
 extern const int lpms_ERR_INPUT_PIXFMT;
@@ -14,17 +15,92 @@ extern const int lpms_ERR_FILTERS;
 extern const int lpms_ERR_PACKET_ONLY;
 extern const int lpms_ERR_FILTER_FLUSHED;
 extern const int lpms_ERR_OUTPUTS;
+extern const int lpms_ERR_INPUT_LIMIT;
+extern const int lpms_ERR_INPUT_CORRUPT;
 
 struct transcode_thread;
 
+#define MAX_AUDIO_TRACKS 8
+
 typedef struct {
     char *name;
     AVDictionary *opts;
 } component_opts;
 
+typedef struct {
+  // Selects an input audio track. `track` is the 1-based position among the
+  // audio streams of the input. If unset, the first track whose `language`
+  // tag matches is used. If both are unset, the best audio stream is used.
+  int track;
+  char *language;
+} track_selector;
+
+typedef struct {
+  int track; // index into input_params.audio_tracks
+  component_opts encoder;
+} audio_map;
+
+// Limits to reject pathological inputs, eg from untrusted sources.
+// Zero values mean no limit.
+typedef struct {
+  double duration;  // seconds between the first and last timestamps
+  int width, height;
+  int frames;       // decoded video frames
+  double pts_gap;   // seconds between consecutive video packets
+  int output_ratio; // encoded frames per decoded frame, per output
+} input_limits;
+
+// Tolerance of corrupt input. Packets that fail to decode are skipped
+// rather than stopping the transcode, and are still stream copied. Frames
+// the decoder concealed errors in are kept. Transcoding stops with
+// lpms_ERR_INPUT_CORRUPT once the skipped packets and concealed frames of
+// the segment exceed either threshold; zero thresholds mean no limit.
+typedef struct {
+  int enabled;
+  int max_errors;   // skipped packets and concealed frames
+  double max_ratio; // of errors to packets sent to the decoders
+} error_tolerance;
+
+// Kinds of decoding errors, as counted in decode_stats
+enum decode_error_type {
+  DECODE_ERR_DEMUXER,           // packet flagged as corrupt by the demuxer
+  DECODE_ERR_INVALID_DATA,      // packet rejected by a decoder as invalid
+  DECODE_ERR_DECODER,           // packet rejected by a decoder otherwise
+  DECODE_ERR_INVALID_BITSTREAM, // frame decoded from an invalid bitstream
+  DECODE_ERR_MISSING_REFERENCE, // frame decoded with missing references
+  NB_DECODE_ERRORS
+};
+
+typedef struct {
+  int packets;   // sent to the decoders
+  int skipped;   // packets that failed to decode; only when tolerant
+  int corrupted; // frames decoded with errors concealed
+  int types[NB_DECODE_ERRORS]; // occurrences of each kind of error
+} decode_stats;
+
+// Analysis of the decoded input. Zero durations or thresholds disable each
+// kind of analysis; defaults apply to the other settings if unset.
+typedef struct {
+  double scene_threshold;  // minimum scene change score, from 0 to 1
+  double black_duration;   // minimum seconds of black video
+  double black_ratio;      // fraction of black pixels in a black picture
+  double silence_duration; // minimum seconds of silence
+  double silence_noise;    // maximum volume of silence, in dB
+} analysis_params;
+
+// EBU R128 loudness normalisation of the audio tracks of an output
+typedef struct {
+  double target;    // integrated loudness in LUFS; disabled if zero
+  double true_peak; // maximum true peak in dBTP
+  int two_pass;     // measure the whole input before transcoding
+} loudness_params;
+
 typedef struct {
   char *fname;
   char *vfilters;
+  // Optional; replaces vfilters when a GPU input has to be decoded in
+  // software and the output is encoded in software too
+  char *sw_vfilters;
   int w, h, bitrate, gop_time;
   AVRational fps;
 
@@ -32,8 +108,47 @@ typedef struct {
   component_opts audio;
   component_opts video;
 
+  // Optional mapping of input audio tracks into this output, each with its
+  // own encoder. If empty, the default track is mapped using `audio`.
+  audio_map *audio_maps;
+  int nb_audio_maps;
+
+  // Whether this output is the source rendition; copied video is then
+  // counted in the results as if it were encoded.
+  int source;
+
+  // Optional forced keyframes, as input timestamps in seconds.
+  // Times must be sorted. The expression is evaluated per frame as with
+  // the expr: form of ffmpeg's -force_key_frames option.
+  double *kf_times;
+  int nb_kf_times;
+  char *kf_expr;
+
+  loudness_params loudness;
+
+  // Optional pixel format of the encoded video, eg yuv420p10le. Otherwise
+  // video is converted to yuv420p, or to the closest format the encoder
+  // supports if it lacks yuv420p.
+  char *pix_fmt;
+
+  // Keep the video on the timeline of the input when converting the frame
+  // rate, so that the output starts at the first timestamp of the input and
+  // lasts as long as the input, to within a frame.
+  int preserve_ts;
+
+  // Optional comparison of the encoded video against the input, computed
+  // while transcoding. The files to compare are ignored.
+  quality_params *quality;
+
 } output_params;
 
+// Timed metadata such as an ID3 tag, presented at the given input timestamp
+typedef struct {
+  double pts; // seconds
+  uint8_t *data;
+  int size;
+} timed_metadata;
+
 typedef struct {
   char *fname;
 
@@ -46,13 +161,120 @@ typedef struct {
   // Optional hardware acceleration
   enum AVHWDeviceType hw_type;
   char *device;
+
+  // Optional demuxer and decoder selection (name + options)
+  component_opts demuxer;
+  component_opts video;
+  component_opts audio;
+
+  // Audio tracks to decode. The first entry is the default track. If empty,
+  // the best audio stream in the input is used as the default track.
+  track_selector *audio_tracks;
+  int nb_audio_tracks;
+
+  // Transcoding stops with lpms_ERR_INPUT_LIMIT if any limit is exceeded
+  input_limits limits;
+
+  analysis_params analysis;
+
+  error_tolerance errors;
+
+  // Muxed as a timed ID3 stream into every MPEG-TS output of the segment
+  timed_metadata *metadata;
+  int nb_metadata;
 } input_params;
 
+#define MAX_KEYFRAMES 128
+
+// Wall time spent in each stage of the pipeline, in microseconds
+typedef struct {
+  int64_t demux, decode, filter, encode, mux;
+} stage_times;
+
+// Resources used by a single transcode call. The pipeline CPU times only
+// cover the thread running the pipeline, not the worker threads of the
+// codecs, so they are a lower bound on the cost of the call. The process
+// figures cover the whole process, including any other sessions.
+typedef struct {
+  int64_t wall_time;           // microseconds
+  int64_t pipeline_cpu_time;   // of the pipeline thread, in microseconds
+  int64_t peak_frame_memory;   // held by the decoded frames of the session, in bytes
+  int64_t process_cpu_time;    // of the whole process, in microseconds
+  int64_t process_peak_memory; // peak resident memory of the process ever, in bytes
+  stage_times stages;          // demuxing and decoding; see output_results
+} resource_usage;
+
 typedef struct {
     int frames;
     int64_t pixels;
+
+    // Timestamps of encoded video keyframes, in seconds on the timeline of
+    // the input. Only the first MAX_KEYFRAMES are kept.
+    double keyframes[MAX_KEYFRAMES];
+    int nb_keyframes;
+
+    // Loudness of the first audio track of the input as measured for
+    // normalisation, and the gain applied to it in dB. Measurements cover
+    // the whole session so far, or the segment in the two-pass mode.
+    int loudness_measured;
+    double loudness, true_peak, gain;
+
+    // Extent of the muxed video, or of the first audio track if there is no
+    // video, in seconds on the timeline of the input.
+    double start_time, duration;
+
+    stage_times stages; // filtering, encoding and muxing of this output
+    int64_t pipeline_cpu_time; // of the pipeline thread on this output, in microseconds
+
+    // Only set if requested; must be freed with lpms_quality_free
+    quality_results quality;
 } output_results;
 
+#define MAX_ANALYSIS_EVENTS 128
+
+typedef struct {
+  double start, end; // seconds
+} time_interval;
+
+typedef struct {
+  int index; // stream index within the input
+  int track; // 1-based position among the audio streams
+  int channels, sample_rate;
+  char codec[32];
+  char language[16];
+} audio_track_info;
+
+typedef struct {
+  int frames;
+  int64_t pixels;
+
+  // Properties of the input video, if any
+  int width, height;
+  AVRational framerate;
+  int64_t bit_rate; // of the whole input; zero if unknown
+
+  // All audio tracks available in the input
+  audio_track_info audio_tracks[MAX_AUDIO_TRACKS];
+  int nb_audio_tracks;
+
+  // Analysis of the decoded input, on the timeline of the input. Only the
+  // first MAX_ANALYSIS_EVENTS of each kind are kept.
+  double scenes[MAX_ANALYSIS_EVENTS];
+  int nb_scenes;
+  time_interval black[MAX_ANALYSIS_EVENTS];
+  int nb_black;
+  time_interval silence[MAX_ANALYSIS_EVENTS]; // of the default audio track
+  int nb_silence;
+
+  // Extent of the input video, or of the default audio track if there is no
+  // video, in seconds.
+  double start_time, duration;
+
+  decode_stats errors;
+
+  resource_usage usage;
+} input_results;
+
 enum LPMSLogLevel {
   LPMS_LOG_TRACE    = AV_LOG_TRACE,
   LPMS_LOG_DEBUG    = AV_LOG_DEBUG,
@@ -66,7 +288,7 @@ enum LPMSLogLevel {
 };
 
 void lpms_init(enum LPMSLogLevel max_level);
-int  lpms_transcode(input_params *inp, output_params *params, output_results *results, int nb_outputs, output_results *decoded_results);
+int  lpms_transcode(input_params *inp, output_params *params, output_results *results, int nb_outputs, input_results *decoded_results);
 struct transcode_thread* lpms_transcode_new();
 void lpms_transcode_stop(struct transcode_thread* handle);
 
@@ -29,6 +29,7 @@ type SegmenterOptions struct {
 	EnforceKeyframe bool //Enforce each segment starts with a keyframe
 	SegLength       time.Duration
 	StartSeq        int
+	ListSize        int // segments kept in the playlist; defaults to 5
 }
 
 type VideoSegment struct {
@@ -38,6 +39,7 @@ type VideoSegment struct {
 	Data   []byte
 	Name   string
 	SeqNo  uint64
+	Cue    *stream.Cue // splice signal from the ingest, if any
 }
 
 type VideoPlaylist struct {
@@ -60,13 +62,14 @@ type FFMpegVideoSegmenter struct {
 	curPlWaitTime  time.Duration
 	curSegWaitTime time.Duration
 	SegLen         time.Duration
+	ListSize       int
 }
 
 func NewFFMpegVideoSegmenter(workDir string, strmID string, localRtmpUrl string, opt SegmenterOptions) *FFMpegVideoSegmenter {
 	if opt.SegLength == 0 {
 		opt.SegLength = time.Second * 4
 	}
-	return &FFMpegVideoSegmenter{WorkDir: workDir, StrmID: strmID, LocalRtmpUrl: localRtmpUrl, SegLen: opt.SegLength, curSegment: opt.StartSeq}
+	return &FFMpegVideoSegmenter{WorkDir: workDir, StrmID: strmID, LocalRtmpUrl: localRtmpUrl, SegLen: opt.SegLength, curSegment: opt.StartSeq, ListSize: opt.ListSize}
 }
 
 //RTMPToHLS invokes FFMpeg to do the segmenting. This method blocks until the segmenter exits.
@@ -82,7 +85,7 @@ func (s *FFMpegVideoSegmenter) RTMPToHLS(ctx context.Context, cleanup bool) erro
 	outp := fmt.Sprintf("%s/%s.m3u8", s.WorkDir, s.StrmID)
 	ts_tmpl := fmt.Sprintf("%s/%s", s.WorkDir, s.StrmID) + "_%d.ts"
 	seglen := strconv.FormatFloat(s.SegLen.Seconds(), 'f', 6, 64)
-	ret := ffmpeg.RTMPToHLS(s.LocalRtmpUrl, outp, ts_tmpl, seglen, s.curSegment)
+	ret := ffmpeg.RTMPToHLS2(s.LocalRtmpUrl, outp, ts_tmpl, seglen, s.curSegment, ffmpeg.HLSOptions{ListSize: s.ListSize})
 	if cleanup {
 		s.Cleanup()
 	}
@@ -102,6 +105,7 @@ func (s *FFMpegVideoSegmenter) PollSegment(ctx context.Context) (*VideoSegment,
 	name := s.StrmID + "_" + strconv.Itoa(s.curSegment) + ".ts"
 	plfn := fmt.Sprintf("%s/%s.m3u8", s.WorkDir, s.StrmID)
 
+	var cue *stream.Cue
 	for i := 0; i < PlaylistRetryCount; i++ {
 		pl, _ := m3u8.NewMediaPlaylist(uint(s.curSegment+1), uint(s.curSegment+1))
 		content := readPlaylist(plfn)
@@ -109,6 +113,7 @@ func (s *FFMpegVideoSegmenter) PollSegment(ctx context.Context) (*VideoSegment,
 		for _, plSeg := range pl.Segments {
 			if plSeg != nil && plSeg.URI == name {
 				length, err = time.ParseDuration(fmt.Sprintf("%vs", plSeg.Duration))
+				cue = stream.NewCueFromSCTE35(plSeg.SCTE)
 				break
 			}
 		}
@@ -126,7 +131,7 @@ func (s *FFMpegVideoSegmenter) PollSegment(ctx context.Context) (*VideoSegment,
 
 	s.curSegment = s.curSegment + 1
 	// glog.Infof("Segment: %v, len:%v", name, len(seg))
-	return &VideoSegment{Codec: av.H264, Format: stream.HLS, Length: length, Data: seg, Name: name, SeqNo: uint64(s.curSegment - 1)}, err
+	return &VideoSegment{Codec: av.H264, Format: stream.HLS, Length: length, Data: seg, Name: name, SeqNo: uint64(s.curSegment - 1), Cue: cue}, err
 }
 
 //PollPlaylist monitors the filesystem and returns a new playlist as it becomes available
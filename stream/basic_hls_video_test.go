@@ -1,6 +1,8 @@
 package stream
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/livepeer/m3u8"
@@ -171,3 +173,47 @@ func TestWindowSize(t *testing.T) {
 		t.Errorf("Expecting test2, but got %v", ml.Variants[0].URI)
 	}
 }
+
+func TestCues(t *testing.T) {
+	strm := NewBasicHLSVideoStream("test_cue", 4)
+	segs := []*HLSSegment{
+		{SeqNo: 1, Name: "seg1.ts", Duration: 2, Cue: &Cue{Type: CueOut, Duration: 4, SCTE35: "/DAlAAAAAAAAAP/wFAUAAAABf+/+AC3GwH4AA3+QAAEAAAAAnM7P7A=="}},
+		{SeqNo: 2, Name: "seg2.ts", Duration: 2, Cue: &Cue{Type: CueCont, Duration: 4, Elapsed: 2}},
+		{SeqNo: 3, Name: "seg3.ts", Duration: 2, Cue: &Cue{Type: CueIn}},
+		{SeqNo: 4, Name: "seg4.ts", Duration: 2},
+	}
+	for _, seg := range segs {
+		if err := strm.AddHLSSegment(seg); err != nil {
+			t.Errorf("Error adding segment: %v", err)
+		}
+	}
+	pl, err := strm.GetStreamPlaylist()
+	if err != nil || pl == nil {
+		t.Fatalf("Error getting playlist: %v", err)
+	}
+	enc := pl.Encode().String()
+	for _, tag := range []string{
+		"#EXT-OATCLS-SCTE35:/DAlAAAAAAAAAP/wFAUAAAABf+/+AC3GwH4AA3+QAAEAAAAAnM7P7A==\n#EXT-X-CUE-OUT:4\n#EXTINF:2.000,\nseg1.ts",
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=2,Duration=4,SCTE35=\n#EXTINF:2.000,\nseg2.ts",
+		"#EXT-X-CUE-IN\n#EXTINF:2.000,\nseg3.ts",
+		"#EXTINF:2.000,\nseg4.ts",
+	} {
+		if !strings.Contains(enc, tag) {
+			t.Errorf("Expecting %q in playlist %v", tag, enc)
+		}
+	}
+
+	// Cues survive a round trip through the playlist
+	decoded, _ := m3u8.NewMediaPlaylist(4, 4)
+	if err := decoded.DecodeFrom(bytes.NewReader([]byte(enc)), true); err != nil {
+		t.Fatalf("Error decoding playlist: %v", err)
+	}
+	for i, seg := range segs {
+		cue := NewCueFromSCTE35(decoded.Segments[i].SCTE)
+		if seg.Cue == nil && cue != nil {
+			t.Errorf("Unexpected cue for %v: %v", seg.Name, cue)
+		} else if seg.Cue != nil && (cue == nil || *cue != *seg.Cue) {
+			t.Errorf("Expecting cue %v for %v, got %v", seg.Cue, seg.Name, cue)
+		}
+	}
+}
@@ -88,6 +88,9 @@ func (s *BasicHLSVideoStream) AddHLSSegment(seg *HLSSegment) error {
 
 	//Add segment to media playlist and buffer
 	s.plCache.AppendSegment(&m3u8.MediaSegment{SeqId: seg.SeqNo, Duration: seg.Duration, URI: seg.Name})
+	if seg.Cue != nil {
+		s.plCache.SetSCTE35(seg.Cue.scte35())
+	}
 	s.segNames = append(s.segNames, seg.Name)
 	s.segMap[seg.Name] = seg
 	if s.plCache.Count() > s.winSize {
@@ -20,3 +20,50 @@ type HLSDemuxer interface {
 type HLSMuxer interface {
 	WriteSegment(seqNo uint64, name string, duration float64, s []byte) error
 }
+
+type CueType int
+
+const (
+	CueOut  CueType = iota // first segment of a break
+	CueCont                // segment within a break
+	CueIn                  // first segment after a break
+)
+
+//Cue marks a segment at a splice point of the ingest, or within a break
+type Cue struct {
+	Type     CueType
+	Duration float64 // of the break in seconds; zero if unknown
+	Elapsed  float64 // seconds since the start of the break
+	SCTE35   string  // base64 splice_info_section, if any
+}
+
+//NewCueFromSCTE35 converts the cue tags of a playlist segment
+func NewCueFromSCTE35(scte *m3u8.SCTE) *Cue {
+	if scte == nil || scte.Syntax != m3u8.SCTE35_OATCLS {
+		return nil
+	}
+	cue := &Cue{Duration: scte.Time, Elapsed: scte.Elapsed, SCTE35: scte.Cue}
+	switch scte.CueType {
+	case m3u8.SCTE35Cue_Start:
+		cue.Type = CueOut
+	case m3u8.SCTE35Cue_Mid:
+		cue.Type = CueCont
+	case m3u8.SCTE35Cue_End:
+		cue.Type = CueIn
+	}
+	return cue
+}
+
+//scte35 returns the cue as EXT-X-CUE-OUT / EXT-X-CUE-OUT-CONT / EXT-X-CUE-IN tags
+func (c *Cue) scte35() *m3u8.SCTE {
+	scte := &m3u8.SCTE{Syntax: m3u8.SCTE35_OATCLS, Cue: c.SCTE35, Time: c.Duration, Elapsed: c.Elapsed}
+	switch c.Type {
+	case CueOut:
+		scte.CueType = m3u8.SCTE35Cue_Start
+	case CueCont:
+		scte.CueType = m3u8.SCTE35Cue_Mid
+	case CueIn:
+		scte.CueType = m3u8.SCTE35Cue_End
+	}
+	return scte
+}
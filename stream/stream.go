@@ -75,6 +75,7 @@ type HLSSegment struct {
 	Name     string
 	Data     []byte
 	Duration float64
+	Cue      *Cue // splice signal for ad insertion, if any
 }
 
 //Compare playlists by segments